@@ -22,6 +22,20 @@ func init() {
 			log.Printf("Failed changing glog default desitination, err: %s", err)
 		}
 	}
+
+	jdfc.RegisterFlags(flag.CommandLine)
+}
+
+var (
+	tlsCertFile, tlsKeyFile string
+	serverCAFile            string
+)
+
+func init() {
+	flag.StringVar(&tlsCertFile, "tls-cert", "", "`file` of PEM encoded client certificate, for jdfss:// urls")
+	flag.StringVar(&tlsKeyFile, "tls-key", "", "`file` of PEM encoded private key for -tls-cert")
+	flag.StringVar(&serverCAFile, "server-ca", "",
+		"`file` of PEM encoded CA certificates to verify jdfs, system CAs are used if not specified")
 }
 
 func main() {
@@ -36,7 +50,15 @@ Simple usage:
 
  %s [ <jdfs-url> ] <mount-point>
 
-`, os.Args[0])
+Mounting from jdfs on the same host over a unix domain socket:
+
+ %s jdfs+unix:///path/to.sock?sub=<sub-dir> <mount-point>
+
+Compressing file data over the wire, with zstd or lz4, and checksumming it:
+
+ %s jdfs://<host>/<sub-dir>?compress=zstd&checksum=crc32c <mount-point>
+
+`, os.Args[0], os.Args[0], os.Args[0])
 	}
 	flag.Parse()
 
@@ -92,6 +114,10 @@ Simple usage:
 	for optKey, optVa := range jdfsURL.Query() {
 		if optKey == "ro" {
 			readOnly = true
+		} else if optKey == "sub" && jdfc.IsUnixURL(jdfsURL) {
+			// not a mount option, but the path to mount
+		} else if optKey == "compress" || optKey == "checksum" {
+			// not a mount option, but negotiated with jdfs
 		} else {
 			// last value takes precedence if multiple present
 			mntOpts[optKey] = optVa[len(optVa)-1]
@@ -121,7 +147,20 @@ Simple usage:
 		cfg.DebugLogger = log.New(os.Stderr, "jdfc: ", 0)
 	}
 
-	if err = jdfc.MountJDFS(jdfc.ConnTCP(jdfsHost), jdfsPath, mountpoint, cfg); err != nil {
+	connector := jdfc.ConnTCP(jdfsHost)
+	if jdfc.IsUnixURL(jdfsURL) {
+		connector = jdfc.ConnUnix(jdfsHost)
+	} else if jdfsURL.Scheme == "jdfss" {
+		tlsCfg, err := jdfc.TLSConfig(jdfsURL.Hostname(), tlsCertFile, tlsKeyFile, serverCAFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%+v", err)
+			os.Exit(5)
+		}
+		connector = jdfc.ConnTLS(jdfsHost, tlsCfg)
+	}
+
+	if err = jdfc.MountJDFS(connector, jdfsPath, mountpoint, cfg,
+		jdfc.WireCompression(jdfsURL), jdfc.WireChecksum(jdfsURL)); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -22,11 +22,13 @@ func init() {
 }
 
 var (
-	tcpAddr string
+	tcpAddr    string
+	socketPath string
 )
 
 func init() {
 	flag.StringVar(&tcpAddr, "tcp", "0.0.0.0:1112", "`addr` specifies the TCP address for JDFS service")
+	flag.StringVar(&socketPath, "unix", "", "`socket-path` to serve JDFS over a unix domain socket, instead of TCP")
 }
 
 func main() {
@@ -41,10 +43,27 @@ Simple usage:
 
  %s [ -tcp <service-addr> ] [ -ppc <parallelism> ] <export-root>
 
-`, os.Args[0])
+Garbage collecting worksets older than <ttl> and not owned by a live connection, offline:
+
+ %s -ws-ttl <ttl> gc-worksets <export-root>
+
+Serving jdfc on the same host over a unix domain socket:
+
+ %s -unix <socket-path> <export-root>
+
+Serving over TLS:
+
+ %s -tls-cert <cert-file> -tls-key <key-file> -client-ca <ca-file> -tls-grants <grants-file> <export-root>
+
+`, os.Args[0], os.Args[0], os.Args[0], os.Args[0])
 	}
 	flag.Parse()
 
+	if flag.NArg() == 2 && flag.Arg(0) == "gc-worksets" {
+		gcWorksets(flag.Arg(1))
+		return
+	}
+
 	if flag.NArg() != 1 {
 		flag.Usage()
 		os.Exit(1)
@@ -57,9 +76,35 @@ Simple usage:
 		os.Exit(2)
 	}
 
-	if err = jdfs.ExportTCP(absRoot, tcpAddr); err != nil {
+	if len(socketPath) > 0 {
+		err = jdfs.ExportUnix(absRoot, socketPath)
+	} else if jdfs.TLSEnabled() {
+		err = jdfs.ExportTLS(absRoot, tcpAddr)
+	} else {
+		err = jdfs.ExportTCP(absRoot, tcpAddr)
+	}
+	if err != nil {
 		fmt.Printf("Error serving JDFS root [%s]=>[%s]: +%v", sharedRoot, absRoot, err)
 		os.Exit(3)
 	}
 
 }
+
+func gcWorksets(exportRoot string) {
+	absRoot, err := filepath.Abs(exportRoot)
+	if err != nil {
+		fmt.Printf("Error with [%s] as export root: +%v", exportRoot, err)
+		os.Exit(2)
+	}
+	ttl := jdfs.WorksetTTL()
+	if ttl <= 0 {
+		fmt.Printf("A positive -ws-ttl is required to gc worksets.\n")
+		os.Exit(1)
+	}
+	removed, err := jdfs.GCWorksets(absRoot, ttl)
+	if err != nil {
+		fmt.Printf("Error collecting worksets under [%s]: +%v", absRoot, err)
+		os.Exit(3)
+	}
+	fmt.Printf("%d stale worksets removed under [%s]\n", removed, absRoot)
+}
@@ -172,6 +172,16 @@ func (c *Connection) Init() (err error) {
 		initOp.Flags |= InitWritebackCache
 	}
 
+	// Have POSIX and flock(2) locks sent to us, instead of local to the kernel.
+	if !c.cfg.DisableLocking {
+		initOp.Flags |= InitPosixLocks | InitFlockLocks
+	}
+
+	// Have directory entries read along with their child inodes, where supported.
+	if !c.cfg.DisableReaddirplus {
+		initOp.Flags |= initReaddirplus
+	}
+
 	c.Reply(ctx, nil)
 	return
 }
@@ -440,6 +450,9 @@ func (c *Connection) shouldLogError(
 	case vfs.ENOSYS:
 		// just not implemented by us
 		return false
+	case vfs.EINTR:
+		// interrupted by the kernel, nothing went wrong
+		return false
 	}
 
 	switch op.(type) {
@@ -463,6 +476,23 @@ func (c *Connection) shouldLogError(
 //
 // LOCKS_EXCLUDED(c.mu)
 func (c *Connection) Reply(ctx context.Context, opErr error) {
+	c.reply(ctx, opErr)()
+}
+
+// ReplyInterrupted replies EINTR to an op previously read using ReadOp, while
+// the op is still being processed, as the kernel interrupted it.
+//
+// buffers of the op's messages are still referenced by the op (e.g. Dst of a
+// ReadFileOp, Data of a WriteFileOp), the returned release func must be called
+// after the op processing finished, to recycle them.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) ReplyInterrupted(ctx context.Context) (release func()) {
+	return c.reply(ctx, syscall.EINTR)
+}
+
+// reply sends the reply to kernel, and returns a func to recycle the messages.
+func (c *Connection) reply(ctx context.Context, opErr error) (release func()) {
 	// Extract the state we stuffed in earlier.
 	var key interface{} = contextKey
 	foo := ctx.Value(key)
@@ -477,8 +507,10 @@ func (c *Connection) Reply(ctx context.Context, opErr error) {
 	fuseID := inMsg.Header().Unique
 
 	// Make sure we destroy the messages when we're done.
-	defer c.putInMessage(inMsg)
-	defer c.putOutMessage(outMsg)
+	release = func() {
+		c.putOutMessage(outMsg)
+		c.putInMessage(inMsg)
+	}
 
 	// Clean up state for this op.
 	c.finishOp(inMsg.Header().Opcode, inMsg.Header().Unique)
@@ -508,6 +540,8 @@ func (c *Connection) Reply(ctx context.Context, opErr error) {
 			c.errorLogger.Printf("writeMessage: %v %v", err, outMsg.Bytes()[:20])
 		}
 	}
+
+	return
 }
 
 // Close the connection. Must not be called until operations that were read
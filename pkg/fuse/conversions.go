@@ -324,6 +324,20 @@ func convertInMessage(
 		sh.Len = readSize
 		sh.Cap = readSize
 
+	case OpReaddirplus:
+		in := (*ReadIn)(inMsg.Consume(ReadInSize(protocol)))
+		if in == nil {
+			err = errors.New("Corrupt OpReaddirplus")
+			return
+		}
+
+		o = &ReadDirPlusOp{
+			Inode:  InodeID(inMsg.Header().Nodeid),
+			Handle: HandleID(in.Fh),
+			Offset: DirOffset(in.Offset),
+			Size:   int(in.Size),
+		}
+
 	case OpRelease:
 		type input ReleaseIn
 		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
@@ -400,7 +414,9 @@ func convertInMessage(
 		}
 
 	case OpStatfs:
-		o = &StatFSOp{}
+		o = &StatFSOp{
+			Inode: InodeID(inMsg.Header().Nodeid),
+		}
 
 	case OpInterrupt:
 		type input InterruptIn
@@ -555,6 +571,95 @@ func convertInMessage(
 			Flags: in.Flags,
 		}
 
+	case OpFallocate:
+		type input FallocateIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			err = errors.New("Corrupt OpFallocate")
+			return
+		}
+
+		o = &FallocateOp{
+			Inode:  InodeID(inMsg.Header().Nodeid),
+			Handle: HandleID(in.Fh),
+			Offset: in.Offset,
+			Length: in.Length,
+			Mode:   in.Mode,
+		}
+
+	case OpLseek:
+		type input LseekIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			err = errors.New("Corrupt OpLseek")
+			return
+		}
+
+		to := &LseekOp{
+			Inode:  InodeID(inMsg.Header().Nodeid),
+			Handle: HandleID(in.Fh),
+			Offset: in.Offset,
+		}
+		switch in.Whence {
+		case LseekWhenceData:
+			to.Whence = SeekData
+		case LseekWhenceHole:
+			to.Whence = SeekHole
+		default:
+			err = fmt.Errorf("Unexpected whence %d of OpLseek", in.Whence)
+			return
+		}
+		o = to
+
+	case OpCopyFileRange:
+		type input CopyFileRangeIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			err = errors.New("Corrupt OpCopyFileRange")
+			return
+		}
+
+		o = &CopyFileRangeOp{
+			InodeIn:   InodeID(inMsg.Header().Nodeid),
+			HandleIn:  HandleID(in.FhIn),
+			OffsetIn:  in.OffIn,
+			InodeOut:  InodeID(in.NodeidOut),
+			HandleOut: HandleID(in.FhOut),
+			OffsetOut: in.OffOut,
+			Length:    in.Len,
+			Flags:     in.Flags,
+		}
+
+	case OpGetlk:
+		in := (*LkIn)(inMsg.Consume(LkInSize(protocol)))
+		if in == nil {
+			err = errors.New("Corrupt OpGetlk")
+			return
+		}
+
+		o = &GetLockOp{
+			Inode:  InodeID(inMsg.Header().Nodeid),
+			Handle: HandleID(in.Fh),
+			Owner:  in.Owner,
+			Lock:   convertKernelLock(in.Lk),
+		}
+
+	case OpSetlk, OpSetlkw:
+		in := (*LkIn)(inMsg.Consume(LkInSize(protocol)))
+		if in == nil {
+			err = errors.New("Corrupt OpSetlk")
+			return
+		}
+
+		o = &SetLockOp{
+			Inode:  InodeID(inMsg.Header().Nodeid),
+			Handle: HandleID(in.Fh),
+			Owner:  in.Owner,
+			Lock:   convertKernelLock(in.Lk),
+			Wait:   inMsg.Header().Opcode == OpSetlkw,
+			Flock:  in.LkFlags&LkFlagFlock != 0,
+		}
+
 	case OpDestroy:
 		o = &DestroyOp{}
 
@@ -710,6 +815,11 @@ func (c *Connection) kernelResponseForOp(
 		// much the user read.
 		m.ShrinkTo(OutMessageHeaderSize + o.BytesRead)
 
+	case *ReadDirPlusOp:
+		for i := range o.Entries {
+			writeDirEntPlus(m, &o.Entries[i])
+		}
+
 	case *ReleaseDirHandleOp:
 		// Empty response
 
@@ -747,6 +857,24 @@ func (c *Connection) kernelResponseForOp(
 	case *ReadSymlinkOp:
 		m.AppendString(o.Target)
 
+	case *FallocateOp:
+		// Empty response
+
+	case *LseekOp:
+		out := (*LseekOut)(m.Grow(int(unsafe.Sizeof(LseekOut{}))))
+		out.Offset = o.Offset
+
+	case *CopyFileRangeOp:
+		out := (*WriteOut)(m.Grow(int(unsafe.Sizeof(WriteOut{}))))
+		out.Size = uint32(o.BytesCopied)
+
+	case *GetLockOp:
+		out := (*LkOut)(m.Grow(int(unsafe.Sizeof(LkOut{}))))
+		out.Lk = convertLockOut(o.Lock)
+
+	case *SetLockOp:
+		// Empty response
+
 	case *StatFSOp:
 		out := (*StatfsOut)(m.Grow(int(unsafe.Sizeof(StatfsOut{}))))
 		out.St.Blocks = o.Blocks
@@ -916,3 +1044,46 @@ func writeXattrSize(m *OutMessage, size uint32) {
 	out := (*GetxattrOut)(m.Grow(int(unsafe.Sizeof(GetxattrOut{}))))
 	out.Size = size
 }
+
+// convertKernelLock converts a lock from the kernel, with os specific lock type.
+func convertKernelLock(lk fileLock) FileLock {
+	fl := FileLock{Start: lk.Start, End: lk.End, Pid: lk.Pid}
+	switch lk.Type {
+	case syscall.F_RDLCK:
+		fl.Type = LockRead
+	case syscall.F_WRLCK:
+		fl.Type = LockWrite
+	default:
+		fl.Type = LockUnlock
+	}
+	return fl
+}
+
+// convertLockOut converts a lock to be sent to the kernel.
+func convertLockOut(fl FileLock) (lk fileLock) {
+	lk.Start, lk.End, lk.Pid = fl.Start, fl.End, fl.Pid
+	switch fl.Type {
+	case LockRead:
+		lk.Type = syscall.F_RDLCK
+	case LockWrite:
+		lk.Type = syscall.F_WRLCK
+	default:
+		lk.Type = syscall.F_UNLCK
+	}
+	return
+}
+
+// writeDirEntPlus appends d to m in the format of fuse_direntplus, taking
+// DirEntPlusSize() bytes.
+func writeDirEntPlus(m *OutMessage, d *DirEntPlus) {
+	out := (*EntryOut)(m.Grow(int(unsafe.Sizeof(EntryOut{}))))
+	convertChildInodeEntry(&d.Entry, out)
+
+	size := DirEntPlusSize(d.Name) - int(unsafe.Sizeof(EntryOut{}))
+	var buf []byte
+	sh := (*reflect.SliceHeader)(unsafe.Pointer(&buf))
+	sh.Data = uintptr(m.Grow(size))
+	sh.Len = size
+	sh.Cap = size
+	WriteDirEnt(buf, d.DirEnt)
+}
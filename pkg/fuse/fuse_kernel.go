@@ -381,6 +381,13 @@ const (
 	OpIoctl       = 39 // Linux?
 	OpPoll        = 40 // Linux?
 
+	// Linux, sent regardless of the negotiated minor version, until replied
+	// with ENOSYS
+	OpFallocate     = 43
+	OpReaddirplus   = 44
+	OpLseek         = 46
+	OpCopyFileRange = 47
+
 	// OS X
 	OpSetvolname = 61
 	OpGetxtimes  = 62
@@ -686,6 +693,47 @@ type LkOut struct {
 	Lk fileLock
 }
 
+// LkFlags
+const (
+	// the lock is a flock(2) lock, not a POSIX one
+	LkFlagFlock = 1 << 0
+)
+
+type FallocateIn struct {
+	Fh      uint64
+	Offset  uint64
+	Length  uint64
+	Mode    uint32
+	Padding uint32
+}
+
+type LseekIn struct {
+	Fh      uint64
+	Offset  uint64
+	Whence  uint32
+	Padding uint32
+}
+
+type LseekOut struct {
+	Offset uint64
+}
+
+// Whence of LseekIn, as of Linux
+const (
+	LseekWhenceData = 3
+	LseekWhenceHole = 4
+)
+
+type CopyFileRangeIn struct {
+	FhIn      uint64
+	OffIn     uint64
+	NodeidOut uint64
+	FhOut     uint64
+	OffOut    uint64
+	Len       uint64
+	Flags     uint64
+}
+
 type AccessIn struct {
 	Mask    uint32
 	Padding uint32
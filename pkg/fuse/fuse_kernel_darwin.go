@@ -86,3 +86,6 @@ type SetxattrIn struct {
 func (s *SetxattrIn) GetPosition() uint32 {
 	return s.Position
 }
+
+// READDIRPLUS is only supported by FUSE on Linux.
+const initReaddirplus InitFlags = 0
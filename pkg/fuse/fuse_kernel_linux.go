@@ -1,6 +1,17 @@
 package fuse
 
-import "time"
+import (
+	"fmt"
+	"time"
+	"unsafe"
+
+	// vfs was separated from this package (fuse) to be dependable by jdfs while
+	// still buildable for smartos (a.k.a. illumos, solaris), as fuse only support
+	// linux and osx (a.k.a. darwin) atm.
+	// import all artifacts back here to minimize changes in this package for the
+	// separation.
+	. "github.com/complyue/jdfs/pkg/vfs"
+)
 
 type Attr struct {
 	Ino       uint64
@@ -68,3 +79,14 @@ type GetxattrIn struct {
 type SetxattrIn struct {
 	setxattrInCommon
 }
+
+// READDIRPLUS is only supported by FUSE on Linux.
+const initReaddirplus = InitDoReaddirplus | InitReaddirplusAuto
+
+func init() {
+	// vfs sizes entries of ReadDirPlusOp without knowing fuse structs
+	if int(unsafe.Sizeof(EntryOut{}))+DirentSize != DirEntPlusHeaderSize {
+		panic(fmt.Sprintf("Oops, DirEntPlusHeaderSize is wrong: %v vs. %v",
+			DirEntPlusHeaderSize, int(unsafe.Sizeof(EntryOut{}))+DirentSize))
+	}
+}
@@ -113,6 +113,21 @@ type MountConfig struct {
 	// syscall doesn't return until the file system returns.
 	DisableWritebackCaching bool
 
+	// Normally POSIX locks (fcntl(2) F_SETLK etc.) and flock(2) locks on files
+	// are sent to the file system, so they're effective across hosts mounting
+	// the same file system.
+	//
+	// Setting DisableLocking leaves them local to the kernel instead.
+	DisableLocking bool
+
+	// Linux only.
+	//
+	// Normally directory listings are read with READDIRPLUS, carrying attributes
+	// of child inodes along, so `ls -l` etc. won't send a lookup per entry.
+	//
+	// Setting DisableReaddirplus reads names only instead.
+	DisableReaddirplus bool
+
 	// OS X only.
 	//
 	// Normally on OS X we mount with the novncache option
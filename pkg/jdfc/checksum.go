@@ -0,0 +1,36 @@
+package jdfc
+
+import (
+	"github.com/complyue/hbi"
+	"github.com/complyue/jdfs/pkg/vfs"
+
+	"github.com/golang/glog"
+)
+
+// bulk data payloads can be checksummed end-to-end, with a method requested per
+// mount, e.g. by `?checksum=crc32c` in the jdfs url, if jdfs told it supported in
+// the mount result, or sent unchecked otherwise. see vfs/payload.go for how
+// payloads are sent.
+
+// useChecksum asks jdfs to checksum bulk data payloads of the session just
+// mounted over po, with method if supported as told by mountedFields.
+//
+// nil is returned for payloads to be sent unchecked.
+func useChecksum(po *hbi.PostingEnd, method string,
+	mountedFields hbi.LitListType) (*vfs.Checksum, error) {
+	if len(method) <= 0 {
+		return nil, nil
+	}
+	checksum, err := vfs.NewChecksum(method)
+	if err != nil {
+		return nil, err
+	}
+
+	if inUse, err := useWireMethod(po, mountedFields, 6, "UseChecksum", method); err != nil {
+		return nil, err
+	} else if !inUse {
+		glog.Warningf("Wire checksum [%s] not supported by jdfs, payloads will be sent unchecked", method)
+		return nil, nil
+	}
+	return checksum, nil
+}
@@ -38,6 +38,19 @@ func PrepareHostingEnv() *hbi.HostingEnv {
 	he.ExposeValue("ERANGE", vfs.ERANGE)
 	he.ExposeValue("ENOSPC", vfs.ENOSPC)
 	he.ExposeValue("ENOATTR", vfs.ENOATTR)
+	he.ExposeValue("EACCES", vfs.EACCES)
+	he.ExposeValue("EROFS", vfs.EROFS)
+	he.ExposeValue("EINTR", vfs.EINTR)
+	he.ExposeValue("EAGAIN", vfs.EAGAIN)
+	he.ExposeValue("EBADF", vfs.EBADF)
+	he.ExposeValue("ENXIO", vfs.ENXIO)
+	he.ExposeValue("EFBIG", vfs.EFBIG)
+	he.ExposeValue("ENODEV", vfs.ENODEV)
+	he.ExposeValue("EPERM", vfs.EPERM)
+	he.ExposeValue("ESPIPE", vfs.ESPIPE)
+	he.ExposeValue("EOVERFLOW", vfs.EOVERFLOW)
+	he.ExposeValue("ETXTBSY", vfs.ETXTBSY)
+	he.ExposeValue("EOPNOTSUPP", vfs.EOPNOTSUPP)
 
 	return he
 }
@@ -46,6 +59,10 @@ func PrepareHostingEnv() *hbi.HostingEnv {
 // directory under the exported root), to a local mountpoint, then serves
 // fs operations over HBI connections between this jdfc and the jdfs, to be
 // established by jdfsConnector.
+//
+// bulk data payloads are compressed over the wire with compress, and checksummed
+// end-to-end with checksum, if not empty and jdfs supports them, see
+// WireCompression() and WireChecksum().
 func MountJDFS(
 	jdfsConnector func(he *hbi.HostingEnv) (
 		po *hbi.PostingEnd, ho *hbi.HostingEnd, err error,
@@ -53,11 +70,22 @@ func MountJDFS(
 	jdfsPath string,
 	mountpoint string,
 	cfg *fuse.MountConfig,
+	compress, checksum string,
 ) (err error) {
-	var (
-		po *hbi.PostingEnd
-		ho *hbi.HostingEnd
-	)
+	fs := &fileSystem{
+		readOnly: cfg.ReadOnly,
+		jdfsPath: jdfsPath,
+		compress: compress, checksum: checksum,
+
+		jdfcUID: uint32(os.Geteuid()), jdfcGID: uint32(os.Getegid()),
+
+		inodes:      make(map[vfs.InodeID]*knownInode),
+		entries:     make(map[entryKey]vfs.InodeID),
+		fileHandles: make(map[vfs.HandleID]*knownHandle),
+		dirHandles:  make(map[vfs.HandleID]*knownHandle),
+	}
+	fs.wireCond = sync.NewCond(&fs.mu)
+
 	defer func() {
 		if e := recover(); e != nil {
 			err = errors.RichError(e)
@@ -65,6 +93,10 @@ func MountJDFS(
 		if err != nil {
 			glog.Errorf("Unexpected jdfc error: %+v", err)
 		}
+		fs.mu.Lock()
+		po, dataPOs := fs.po, fs.dataPOs
+		fs.mu.Unlock()
+		closeDataWires(dataPOs)
 		if po != nil && !po.Disconnected() {
 			if err != nil {
 				po.Disconnect(fmt.Sprintf("Unexpected jdfc error: %+v", err), true)
@@ -74,56 +106,77 @@ func MountJDFS(
 		}
 	}()
 
-	he := PrepareHostingEnv()
+	var dialHBI func() error
+
+	// a fresh hosting env is prepared for each wire to jdfs
+	prepareEnv := func() *hbi.HostingEnv {
+		he := PrepareHostingEnv()
+
+		// expose fs as the reactor
+		he.ExposeReactor(fs)
+
+		he.ExposeFunction("__hbi_cleanup__", func(
+			po *hbi.PostingEnd, ho *hbi.HostingEnd, discReason string) {
+			if autoReconnect && fs.resumable() {
+				// FUSE ops will block until reconnected, in-flight ones will be retried if
+				// safe to do so, or fail with EIO.
+				if fs.connLost(po) {
+					glog.Warningf("jdfs disconnected due to: %s, reconnecting ...", discReason)
+					go fs.reconnect(dialHBI)
+				}
+				return
+			}
 
-	fs := &fileSystem{
-		readOnly: cfg.ReadOnly,
-		jdfsPath: jdfsPath,
+			// terminate jdfc (the FUSE user process), this leaves the mountpoint denying all
+			// services. this is actually better than unmounting it, as naive programs may
+			// think all files have been deleted due to the unmount, or even
+			// start writing new files under paths of the mountpoint (which is not JDFS anymore).
+			//
+			// next run of jdfc for the same mountpoint will try unmounting immediately
+			// before the new mounting attempt, if broken FUSE mount detected. that's not
+			// perfect yet, but opens much smaller window of time for naive programs working
+			// on the JDFS mount to make mistakes.
+
+			if len(discReason) > 0 {
+				fmt.Printf("jdfs disconnected due to: %s", discReason)
+				os.Exit(6)
+			}
+			os.Exit(0)
+		})
 
-		jdfcUID: uint32(os.Geteuid()), jdfcGID: uint32(os.Getegid()),
+		return he
 	}
 
-	// expose fs as the reactor
-	he.ExposeReactor(fs)
+	dialHBI = func() error {
+		po, ho, err := jdfsConnector(prepareEnv())
+		if err != nil {
+			return err
+		}
 
-	dialHBI := func() error {
-		po, ho, err = jdfsConnector(he)
+		lost, err := fs.connReset(po, ho)
 		if err != nil {
 			return err
 		}
 
-		fs.connReset(po, ho)
+		fs.mu.Lock()
+		token, gen := fs.jdfsSession, fs.wireGen
+		fs.mu.Unlock()
+		fs.attachDataWires(jdfsConnector, token, gen)
+
+		// kernel may send ops to fulfill invalidations, do it after ops unblocked
+		go fs.invalidateResumed(lost)
 
 		return nil
 	}
 
-	he.ExposeFunction("__hbi_cleanup__", func(
-		po *hbi.PostingEnd, ho *hbi.HostingEnd, discReason string) {
-		// terminate jdfc (the FUSE user process), this leaves the mountpoint denying all
-		// services. this is actually better than unmounting it, as naive programs may
-		// think all files have been deleted due to the unmount, or even
-		// start writing new files under paths of the mountpoint (which is not JDFS anymore).
-		//
-		// next run of jdfc for the same mountpoint will try unmounting immediately
-		// before the new mounting attempt, if broken FUSE mount detected. that's not
-		// perfect yet, but opens much smaller window of time for naive programs working
-		// on the JDFS mount to make mistakes.
-
-		if len(discReason) > 0 {
-			fmt.Printf("jdfs disconnected due to: %s", discReason)
-			os.Exit(6)
-		}
-		os.Exit(0)
-
-		// todo auto reconnect jdfs. but need to figure out the way to tell FUSE kernel
-		//      to invalidate all cache and handles in this case ?
-	})
-
 	if err = dialHBI(); err != nil {
 		return err
 	}
 
-	mfs, fuseConn, err := fuse.Mount(mountpoint, &fileSystemServer{fs: fs}, cfg)
+	mfs, fuseConn, err := fuse.Mount(mountpoint, &fileSystemServer{
+		fs:        fs,
+		metaSlots: newOpSlots(ppc), dataSlots: newOpSlots(ppc),
+	}, cfg)
 	if err != nil {
 		return err
 	}
@@ -152,6 +205,8 @@ func MountJDFS(
 type fileSystem struct {
 	readOnly bool
 	jdfsPath string
+	// wire compression/checksum requested
+	compress, checksum string
 
 	jdfcUID, jdfcGID uint32
 
@@ -159,9 +214,36 @@ type fileSystem struct {
 
 	fuseConn *fuse.Connection
 
+	// current wire to jdfs, nil while reconnecting
 	po *hbi.PostingEnd
 	ho *hbi.HostingEnd
 
+	// data wires attached to the session mounted over po, see datawire.go
+	dataPOs  []*hbi.PostingEnd
+	dataNext int
+	// token for data wires to attach to the session mounted, empty if jdfs can't
+	jdfsSession string
+	// how bulk data payloads are sent to/from the session mounted
+	codec vfs.PayloadCodec
+
+	// generation number of the wires to jdfs, increased on each connection/disconnection
+	wireGen int
+	// signaled on wire changes
+	wireCond *sync.Cond
+
+	// inodes referenced by FUSE kernel, and name entries to reach them,
+	// kept to resume the session after reconnected
+	inodes  map[vfs.InodeID]*knownInode
+	entries map[entryKey]vfs.InodeID
+
+	// file/dir handles as given to FUSE kernel
+	fileHandles map[vfs.HandleID]*knownHandle
+	dirHandles  map[vfs.HandleID]*knownHandle
+	lastHandle  vfs.HandleID
+
+	// set once unmounted, no reconnection then
+	destroyed bool
+
 	jdfsUID, jdfsGID uint32
 	jdfsPID          int
 }
@@ -182,14 +264,15 @@ func (fs *fileSystem) mapOwner(attrs *vfs.InodeAttributes) {
 	}
 }
 
+// connReset mounts over a newly connected wire to jdfs, resumes the session if
+// reconnected, then unblocks FUSE ops.
 func (fs *fileSystem) connReset(
 	po *hbi.PostingEnd, ho *hbi.HostingEnd,
-) {
+) (lost []entryKey, err error) {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
-	fs.po, fs.ho = po, ho
-	if err := func() (err error) {
+	if err = func() (err error) {
 		defer func() {
 			if e := recover(); e != nil {
 				err = errors.RichError(e)
@@ -219,43 +302,87 @@ Mount(%#v, %#v)
 		fs.jdfsUID = uint32(mountedFields[1].(hbi.LitIntType))
 		fs.jdfsGID = uint32(mountedFields[2].(hbi.LitIntType))
 		fs.jdfsPID = int(mountedFields[3].(hbi.LitIntType))
+		fs.jdfsSession = ""
+		if len(mountedFields) > 4 { // older jdfs tells no session token
+			fs.jdfsSession, _ = mountedFields[4].(string)
+		}
 
+		if fs.codec.Compressor, err = useCompression(po, fs.compress, mountedFields); err != nil {
+			return
+		}
+		fs.codec.Checksum, err = useChecksum(po, fs.checksum, mountedFields)
 		return
-	}(); err != nil {
-		fs.po, fs.ho = nil, nil
+	}(); err == nil {
+		lost, err = fs.resume(po)
+	}
+	if err != nil {
 		glog.Errorf("Error comm with jdfs: %+v", err)
 		if !po.Disconnected() {
 			po.Disconnect(fmt.Sprintf("server mount failed: %v", err), false)
 		}
-		os.Exit(7) // fail hard
+		return
 	}
+
+	fs.po, fs.ho = po, ho
+	fs.wireGen++
+	fs.wireCond.Broadcast()
+
+	return
 }
 
+// InvalidateNode is pushed by jdfs, for changes observed on its local fs.
+//
+// the FUSE kernel may block the notification until in-flight ops on the same inode
+// are replied, while results of those ops come through this very HBI wire, so the
+// hosting loop must not be blocked here, neither by fs.mu which is held by connReset()
+// during the mount conversation.
 func (fs *fileSystem) InvalidateNode(
 	inode vfs.InodeID, offset, size int64,
 ) {
-	if err := fs.fuseConn.InvalidateNode(inode, offset, size); err != nil && err != vfs.ENOENT {
-		glog.Fatalf("Unexpected fuse kernel error on inode invalidation [%T] - %+v", err, err)
-	}
+	go func() {
+		fuseConn := fs.mountedConn()
+		if fuseConn == nil {
+			return // not mounted yet, nothing cached by kernel
+		}
+		if err := fuseConn.InvalidateNode(inode, offset, size); err != nil && err != syscall.ENOENT {
+			glog.Fatalf("Unexpected fuse kernel error on inode invalidation [%T] - %+v", err, err)
+		}
+	}()
 }
 
+// InvalidateEntry is pushed by jdfs, for changes observed on its local fs.
+//
+// see InvalidateNode for why it's done asynchronously.
 func (fs *fileSystem) InvalidateEntry(
 	parent vfs.InodeID, name string,
 ) {
-	if err := fs.fuseConn.InvalidateEntry(parent, name); err != nil && err != vfs.ENOENT {
-		glog.Fatalf("Unexpected fuse kernel error on entry invalidation [%T] - %+v", err, err)
-	}
+	go func() {
+		fuseConn := fs.mountedConn()
+		if fuseConn == nil {
+			return // not mounted yet, nothing cached by kernel
+		}
+		if err := fuseConn.InvalidateEntry(parent, name); err != nil && err != syscall.ENOENT {
+			glog.Fatalf("Unexpected fuse kernel error on entry invalidation [%T] - %+v", err, err)
+		}
+	}()
+}
+
+func (fs *fileSystem) mountedConn() *fuse.Connection {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.fuseConn
 }
 
 func (fs *fileSystem) StatFS(
 	ctx context.Context,
 	op *vfs.StatFSOp) (err error) {
-	co, err := fs.po.NewCo(nil)
+	co, err := fs.newCo(ctx)
 	if err != nil {
 		panic(err)
 	}
 	defer co.Close()
-	if err = co.SendCode(`StatFS()`); err != nil {
+	if err = co.SendCode(fmt.Sprintf(`StatFS(%#v)`, op.Inode)); err != nil {
 		panic(err)
 	}
 	if err = co.StartRecv(); err != nil {
@@ -271,7 +398,7 @@ func (fs *fileSystem) StatFS(
 func (fs *fileSystem) LookUpInode(
 	ctx context.Context,
 	op *vfs.LookUpInodeOp) (err error) {
-	co, err := fs.po.NewCo(nil)
+	co, err := fs.newCo(ctx)
 	if err != nil {
 		panic(err)
 	}
@@ -301,13 +428,15 @@ LookUpInode(%#v, %#v)
 
 	fs.mapOwner(&op.Entry.Attributes)
 
+	fs.learnInode(op.Parent, op.Name, op.Entry.Child)
+
 	return
 }
 
 func (fs *fileSystem) GetInodeAttributes(
 	ctx context.Context,
 	op *vfs.GetInodeAttributesOp) (err error) {
-	co, err := fs.po.NewCo(nil)
+	co, err := fs.newCo(ctx)
 	if err != nil {
 		panic(err)
 	}
@@ -344,7 +473,7 @@ GetInodeAttributes(%#v)
 func (fs *fileSystem) SetInodeAttributes(
 	ctx context.Context,
 	op *vfs.SetInodeAttributesOp) (err error) {
-	co, err := fs.po.NewCo(nil)
+	co, err := fs.newCo(ctx)
 	if err != nil {
 		panic(err)
 	}
@@ -400,7 +529,12 @@ SetInodeAttributes(%#v,%#v, %#v, %#v,%#v, %#v, %#v)
 func (fs *fileSystem) ForgetInode(
 	ctx context.Context,
 	op *vfs.ForgetInodeOp) (err error) {
-	co, err := fs.po.NewCo(nil)
+	srvN := fs.forgetInode(op.Inode, int(op.N))
+	if srvN <= 0 {
+		return // jdfs has no reference to forget, after some failed resuming
+	}
+
+	co, err := fs.newCo(ctx)
 	if err != nil {
 		panic(err)
 	}
@@ -408,7 +542,7 @@ func (fs *fileSystem) ForgetInode(
 
 	if err = co.SendCode(fmt.Sprintf(`
 ForgetInode(%#v, %#v)
-`, op.Inode, op.N)); err != nil {
+`, op.Inode, srvN)); err != nil {
 		panic(err)
 	}
 
@@ -418,7 +552,7 @@ ForgetInode(%#v, %#v)
 func (fs *fileSystem) MkDir(
 	ctx context.Context,
 	op *vfs.MkDirOp) (err error) {
-	co, err := fs.po.NewCo(nil)
+	co, err := fs.newCo(ctx)
 	if err != nil {
 		panic(err)
 	}
@@ -449,6 +583,8 @@ MkDir(%#v, %#v, %#v)
 
 	fs.mapOwner(&op.Entry.Attributes)
 
+	fs.learnInode(op.Parent, op.Name, op.Entry.Child)
+
 	return
 }
 
@@ -462,7 +598,7 @@ func (fs *fileSystem) MkNode(
 func (fs *fileSystem) CreateFile(
 	ctx context.Context,
 	op *vfs.CreateFileOp) (err error) {
-	co, err := fs.po.NewCo(nil)
+	co, err := fs.newCo(ctx)
 	if err != nil {
 		panic(err)
 	}
@@ -501,15 +637,19 @@ CreateFile(%#v, %#v, %#v)
 		panic(err)
 	}
 
+	op.Handle = fs.registerHandle(false, op.Entry.Child, true, op.Handle)
+
 	fs.mapOwner(&op.Entry.Attributes)
 
+	fs.learnInode(op.Parent, op.Name, op.Entry.Child)
+
 	return
 }
 
 func (fs *fileSystem) CreateSymlink(
 	ctx context.Context,
 	op *vfs.CreateSymlinkOp) (err error) {
-	co, err := fs.po.NewCo(nil)
+	co, err := fs.newCo(ctx)
 	if err != nil {
 		panic(err)
 	}
@@ -540,13 +680,15 @@ CreateSymlink(%#v, %#v, %#v)
 
 	fs.mapOwner(&op.Entry.Attributes)
 
+	fs.learnInode(op.Parent, op.Name, op.Entry.Child)
+
 	return
 }
 
 func (fs *fileSystem) CreateLink(
 	ctx context.Context,
 	op *vfs.CreateLinkOp) (err error) {
-	co, err := fs.po.NewCo(nil)
+	co, err := fs.newCo(ctx)
 	if err != nil {
 		panic(err)
 	}
@@ -577,13 +719,15 @@ CreateLink(%#v, %#v, %#v)
 
 	fs.mapOwner(&op.Entry.Attributes)
 
+	fs.learnInode(op.Parent, op.Name, op.Entry.Child)
+
 	return
 }
 
 func (fs *fileSystem) Rename(
 	ctx context.Context,
 	op *vfs.RenameOp) (err error) {
-	co, err := fs.po.NewCo(nil)
+	co, err := fs.newCo(ctx)
 	if err != nil {
 		panic(err)
 	}
@@ -607,13 +751,15 @@ Rename(%#v, %#v, %#v, %#v)
 		return syscall.Errno(fse)
 	}
 
+	fs.entryMoved(op.OldParent, op.OldName, op.NewParent, op.NewName)
+
 	return
 }
 
 func (fs *fileSystem) RmDir(
 	ctx context.Context,
 	op *vfs.RmDirOp) (err error) {
-	co, err := fs.po.NewCo(nil)
+	co, err := fs.newCo(ctx)
 	if err != nil {
 		panic(err)
 	}
@@ -637,13 +783,15 @@ RmDir(%#v, %#v)
 		return syscall.Errno(fse)
 	}
 
+	fs.entryRemoved(op.Parent, op.Name)
+
 	return
 }
 
 func (fs *fileSystem) Unlink(
 	ctx context.Context,
 	op *vfs.UnlinkOp) (err error) {
-	co, err := fs.po.NewCo(nil)
+	co, err := fs.newCo(ctx)
 	if err != nil {
 		panic(err)
 	}
@@ -667,13 +815,15 @@ Unlink(%#v, %#v)
 		return syscall.Errno(fse)
 	}
 
+	fs.entryRemoved(op.Parent, op.Name)
+
 	return
 }
 
 func (fs *fileSystem) OpenDir(
 	ctx context.Context,
 	op *vfs.OpenDirOp) (err error) {
-	co, err := fs.po.NewCo(nil)
+	co, err := fs.newCo(ctx)
 	if err != nil {
 		panic(err)
 	}
@@ -704,7 +854,7 @@ OpenDir(%#v)
 	if handle, ok := handle.(hbi.LitIntType); !ok {
 		panic(errors.Errorf("unexpected handle type [%T] of handle value [%v]", handle, handle))
 	} else {
-		op.Handle = vfs.HandleID(handle)
+		op.Handle = fs.registerHandle(true, op.Inode, false, vfs.HandleID(handle))
 	}
 
 	return
@@ -713,7 +863,12 @@ OpenDir(%#v)
 func (fs *fileSystem) ReadDir(
 	ctx context.Context,
 	op *vfs.ReadDirOp) (err error) {
-	co, err := fs.po.NewCo(nil)
+	srvHandle, err := fs.srvHandle(true, op.Handle)
+	if err != nil {
+		return
+	}
+
+	co, err := fs.newCo(ctx)
 	if err != nil {
 		panic(err)
 	}
@@ -721,7 +876,7 @@ func (fs *fileSystem) ReadDir(
 
 	if err = co.SendCode(fmt.Sprintf(`
 ReadDir(%#v, %#v, %#v, %#v)
-`, op.Inode, op.Handle, op.Offset, len(op.Dst))); err != nil {
+`, op.Inode, srvHandle, op.Offset, len(op.Dst))); err != nil {
 		panic(err)
 	}
 
@@ -755,10 +910,91 @@ ReadDir(%#v, %#v, %#v, %#v)
 	return
 }
 
+func (fs *fileSystem) ReadDirPlus(
+	ctx context.Context,
+	op *vfs.ReadDirPlusOp) (err error) {
+	srvHandle, err := fs.srvHandle(true, op.Handle)
+	if err != nil {
+		return
+	}
+
+	co, err := fs.newCo(ctx)
+	if err != nil {
+		panic(err)
+	}
+	defer co.Close()
+
+	if err = co.SendCode(fmt.Sprintf(`
+ReadDirPlus(%#v, %#v, %#v, %#v)
+`, op.Inode, srvHandle, op.Offset, op.Size)); err != nil {
+		panic(err)
+	}
+
+	if err = co.StartRecv(); err != nil {
+		panic(err)
+	}
+
+	if fsErr, err := co.RecvObj(); err != nil {
+		panic(err)
+	} else if fse, ok := fsErr.(vfs.FsError); !ok {
+		panic(errors.Errorf("Unexpected fs error from jdfs with type [%T] - %+v", fsErr, fsErr))
+	} else if fse != 0 {
+		return syscall.Errno(fse)
+	}
+
+	// dir entries as [offset, type, name] literals, then child inode entries as binary
+	dirEnts, err := co.RecvObj()
+	if err != nil {
+		panic(err)
+	}
+	dirEntList, ok := dirEnts.(hbi.LitListType)
+	if !ok {
+		panic(errors.Errorf("unexpected dirEnts type [%T] of dirEnts value [%v]", dirEnts, dirEnts))
+	}
+	if len(dirEntList) <= 0 {
+		return // end of dir
+	}
+
+	op.Entries = make([]vfs.DirEntPlus, len(dirEntList))
+	ces := make([]vfs.ChildInodeEntry, len(dirEntList))
+	bufView := ((*[1 << 30]byte)(unsafe.Pointer(&ces[0])))[:uintptr(len(ces))*unsafe.Sizeof(ces[0])]
+	if err = co.RecvData(bufView); err != nil {
+		panic(err)
+	}
+
+	for i, de := range dirEntList {
+		deFields, ok := de.(hbi.LitListType)
+		if !ok || len(deFields) != 3 {
+			panic(errors.Errorf("unexpected dirEnt type [%T] of dirEnt value [%v]", de, de))
+		}
+		name := deFields[2].(string)
+		dep := &op.Entries[i]
+		dep.DirEnt = vfs.DirEnt{
+			Offset: vfs.DirOffset(deFields[0].(hbi.LitIntType)),
+			Inode:  ces[i].Child,
+			Name:   name,
+			Type:   vfs.DirEntType(deFields[1].(hbi.LitIntType)),
+		}
+		dep.Entry = ces[i]
+
+		fs.mapOwner(&dep.Entry.Attributes)
+
+		// the kernel counts a reference to each child returned, as if looked up
+		fs.learnInode(op.Inode, name, dep.Entry.Child)
+	}
+
+	return
+}
+
 func (fs *fileSystem) ReleaseDirHandle(
 	ctx context.Context,
 	op *vfs.ReleaseDirHandleOp) (err error) {
-	co, err := fs.po.NewCo(nil)
+	srvHandle := fs.releaseHandle(true, op.Handle)
+	if srvHandle == 0 {
+		return // lost by failed resuming
+	}
+
+	co, err := fs.newCo(ctx)
 	if err != nil {
 		panic(err)
 	}
@@ -766,7 +1002,7 @@ func (fs *fileSystem) ReleaseDirHandle(
 
 	if err = co.SendCode(fmt.Sprintf(`
 ReleaseDirHandle(%#v)
-`, op.Handle)); err != nil {
+`, srvHandle)); err != nil {
 		panic(err)
 	}
 
@@ -776,7 +1012,7 @@ ReleaseDirHandle(%#v)
 func (fs *fileSystem) OpenFile(
 	ctx context.Context,
 	op *vfs.OpenFileOp) (err error) {
-	co, err := fs.po.NewCo(nil)
+	co, err := fs.newCo(ctx)
 	if err != nil {
 		panic(err)
 	}
@@ -814,7 +1050,7 @@ OpenFile(%#v, %#v, %#v)
 	if handle, ok := handle.(hbi.LitIntType); !ok {
 		panic(errors.Errorf("unexpected handle type [%T] of handle value [%v]", handle, handle))
 	} else {
-		op.Handle = vfs.HandleID(handle)
+		op.Handle = fs.registerHandle(false, op.Inode, writable, vfs.HandleID(handle))
 	}
 
 	return
@@ -823,7 +1059,12 @@ OpenFile(%#v, %#v, %#v)
 func (fs *fileSystem) ReadFile(
 	ctx context.Context,
 	op *vfs.ReadFileOp) (err error) {
-	co, err := fs.po.NewCo(nil)
+	srvHandle, err := fs.srvHandle(false, op.Handle)
+	if err != nil {
+		return
+	}
+
+	co, err := fs.newDataCo(ctx)
 	if err != nil {
 		panic(err)
 	}
@@ -831,7 +1072,7 @@ func (fs *fileSystem) ReadFile(
 
 	if err = co.SendCode(fmt.Sprintf(`
 ReadFile(%#v, %#v, %#v, %#v)
-`, op.Inode, op.Handle, op.Offset, len(op.Dst))); err != nil {
+`, op.Inode, srvHandle, op.Offset, len(op.Dst))); err != nil {
 		panic(err)
 	}
 
@@ -863,7 +1104,10 @@ ReadFile(%#v, %#v, %#v, %#v)
 	}
 
 	if op.BytesRead > 0 {
-		if err = co.RecvData(op.Dst[:op.BytesRead]); err != nil {
+		if err = co.recvPayload(op.Dst[:op.BytesRead]); err != nil {
+			if fse, ok := err.(vfs.FsError); ok {
+				return syscall.Errno(fse)
+			}
 			panic(err)
 		}
 	}
@@ -880,7 +1124,12 @@ ReadFile(%#v, %#v, %#v, %#v)
 func (fs *fileSystem) WriteFile(
 	ctx context.Context,
 	op *vfs.WriteFileOp) (err error) {
-	co, err := fs.po.NewCo(nil)
+	srvHandle, err := fs.srvHandle(false, op.Handle)
+	if err != nil {
+		return
+	}
+
+	co, err := fs.newDataCo(ctx)
 	if err != nil {
 		panic(err)
 	}
@@ -888,10 +1137,10 @@ func (fs *fileSystem) WriteFile(
 
 	if err = co.SendCode(fmt.Sprintf(`
 WriteFile(%#v, %#v, %#v, %#v)
-`, op.Inode, op.Handle, op.Offset, len(op.Data))); err != nil {
+`, op.Inode, srvHandle, op.Offset, len(op.Data))); err != nil {
 		panic(err)
 	}
-	if err = co.SendData(op.Data); err != nil {
+	if err = co.sendPayload(op.Data); err != nil {
 		panic(err)
 	}
 
@@ -913,7 +1162,12 @@ WriteFile(%#v, %#v, %#v, %#v)
 func (fs *fileSystem) SyncFile(
 	ctx context.Context,
 	op *vfs.SyncFileOp) (err error) {
-	co, err := fs.po.NewCo(nil)
+	srvHandle, err := fs.srvHandle(false, op.Handle)
+	if err != nil {
+		return
+	}
+
+	co, err := fs.newDataCo(ctx)
 	if err != nil {
 		panic(err)
 	}
@@ -921,7 +1175,7 @@ func (fs *fileSystem) SyncFile(
 
 	if err = co.SendCode(fmt.Sprintf(`
 SyncFile(%#v, %#v)
-`, op.Inode, op.Handle)); err != nil {
+`, op.Inode, srvHandle)); err != nil {
 		panic(err)
 	}
 
@@ -949,10 +1203,256 @@ func (fs *fileSystem) FlushFile(
 	return
 }
 
+func (fs *fileSystem) Fallocate(
+	ctx context.Context,
+	op *vfs.FallocateOp) (err error) {
+	srvHandle, err := fs.srvHandle(false, op.Handle)
+	if err != nil {
+		return
+	}
+
+	co, err := fs.newDataCo(ctx)
+	if err != nil {
+		panic(err)
+	}
+	defer co.Close()
+
+	if err = co.SendCode(fmt.Sprintf(`
+Fallocate(%#v, %#v, %d, %d, %d)
+`, op.Inode, srvHandle, int64(op.Offset), int64(op.Length), op.Mode)); err != nil {
+		panic(err)
+	}
+
+	if err = co.StartRecv(); err != nil {
+		panic(err)
+	}
+
+	if fsErr, err := co.RecvObj(); err != nil {
+		panic(err)
+	} else if fse, ok := fsErr.(vfs.FsError); !ok {
+		panic(errors.Errorf("Unexpected fs error from jdfs with type [%T] - %+v", fsErr, fsErr))
+	} else if fse != 0 {
+		return syscall.Errno(fse)
+	}
+
+	return
+}
+
+func (fs *fileSystem) Lseek(
+	ctx context.Context,
+	op *vfs.LseekOp) (err error) {
+	srvHandle, err := fs.srvHandle(false, op.Handle)
+	if err != nil {
+		return
+	}
+
+	co, err := fs.newCo(ctx)
+	if err != nil {
+		panic(err)
+	}
+	defer co.Close()
+
+	if err = co.SendCode(fmt.Sprintf(`
+Lseek(%#v, %#v, %d, %d)
+`, op.Inode, srvHandle, int64(op.Offset), op.Whence)); err != nil {
+		panic(err)
+	}
+
+	if err = co.StartRecv(); err != nil {
+		panic(err)
+	}
+
+	if fsErr, err := co.RecvObj(); err != nil {
+		panic(err)
+	} else if fse, ok := fsErr.(vfs.FsError); !ok {
+		panic(errors.Errorf("Unexpected fs error from jdfs with type [%T] - %+v", fsErr, fsErr))
+	} else if fse != 0 {
+		return syscall.Errno(fse)
+	}
+
+	offset, err := co.RecvObj()
+	if err != nil {
+		panic(err)
+	}
+	if offset, ok := offset.(hbi.LitIntType); !ok {
+		panic(errors.Errorf("unexpected offset type [%T] of offset value [%v]", offset, offset))
+	} else {
+		op.Offset = uint64(offset)
+	}
+
+	return
+}
+
+func (fs *fileSystem) CopyFileRange(
+	ctx context.Context,
+	op *vfs.CopyFileRangeOp) (err error) {
+	srvHandleIn, err := fs.srvHandle(false, op.HandleIn)
+	if err != nil {
+		return
+	}
+	srvHandleOut, err := fs.srvHandle(false, op.HandleOut)
+	if err != nil {
+		return
+	}
+
+	co, err := fs.newDataCo(ctx)
+	if err != nil {
+		panic(err)
+	}
+	defer co.Close()
+
+	// data is copied at jdfs, only the number of bytes copied comes back
+	if err = co.SendCode(fmt.Sprintf(`
+CopyFileRange(%#v, %#v, %d, %#v, %#v, %d, %d)
+`, op.InodeIn, srvHandleIn, int64(op.OffsetIn),
+		op.InodeOut, srvHandleOut, int64(op.OffsetOut), int64(op.Length))); err != nil {
+		panic(err)
+	}
+
+	if err = co.StartRecv(); err != nil {
+		panic(err)
+	}
+
+	if fsErr, err := co.RecvObj(); err != nil {
+		panic(err)
+	} else if fse, ok := fsErr.(vfs.FsError); !ok {
+		panic(errors.Errorf("Unexpected fs error from jdfs with type [%T] - %+v", fsErr, fsErr))
+	} else if fse != 0 {
+		return syscall.Errno(fse)
+	}
+
+	bytesCopied, err := co.RecvObj()
+	if err != nil {
+		panic(err)
+	}
+	if bytesCopied, ok := bytesCopied.(hbi.LitIntType); !ok {
+		panic(errors.Errorf("unexpected bytesCopied type [%T] of bytesCopied value [%v]",
+			bytesCopied, bytesCopied))
+	} else {
+		op.BytesCopied = uint64(bytesCopied)
+	}
+
+	return
+}
+
+func (fs *fileSystem) GetLock(
+	ctx context.Context,
+	op *vfs.GetLockOp) (err error) {
+	srvHandle, err := fs.srvHandle(false, op.Handle)
+	if err != nil {
+		return
+	}
+
+	co, err := fs.newCo(ctx)
+	if err != nil {
+		panic(err)
+	}
+	defer co.Close()
+
+	// lock owner is opaque to jdfs, sent as int64 to fit int literals
+	if err = co.SendCode(fmt.Sprintf(`
+GetLock(%#v, %#v, %d, %d, %d, %d)
+`, op.Inode, srvHandle, int64(op.Owner),
+		int64(op.Lock.Start), int64(op.Lock.End), op.Lock.Type)); err != nil {
+		panic(err)
+	}
+
+	if err = co.StartRecv(); err != nil {
+		panic(err)
+	}
+
+	if fsErr, err := co.RecvObj(); err != nil {
+		panic(err)
+	} else if fse, ok := fsErr.(vfs.FsError); !ok {
+		panic(errors.Errorf("Unexpected fs error from jdfs with type [%T] - %+v", fsErr, fsErr))
+	} else if fse != 0 {
+		return syscall.Errno(fse)
+	}
+
+	lockObj, err := co.RecvObj()
+	if err != nil {
+		panic(err)
+	}
+	lockFields, ok := lockObj.(hbi.LitListType)
+	if !ok || len(lockFields) != 3 {
+		panic(errors.Errorf("unexpected lock type [%T] of lock value [%v]", lockObj, lockObj))
+	}
+	op.Lock = vfs.FileLock{
+		Type:  vfs.LockType(lockFields[0].(hbi.LitIntType)),
+		Start: uint64(lockFields[1].(hbi.LitIntType)),
+		End:   uint64(lockFields[2].(hbi.LitIntType)),
+		// held by a process on some jdfc, or by a process on jdfs
+		Pid: 0,
+	}
+
+	return
+}
+
+func (fs *fileSystem) SetLock(
+	ctx context.Context,
+	op *vfs.SetLockOp) (err error) {
+	srvHandle, err := fs.srvHandle(false, op.Handle)
+	if err != nil {
+		return
+	}
+
+	if err = fs.setLock(ctx, op, srvHandle, op.Lock.Type); err != nil {
+		return
+	}
+
+	if op.Wait && op.Lock.Type != vfs.LockUnlock && ctx.Err() != nil {
+		// granted after interrupted, the kernel has been replied EINTR, don't
+		// leave the lock held at jdfs
+		if err = fs.setLock(context.Background(), op, srvHandle, vfs.LockUnlock); err != nil {
+			glog.Errorf("Failed undoing lock interrupted - %+v", err)
+		}
+		return vfs.EINTR
+	}
+
+	return
+}
+
+func (fs *fileSystem) setLock(ctx context.Context,
+	op *vfs.SetLockOp, srvHandle vfs.HandleID, lt vfs.LockType) (err error) {
+	co, err := fs.newCo(ctx)
+	if err != nil {
+		panic(err)
+	}
+	defer co.Close()
+
+	// jdfs waits a conflicting lock without holding the wire, an interruption
+	// from the kernel cancels the wait via ctx
+	if err = co.SendCode(fmt.Sprintf(`
+SetLock(%#v, %#v, %d, %d, %d, %d, %#v, %#v)
+`, op.Inode, srvHandle, int64(op.Owner),
+		int64(op.Lock.Start), int64(op.Lock.End), lt, op.Wait, op.Flock)); err != nil {
+		panic(err)
+	}
+
+	if err = co.StartRecv(); err != nil {
+		panic(err)
+	}
+
+	if fsErr, err := co.RecvObj(); err != nil {
+		panic(err)
+	} else if fse, ok := fsErr.(vfs.FsError); !ok {
+		panic(errors.Errorf("Unexpected fs error from jdfs with type [%T] - %+v", fsErr, fsErr))
+	} else if fse != 0 {
+		return syscall.Errno(fse)
+	}
+
+	return
+}
+
 func (fs *fileSystem) ReleaseFileHandle(
 	ctx context.Context,
 	op *vfs.ReleaseFileHandleOp) (err error) {
-	co, err := fs.po.NewCo(nil)
+	srvHandle := fs.releaseHandle(false, op.Handle)
+	if srvHandle == 0 {
+		return // lost by failed resuming
+	}
+
+	co, err := fs.newCo(ctx)
 	if err != nil {
 		panic(err)
 	}
@@ -960,7 +1460,7 @@ func (fs *fileSystem) ReleaseFileHandle(
 
 	if err = co.SendCode(fmt.Sprintf(`
 ReleaseFileHandle(%#v)
-`, op.Handle)); err != nil {
+`, srvHandle)); err != nil {
 		panic(err)
 	}
 
@@ -970,7 +1470,7 @@ ReleaseFileHandle(%#v)
 func (fs *fileSystem) ReadSymlink(
 	ctx context.Context,
 	op *vfs.ReadSymlinkOp) (err error) {
-	co, err := fs.po.NewCo(nil)
+	co, err := fs.newCo(ctx)
 	if err != nil {
 		panic(err)
 	}
@@ -1010,7 +1510,7 @@ ReadSymlink(%#v)
 func (fs *fileSystem) RemoveXattr(
 	ctx context.Context,
 	op *vfs.RemoveXattrOp) (err error) {
-	co, err := fs.po.NewCo(nil)
+	co, err := fs.newCo(ctx)
 	if err != nil {
 		panic(err)
 	}
@@ -1040,7 +1540,7 @@ RemoveXattr(%#v, %#v)
 func (fs *fileSystem) GetXattr(
 	ctx context.Context,
 	op *vfs.GetXattrOp) (err error) {
-	co, err := fs.po.NewCo(nil)
+	co, err := fs.newCo(ctx)
 	if err != nil {
 		panic(err)
 	}
@@ -1087,7 +1587,7 @@ GetXattr(%#v, %#v, %#v)
 func (fs *fileSystem) ListXattr(
 	ctx context.Context,
 	op *vfs.ListXattrOp) (err error) {
-	co, err := fs.po.NewCo(nil)
+	co, err := fs.newCo(ctx)
 	if err != nil {
 		panic(err)
 	}
@@ -1136,7 +1636,7 @@ func (fs *fileSystem) SetXattr(
 	op *vfs.SetXattrOp) (err error) {
 	// allow no space consumption
 	err = syscall.ENOSPC
-	co, err := fs.po.NewCo(nil)
+	co, err := fs.newCo(ctx)
 	if err != nil {
 		panic(err)
 	}
@@ -1167,7 +1667,14 @@ SetXattr(%#v, %#v, %#v, %#v)
 }
 
 func (fs *fileSystem) Destroy() {
-	if fs.po != nil {
-		fs.po.Close()
+	fs.mu.Lock()
+	fs.destroyed = true
+	po, dataPOs := fs.po, fs.dataPOs
+	fs.dataPOs = nil
+	fs.mu.Unlock()
+
+	closeDataWires(dataPOs)
+	if po != nil {
+		po.Close()
 	}
 }
@@ -0,0 +1,35 @@
+package jdfc
+
+import (
+	"github.com/complyue/hbi"
+	"github.com/complyue/jdfs/pkg/vfs"
+
+	"github.com/golang/glog"
+)
+
+// bulk data payloads can be compressed over the wire, with a method requested per
+// mount, e.g. by `?compress=zstd` in the jdfs url, if jdfs told it supported in the
+// mount result, or sent raw otherwise. see vfs/payload.go for how payloads are sent.
+
+// useCompression asks jdfs to compress bulk data payloads of the session just
+// mounted over po, with method if supported as told by mountedFields.
+//
+// nil is returned for payloads to be sent raw.
+func useCompression(po *hbi.PostingEnd, method string,
+	mountedFields hbi.LitListType) (*vfs.Compressor, error) {
+	if len(method) <= 0 {
+		return nil, nil
+	}
+	compressor, err := vfs.NewCompressor(method)
+	if err != nil {
+		return nil, err
+	}
+
+	if inUse, err := useWireMethod(po, mountedFields, 5, "UseCompression", method); err != nil {
+		return nil, err
+	} else if !inUse {
+		glog.Warningf("Wire compression [%s] not supported by jdfs, payloads will be sent raw", method)
+		return nil, nil
+	}
+	return compressor, nil
+}
@@ -0,0 +1,164 @@
+package jdfc
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/complyue/hbi"
+	"github.com/complyue/jdfs/pkg/errors"
+
+	"github.com/golang/glog"
+)
+
+// bulk data of file reads/writes can be MBs per op, queuing small metadata replies
+// (e.g. lookups and stat'ing for an interactive `ls`) behind them on a single wire.
+// so besides the wire mounted over, more wires are connected to jdfs, attached to
+// the same session there as data channels, with data ops striped across them.
+//
+// jdfs can only attach data channels to a session served by the same process,
+// i.e. when it runs with -solo (the default), and it tells a session token on mount
+// only then. data ops go over the mounted wire as well, while no data wire is
+// attached, which is logged as a warning, for the throughput to be explained.
+
+var (
+	// number of wires connected for bulk data ops
+	dataWires = 2
+)
+
+// attachDataWires connects data wires to jdfs with jdfsConnector, attached to the
+// session mounted over the wire of generation gen, with token told by jdfs on mount.
+//
+// failures are not fatal, data ops just go over the mounted wire then.
+func (fs *fileSystem) attachDataWires(
+	jdfsConnector func(he *hbi.HostingEnv) (
+		po *hbi.PostingEnd, ho *hbi.HostingEnd, err error,
+	),
+	token string, gen int,
+) {
+	if dataWires <= 0 {
+		return
+	}
+	if len(token) <= 0 {
+		glog.Warningf("jdfs serves this session in a process of its own (-solo=false or over TLS),"+
+			" none of %d data wires can attach, data ops go over the mounted wire", dataWires)
+		return
+	}
+
+	attached := 0
+	defer func() {
+		if attached < dataWires {
+			glog.Warningf("Only %d of %d data wires attached to jdfs session", attached, dataWires)
+		} else {
+			glog.V(1).Infof("%d data wires attached to jdfs session", attached)
+		}
+	}()
+	for i := 0; i < dataWires; i++ {
+		he := PrepareHostingEnv()
+		he.ExposeFunction("__hbi_cleanup__", func(
+			po *hbi.PostingEnd, ho *hbi.HostingEnd, discReason string) {
+			fs.dataWireLost(po)
+		})
+
+		po, _, err := jdfsConnector(he)
+		if err != nil {
+			glog.Warningf("Failed connecting data wire to jdfs - %+v", err)
+			return
+		}
+		if err = attachSession(po, token); err != nil {
+			glog.Warningf("Failed attaching data wire to jdfs session - %+v", err)
+			po.Close()
+			return
+		}
+
+		if !func() bool {
+			fs.mu.Lock()
+			defer fs.mu.Unlock()
+
+			if fs.wireGen != gen || fs.po == nil {
+				return false // the session is gone meanwhile
+			}
+			fs.dataPOs = append(fs.dataPOs, po)
+			attached++
+			return true
+		}() {
+			po.Close()
+			return
+		}
+	}
+}
+
+// attachSession attaches a newly connected wire to the jdfs session with token.
+func attachSession(po *hbi.PostingEnd, token string) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = errors.RichError(e)
+		}
+	}()
+
+	co, err := po.NewCo(nil)
+	if err != nil {
+		return err
+	}
+	defer co.Close()
+	if err = co.SendCode(fmt.Sprintf(`
+AttachSession(%#v)
+`, token)); err != nil {
+		return err
+	}
+	if err = co.StartRecv(); err != nil {
+		return err
+	}
+	errReason, err := recvString(co)
+	if err != nil {
+		return err
+	}
+	if len(errReason) > 0 {
+		return errors.New(errReason)
+	}
+	return nil
+}
+
+// dataWireLost is called when a data wire dropped, data ops in flight over it are
+// retried over other wires if safe to do so, or fail with EIO.
+func (fs *fileSystem) dataWireLost(po *hbi.PostingEnd) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for i, dpo := range fs.dataPOs {
+		if dpo == po {
+			fs.dataPOs = append(fs.dataPOs[:i:i], fs.dataPOs[i+1:]...)
+			fs.wireGen++
+			fs.wireCond.Broadcast()
+			return
+		}
+	}
+}
+
+// closeDataWires closes data wires of a dropped or unmounted session.
+func closeDataWires(dataPOs []*hbi.PostingEnd) {
+	for _, po := range dataPOs {
+		if !po.Disconnected() {
+			po.Close()
+		}
+	}
+}
+
+// newDataCo starts a posting conversation with jdfs for a bulk data op, over the
+// data wires round robin, or over the mounted wire if none attached.
+func (fs *fileSystem) newDataCo(ctx context.Context) (*opCo, error) {
+	fs.mu.Lock()
+	for fs.po == nil {
+		fs.wireCond.Wait()
+	}
+	po, codec := fs.po, fs.codec
+	for range fs.dataPOs {
+		fs.dataNext = (fs.dataNext + 1) % len(fs.dataPOs)
+		if dpo := fs.dataPOs[fs.dataNext]; !dpo.Disconnected() {
+			po = dpo
+			break
+		}
+	}
+	fs.mu.Unlock()
+
+	return newOpCo(ctx, po, codec)
+}
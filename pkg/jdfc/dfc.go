@@ -0,0 +1,576 @@
+package jdfc
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/complyue/jdfs/pkg/errors"
+	"github.com/complyue/jdfs/pkg/vfs"
+
+	"github.com/complyue/hbi"
+)
+
+// direct data file access, without FUSE
+
+// max bytes transferred by a single ReadJDF/WriteJDF conversation, jdfs allocates
+// buffer of the full size requested, larger reads/writes are split into chunks.
+const dataChunkSize = 16 * 1024 * 1024
+
+// ErrDataFileClosed is returned from operations on a closed DataFile.
+var ErrDataFileClosed = errors.New("data file already closed")
+
+// DataFileClient accesses data files under a JDFS directory (can be root path or
+// sub directory under the exported root), over an HBI wire of its own, to be
+// established by jdfsConnector. No FUSE mount is involved.
+//
+// a data file (JDF) is identified by its path without extension, it consists of
+// a meta file with metaExt, and a data file with dataExt.
+type DataFileClient struct {
+	readOnly bool
+	jdfsPath string
+
+	metaExt, dataExt string
+
+	// wire compression/checksum requested, and how payloads are sent as in use
+	compress, checksum string
+	codec              vfs.PayloadCodec
+
+	po *hbi.PostingEnd
+	ho *hbi.HostingEnd
+
+	jdfsUID, jdfsGID uint32
+	jdfsPID          int
+}
+
+// NewDataFileClient connects to jdfs with jdfsConnector, and mounts jdfsPath for
+// direct data file access.
+//
+// bulk data payloads are compressed over the wire with compress, and checksummed
+// end-to-end with checksum, if not empty and jdfs supports them.
+func NewDataFileClient(
+	jdfsConnector func(he *hbi.HostingEnv) (
+		po *hbi.PostingEnd, ho *hbi.HostingEnd, err error,
+	),
+	jdfsPath string, readOnly bool,
+	metaExt, dataExt string,
+	compress, checksum string,
+) (dfc *DataFileClient, err error) {
+	he := PrepareHostingEnv()
+
+	// jdfs pushes invalidations for changes observed on its local fs, nothing
+	// is cached here to be invalidated.
+	he.ExposeFunction("InvalidateNode", func(inode vfs.InodeID, offset, size int64) {})
+	he.ExposeFunction("InvalidateEntry", func(parent vfs.InodeID, name string) {})
+
+	po, ho, err := jdfsConnector(he)
+	if err != nil {
+		return nil, err
+	}
+
+	dfc = &DataFileClient{
+		readOnly: readOnly,
+		jdfsPath: jdfsPath,
+
+		metaExt: metaExt, dataExt: dataExt,
+
+		compress: compress, checksum: checksum,
+
+		po: po, ho: ho,
+	}
+	if err = dfc.mount(); err != nil {
+		if !po.Disconnected() {
+			po.Disconnect(fmt.Sprintf("server mount failed: %v", err), false)
+		}
+		return nil, err
+	}
+
+	return dfc, nil
+}
+
+func (dfc *DataFileClient) mount() (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = errors.RichError(e)
+		}
+	}()
+
+	co, err := dfc.po.NewCo(nil)
+	if err != nil {
+		return err
+	}
+	defer co.Close()
+
+	if err = co.SendCode(fmt.Sprintf(`
+Mount(%#v, %#v)
+`, dfc.readOnly, dfc.jdfsPath)); err != nil {
+		return err
+	}
+	if err = co.StartRecv(); err != nil {
+		return err
+	}
+	mountResult, err := co.RecvObj()
+	if err != nil {
+		return err
+	}
+	mountedFields := mountResult.(hbi.LitListType)
+	dfc.jdfsUID = uint32(mountedFields[1].(hbi.LitIntType))
+	dfc.jdfsGID = uint32(mountedFields[2].(hbi.LitIntType))
+	dfc.jdfsPID = int(mountedFields[3].(hbi.LitIntType))
+
+	if dfc.codec.Compressor, err = useCompression(dfc.po, dfc.compress, mountedFields); err != nil {
+		return err
+	}
+	if dfc.codec.Checksum, err = useChecksum(dfc.po, dfc.checksum, mountedFields); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Close disconnects from jdfs, data files opened through this client are no
+// longer usable then.
+func (dfc *DataFileClient) Close() error {
+	if !dfc.po.Disconnected() {
+		dfc.po.Close()
+	}
+	return nil
+}
+
+// List lists data files under rootDir, recursively.
+func (dfc *DataFileClient) List(rootDir string) (dfl *vfs.DataFileList, err error) {
+	co, err := dfc.po.NewCo(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer co.Close()
+
+	if err = co.SendCode(fmt.Sprintf(`
+ListJDF(%#v, %#v, %#v)
+`, rootDir, dfc.metaExt, dfc.dataExt)); err != nil {
+		return nil, err
+	}
+	if err = co.StartRecv(); err != nil {
+		return nil, err
+	}
+
+	listLen, err := recvInt(co)
+	if err != nil {
+		return nil, err
+	}
+	if listLen <= 0 {
+		return &vfs.DataFileList{}, nil
+	}
+	pathFlatLen, err := recvInt(co)
+	if err != nil {
+		return nil, err
+	}
+
+	dfl, payload := vfs.ToReceiveDataFileList(int(listLen), int(pathFlatLen))
+	if !dfc.codec.Raw() {
+		// each buffer sent as a payload of its own
+		for _, buf := range payload {
+			if len(buf) > 0 {
+				if err = dfc.codec.RecvPayload(co, buf, "jdfs"); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return dfl, nil
+	}
+	i := 0
+	if err = co.RecvStream(func() ([]byte, error) {
+		for i < len(payload) {
+			buf := payload[i]
+			i++
+			if len(buf) > 0 { // jdfs doesn't send empty buffers
+				return buf, nil
+			}
+		}
+		return nil, nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return dfl, nil
+}
+
+// Stat returns inode and size of the data file at jdfPath.
+func (dfc *DataFileClient) Stat(jdfPath string) (inode vfs.InodeID, size int64, err error) {
+	co, err := dfc.po.NewCo(nil)
+	if err != nil {
+		return
+	}
+	defer co.Close()
+
+	if err = co.SendCode(fmt.Sprintf(`
+StatJDF(%#v, %#v, %#v)
+`, jdfPath, dfc.metaExt, dfc.dataExt)); err != nil {
+		return
+	}
+	if err = co.StartRecv(); err != nil {
+		return
+	}
+	if err = recvFsErr(co, "stat", jdfPath); err != nil {
+		return
+	}
+
+	inodeVal, err := recvInt(co)
+	if err != nil {
+		return
+	}
+	sizeVal, err := recvInt(co)
+	if err != nil {
+		return
+	}
+
+	return vfs.InodeID(inodeVal), int64(sizeVal), nil
+}
+
+// Open opens an existing data file at jdfPath, its first headerBytes bytes are
+// read into DataFile.Header, and its meta file into DataFile.Meta.
+func (dfc *DataFileClient) Open(jdfPath string, headerBytes int) (df *DataFile, err error) {
+	co, err := dfc.po.NewCo(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer co.Close()
+
+	if err = co.SendCode(fmt.Sprintf(`
+OpenJDF(%#v, %d, %#v, %#v)
+`, jdfPath, headerBytes, dfc.metaExt, dfc.dataExt)); err != nil {
+		return nil, err
+	}
+	if err = co.StartRecv(); err != nil {
+		return nil, err
+	}
+	if err = recvFsErr(co, "open", jdfPath); err != nil {
+		return nil, err
+	}
+
+	df = &DataFile{dfc: dfc, path: jdfPath}
+
+	if headerBytes > 0 {
+		df.Header = make([]byte, headerBytes)
+		if err = co.RecvData(df.Header); err != nil {
+			return nil, err
+		}
+	}
+
+	metaLen, err := recvInt(co)
+	if err != nil {
+		return nil, err
+	}
+	if metaLen > 0 {
+		df.Meta = make([]byte, metaLen)
+		if err = co.RecvData(df.Meta); err != nil {
+			return nil, err
+		}
+	}
+
+	dfSize, err := recvInt(co)
+	if err != nil {
+		return nil, err
+	}
+	df.Size = int64(dfSize)
+
+	if df.handle, err = recvHandle(co); err != nil {
+		return nil, err
+	}
+
+	return df, nil
+}
+
+// Alloc creates a data file at jdfPath with size bytes, header is written at
+// offset 0 of it, and meta is written as its meta file. An existing data file
+// at jdfPath is replaced if replaceExisting, or its content is overwritten.
+//
+// header must not be empty.
+func (dfc *DataFileClient) Alloc(jdfPath string, replaceExisting bool,
+	header, meta []byte, size int64) (df *DataFile, err error) {
+	if len(header) <= 0 {
+		return nil, &os.PathError{Op: "alloc", Path: jdfPath, Err: syscall.EINVAL}
+	}
+
+	co, err := dfc.po.NewCo(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer co.Close()
+
+	if err = co.SendCode(fmt.Sprintf(`
+AllocJDF(%#v, %#v, %#v, %#v, %d, %d, %d)
+`, jdfPath, replaceExisting, dfc.metaExt, dfc.dataExt, len(header), len(meta), size)); err != nil {
+		return nil, err
+	}
+	if err = co.SendData(header); err != nil {
+		return nil, err
+	}
+	if len(meta) > 0 {
+		if err = co.SendData(meta); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = co.StartRecv(); err != nil {
+		return nil, err
+	}
+	if err = recvFsErr(co, "alloc", jdfPath); err != nil {
+		return nil, err
+	}
+
+	df = &DataFile{dfc: dfc, path: jdfPath, Header: header, Meta: meta, Size: size}
+	if df.handle, err = recvHandle(co); err != nil {
+		return nil, err
+	}
+
+	return df, nil
+}
+
+// DataFile is a data file opened or allocated through a DataFileClient.
+//
+// ReadAt/WriteAt can be called concurrently, each in a conversation of its own.
+type DataFile struct {
+	dfc    *DataFileClient
+	path   string
+	handle vfs.DataFileHandle
+
+	// header bytes as read on open, or written on alloc
+	Header []byte
+	// content of the meta file as read on open, or written on alloc
+	Meta []byte
+	// size of the data file as known on open or alloc
+	Size int64
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+var (
+	_ io.ReaderAt = (*DataFile)(nil)
+	_ io.WriterAt = (*DataFile)(nil)
+	_ io.Closer   = (*DataFile)(nil)
+)
+
+// Path returns the path of this data file, without extension.
+func (df *DataFile) Path() string {
+	return df.path
+}
+
+// Inode returns the inode of this data file at jdfs.
+func (df *DataFile) Inode() vfs.InodeID {
+	return df.handle.Inode
+}
+
+// ReadAt implements io.ReaderAt, reading past end of the data file results in
+// io.EOF with fewer bytes read.
+func (df *DataFile) ReadAt(p []byte, off int64) (n int, err error) {
+	df.mu.RLock()
+	defer df.mu.RUnlock()
+	if df.closed {
+		return 0, ErrDataFileClosed
+	}
+
+	return df.readAt(p, off)
+}
+
+// readAt reads in chunks, with df.mu locked.
+func (df *DataFile) readAt(p []byte, off int64) (n int, err error) {
+	for n < len(p) {
+		chunk := p[n:]
+		if len(chunk) > dataChunkSize {
+			chunk = chunk[:dataChunkSize]
+		}
+		var bytesRead int
+		if bytesRead, err = df.readChunk(chunk, off+int64(n)); err != nil {
+			return
+		}
+		n += bytesRead
+		if bytesRead < len(chunk) {
+			return n, io.EOF
+		}
+	}
+	return
+}
+
+func (df *DataFile) readChunk(buf []byte, off int64) (bytesRead int, err error) {
+	co, err := df.dfc.po.NewCo(nil)
+	if err != nil {
+		return 0, err
+	}
+	defer co.Close()
+
+	if err = co.SendCode(fmt.Sprintf(`
+ReadJDF(%d, %d, %d, %d)
+`, df.handle.Handle, df.handle.Inode, off, len(buf))); err != nil {
+		return 0, err
+	}
+	if err = co.StartRecv(); err != nil {
+		return 0, err
+	}
+	if err = recvFsErr(co, "read", df.path); err != nil {
+		return 0, err
+	}
+
+	n, err := recvInt(co)
+	if err != nil {
+		return 0, err
+	}
+	if n > 0 {
+		if int(n) > len(buf) {
+			return 0, errors.Errorf("jdfs sent %d bytes for a read of %d bytes ?!", n, len(buf))
+		}
+		if err = df.dfc.codec.RecvPayload(co, buf[:n], "jdfs"); err != nil {
+			if fse, ok := err.(vfs.FsError); ok {
+				return 0, &os.PathError{Op: "read", Path: df.path, Err: syscall.Errno(fse)}
+			}
+			return 0, err
+		}
+	}
+	return int(n), nil
+}
+
+// WriteAt implements io.WriterAt, the data file is extended as needed.
+func (df *DataFile) WriteAt(p []byte, off int64) (n int, err error) {
+	df.mu.RLock()
+	defer df.mu.RUnlock()
+	if df.closed {
+		return 0, ErrDataFileClosed
+	}
+
+	return df.writeAt(p, off)
+}
+
+// writeAt writes in chunks, with df.mu locked.
+func (df *DataFile) writeAt(p []byte, off int64) (n int, err error) {
+	for n < len(p) {
+		chunk := p[n:]
+		if len(chunk) > dataChunkSize {
+			chunk = chunk[:dataChunkSize]
+		}
+		if err = df.writeChunk(chunk, off+int64(n)); err != nil {
+			return
+		}
+		n += len(chunk)
+	}
+	return
+}
+
+func (df *DataFile) writeChunk(buf []byte, off int64) (err error) {
+	co, err := df.dfc.po.NewCo(nil)
+	if err != nil {
+		return err
+	}
+	defer co.Close()
+
+	if err = co.SendCode(fmt.Sprintf(`
+WriteJDF(%d, %d, %d, %d)
+`, df.handle.Handle, df.handle.Inode, off, len(buf))); err != nil {
+		return err
+	}
+	if err = df.dfc.codec.SendPayload(co, buf); err != nil {
+		return err
+	}
+	if err = co.StartRecv(); err != nil {
+		return err
+	}
+	return recvFsErr(co, "write", df.path)
+}
+
+// Sync commits the data file's content to stable storage at jdfs.
+func (df *DataFile) Sync() (err error) {
+	df.mu.RLock()
+	defer df.mu.RUnlock()
+	if df.closed {
+		return ErrDataFileClosed
+	}
+
+	co, err := df.dfc.po.NewCo(nil)
+	if err != nil {
+		return err
+	}
+	defer co.Close()
+
+	if err = co.SendCode(fmt.Sprintf(`
+SyncJDF(%d, %d)
+`, df.handle.Handle, df.handle.Inode)); err != nil {
+		return err
+	}
+	if err = co.StartRecv(); err != nil {
+		return err
+	}
+	return recvFsErr(co, "sync", df.path)
+}
+
+// Close releases the data file handle at jdfs, subsequent operations on this
+// data file fail with ErrDataFileClosed.
+func (df *DataFile) Close() (err error) {
+	df.mu.Lock()
+	defer df.mu.Unlock()
+	if df.closed {
+		return ErrDataFileClosed
+	}
+	df.closed = true
+
+	co, err := df.dfc.po.NewCo(nil)
+	if err != nil {
+		return err
+	}
+	defer co.Close()
+
+	// jdfs sends nothing back
+	return co.SendCode(fmt.Sprintf(`
+CloseJDF(%d, %d)
+`, df.handle.Handle, df.handle.Inode))
+}
+
+// recvFsErr receives the fs error jdfs sends back first for most data file
+// operations, a non-zero one is returned as *os.PathError wrapping the errno.
+func recvFsErr(co *hbi.PoCo, op, jdfPath string) error {
+	fsErr, err := co.RecvObj()
+	if err != nil {
+		return err
+	}
+	fse, ok := fsErr.(vfs.FsError)
+	if !ok {
+		return errors.Errorf("Unexpected fs error from jdfs with type [%T] - %+v", fsErr, fsErr)
+	}
+	if fse != 0 {
+		return &os.PathError{Op: op, Path: jdfPath, Err: syscall.Errno(fse)}
+	}
+	return nil
+}
+
+func recvInt(co *hbi.PoCo) (hbi.LitIntType, error) {
+	obj, err := co.RecvObj()
+	if err != nil {
+		return 0, err
+	}
+	i, ok := obj.(hbi.LitIntType)
+	if !ok {
+		return 0, errors.Errorf("unexpected int type [%T] of value [%v]", obj, obj)
+	}
+	return i, nil
+}
+
+// recvHandle receives a data file handle sent as `[handle,inode]`
+func recvHandle(co *hbi.PoCo) (handle vfs.DataFileHandle, err error) {
+	obj, err := co.RecvObj()
+	if err != nil {
+		return
+	}
+	fields, ok := obj.(hbi.LitListType)
+	if !ok || len(fields) != 2 {
+		err = errors.Errorf("unexpected handle type [%T] of handle value [%v]", obj, obj)
+		return
+	}
+	h, ok1 := fields[0].(hbi.LitIntType)
+	inode, ok2 := fields[1].(hbi.LitIntType)
+	if !ok1 || !ok2 {
+		err = errors.Errorf("unexpected handle value [%v]", obj)
+		return
+	}
+	return vfs.DataFileHandle{Handle: int(h), Inode: vfs.InodeID(inode)}, nil
+}
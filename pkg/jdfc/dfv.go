@@ -0,0 +1,203 @@
+package jdfc
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"syscall"
+
+	"github.com/complyue/hbi"
+	"github.com/complyue/jdfs/pkg/errors"
+	"github.com/complyue/jdfs/pkg/vfs"
+)
+
+// vectored data file access, many ranges of a data file are read/written in a
+// single conversation, with data of all ranges concatenated in request order, as a
+// single payload.
+
+// ReadRanges reads many ranges of the data file into buf, in as few round trips as
+// possible. data of each range follows the previous one in buf, which must be of
+// the total size of ranges.
+//
+// bytes read of each range are returned, fewer than its size only past end of the
+// data file, with the rest of its data zeroed.
+func (df *DataFile) ReadRanges(ranges []vfs.DataRange, buf []byte) (ns []int, err error) {
+	df.mu.RLock()
+	defer df.mu.RUnlock()
+	if df.closed {
+		return nil, ErrDataFileClosed
+	}
+	if err = checkRanges(ranges, buf); err != nil {
+		return nil, &os.PathError{Op: "read", Path: df.path, Err: err}
+	}
+
+	ns = make([]int, len(ranges))
+	if err = batchRanges(ranges, buf, func(i int, batch []vfs.DataRange, buf []byte) error {
+		return df.readBatch(batch, buf, ns[i:i+len(batch)])
+	}, func(i int, r vfs.DataRange, buf []byte) error {
+		n, err := df.readAt(buf, r.Offset)
+		if err == io.EOF {
+			for j := n; j < len(buf); j++ {
+				buf[j] = 0
+			}
+			err = nil
+		}
+		ns[i] = n
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return ns, nil
+}
+
+// WriteRanges writes many ranges of the data file from buf, in as few round trips
+// as possible. data of each range follows the previous one in buf, which must be
+// of the total size of ranges. overlapping ranges are written in unspecified order.
+func (df *DataFile) WriteRanges(ranges []vfs.DataRange, buf []byte) (err error) {
+	df.mu.RLock()
+	defer df.mu.RUnlock()
+	if df.closed {
+		return ErrDataFileClosed
+	}
+	if err = checkRanges(ranges, buf); err != nil {
+		return &os.PathError{Op: "write", Path: df.path, Err: err}
+	}
+
+	return batchRanges(ranges, buf, func(i int, batch []vfs.DataRange, buf []byte) error {
+		return df.writeBatch(batch, buf)
+	}, func(i int, r vfs.DataRange, buf []byte) error {
+		_, err := df.writeAt(buf, r.Offset)
+		return err
+	})
+}
+
+// checkRanges validates ranges against their data buffer.
+func checkRanges(ranges []vfs.DataRange, buf []byte) error {
+	total := int64(0)
+	for _, r := range ranges {
+		if r.Offset < 0 || r.Size < 0 || r.Offset > math.MaxInt64-r.Size ||
+			r.Size > int64(len(buf))-total {
+			return syscall.EINVAL
+		}
+		total += r.Size
+	}
+	if total != int64(len(buf)) {
+		return syscall.EINVAL
+	}
+	return nil
+}
+
+// batchRanges splits ranges into batches within vfs.MaxDataRanges and
+// vfs.MaxDataRangesSize each, vf is called for each batch with its part of buf, and
+// index of its first range. a range larger than vfs.MaxDataRangesSize is done alone
+// by lf, in chunks.
+func batchRanges(ranges []vfs.DataRange, buf []byte,
+	vf func(i int, batch []vfs.DataRange, buf []byte) error,
+	lf func(i int, r vfs.DataRange, buf []byte) error) error {
+	i0, pos0, pos := 0, int64(0), int64(0)
+	flush := func(i int) error {
+		if i > i0 {
+			if err := vf(i0, ranges[i0:i], buf[pos0:pos]); err != nil {
+				return err
+			}
+		}
+		i0, pos0 = i, pos
+		return nil
+	}
+	for i, r := range ranges {
+		if r.Size > vfs.MaxDataRangesSize {
+			if err := flush(i); err != nil {
+				return err
+			}
+			if err := lf(i, r, buf[pos:pos+r.Size]); err != nil {
+				return err
+			}
+			pos += r.Size
+			i0, pos0 = i+1, pos
+			continue
+		}
+		if i-i0 >= vfs.MaxDataRanges || pos+r.Size-pos0 > vfs.MaxDataRangesSize {
+			if err := flush(i); err != nil {
+				return err
+			}
+		}
+		pos += r.Size
+	}
+	return flush(len(ranges))
+}
+
+func (df *DataFile) readBatch(ranges []vfs.DataRange, buf []byte, ns []int) (err error) {
+	co, err := df.dfc.po.NewCo(nil)
+	if err != nil {
+		return err
+	}
+	defer co.Close()
+
+	if err = co.SendCode(fmt.Sprintf(`
+ReadJDFv(%d, %d, %d)
+`, df.handle.Handle, df.handle.Inode, len(ranges))); err != nil {
+		return err
+	}
+	if err = co.SendData(vfs.DataRangesBytes(ranges)); err != nil {
+		return err
+	}
+	if err = co.StartRecv(); err != nil {
+		return err
+	}
+	if err = recvFsErr(co, "read", df.path); err != nil {
+		return err
+	}
+
+	obj, err := co.RecvObj()
+	if err != nil {
+		return err
+	}
+	bytesRead, ok := obj.(hbi.LitListType)
+	if !ok || len(bytesRead) != len(ranges) {
+		return errors.Errorf("unexpected bytes read of %d ranges [%T] [%v]", len(ranges), obj, obj)
+	}
+	for i, obj := range bytesRead {
+		n, ok := obj.(hbi.LitIntType)
+		if !ok || n < 0 || int64(n) > ranges[i].Size {
+			return errors.Errorf("jdfs read [%v] bytes for a range of %d bytes ?!", obj, ranges[i].Size)
+		}
+		ns[i] = int(n)
+	}
+
+	if len(buf) > 0 {
+		if err = df.dfc.codec.RecvPayload(co, buf, "jdfs"); err != nil {
+			if fse, ok := err.(vfs.FsError); ok {
+				return &os.PathError{Op: "read", Path: df.path, Err: syscall.Errno(fse)}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (df *DataFile) writeBatch(ranges []vfs.DataRange, buf []byte) (err error) {
+	co, err := df.dfc.po.NewCo(nil)
+	if err != nil {
+		return err
+	}
+	defer co.Close()
+
+	if err = co.SendCode(fmt.Sprintf(`
+WriteJDFv(%d, %d, %d, %d)
+`, df.handle.Handle, df.handle.Inode, len(ranges), len(buf))); err != nil {
+		return err
+	}
+	if err = co.SendData(vfs.DataRangesBytes(ranges)); err != nil {
+		return err
+	}
+	if len(buf) > 0 {
+		if err = df.dfc.codec.SendPayload(co, buf); err != nil {
+			return err
+		}
+	}
+	if err = co.StartRecv(); err != nil {
+		return err
+	}
+	return recvFsErr(co, "write", df.path)
+}
@@ -0,0 +1,17 @@
+package jdfc
+
+import "flag"
+
+// jdfc is used as a library as well, it doesn't register process flags on its
+// own, tunables below stay at their defaults unless a command registers them.
+
+// RegisterFlags registers flags tuning jdfc to fs, a command should call it before
+// parsing its flags.
+func RegisterFlags(fs *flag.FlagSet) {
+	fs.IntVar(&ppc, "ppc", ppc,
+		"max `parallelism` of ops in flight to jdfs, of metadata ops and of data ops each, 0 for unlimited")
+	fs.IntVar(&dataWires, "data-wires", dataWires,
+		"`number` of wires to jdfs for bulk data ops besides the one for metadata, 0 for none, unavailable if jdfs runs with -solo=false or over TLS, as warned in the log")
+	fs.BoolVar(&autoReconnect, "reconnect", autoReconnect,
+		"reconnect jdfs and resume the JDFS session after disconnected, instead of exiting")
+}
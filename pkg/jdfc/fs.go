@@ -9,11 +9,16 @@ import (
 	"github.com/complyue/jdfs/pkg/errors"
 	"github.com/complyue/jdfs/pkg/fuse"
 	"github.com/complyue/jdfs/pkg/vfs"
+
+	"github.com/golang/glog"
 )
 
 type fileSystemServer struct {
 	fs          *fileSystem
 	opsInFlight sync.WaitGroup
+
+	// slots bounding metadata/data ops in flight to jdfs, see ppc.go
+	metaSlots, dataSlots opSlots
 }
 
 func (s *fileSystemServer) ServeOps(c *fuse.Connection) {
@@ -49,10 +54,140 @@ func (s *fileSystemServer) handleOp(
 	op interface{}) {
 	defer s.opsInFlight.Done()
 
-	var postJob func() error
+	if !interruptibleOp(op) {
+		postJob, err := s.performOp(c, ctx, op)
+		c.Reply(ctx, err)
+		s.runPostJob(postJob)
+		return
+	}
+
+	var (
+		postJob func() error
+		err     error
+	)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		postJob, err = s.performOp(c, ctx, op)
+	}()
+
+	select {
+	case <-done:
+		c.Reply(ctx, err)
+		s.runPostJob(postJob)
+	case <-ctx.Done():
+		// interrupted by the kernel, jdfs has been told to cancel it by the
+		// conversation in flight, but don't wait for a hung jdfs to answer.
+		release := c.ReplyInterrupted(ctx)
+		// the op still references its message buffers, and the conversation
+		// has to be finished to keep the wire in sync
+		<-done
+		release()
+		s.runPostJob(postJob)
+	}
+}
+
+// performOp performs the op, retrying it after the wire to jdfs reconnected if
+// it's safe to do so.
+func (s *fileSystemServer) performOp(
+	c *fuse.Connection,
+	ctx context.Context,
+	op interface{}) (postJob func() error, err error) {
+	// bound ops in flight to jdfs, see ppc.go
+	slots := s.opSlotsOf(op)
+	if err = slots.acquire(ctx, interruptibleOp(op)); err != nil {
+		return nil, syscall.EINTR
+	}
+	defer slots.release()
+
+	for {
+		wireGen := s.fs.currentWire()
+		var wireDropped bool
+		if postJob, err, wireDropped = s.dispatchOp(c, ctx, op, wireGen); !wireDropped {
+			break
+		}
+		// the wire to jdfs dropped amid this op
+		if !retryableOp(op) {
+			// it's unknown whether the op has taken effect at jdfs
+			err = vfs.EIO
+			break
+		}
+		if ctx.Err() != nil {
+			// interrupted meanwhile, not worth retrying
+			err = vfs.EINTR
+			break
+		}
+		// retry after reconnected
+		s.fs.awaitWire(wireGen)
+	}
+
+	// convert portable error type back to os specific errno error type
+	if fse, ok := err.(vfs.FsError); ok {
+		err = syscall.Errno(fse)
+	}
+
+	return
+}
+
+func (s *fileSystemServer) runPostJob(postJob func() error) {
+	if postJob != nil {
+		if err := postJob(); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// retryableOp tells whether an op can be safely retried after it failed due to
+// the wire to jdfs dropped, i.e. idempotent.
+func retryableOp(op interface{}) bool {
+	switch typed := op.(type) {
+	case *vfs.StatFSOp, *vfs.LookUpInodeOp, *vfs.GetInodeAttributesOp,
+		*vfs.ReadDirOp, *vfs.ReadFileOp, *vfs.WriteFileOp, *vfs.SyncFileOp,
+		*vfs.LseekOp,
+		*vfs.ReadSymlinkOp, *vfs.GetXattrOp, *vfs.ListXattrOp:
+		return true
+	case *vfs.FallocateOp:
+		// collapsing or inserting a range shifts data after it, not to be repeated
+		return typed.Mode&^vfs.FallocModes == 0
+	}
+	return false
+}
+
+// interruptibleOp tells whether an op can be replied EINTR on interruption from
+// the kernel, before jdfs answers it. only read-only ops can be, a mutating op
+// may still take effect at jdfs after told to cancel, so its actual result is
+// waited for, which is EINTR if jdfs cancelled it in time. SetLockOp is the
+// exception, as a lock granted after interrupted is undone by SetLock. ops
+// referencing inodes or handles can't be either, or their reference counting
+// would go out of sync with the kernel.
+func interruptibleOp(op interface{}) bool {
+	switch op.(type) {
+	case *vfs.StatFSOp, *vfs.GetInodeAttributesOp,
+		*vfs.ReadDirOp, *vfs.ReadFileOp, *vfs.LseekOp,
+		*vfs.GetLockOp, *vfs.SetLockOp,
+		*vfs.ReadSymlinkOp, *vfs.GetXattrOp, *vfs.ListXattrOp:
+		return true
+	}
+	return false
+}
+
+// dispatchOp performs the op with the appropriate method, a panic from the wire of
+// generation wireGen dropped is recovered, with wireDropped returned true.
+func (s *fileSystemServer) dispatchOp(
+	c *fuse.Connection,
+	ctx context.Context,
+	op interface{}, wireGen int) (postJob func() error, err error, wireDropped bool) {
+	defer func() {
+		if e := recover(); e != nil {
+			if !s.fs.wireDropped(wireGen) {
+				panic(e) // not a wire failure, crash as before
+			}
+			glog.Warningf("FUSE op %T interrupted by jdfs disconnection - %+v", op, e)
+			wireDropped = true
+		}
+	}()
 
 	// Dispatch to the appropriate method.
-	var err error
 	switch typed := op.(type) {
 
 	case *vfs.StatFSOp:
@@ -100,6 +235,9 @@ func (s *fileSystemServer) handleOp(
 	case *vfs.ReadDirOp:
 		err = s.fs.ReadDir(ctx, typed)
 
+	case *vfs.ReadDirPlusOp:
+		err = s.fs.ReadDirPlus(ctx, typed)
+
 	case *vfs.ReleaseDirHandleOp:
 		err = s.fs.ReleaseDirHandle(ctx, typed)
 
@@ -135,6 +273,21 @@ func (s *fileSystemServer) handleOp(
 			return nil
 		}
 
+	case *vfs.FallocateOp:
+		err = s.fs.Fallocate(ctx, typed)
+
+	case *vfs.LseekOp:
+		err = s.fs.Lseek(ctx, typed)
+
+	case *vfs.CopyFileRangeOp:
+		err = s.fs.CopyFileRange(ctx, typed)
+
+	case *vfs.GetLockOp:
+		err = s.fs.GetLock(ctx, typed)
+
+	case *vfs.SetLockOp:
+		err = s.fs.SetLock(ctx, typed)
+
 	case *vfs.ReleaseFileHandleOp:
 		err = s.fs.ReleaseFileHandle(ctx, typed)
 
@@ -157,16 +310,5 @@ func (s *fileSystemServer) handleOp(
 		err = vfs.ENOSYS
 	}
 
-	// convert portable error type back to os specific errno error type
-	if fse, ok := err.(vfs.FsError); ok {
-		err = syscall.Errno(fse)
-	}
-
-	c.Reply(ctx, err)
-
-	if postJob != nil {
-		if err = postJob(); err != nil {
-			panic(err)
-		}
-	}
+	return
 }
@@ -9,6 +9,7 @@ import (
 
 	"github.com/complyue/jdfs/pkg/errors"
 	"github.com/complyue/jdfs/pkg/fuse"
+	"github.com/complyue/jdfs/pkg/vfs"
 	"github.com/golang/glog"
 )
 
@@ -51,10 +52,40 @@ func PrepareMountpoint(mpArg string) (mountpoint string, err error) {
 }
 
 // ResolveJDFS infers JDFS server information from specified url and target mountpoint.
+//
+// the url scheme can be `jdfs` for plain TCP, or `jdfss` for TLS, or `jdfs+unix`
+// for a unix domain socket on the same host, in which case jdfsHost is the socket
+// path, and jdfsPath comes from the `sub` query parameter, e.g.
+// `jdfs+unix:///path/to.sock?sub=some/dir`
+//
+// wire compression of bulk data payloads can be requested by the `compress` query
+// parameter, e.g. `jdfs://host/some/dir?compress=zstd`, see WireCompression(), and
+// end-to-end checksums of them by `checksum`, e.g. `?checksum=crc32c`, see
+// WireChecksum().
 func ResolveJDFS(urlArg, mountpoint string) (jdfsURL *url.URL,
 	jdfsHost, jdfsPath string, err error) {
 	var jdfsHostName, jdfsPort string
+	var socketPath string
 	defer func() {
+		// run after jdfsURL finalized
+		if err != nil || jdfsURL == nil {
+			return
+		}
+		if _, e := vfs.NewCompressor(WireCompression(jdfsURL)); e != nil {
+			err = errors.Wrapf(e, "Invalid jdfs url: [%s]", jdfsURL)
+		} else if _, e := vfs.NewChecksum(WireChecksum(jdfsURL)); e != nil {
+			err = errors.Wrapf(e, "Invalid jdfs url: [%s]", jdfsURL)
+		}
+	}()
+	defer func() {
+		if len(socketPath) > 0 {
+			jdfsHost = socketPath
+			if strings.HasPrefix(jdfsPath, "/") {
+				jdfsPath = jdfsPath[1:] // make sure jdfsPath is always relative
+			}
+			return
+		}
+
 		if len(jdfsHostName) <= 0 {
 			jdfsURL = nil
 			return
@@ -85,9 +116,14 @@ func ResolveJDFS(urlArg, mountpoint string) (jdfsURL *url.URL,
 			err = errors.Wrapf(err, "Failed parsing jdfs url [%s]", urlArg)
 			return
 		}
-		if !jdfsURL.IsAbs() || "jdfs" != jdfsURL.Scheme {
+		if !jdfsURL.IsAbs() || !validScheme(jdfsURL.Scheme) {
 			err = errors.Errorf("Invalid jdfs url: [%s]", urlArg)
 		}
+		if jdfsURL.Scheme == unixScheme {
+			socketPath = jdfsURL.Path
+			jdfsPath = jdfsURL.Query().Get("sub")
+			return
+		}
 		jdfsHostName = jdfsURL.Hostname()
 		jdfsPort = jdfsURL.Port()
 		if len(jdfsURL.Path) <= 0 || jdfsURL.Path == "/" {
@@ -120,12 +156,10 @@ func ResolveJDFS(urlArg, mountpoint string) (jdfsURL *url.URL,
 				return
 			}
 
-			if !jdfsRootURL.IsAbs() || "jdfs" != jdfsRootURL.Scheme {
+			if !jdfsRootURL.IsAbs() || !validScheme(jdfsRootURL.Scheme) {
 				err = errors.Errorf("Invalid JDFS url: [%s] in [%s]", magicRoot, magicFn)
 				return
 			}
-			jdfsHostName = jdfsRootURL.Hostname()
-			jdfsPort = jdfsRootURL.Port()
 
 			var mpRel string
 			if mpRel, err = filepath.Rel(atDir, mountpoint); err != nil {
@@ -137,6 +171,13 @@ func ResolveJDFS(urlArg, mountpoint string) (jdfsURL *url.URL,
 			}
 
 			jdfsRootPath := jdfsRootURL.Path
+			if jdfsRootURL.Scheme == unixScheme {
+				socketPath = jdfsRootURL.Path
+				jdfsRootPath = jdfsRootURL.Query().Get("sub")
+			} else {
+				jdfsHostName = jdfsRootURL.Hostname()
+				jdfsPort = jdfsRootURL.Port()
+			}
 			if len(jdfsRootPath) <= 0 || jdfsRootPath == "/" {
 				jdfsRootPath = ""
 			}
@@ -151,7 +192,13 @@ func ResolveJDFS(urlArg, mountpoint string) (jdfsURL *url.URL,
 
 			// inherite query/fragment from configured root url
 			derivedURL := *jdfsRootURL
-			derivedURL.Path = jdfsPath
+			if socketPath != "" {
+				q := derivedURL.Query()
+				q.Set("sub", jdfsPath)
+				derivedURL.RawQuery = q.Encode()
+			} else {
+				derivedURL.Path = jdfsPath
+			}
 			jdfsURL = &derivedURL
 
 			break
@@ -166,3 +213,26 @@ func ResolveJDFS(urlArg, mountpoint string) (jdfsURL *url.URL,
 
 	return
 }
+
+// url scheme for jdfs over a unix domain socket on the same host
+const unixScheme = "jdfs+unix"
+
+func validScheme(scheme string) bool {
+	return scheme == "jdfs" || scheme == "jdfss" || scheme == unixScheme
+}
+
+// IsUnixURL tells whether the jdfs url is for a unix domain socket
+func IsUnixURL(jdfsURL *url.URL) bool {
+	return jdfsURL.Scheme == unixScheme
+}
+
+// WireCompression returns the wire compression requested by the jdfs url, empty
+// for none.
+func WireCompression(jdfsURL *url.URL) string {
+	return jdfsURL.Query().Get("compress")
+}
+
+// WireChecksum returns the wire checksum requested by the jdfs url, empty for none.
+func WireChecksum(jdfsURL *url.URL) string {
+	return jdfsURL.Query().Get("checksum")
+}
@@ -0,0 +1,53 @@
+package jdfc
+
+import (
+	"fmt"
+
+	"github.com/complyue/hbi"
+	"github.com/complyue/jdfs/pkg/errors"
+)
+
+// bulk data payloads are sent/received by a vfs.PayloadCodec negotiated right after
+// mounted, see vfs/payload.go for how they are framed over the wire.
+
+// useWireMethod asks jdfs by calling jdfsFunc, to use method for bulk data payloads
+// of the session just mounted over po, if it's among those jdfs told supported by
+// mountedFields[field]. whether it's in use is returned.
+func useWireMethod(po *hbi.PostingEnd, mountedFields hbi.LitListType, field int,
+	jdfsFunc, method string) (bool, error) {
+	supported := false
+	if len(mountedFields) > field { // older jdfs tells less
+		methods, _ := mountedFields[field].(hbi.LitListType)
+		for _, m := range methods {
+			if m == method {
+				supported = true
+				break
+			}
+		}
+	}
+	if !supported {
+		return false, nil
+	}
+
+	co, err := po.NewCo(nil)
+	if err != nil {
+		return false, err
+	}
+	defer co.Close()
+	if err = co.SendCode(fmt.Sprintf(`
+%s(%#v)
+`, jdfsFunc, method)); err != nil {
+		return false, err
+	}
+	if err = co.StartRecv(); err != nil {
+		return false, err
+	}
+	errReason, err := recvString(co)
+	if err != nil {
+		return false, err
+	}
+	if len(errReason) > 0 {
+		return false, errors.Errorf("jdfs refused %s(%#v) - %s", jdfsFunc, method, errReason)
+	}
+	return true, nil
+}
@@ -0,0 +1,68 @@
+package jdfc
+
+import (
+	"context"
+
+	"github.com/complyue/jdfs/pkg/vfs"
+)
+
+// the kernel can have many FUSE ops outstanding, each served by its own goroutine,
+// conversations posted to jdfs for them are bounded in parallelism by -ppc, with
+// metadata ops and data ops each having their own slots, so bulk reads/writes
+// won't starve stat'ing and lookups of the same mount.
+//
+// ops not conversing with jdfs, or cheap enough and must not be held back, e.g.
+// forgetting inodes and releasing handles, or waiting for others, i.e. file
+// locking, take no slot.
+
+var (
+	// max number of metadata/data ops each, in flight to jdfs concurrently
+	ppc = 32
+)
+
+// opSlots bounds ops of a class in flight concurrently, nil for unlimited.
+type opSlots chan struct{}
+
+func newOpSlots(n int) opSlots {
+	if n <= 0 {
+		return nil
+	}
+	return make(opSlots, n)
+}
+
+// acquire waits for a free slot, if ctx is done before one available, EINTR is
+// returned for an interruptible op.
+func (s opSlots) acquire(ctx context.Context, interruptible bool) error {
+	if s == nil {
+		return nil
+	}
+	if !interruptible {
+		s <- struct{}{}
+		return nil
+	}
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return vfs.EINTR
+	}
+}
+
+func (s opSlots) release() {
+	if s != nil {
+		<-s
+	}
+}
+
+// opSlotsOf returns the slots an op is to take, nil if it takes none.
+func (s *fileSystemServer) opSlotsOf(op interface{}) opSlots {
+	switch op.(type) {
+	case *vfs.ForgetInodeOp, *vfs.ReleaseDirHandleOp, *vfs.ReleaseFileHandleOp,
+		*vfs.FlushFileOp, *vfs.GetLockOp, *vfs.SetLockOp:
+		return nil
+	case *vfs.ReadFileOp, *vfs.WriteFileOp, *vfs.SyncFileOp,
+		*vfs.FallocateOp, *vfs.CopyFileRangeOp:
+		return s.dataSlots
+	}
+	return s.metaSlots
+}
@@ -0,0 +1,500 @@
+package jdfc
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/complyue/hbi"
+	"github.com/complyue/jdfs/pkg/errors"
+	"github.com/complyue/jdfs/pkg/vfs"
+
+	"github.com/golang/glog"
+)
+
+var (
+	// whether to reconnect jdfs after the wire dropped, or exit jdfc
+	autoReconnect = true
+)
+
+const (
+	reconnectBackoffMin = 1 * time.Second
+	reconnectBackoffMax = 30 * time.Second
+)
+
+// an inode as referenced by the FUSE kernel, tracked so jdfs can be told to reload it
+// after reconnected.
+type knownInode struct {
+	// the name entry through which this inode was last reached,
+	// parent is 0 if it has been unlinked
+	parent vfs.InodeID
+	name   string
+
+	// number of references counted by FUSE kernel
+	refcnt int
+	// number of references jdfs knows about, can be less than refcnt after some
+	// inode failed resuming
+	srvRefcnt int
+}
+
+type entryKey struct {
+	parent vfs.InodeID
+	name   string
+}
+
+// a file/dir handle as given to FUSE kernel, stays valid across reconnections,
+// while the handle at jdfs may change.
+type knownHandle struct {
+	inode    vfs.InodeID
+	writable bool
+
+	// handle at jdfs, 0 if lost by failed resuming
+	srv vfs.HandleID
+}
+
+// learnInode records an inode reached through the named entry, with one more reference
+// counted by FUSE kernel. must be called after the op succeeded at jdfs.
+func (fs *fileSystem) learnInode(parent vfs.InodeID, name string, inode vfs.InodeID) {
+	if inode == vfs.RootInodeID {
+		return // root is always there
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	ki, ok := fs.inodes[inode]
+	if !ok {
+		ki = &knownInode{}
+		fs.inodes[inode] = ki
+	} else if ki.parent != 0 {
+		delete(fs.entries, entryKey{ki.parent, ki.name})
+	}
+	ki.parent, ki.name = parent, name
+	ki.refcnt++
+	ki.srvRefcnt++
+	fs.entries[entryKey{parent, name}] = inode
+}
+
+// forgetInode decreases references counted by FUSE kernel, and returns number of
+// references to be forgotten by jdfs.
+func (fs *fileSystem) forgetInode(inode vfs.InodeID, n int) (srvN int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	ki, ok := fs.inodes[inode]
+	if !ok {
+		return n // not tracked, let jdfs decide
+	}
+	ki.refcnt -= n
+	if ki.srvRefcnt > ki.refcnt {
+		if ki.refcnt < 0 {
+			srvN, ki.srvRefcnt = ki.srvRefcnt, 0
+		} else {
+			srvN, ki.srvRefcnt = ki.srvRefcnt-ki.refcnt, ki.refcnt
+		}
+	}
+	if ki.refcnt <= 0 {
+		if ki.parent != 0 {
+			if fs.entries[entryKey{ki.parent, ki.name}] == inode {
+				delete(fs.entries, entryKey{ki.parent, ki.name})
+			}
+		}
+		delete(fs.inodes, inode)
+	}
+	return
+}
+
+// entryMoved updates tracked name entries after a successful rename at jdfs.
+func (fs *fileSystem) entryMoved(oldParent vfs.InodeID, oldName string,
+	newParent vfs.InodeID, newName string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if replaced, ok := fs.entries[entryKey{newParent, newName}]; ok {
+		if ki, ok := fs.inodes[replaced]; ok {
+			ki.parent, ki.name = 0, ""
+		}
+		delete(fs.entries, entryKey{newParent, newName})
+	}
+
+	inode, ok := fs.entries[entryKey{oldParent, oldName}]
+	if !ok {
+		return
+	}
+	delete(fs.entries, entryKey{oldParent, oldName})
+	if ki, ok := fs.inodes[inode]; ok {
+		ki.parent, ki.name = newParent, newName
+		fs.entries[entryKey{newParent, newName}] = inode
+	}
+}
+
+// entryRemoved updates tracked name entries after a successful unlink/rmdir at jdfs.
+func (fs *fileSystem) entryRemoved(parent vfs.InodeID, name string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	inode, ok := fs.entries[entryKey{parent, name}]
+	if !ok {
+		return
+	}
+	delete(fs.entries, entryKey{parent, name})
+	if ki, ok := fs.inodes[inode]; ok {
+		ki.parent, ki.name = 0, ""
+	}
+}
+
+// must have fs.mu locked
+func (fs *fileSystem) inodePath(inode vfs.InodeID) (jdfPath string, ok bool) {
+	var names []string
+	for hops := 0; inode != vfs.RootInodeID; hops++ {
+		ki, ok := fs.inodes[inode]
+		if !ok || ki.parent == 0 || hops > len(fs.inodes) {
+			return "", false // unlinked, or corrupted tracking
+		}
+		names = append(names, ki.name)
+		inode = ki.parent
+	}
+	if len(names) <= 0 {
+		return ".", true
+	}
+	for i, j := 0, len(names)-1; i < j; i, j = i+1, j-1 {
+		names[i], names[j] = names[j], names[i]
+	}
+	return strings.Join(names, "/"), true
+}
+
+// registerHandle assigns a handle to be given to FUSE kernel, for a handle opened at jdfs.
+func (fs *fileSystem) registerHandle(dir bool, inode vfs.InodeID, writable bool,
+	srv vfs.HandleID) (handle vfs.HandleID) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.lastHandle++
+	handle = fs.lastHandle
+	kh := &knownHandle{inode: inode, writable: writable, srv: srv}
+	if dir {
+		fs.dirHandles[handle] = kh
+	} else {
+		fs.fileHandles[handle] = kh
+	}
+	return
+}
+
+// srvHandle translates a handle from FUSE kernel to the handle at jdfs.
+func (fs *fileSystem) srvHandle(dir bool, handle vfs.HandleID) (srv vfs.HandleID, err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var kh *knownHandle
+	if dir {
+		kh = fs.dirHandles[handle]
+	} else {
+		kh = fs.fileHandles[handle]
+	}
+	if kh == nil || kh.srv == 0 {
+		// not existing or lost by failed resuming
+		return 0, vfs.EIO
+	}
+	return kh.srv, nil
+}
+
+// releaseHandle unregisters a handle from FUSE kernel, and returns the handle at jdfs
+// to be released, 0 if none.
+func (fs *fileSystem) releaseHandle(dir bool, handle vfs.HandleID) (srv vfs.HandleID) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	handles := fs.fileHandles
+	if dir {
+		handles = fs.dirHandles
+	}
+	if kh, ok := handles[handle]; ok {
+		srv = kh.srv
+		delete(handles, handle)
+	}
+	return
+}
+
+// resumable tells whether the session should be resumed after disconnected, i.e.
+// mounted and not yet unmounted.
+func (fs *fileSystem) resumable() bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.fuseConn != nil && !fs.destroyed
+}
+
+// connLost is called when the wire to jdfs dropped, FUSE ops will block until
+// reconnected and resumed.
+//
+// returns false if po is not the current wire, e.g. a wire dropped during resuming.
+func (fs *fileSystem) connLost(po *hbi.PostingEnd) bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.po != po {
+		return false
+	}
+	fs.po, fs.ho = nil, nil
+	// jdfs disconnects data wires of the session as well, don't wait for that
+	go closeDataWires(fs.dataPOs)
+	fs.dataPOs = nil
+	fs.wireGen++
+	fs.wireCond.Broadcast()
+	return true
+}
+
+// newCo starts a posting conversation with jdfs for a FUSE op, waiting for the
+// wire to be reconnected if currently dropped.
+//
+// jdfs is told to cancel the op, if ctx is done (i.e. the op interrupted by the
+// kernel) before the conversation closed.
+func (fs *fileSystem) newCo(ctx context.Context) (*opCo, error) {
+	fs.mu.Lock()
+	for fs.po == nil {
+		fs.wireCond.Wait()
+	}
+	po, codec := fs.po, fs.codec
+	fs.mu.Unlock()
+
+	return newOpCo(ctx, po, codec)
+}
+
+// newOpCo starts a posting conversation for a FUSE op over po, with bulk data
+// payloads sent by codec, of the session mounted at the time.
+func newOpCo(ctx context.Context, po *hbi.PostingEnd,
+	codec vfs.PayloadCodec) (*opCo, error) {
+	co, err := po.NewCo(nil)
+	if err != nil {
+		return nil, err
+	}
+	oc := &opCo{PoCo: co, closed: make(chan struct{}), codec: codec}
+	if ctx.Done() != nil {
+		go oc.cancelOnDone(ctx, po)
+	}
+	return oc, nil
+}
+
+// opCo is a posting conversation for a FUSE op.
+type opCo struct {
+	*hbi.PoCo
+
+	closed chan struct{}
+
+	codec vfs.PayloadCodec
+}
+
+func (oc *opCo) sendPayload(payload []byte) error {
+	return oc.codec.SendPayload(oc.PoCo, payload)
+}
+
+func (oc *opCo) recvPayload(buf []byte) error {
+	return oc.codec.RecvPayload(oc.PoCo, buf, "jdfs")
+}
+
+func (oc *opCo) Close() error {
+	close(oc.closed)
+	return oc.PoCo.Close()
+}
+
+func (oc *opCo) cancelOnDone(ctx context.Context, po *hbi.PostingEnd) {
+	select {
+	case <-oc.closed:
+	case <-ctx.Done():
+		select {
+		case <-oc.closed:
+			return // finished anyway
+		default:
+		}
+		// the conversation is to be finished by the op as normal, with EINTR if
+		// jdfs cancelled it in time, or with the result otherwise.
+		if err := po.Notif(fmt.Sprintf(`
+CancelOp(%#v)
+`, oc.CoSeq())); err != nil {
+			glog.Warningf("Failed telling jdfs to cancel op of co [%s] - %+v", oc.CoSeq(), err)
+		}
+	}
+}
+
+// currentWire returns generation number of current wires to jdfs.
+func (fs *fileSystem) currentWire() int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.wireGen
+}
+
+// wireDropped tells whether the wires of generation gen have any dropped.
+func (fs *fileSystem) wireDropped(gen int) bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.wireGen != gen || fs.po == nil || fs.po.Disconnected() {
+		return true
+	}
+	for _, po := range fs.dataPOs {
+		if po.Disconnected() {
+			return true
+		}
+	}
+	return false
+}
+
+// awaitWire waits until a wire newer than generation gen is ready.
+func (fs *fileSystem) awaitWire(gen int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for fs.wireGen == gen || fs.po == nil {
+		fs.wireCond.Wait()
+	}
+}
+
+// reconnect redials jdfs with backoff until a new wire is established and the
+// session resumed.
+func (fs *fileSystem) reconnect(dial func() error) {
+	backoff := reconnectBackoffMin
+	for {
+		err := dial()
+		if err == nil {
+			return
+		}
+		glog.Errorf("Failed reconnecting jdfs, retry in %v - %+v", backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > reconnectBackoffMax {
+			backoff = reconnectBackoffMax
+		}
+	}
+}
+
+// resume re-establishes jdfs server side states of this JDFS session, over a newly
+// mounted wire. must have fs.mu locked.
+//
+// returned are inodes jdfs failed resuming, kernel cache of their name entries should
+// be invalidated.
+func (fs *fileSystem) resume(po *hbi.PostingEnd) (lost []entryKey, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = errors.RichError(e)
+		}
+	}()
+
+	recvFsErr := func(co *hbi.PoCo) vfs.FsError {
+		if err := co.StartRecv(); err != nil {
+			panic(err)
+		}
+		fsErr, err := co.RecvObj()
+		if err != nil {
+			panic(err)
+		}
+		fse, ok := fsErr.(vfs.FsError)
+		if !ok {
+			panic(errors.Errorf("Unexpected fs error from jdfs with type [%T] - %+v", fsErr, fsErr))
+		}
+		return fse
+	}
+	recvHandle := func(co *hbi.PoCo) vfs.HandleID {
+		handle, err := co.RecvObj()
+		if err != nil {
+			panic(err)
+		}
+		h, ok := handle.(hbi.LitIntType)
+		if !ok {
+			panic(errors.Errorf("unexpected handle type [%T] of handle value [%v]", handle, handle))
+		}
+		return vfs.HandleID(h)
+	}
+
+	for inode, ki := range fs.inodes {
+		jdfPath, ok := fs.inodePath(inode)
+		fse := vfs.ENOENT
+		if ok {
+			func() {
+				co, err := po.NewCo(nil)
+				if err != nil {
+					panic(err)
+				}
+				defer co.Close()
+				if err = co.SendCode(fmt.Sprintf(`
+ResumeInode(%#v, %#v, %#v)
+`, inode, jdfPath, ki.refcnt)); err != nil {
+					panic(err)
+				}
+				fse = recvFsErr(co)
+			}()
+		}
+		if fse != 0 {
+			glog.Warningf("Inode [%d] at [%s] lost after reconnected - %v", inode, jdfPath, fse)
+			ki.srvRefcnt = 0
+			if ki.parent != 0 {
+				lost = append(lost, entryKey{ki.parent, ki.name})
+			}
+			continue
+		}
+		ki.srvRefcnt = ki.refcnt
+	}
+
+	reopen := func(dir bool, kh *knownHandle) {
+		kh.srv = 0
+		co, err := po.NewCo(nil)
+		if err != nil {
+			panic(err)
+		}
+		defer co.Close()
+		if dir {
+			err = co.SendCode(fmt.Sprintf(`
+OpenDir(%#v)
+`, kh.inode))
+		} else {
+			err = co.SendCode(fmt.Sprintf(`
+OpenFile(%#v, %#v, %#v)
+`, kh.inode, kh.writable, false))
+		}
+		if err != nil {
+			panic(err)
+		}
+		if fse := recvFsErr(co); fse != 0 {
+			glog.Warningf("Handle on inode [%d] lost after reconnected - %v", kh.inode, fse)
+			return
+		}
+		kh.srv = recvHandle(co)
+	}
+	for _, kh := range fs.dirHandles {
+		reopen(true, kh)
+	}
+	for _, kh := range fs.fileHandles {
+		reopen(false, kh)
+	}
+
+	return
+}
+
+// invalidateResumed invalidates FUSE kernel cache after resumed, as things may have
+// changed at jdfs while disconnected.
+func (fs *fileSystem) invalidateResumed(lost []entryKey) {
+	fuseConn := fs.mountedConn()
+	if fuseConn == nil {
+		return
+	}
+
+	fs.mu.Lock()
+	inodes := make([]vfs.InodeID, 0, len(fs.inodes)+1)
+	inodes = append(inodes, vfs.RootInodeID)
+	for inode := range fs.inodes {
+		inodes = append(inodes, inode)
+	}
+	fs.mu.Unlock()
+
+	for _, ent := range lost {
+		if err := fuseConn.InvalidateEntry(ent.parent, ent.name); err != nil && err != syscall.ENOENT {
+			glog.Errorf("Unexpected fuse kernel error on entry invalidation [%T] - %+v", err, err)
+		}
+	}
+	for _, inode := range inodes {
+		if err := fuseConn.InvalidateNode(inode, 0, -1); err != nil && err != syscall.ENOENT {
+			glog.Errorf("Unexpected fuse kernel error on inode invalidation [%T] - %+v", err, err)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package jdfc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+
+	"github.com/complyue/hbi"
+	"github.com/complyue/jdfs/pkg/errors"
+)
+
+// TLSConfig creates the TLS config to connect jdfs at serverName, with the client
+// certificate from PEM encoded tlsCertFile/tlsKeyFile, and jdfs verified against
+// CA certificates from PEM encoded serverCAFile, or system CAs if it's empty.
+func TLSConfig(serverName string, tlsCertFile, tlsKeyFile, serverCAFile string) (
+	cfg *tls.Config, err error) {
+	if len(tlsCertFile) <= 0 || len(tlsKeyFile) <= 0 {
+		return nil, errors.New("client certificate and private key are required for jdfss://")
+	}
+	cert, err := tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading TLS client certificate")
+	}
+	cfg = &tls.Config{
+		ServerName:   serverName,
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if len(serverCAFile) > 0 {
+		caPEM, err := ioutil.ReadFile(serverCAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "loading server CA")
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, errors.Errorf("no CA certificate found in [%s]", serverCAFile)
+		}
+	}
+	return
+}
+
+// ConnTLS connects a JDFS client to the JDFS server over a TLS connection
+// dialed to serverAddr.
+func ConnTLS(serverAddr string, cfg *tls.Config) func(he *hbi.HostingEnv) (
+	po *hbi.PostingEnd, ho *hbi.HostingEnd, err error,
+) {
+	return func(he *hbi.HostingEnv) (
+		po *hbi.PostingEnd, ho *hbi.HostingEnd, err error,
+	) {
+		var conn *tls.Conn
+		if conn, err = tls.Dial("tcp", serverAddr, cfg); err != nil {
+			return
+		}
+		if err = conn.Handshake(); err != nil {
+			conn.Close()
+			return
+		}
+		return hbi.TakeConn(net.Conn(conn), he)
+	}
+}
@@ -0,0 +1,23 @@
+package jdfc
+
+import (
+	"net"
+
+	"github.com/complyue/hbi"
+)
+
+// ConnUnix connects a JDFS client to the JDFS server on the same host, over a
+// unix domain socket at socketPath.
+func ConnUnix(socketPath string) func(he *hbi.HostingEnv) (
+	po *hbi.PostingEnd, ho *hbi.HostingEnd, err error,
+) {
+	return func(he *hbi.HostingEnv) (
+		po *hbi.PostingEnd, ho *hbi.HostingEnd, err error,
+	) {
+		var conn *net.UnixConn
+		if conn, err = net.DialUnix("unix", nil, &net.UnixAddr{Name: socketPath, Net: "unix"}); err != nil {
+			return
+		}
+		return hbi.TakeConn(conn, he)
+	}
+}
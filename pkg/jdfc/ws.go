@@ -0,0 +1,283 @@
+package jdfc
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/complyue/jdfs/pkg/errors"
+
+	"github.com/complyue/hbi"
+)
+
+// workset management, see jdfs' MakeWorksetRoot/CommitWorkset/DiscardWorksetRoot
+//
+// a workset is a private dir at jdfs, data files are allocated and written there,
+// then published to their public paths at once by a commit.
+
+// ErrWorksetDiscarded is returned from operations on a discarded Workset.
+var ErrWorksetDiscarded = errors.New("workset already discarded")
+
+// WorksetError is returned when jdfs failed a workset operation, with the reason
+// as reported by jdfs.
+type WorksetError struct {
+	// one of "make", "commit", "stat", "list"
+	Op string
+	// the workset root dir, or base dir for "make" and "list"
+	Dir string
+
+	Reason string
+}
+
+func (e *WorksetError) Error() string {
+	return fmt.Sprintf("workset %s [%s]: %s", e.Op, e.Dir, e.Reason)
+}
+
+// WorksetInfo describes a workset at jdfs.
+type WorksetInfo struct {
+	// the workset root dir, relative to the mounted root
+	Root string
+
+	Age time.Duration
+
+	// total bytes of files in it
+	Size int64
+
+	// the session made it, empty if unknown
+	Owner string
+
+	// whether the owner session is still connected
+	Live bool
+}
+
+// Workset is a workset made through a DataFileClient.
+type Workset struct {
+	dfc  *DataFileClient
+	wsrd string
+
+	mu        sync.Mutex
+	discarded bool
+}
+
+// MakeWorkset makes a new workset root dir under baseDir, with name resembling
+// nameHint. Name of baseDir should start with '.' to have workset files hidden
+// from public data file lookups.
+//
+// the workset is owned by this client's session until discarded or the session
+// ends, jdfs started with -ws-ttl garbage collects it after that.
+func (dfc *DataFileClient) MakeWorkset(baseDir, nameHint string) (ws *Workset, err error) {
+	co, err := dfc.po.NewCo(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer co.Close()
+
+	if err = co.SendCode(fmt.Sprintf(`
+MakeWorksetRoot(%#v, %#v)
+`, baseDir, nameHint)); err != nil {
+		return nil, err
+	}
+	if err = co.StartRecv(); err != nil {
+		return nil, err
+	}
+	// jdfs sends the wsrd back even on error
+	errReason, err := recvString(co)
+	if err != nil {
+		return nil, err
+	}
+	wsrd, err := recvString(co)
+	if err != nil {
+		return nil, err
+	}
+	if len(errReason) > 0 {
+		return nil, &WorksetError{Op: "make", Dir: baseDir, Reason: errReason}
+	}
+
+	return &Workset{dfc: dfc, wsrd: wsrd}, nil
+}
+
+// Root returns the workset root dir, relative to the mounted root.
+func (ws *Workset) Root() string {
+	return ws.wsrd
+}
+
+// Alloc allocates a data file in this workset, to be published at pubPath by a
+// commit, see DataFileClient.Alloc for the arguments.
+func (ws *Workset) Alloc(pubPath string, header, meta []byte, size int64) (*DataFile, error) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.discarded {
+		return nil, ErrWorksetDiscarded
+	}
+
+	return ws.dfc.Alloc(ws.wsrd+"/"+pubPath, true, header, meta, size)
+}
+
+// Commit publishes data files in this workset to pubPaths, overwriting existing
+// ones, atomically. Data files allocated should be closed before committed.
+func (ws *Workset) Commit(pubPaths []string) (err error) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.discarded {
+		return ErrWorksetDiscarded
+	}
+
+	co, err := ws.dfc.po.NewCo(nil)
+	if err != nil {
+		return err
+	}
+	defer co.Close()
+
+	if err = co.SendCode(fmt.Sprintf(`
+CommitWorkset(%#v, %d, %#v, %#v)
+`, ws.wsrd, len(pubPaths), ws.dfc.metaExt, ws.dfc.dataExt)); err != nil {
+		return err
+	}
+	for _, pubPath := range pubPaths {
+		if err = co.SendObj(fmt.Sprintf("%#v", pubPath)); err != nil {
+			return err
+		}
+	}
+	if err = co.StartRecv(); err != nil {
+		return err
+	}
+	return recvErrReason(co, "commit", ws.wsrd)
+}
+
+// Discard removes this workset with whatever left in it, it's a no-op if already
+// discarded. Files published by a successful commit are not affected, so it's
+// safe to defer Discard() right after the workset is made.
+func (ws *Workset) Discard() (err error) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.discarded {
+		return nil
+	}
+
+	co, err := ws.dfc.po.NewCo(nil)
+	if err != nil {
+		return err
+	}
+	defer co.Close()
+
+	// jdfs sends nothing back
+	if err = co.SendCode(fmt.Sprintf(`
+DiscardWorksetRoot(%#v)
+`, ws.wsrd)); err != nil {
+		return err
+	}
+	ws.discarded = true
+	return nil
+}
+
+// Stat inspects this workset.
+func (ws *Workset) Stat() (*WorksetInfo, error) {
+	return ws.dfc.StatWorkset(ws.wsrd)
+}
+
+// StatWorkset inspects the workset at root dir wsrd.
+func (dfc *DataFileClient) StatWorkset(wsrd string) (wi *WorksetInfo, err error) {
+	co, err := dfc.po.NewCo(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer co.Close()
+
+	if err = co.SendCode(fmt.Sprintf(`
+StatWorkset(%#v)
+`, wsrd)); err != nil {
+		return nil, err
+	}
+	if err = co.StartRecv(); err != nil {
+		return nil, err
+	}
+	if err = recvErrReason(co, "stat", wsrd); err != nil {
+		return nil, err
+	}
+	return recvWorksetInfo(co)
+}
+
+// ListWorksets lists worksets under baseDir.
+func (dfc *DataFileClient) ListWorksets(baseDir string) (wsl []*WorksetInfo, err error) {
+	co, err := dfc.po.NewCo(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer co.Close()
+
+	if err = co.SendCode(fmt.Sprintf(`
+ListWorksets(%#v)
+`, baseDir)); err != nil {
+		return nil, err
+	}
+	if err = co.StartRecv(); err != nil {
+		return nil, err
+	}
+	if err = recvErrReason(co, "list", baseDir); err != nil {
+		return nil, err
+	}
+	n, err := recvInt(co)
+	if err != nil {
+		return nil, err
+	}
+	wsl = make([]*WorksetInfo, 0, n)
+	for i := 0; i < int(n); i++ {
+		wi, err := recvWorksetInfo(co)
+		if err != nil {
+			return nil, err
+		}
+		wsl = append(wsl, wi)
+	}
+	return wsl, nil
+}
+
+// recvErrReason receives the error reason jdfs sends back first for workset
+// operations, a non-empty one is returned as *WorksetError.
+func recvErrReason(co *hbi.PoCo, op, dir string) error {
+	errReason, err := recvString(co)
+	if err != nil {
+		return err
+	}
+	if len(errReason) > 0 {
+		return &WorksetError{Op: op, Dir: dir, Reason: errReason}
+	}
+	return nil
+}
+
+func recvString(co *hbi.PoCo) (string, error) {
+	obj, err := co.RecvObj()
+	if err != nil {
+		return "", err
+	}
+	s, ok := obj.(string)
+	if !ok {
+		return "", errors.Errorf("unexpected string type [%T] of value [%v]", obj, obj)
+	}
+	return s, nil
+}
+
+// recvWorksetInfo receives a workset info sent as:
+//
+//	[ wsrd, age in seconds, size in bytes, owner session, whether owner live ]
+func recvWorksetInfo(co *hbi.PoCo) (*WorksetInfo, error) {
+	obj, err := co.RecvObj()
+	if err != nil {
+		return nil, err
+	}
+	fields, ok := obj.(hbi.LitListType)
+	if !ok || len(fields) != 5 {
+		return nil, errors.Errorf("unexpected workset info type [%T] of value [%v]", obj, obj)
+	}
+	wsrd, ok1 := fields[0].(string)
+	age, ok2 := fields[1].(hbi.LitIntType)
+	size, ok3 := fields[2].(hbi.LitIntType)
+	owner, ok4 := fields[3].(string)
+	live, ok5 := fields[4].(bool)
+	if !(ok1 && ok2 && ok3 && ok4 && ok5) {
+		return nil, errors.Errorf("unexpected workset info value [%v]", obj)
+	}
+	return &WorksetInfo{
+		Root: wsrd, Age: time.Duration(age) * time.Second, Size: int64(size),
+		Owner: owner, Live: live,
+	}, nil
+}
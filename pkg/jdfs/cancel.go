@@ -0,0 +1,51 @@
+package jdfs
+
+import (
+	"context"
+)
+
+// jdfc tells jdfs to cancel an op in flight, when the FUSE op is interrupted by
+// its kernel, by the coSeq of the posting conversation carrying the op.
+//
+// cancellation is best effort, an op checks its context at points where it's
+// safe to bail out with EINTR, it must still finish the conversation as normal,
+// and release whatever it acquired, e.g. file handle op counts.
+
+// opContext returns a context for the op of current hosting conversation, to be
+// done once jdfc requested to cancel the op. The returned done func must be
+// called when the op finished.
+//
+// this must be called before the wire released by co.FinishRecv(), or the cancel
+// request may be landed before the op registered.
+func (efs *exportedFileSystem) opContext() (ctx context.Context, done func()) {
+	coSeq := efs.ho.Co().CoSeq()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	efs.opMu.Lock()
+	if efs.opCancels == nil {
+		efs.opCancels = make(map[string]context.CancelFunc)
+	}
+	efs.opCancels[coSeq] = cancel
+	efs.opMu.Unlock()
+
+	return ctx, func() {
+		efs.opMu.Lock()
+		delete(efs.opCancels, coSeq)
+		efs.opMu.Unlock()
+
+		cancel()
+	}
+}
+
+// CancelOp is requested by jdfc to cancel the op carried by its conversation
+// identified by coSeq, it's a no-op if the op has finished.
+func (efs *exportedFileSystem) CancelOp(coSeq string) {
+	efs.opMu.Lock()
+	cancel := efs.opCancels[coSeq]
+	efs.opMu.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+}
@@ -0,0 +1,40 @@
+package jdfs
+
+import (
+	"fmt"
+
+	"github.com/complyue/jdfs/pkg/vfs"
+	"github.com/golang/glog"
+)
+
+// bulk data payloads can be checksummed end-to-end, with a method jdfc requested
+// right after mounted, among those told supported by jdfs in the mount result, see
+// vfs/payload.go for how payloads are sent.
+
+// UseChecksum makes bulk data payloads of this session checksummed with method,
+// or unchecked if method is empty, sends back an error reason, empty on success.
+//
+// jdfc calls it right after mounted, before any data op is conversed.
+func (efs *exportedFileSystem) UseChecksum(method string) {
+	co := efs.ho.Co()
+	if err := co.FinishRecv(); err != nil {
+		panic(err)
+	}
+
+	errReason := ""
+	if efs.root == nil || efs.session != nil {
+		errReason = "not on a mounted wire"
+	} else if checksum, err := vfs.NewChecksum(method); err != nil {
+		errReason = err.Error()
+	} else {
+		efs.codec.Checksum = checksum
+		glog.V(1).Infof("Payloads to/from [%s] checksummed with [%s]", efs.ho.NetIdent(), method)
+	}
+
+	if err := co.StartSend(); err != nil {
+		panic(err)
+	}
+	if err := co.SendObj(fmt.Sprintf("%#v", errReason)); err != nil {
+		panic(err)
+	}
+}
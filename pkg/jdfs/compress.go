@@ -0,0 +1,40 @@
+package jdfs
+
+import (
+	"fmt"
+
+	"github.com/complyue/jdfs/pkg/vfs"
+	"github.com/golang/glog"
+)
+
+// bulk data payloads can be compressed over the wire, with a method jdfc requested
+// right after mounted, among those told supported by jdfs in the mount result, see
+// vfs/payload.go for how payloads are sent.
+
+// UseCompression makes bulk data payloads of this session compressed with method,
+// or raw if method is empty, sends back an error reason, empty on success.
+//
+// jdfc calls it right after mounted, before any data op is conversed.
+func (efs *exportedFileSystem) UseCompression(method string) {
+	co := efs.ho.Co()
+	if err := co.FinishRecv(); err != nil {
+		panic(err)
+	}
+
+	errReason := ""
+	if efs.root == nil || efs.session != nil {
+		errReason = "not on a mounted wire"
+	} else if compressor, err := vfs.NewCompressor(method); err != nil {
+		errReason = err.Error()
+	} else {
+		efs.codec.Compressor = compressor
+		glog.V(1).Infof("Payloads to [%s] compressed with [%s]", efs.ho.NetIdent(), method)
+	}
+
+	if err := co.StartSend(); err != nil {
+		panic(err)
+	}
+	if err := co.SendObj(fmt.Sprintf("%#v", errReason)); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,125 @@
+package jdfs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/complyue/jdfs/pkg/vfs"
+)
+
+// names with this prefix are for jdfs' own bookkeeping under the export root, e.g.
+// the commit registry, workset owner files and commit backups, they are hidden
+// from jdfc, and refused in any path or name from jdfc.
+const reservedPrefix = ".jdfs-"
+
+func reservedName(name string) bool {
+	return strings.HasPrefix(name, reservedPrefix)
+}
+
+// confinePath confines a path from jdfc to the mounted root, returns the cleaned
+// relative path, or EACCES if it escapes the mounted root, either lexically or
+// through symlinks, or reaches a reserved name.
+//
+// the path needs not to exist, its deepest existing ancestor is checked then.
+func (r *mountedRoot) confinePath(p string) (string, error) {
+	return confineUnder(r.path, p)
+}
+
+// confineUnder confines a relative path to the root dir.
+func confineUnder(root, p string) (string, error) {
+	if filepath.IsAbs(p) {
+		return "", vfs.EACCES
+	}
+	cp := filepath.Clean(p)
+	if cp == ".." || strings.HasPrefix(cp, "../") {
+		return "", vfs.EACCES
+	}
+	for _, name := range strings.Split(cp, "/") {
+		if reservedName(name) {
+			return "", vfs.EACCES
+		}
+	}
+
+	// check the deepest existing ancestor, symlinks through the path resolved
+	for checkPath := cp; ; checkPath = filepath.Dir(checkPath) {
+		err := resolveBeneath(root, checkPath)
+		if err == nil {
+			return cp, nil
+		}
+		if (err == syscall.ENOENT || err == syscall.ENOTDIR) && checkPath != "." {
+			continue
+		}
+		if err == syscall.EXDEV || err == syscall.ELOOP {
+			return "", vfs.EACCES
+		}
+		return "", err
+	}
+}
+
+// evalBeneath checks p resolves to somewhere under root, by evaluating symlinks,
+// this is the fallback where openat2 with RESOLVE_BENEATH is not available.
+//
+// EXDEV is returned if it escapes.
+func evalBeneath(root, p string) error {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return unwrapPathErr(err)
+	}
+	realPath, err := filepath.EvalSymlinks(filepath.Join(root, p))
+	if err != nil {
+		err = unwrapPathErr(err)
+		if err == syscall.ENOENT {
+			// a dangling symlink can be followed on creation, its target must be
+			// confined as well
+			if target, e := os.Readlink(filepath.Join(root, p)); e == nil {
+				if filepath.IsAbs(target) {
+					return syscall.EXDEV
+				}
+				if _, e = confineUnder(root, filepath.Join(filepath.Dir(p), target)); e != nil {
+					return syscall.EXDEV
+				}
+			}
+		}
+		return err
+	}
+	rel, err := filepath.Rel(realRoot, realPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return syscall.EXDEV
+	}
+	return nil
+}
+
+func unwrapPathErr(err error) error {
+	if pe, ok := err.(*os.PathError); ok {
+		return pe.Err
+	}
+	return err
+}
+
+// checkName checks a child name from jdfc names an entry right in its parent dir,
+// returns EACCES if it'd reach elsewhere through the path built with childPath, or
+// is a reserved name.
+func checkName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsRune(name, '/') ||
+		reservedName(name) {
+		return vfs.EACCES
+	}
+	return nil
+}
+
+// confineJDF confines a data file path from jdfc, together with its meta file and
+// data file paths, returns the cleaned data file path.
+func (r *mountedRoot) confineJDF(jdfPath, metaExt, dataExt string) (string, error) {
+	cp, err := r.confinePath(jdfPath)
+	if err != nil {
+		return "", err
+	}
+	for _, ext := range []string{metaExt, dataExt} {
+		if _, err = r.confinePath(cp + ext); err != nil {
+			return "", err
+		}
+	}
+	return cp, nil
+}
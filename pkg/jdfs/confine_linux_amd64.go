@@ -0,0 +1,47 @@
+package jdfs
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// resolveBeneath checks p resolves to somewhere under root, with openat2 and
+// RESOLVE_BENEATH, falls back to evaluating symlinks on kernels before 5.6.
+func resolveBeneath(root, p string) error {
+	dirfd, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dirfd)
+	fd, err := unix.Openat2(dirfd, p, &unix.OpenHow{
+		Flags:   unix.O_PATH | unix.O_CLOEXEC,
+		Resolve: unix.RESOLVE_BENEATH,
+	})
+	if err == unix.ENOSYS {
+		return evalBeneath(root, p)
+	}
+	if err != nil {
+		return err
+	}
+	unix.Close(fd)
+	return nil
+}
+
+// openBeneath is openat(2) never resolving to outside of dirfd, with openat2 and
+// RESOLVE_BENEATH, so a confined path can't escape by symlinks swapped in after
+// checked. falls back to openat on kernels before 5.6.
+//
+// EACCES is returned if it escapes.
+func openBeneath(dirfd int, p string, flag int, mode uint32) (int, error) {
+	how := &unix.OpenHow{Flags: uint64(flag), Resolve: unix.RESOLVE_BENEATH}
+	if flag&(unix.O_CREAT|unix.O_TMPFILE) != 0 {
+		how.Mode = uint64(mode) // openat2 fails with EINVAL on mode otherwise
+	}
+	fd, err := unix.Openat2(dirfd, p, how)
+	switch err {
+	case unix.ENOSYS:
+		return unix.Openat(dirfd, p, flag, mode)
+	case unix.EXDEV:
+		return -1, unix.EACCES
+	}
+	return fd, err
+}
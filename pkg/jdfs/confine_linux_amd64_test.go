@@ -0,0 +1,64 @@
+package jdfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// paths confined when checked can be swapped to symlinks escaping before opened,
+// opens themselves must never resolve to outside of the mounted root.
+func TestOpenBeneath(t *testing.T) {
+	te := newTestExport(t)
+	defer te.close()
+
+	if fd, err := unix.Openat2(unix.AT_FDCWD, te.root, &unix.OpenHow{
+		Flags: unix.O_PATH | unix.O_CLOEXEC, Resolve: unix.RESOLVE_BENEATH,
+	}); err == unix.ENOSYS {
+		t.Skip("openat2 not available")
+	} else if err == nil {
+		unix.Close(fd)
+	}
+
+	r, err := openRoot(te.root, ".", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.dir.Close()
+
+	if f, err := r.openFile("inside/ok"+testDataExt, os.O_RDONLY, 0); err != nil {
+		t.Errorf("failed opening inside/ok - %v", err)
+	} else {
+		f.Close()
+	}
+
+	for _, p := range []string{
+		"../outside/secret" + testDataExt,
+		filepath.Join(te.outside, "secret"+testDataExt),
+		"escape/secret" + testDataExt,
+		"abs/secret" + testDataExt,
+	} {
+		if f, err := r.openFile(p, os.O_RDONLY, 0); err == nil {
+			f.Close()
+			t.Errorf("opened [%s]", p)
+		} else if unwrapPathErr(err) != unix.EACCES {
+			t.Errorf("opening [%s] got %v", p, err)
+		}
+	}
+	if f, err := r.openFile("inside/dangle"+testDataExt, os.O_CREATE|os.O_RDWR, 0644); err == nil {
+		f.Close()
+		t.Errorf("created through dangling symlink to outside")
+	}
+	if _, err := os.Lstat(filepath.Join(te.outside, "dangled"+testDataExt)); !os.IsNotExist(err) {
+		t.Errorf("file created outside - %v", err)
+	}
+
+	for _, mountPath := range []string{"escape", "abs"} {
+		if r, err := openRoot(te.root, mountPath, false, false); err == nil {
+			r.dir.Close()
+			t.Errorf("opened [%s] as mounted root", mountPath)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+package jdfs
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// resolveBeneath checks p resolves to somewhere under root, by evaluating symlinks
+// as openat2 is not available.
+func resolveBeneath(root, p string) error {
+	return evalBeneath(root, p)
+}
+
+// openBeneath is plain openat(2) as openat2 is not available, confinement of p is
+// only what's checked before opening.
+func openBeneath(dirfd int, p string, flag int, mode uint32) (int, error) {
+	return unix.Openat(dirfd, p, flag, mode)
+}
@@ -0,0 +1,534 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package jdfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/complyue/hbi"
+	"github.com/complyue/jdfs/pkg/jdfc"
+	"github.com/complyue/jdfs/pkg/vfs"
+)
+
+const testMetaExt, testDataExt = ".meta", ".data"
+
+// testExport is a temp dir exported over a unix socket, served in this process.
+//
+// the export root has a data file inside/ok, symlinks escape -> ../outside and
+// abs -> <abs path of outside>, and a dangling symlink inside/dangle.data ->
+// ../../outside/dangled.data. next to the export root, outside has a data file
+// secret and a workset like dir .victim, none of them should be reachable.
+type testExport struct {
+	dir     string
+	root    string
+	outside string
+	socket  string
+
+	listener *net.UnixListener
+}
+
+func newTestExport(t *testing.T) *testExport {
+	dir, err := ioutil.TempDir("", "jdfs-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// symlinks in the temp dir path (e.g. /tmp on macOS) would confuse checks
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		t.Fatal(err)
+	}
+	te := &testExport{
+		dir:     dir,
+		root:    filepath.Join(dir, "export"),
+		outside: filepath.Join(dir, "outside"),
+		socket:  filepath.Join(dir, "jdfs.sock"),
+	}
+
+	for _, d := range []string{
+		filepath.Join(te.root, "inside"),
+		filepath.Join(te.outside, ".victim"),
+	} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for fn, content := range map[string]string{
+		filepath.Join(te.root, "inside", "ok"+testMetaExt):   "ok meta",
+		filepath.Join(te.root, "inside", "ok"+testDataExt):   "ok data content.",
+		filepath.Join(te.outside, "secret"+testMetaExt):      "secret meta",
+		filepath.Join(te.outside, "secret"+testDataExt):      "secret data.....",
+		filepath.Join(te.outside, ".victim", "precious.txt"): "precious",
+	} {
+		if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		filepath.Join(te.root, "escape"):                       "../outside",
+		filepath.Join(te.root, "abs"):                          te.outside,
+		filepath.Join(te.root, "inside", "dangle"+testDataExt): "../../outside/dangled" + testDataExt,
+	} {
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if te.listener, err = net.ListenUnix("unix",
+		&net.UnixAddr{Name: te.socket, Net: "unix"}); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := te.listener.AcceptUnix()
+			if err != nil {
+				return
+			}
+			go serveUnixConn(te.root, conn)
+		}
+	}()
+
+	return te
+}
+
+func (te *testExport) close() {
+	te.listener.Close()
+	os.RemoveAll(te.dir)
+}
+
+// listOutside lists all files under outside, relative to it.
+func (te *testExport) listOutside(t *testing.T) []string {
+	var files []string
+	if err := filepath.Walk(te.outside, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(te.outside, p)
+		files = append(files, rel)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// testWire is a wire to the test export, speaking jdfs methods as jdfc does.
+type testWire struct {
+	t  *testing.T
+	po *hbi.PostingEnd
+}
+
+func (te *testExport) dial(t *testing.T) *testWire {
+	he := jdfc.PrepareHostingEnv()
+	// jdfs pushes invalidations, nothing cached here
+	he.ExposeFunction("InvalidateNode", func(inode vfs.InodeID, offset, size int64) {})
+	he.ExposeFunction("InvalidateEntry", func(parent vfs.InodeID, name string) {})
+	po, _, err := jdfc.ConnUnix(te.socket)(he)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testWire{t: t, po: po}
+}
+
+func (w *testWire) close() {
+	if !w.po.Disconnected() {
+		w.po.Close()
+	}
+}
+
+// mount mounts jdfsPath over this wire, jdfs disconnects it if refused.
+func (w *testWire) mount(readOnly bool, jdfsPath string) error {
+	co, err := w.po.NewCo(nil)
+	if err != nil {
+		return err
+	}
+	defer co.Close()
+	if err = co.SendCode(fmt.Sprintf(`
+Mount(%#v, %#v)
+`, readOnly, jdfsPath)); err != nil {
+		return err
+	}
+	if err = co.StartRecv(); err != nil {
+		return err
+	}
+	_, err = co.RecvObj()
+	return err
+}
+
+// call sends code, followed by each of args as an obj if a string or as binary
+// data if a []byte, then starts receiving the result.
+func (w *testWire) call(code string, args ...interface{}) *hbi.PoCo {
+	co, err := w.po.NewCo(nil)
+	if err != nil {
+		w.t.Fatal(err)
+	}
+	if err = co.SendCode(code); err != nil {
+		w.t.Fatal(err)
+	}
+	for _, arg := range args {
+		switch a := arg.(type) {
+		case string:
+			err = co.SendObj(fmt.Sprintf("%#v", a))
+		case []byte:
+			err = co.SendData(a)
+		default:
+			panic(fmt.Sprintf("unexpected arg type %T", arg))
+		}
+		if err != nil {
+			w.t.Fatal(err)
+		}
+	}
+	if err = co.StartRecv(); err != nil {
+		w.t.Fatal(err)
+	}
+	return co
+}
+
+func (w *testWire) recvObj(co *hbi.PoCo) interface{} {
+	obj, err := co.RecvObj()
+	if err != nil {
+		w.t.Fatal(err)
+	}
+	return obj
+}
+
+// fsErr calls a method replying an fs error first, returns that fs error.
+func (w *testWire) fsErr(code string, args ...interface{}) vfs.FsError {
+	co := w.call(code, args...)
+	defer co.Close()
+	fse, ok := w.recvObj(co).(vfs.FsError)
+	if !ok {
+		w.t.Fatalf("no fs error replied to %s", strings.TrimSpace(code))
+	}
+	return fse
+}
+
+// errReason calls a workset method replying an error reason first, returns
+// that error reason.
+func (w *testWire) errReason(code string, args ...interface{}) string {
+	co := w.call(code, args...)
+	defer co.Close()
+	reason, ok := w.recvObj(co).(string)
+	if !ok {
+		w.t.Fatalf("no error reason replied to %s", strings.TrimSpace(code))
+	}
+	return reason
+}
+
+// openJDF opens a data file, returns its handle and size.
+func (w *testWire) openJDF(jdfPath string) (handle vfs.DataFileHandle, size int64) {
+	co := w.call(fmt.Sprintf(`
+OpenJDF(%#v, 0, %#v, %#v)
+`, jdfPath, testMetaExt, testDataExt))
+	defer co.Close()
+	if fse := w.recvObj(co).(vfs.FsError); fse != 0 {
+		w.t.Fatalf("open [%s] failed - %s", jdfPath, fse.Repr())
+	}
+	metaBuf := make([]byte, w.recvObj(co).(hbi.LitIntType))
+	if err := co.RecvData(metaBuf); err != nil {
+		w.t.Fatal(err)
+	}
+	size = int64(w.recvObj(co).(hbi.LitIntType))
+	fields := w.recvObj(co).(hbi.LitListType)
+	handle.Handle = int(fields[0].(hbi.LitIntType))
+	handle.Inode = vfs.InodeID(fields[1].(hbi.LitIntType))
+	return
+}
+
+// listJDF lists data files under rootDir, returns their paths.
+func (w *testWire) listJDF(rootDir string) []string {
+	co := w.call(fmt.Sprintf(`
+ListJDF(%#v, %#v, %#v)
+`, rootDir, testMetaExt, testDataExt))
+	defer co.Close()
+	listLen := w.recvObj(co).(hbi.LitIntType)
+	if listLen <= 0 {
+		return nil
+	}
+	pathFlatLen := w.recvObj(co).(hbi.LitIntType)
+	dfl, payload := vfs.ToReceiveDataFileList(int(listLen), int(pathFlatLen))
+	for _, buf := range payload {
+		if len(buf) > 0 {
+			if err := co.RecvData(buf); err != nil {
+				w.t.Fatal(err)
+			}
+		}
+	}
+	paths := make([]string, dfl.Len())
+	for i := range paths {
+		_, paths[i] = dfl.Get(i)
+	}
+	return paths
+}
+
+func TestConfinePaths(t *testing.T) {
+	te := newTestExport(t)
+	defer te.close()
+	outsideFiles := te.listOutside(t)
+
+	// data file paths escaping the mounted root, lexically or through symlinks
+	hostileJDFs := []string{
+		"../outside/secret",
+		"inside/../../outside/secret",
+		filepath.Join(te.outside, "secret"),
+		"escape/secret",
+		"abs/secret",
+		// jdfs' own bookkeeping
+		commitsDirName + "/forged",
+		".ws/" + backupDirName + "/inside/ok",
+	}
+
+	t.Run("Mount", func(t *testing.T) {
+		for _, jdfsPath := range []string{
+			"..", "../outside", "/../outside", "inside/../../outside",
+			te.outside, "escape", "/abs", "abs/.victim", commitsDirName,
+		} {
+			w := te.dial(t)
+			if err := w.mount(false, jdfsPath); err == nil {
+				t.Errorf("mounted [%s]", jdfsPath)
+			}
+			w.close()
+		}
+		w := te.dial(t)
+		defer w.close()
+		if err := w.mount(false, "/inside"); err != nil {
+			t.Errorf("failed mounting /inside - %v", err)
+		}
+	})
+
+	w := te.dial(t)
+	defer w.close()
+	if err := w.mount(false, "/"); err != nil {
+		t.Fatalf("failed mounting export root - %v", err)
+	}
+
+	t.Run("ListJDF", func(t *testing.T) {
+		if paths := w.listJDF("inside"); len(paths) != 1 {
+			t.Errorf("unexpected data files %v under inside", paths)
+		}
+		for _, rootDir := range []string{
+			"..", "../outside", "inside/../..", te.outside, "escape", "abs",
+		} {
+			if paths := w.listJDF(rootDir); len(paths) > 0 {
+				t.Errorf("listed %v under [%s]", paths, rootDir)
+			}
+		}
+	})
+
+	t.Run("StatJDF", func(t *testing.T) {
+		if fse := w.fsErr(fmt.Sprintf(`
+StatJDF(%#v, %#v, %#v)
+`, "inside/ok", testMetaExt, testDataExt)); fse != 0 {
+			t.Errorf("failed stating inside/ok - %s", fse.Repr())
+		}
+		for _, jdfPath := range hostileJDFs {
+			if fse := w.fsErr(fmt.Sprintf(`
+StatJDF(%#v, %#v, %#v)
+`, jdfPath, testMetaExt, testDataExt)); fse != vfs.EACCES {
+				t.Errorf("stating [%s] got %s", jdfPath, fse.Repr())
+			}
+		}
+	})
+
+	t.Run("OpenJDF", func(t *testing.T) {
+		for _, jdfPath := range hostileJDFs {
+			if fse := w.fsErr(fmt.Sprintf(`
+OpenJDF(%#v, 0, %#v, %#v)
+`, jdfPath, testMetaExt, testDataExt)); fse != vfs.EACCES {
+				t.Errorf("opening [%s] got %s", jdfPath, fse.Repr())
+			}
+		}
+	})
+
+	t.Run("AllocJDF", func(t *testing.T) {
+		for _, jdfPath := range append(hostileJDFs,
+			"../outside/new", "escape/new", "abs/new", "inside/dangle") {
+			if fse := w.fsErr(fmt.Sprintf(`
+AllocJDF(%#v, %#v, %#v, %#v, %d, %d, %d)
+`, jdfPath, true, testMetaExt, testDataExt, 4, 0, 16),
+				[]byte("HDR!")); fse != vfs.EACCES {
+				t.Errorf("allocating [%s] got %s", jdfPath, fse.Repr())
+			}
+		}
+	})
+
+	t.Run("CopyJDF", func(t *testing.T) {
+		handle, size := w.openJDF("inside/ok")
+		for _, jdfPath := range append(hostileJDFs, "../outside/new", "escape/new") {
+			if fse := w.fsErr(fmt.Sprintf(`
+CopyJDF(%d, %d, %#v, %#v, %d, %d, %d, %d, %d, %d, %#v, %#v)
+`, handle.Handle, handle.Inode, jdfPath, true, size, 0, 0, 0, 4, 0,
+				testMetaExt, testDataExt), []byte("HDR!")); fse != vfs.EACCES {
+				t.Errorf("copying to [%s] got %s", jdfPath, fse.Repr())
+			}
+		}
+	})
+
+	t.Run("ResumeInode", func(t *testing.T) {
+		fi, err := os.Stat(filepath.Join(te.outside, "secret"+testDataExt))
+		if err != nil {
+			t.Fatal(err)
+		}
+		inode := fi.Sys().(*syscall.Stat_t).Ino
+		for _, jdfPath := range hostileJDFs {
+			if fse := w.fsErr(fmt.Sprintf(`
+ResumeInode(%d, %#v, 1)
+`, inode, jdfPath+testDataExt)); fse != vfs.EACCES {
+				t.Errorf("resuming [%s] got %s", jdfPath, fse.Repr())
+			}
+		}
+	})
+
+	t.Run("MakeWorksetRoot", func(t *testing.T) {
+		for _, baseDir := range []string{
+			"../outside", "./../outside", ".ws/../../outside", te.outside, "escape", "abs",
+		} {
+			if reason := w.errReason(fmt.Sprintf(`
+MakeWorksetRoot(%#v, %#v)
+`, baseDir, "ws")); reason == "" {
+				t.Errorf("made workset under [%s]", baseDir)
+			}
+		}
+		for _, nameHint := range []string{"..", "../../outside/.victim", "."} {
+			if reason := w.errReason(fmt.Sprintf(`
+MakeWorksetRoot(%#v, %#v)
+`, ".ws", nameHint)); reason == "" {
+				t.Errorf("made workset with name hint [%s]", nameHint)
+			}
+		}
+	})
+
+	t.Run("CommitWorkset", func(t *testing.T) {
+		for _, wsrd := range []string{
+			"../outside/.victim", ".ws/../../outside/.victim",
+			filepath.Join(te.outside, ".victim"), "escape/.victim", "abs/.victim",
+		} {
+			if reason := w.errReason(fmt.Sprintf(`
+CommitWorkset(%#v, 0, %#v, %#v)
+`, wsrd, testMetaExt, testDataExt)); reason == "" {
+				t.Errorf("committed workset [%s]", wsrd)
+			}
+		}
+
+		co := w.call(fmt.Sprintf(`
+MakeWorksetRoot(%#v, %#v)
+`, ".ws", "commit"))
+		reason, wsrd := w.recvObj(co).(string), w.recvObj(co).(string)
+		co.Close()
+		if reason != "" {
+			t.Fatalf("failed making workset - %s", reason)
+		}
+		for _, pubPath := range hostileJDFs {
+			if reason := w.errReason(fmt.Sprintf(`
+CommitWorkset(%#v, 1, %#v, %#v)
+`, wsrd, testMetaExt, testDataExt), pubPath); !strings.Contains(reason, vfs.EACCES.Repr()) {
+				t.Errorf("committing to [%s] got [%s]", pubPath, reason)
+			}
+		}
+	})
+
+	t.Run("StatWorkset", func(t *testing.T) {
+		for _, wsrd := range []string{"../outside/.victim", "escape/.victim", "abs/.victim"} {
+			if reason := w.errReason(fmt.Sprintf(`
+StatWorkset(%#v)
+`, wsrd)); reason == "" {
+				t.Errorf("stated workset [%s]", wsrd)
+			}
+		}
+	})
+
+	t.Run("ListWorksets", func(t *testing.T) {
+		for _, baseDir := range []string{"..", "../outside", "escape", "abs"} {
+			if reason := w.errReason(fmt.Sprintf(`
+ListWorksets(%#v)
+`, baseDir)); reason == "" {
+				t.Errorf("listed worksets under [%s]", baseDir)
+			}
+		}
+	})
+
+	t.Run("DiscardWorksetRoot", func(t *testing.T) {
+		for _, wsrd := range []string{
+			"../outside/.victim", ".ws/../../outside/.victim", "escape/.victim", "abs/.victim",
+		} {
+			// jdfs replies nothing
+			co, err := w.po.NewCo(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = co.SendCode(fmt.Sprintf(`
+DiscardWorksetRoot(%#v)
+`, wsrd)); err != nil {
+				t.Fatal(err)
+			}
+			co.Close()
+		}
+
+		// discard a legit workset after them, and wait it removed
+		co := w.call(fmt.Sprintf(`
+MakeWorksetRoot(%#v, %#v)
+`, ".ws", "discard"))
+		reason, wsrd := w.recvObj(co).(string), w.recvObj(co).(string)
+		co.Close()
+		if reason != "" {
+			t.Fatalf("failed making workset - %s", reason)
+		}
+		if co, err := w.po.NewCo(nil); err != nil {
+			t.Fatal(err)
+		} else if err = co.SendCode(fmt.Sprintf(`
+DiscardWorksetRoot(%#v)
+`, wsrd)); err != nil {
+			t.Fatal(err)
+		} else {
+			co.Close()
+		}
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			if _, err := os.Lstat(filepath.Join(te.root, wsrd)); os.IsNotExist(err) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("workset [%s] not discarded", wsrd)
+			}
+		}
+	})
+
+	t.Run("names", func(t *testing.T) {
+		// jdfc sends only names of direct children, anything else reaches elsewhere,
+		// reserved names are jdfs' own
+		for _, name := range []string{
+			"", ".", "..", "../outside", "inside/ok" + testDataExt, commitsDirName,
+		} {
+			for _, code := range []string{
+				fmt.Sprintf(`LookUpInode(%d, %#v)`, vfs.RootInodeID, name),
+				fmt.Sprintf(`MkDir(%d, %#v, %d)`, vfs.RootInodeID, name, 0755),
+				fmt.Sprintf(`CreateFile(%d, %#v, %d)`, vfs.RootInodeID, name, 0644),
+				fmt.Sprintf(`CreateSymlink(%d, %#v, %#v)`, vfs.RootInodeID, name, "inside"),
+				fmt.Sprintf(`CreateLink(%d, %#v, %d)`, vfs.RootInodeID, name, vfs.RootInodeID),
+				fmt.Sprintf(`Rename(%d, %#v, %d, %#v)`, vfs.RootInodeID, name, vfs.RootInodeID, "renamed"),
+				fmt.Sprintf(`Rename(%d, %#v, %d, %#v)`, vfs.RootInodeID, "inside", vfs.RootInodeID, name),
+				fmt.Sprintf(`RmDir(%d, %#v)`, vfs.RootInodeID, name),
+				fmt.Sprintf(`Unlink(%d, %#v)`, vfs.RootInodeID, name),
+			} {
+				if fse := w.fsErr(code); fse != vfs.EACCES {
+					t.Errorf("%s got %s", code, fse.Repr())
+				}
+			}
+		}
+	})
+
+	if files := te.listOutside(t); strings.Join(files, "\n") != strings.Join(outsideFiles, "\n") {
+		t.Errorf("files outside changed from %v to %v", outsideFiles, files)
+	}
+	if _, err := os.Lstat(filepath.Join(te.root, "inside", "ok"+testDataExt)); err != nil {
+		t.Errorf("data file inside lost - %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+package jdfs
+
+import (
+	"io"
+
+	"github.com/complyue/hbi"
+	"github.com/complyue/jdfs/pkg/vfs"
+	"github.com/golang/glog"
+)
+
+// max bytes copied per step of a server side copy, the op is checked for
+// cancellation between steps
+const copyChunkSize = 4 * 1024 * 1024
+
+// CopyFileRange copies data between 2 files opened by jdfc, the data never
+// crosses the wire.
+//
+// copy_file_range(2) is used where available, which reflinks on filesystems
+// supporting that, falling back to a chunked copy through a buffer otherwise.
+func (efs *exportedFileSystem) CopyFileRange(inodeIn vfs.InodeID, handleIn int, offsetIn int64,
+	inodeOut vfs.InodeID, handleOut int, offsetOut int64, length int64) {
+	co := efs.ho.Co()
+
+	ctx, opDone := efs.opContext()
+	defer opDone()
+
+	var bytesCopied int64
+	fsErr := func() error {
+		// do this before the underlying HBI wire released
+		icfhIn, err := efs.icd.GetFileHandle(inodeIn, handleIn, 1)
+		if err != nil {
+			return err
+		}
+		defer efs.icd.FileHandleOpDone(icfhIn)
+		icfhOut, err := efs.icd.GetFileHandle(inodeOut, handleOut, 1)
+		if err != nil {
+			return err
+		}
+		defer efs.icd.FileHandleOpDone(icfhOut)
+
+		if err := co.FinishRecv(); err != nil {
+			panic(err)
+		}
+
+		if err := efs.dataSlots.acquireFor(ctx); err != nil {
+			return err
+		}
+		defer efs.dataSlots.release()
+
+		if err := efs.checkWritable(icfhOut.f.Name()); err != nil {
+			return err
+		}
+		if !icfhOut.writable {
+			return vfs.EBADF
+		}
+		efs.watcher.selfChange(icfhOut.f.Name())
+
+		var buf []byte // allocated on falling back to chunked copy
+		for bytesCopied < length {
+			if ctx.Err() != nil {
+				if bytesCopied > 0 {
+					break // report the partial copy
+				}
+				return vfs.EINTR
+			}
+
+			n := length - bytesCopied
+			if n > copyChunkSize {
+				n = copyChunkSize
+			}
+
+			var nc int
+			if buf == nil {
+				nc, err = copyFileRange(icfhIn.f, offsetIn+bytesCopied,
+					icfhOut.f, offsetOut+bytesCopied, int(n))
+				if err == vfs.EOPNOTSUPP {
+					buf = efs.bufPool.Get(copyChunkSize)
+					defer efs.bufPool.Return(buf)
+					continue
+				}
+			} else {
+				if nc, err = icfhIn.f.ReadAt(buf[:n], offsetIn+bytesCopied); err == io.EOF {
+					err = nil
+				}
+				if err != nil {
+					nc = 0
+				} else if nc > 0 {
+					nc, err = icfhOut.f.WriteAt(buf[:nc], offsetOut+bytesCopied)
+				}
+			}
+			bytesCopied += int64(nc)
+			if err != nil {
+				glog.Errorf("Error copying file [%d] [%s]:[%s] @%d to [%d] [%s]:[%s] @%d - %+v",
+					inodeIn, efs.root.path, icfhIn.f.Name(), offsetIn+bytesCopied,
+					inodeOut, efs.root.path, icfhOut.f.Name(), offsetOut+bytesCopied, err)
+				if bytesCopied > 0 {
+					break // report the partial copy
+				}
+				return err
+			}
+			if nc <= 0 {
+				break // end of source file
+			}
+		}
+
+		if glog.V(2) {
+			glog.Infof("Copied %d bytes from file [%d] [%s]:[%s] @%d to [%d] [%s]:[%s] @%d",
+				bytesCopied, inodeIn, efs.root.path, icfhIn.f.Name(), offsetIn,
+				inodeOut, efs.root.path, icfhOut.f.Name(), offsetOut)
+		}
+		return nil
+	}()
+
+	if err := co.StartSend(); err != nil {
+		panic(err)
+	}
+
+	fse := vfs.FsErr(fsErr)
+	if err := co.SendObj(fse.Repr()); err != nil {
+		panic(err)
+	}
+	if fse != 0 {
+		return
+	}
+
+	if err := co.SendObj(hbi.Repr(bytesCopied)); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,116 @@
+package jdfs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// a jdfc can connect more wires to jdfs besides the one it mounted over, attached
+// to its session as data channels, with bulk data ops striped across them, so
+// small metadata replies won't queue up behind MBs of file data on a single wire.
+//
+// a data channel shares in-core data of the session, while it has conversations
+// and cancellations of its own. it can only be attached to a session served by
+// the same jdfs process, i.e. in -solo mode (the default, but never over TLS), the
+// session token is told to jdfc on mount only then, or jdfc will do with the
+// single wire.
+
+// sessions served by this process, data channels can be attached to
+var sessions = struct {
+	byToken map[string]*exportedFileSystem
+	mu      sync.Mutex
+}{byToken: make(map[string]*exportedFileSystem)}
+
+// registerSession makes this session available for data channels to attach, by
+// a token told to jdfc on mount.
+func (efs *exportedFileSystem) registerSession() {
+	var tokenBytes [16]byte
+	if _, err := rand.Read(tokenBytes[:]); err != nil {
+		glog.Errorf("No data channel can attach to session of [%s] - %+v", efs.ho.NetIdent(), err)
+		return
+	}
+
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+
+	efs.token = hex.EncodeToString(tokenBytes[:])
+	sessions.byToken[efs.token] = efs
+}
+
+// unregisterSession disconnects data channels attached to this session, after the
+// wire it mounted over disconnected.
+func (efs *exportedFileSystem) unregisterSession() {
+	sessions.mu.Lock()
+	if len(efs.token) > 0 {
+		delete(sessions.byToken, efs.token)
+	}
+	dataChans := efs.dataChans
+	efs.dataChans = nil
+	sessions.mu.Unlock()
+
+	for _, dc := range dataChans {
+		dc.ho.Disconnect("JDFS session ended", false)
+	}
+}
+
+// detachSession is called after a data channel disconnected.
+func (efs *exportedFileSystem) detachSession() {
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+
+	sess := efs.session
+	for i, dc := range sess.dataChans {
+		if dc == efs {
+			sess.dataChans = append(sess.dataChans[:i], sess.dataChans[i+1:]...)
+			break
+		}
+	}
+}
+
+// AttachSession attaches this wire as a data channel to the session identified by
+// token, sends back an error reason, empty if attached.
+func (efs *exportedFileSystem) AttachSession(token string) {
+	co := efs.ho.Co()
+	if err := co.FinishRecv(); err != nil {
+		panic(err)
+	}
+
+	errReason := func() string {
+		if efs.root != nil || efs.session != nil {
+			return "wire already mounted or attached"
+		}
+
+		sessions.mu.Lock()
+		defer sessions.mu.Unlock()
+
+		sess := sessions.byToken[token]
+		if sess == nil {
+			return "no such session in this jdfs process"
+		}
+		efs.readOnly, efs.roSubtrees, efs.root = sess.readOnly, sess.roSubtrees, sess.root
+		efs.icd, efs.dfd, efs.watcher = sess.icd, sess.dfd, sess.watcher
+		efs.metaSlots, efs.dataSlots = sess.metaSlots, sess.dataSlots
+		efs.codec.Compressor, efs.codec.Checksum = sess.codec.Compressor, sess.codec.Checksum
+		efs.session = sess
+		sess.dataChans = append(sess.dataChans, efs)
+		return ""
+	}()
+
+	if len(errReason) > 0 {
+		glog.Warningf("Data channel from [%s] not attached - %s", efs.ho.NetIdent(), errReason)
+	} else {
+		glog.V(1).Infof("Data channel from [%s] attached to session of [%s]",
+			efs.ho.NetIdent(), efs.session.ho.NetIdent())
+	}
+
+	if err := co.StartSend(); err != nil {
+		panic(err)
+	}
+	if err := co.SendObj(fmt.Sprintf("%#v", errReason)); err != nil {
+		panic(err)
+	}
+}
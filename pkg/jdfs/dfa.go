@@ -3,7 +3,6 @@ package jdfs
 import (
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -19,21 +18,21 @@ import (
 
 // direct data file access methods
 
-func listJDF(dir string, dfl *vfs.DataFileList, metaExt, dataExt string) {
+func (r *mountedRoot) listJDF(dir string, dfl *vfs.DataFileList, metaExt, dataExt string) {
 
 	dir2open := dir
 	if len(dir2open) <= 0 {
 		dir2open = "."
 	}
-	df, err := os.OpenFile(dir2open, os.O_RDONLY, 0)
+	df, err := r.openFile(dir2open, os.O_RDONLY, 0)
 	if err != nil {
-		glog.Warningf("LSDF failed opening dir [%s]:[%s] - %+v", jdfsRootPath, dir, err)
+		glog.Warningf("LSDF failed opening dir [%s]:[%s] - %+v", r.path, dir, err)
 		return
 	}
 	defer df.Close() // hold an ancestor dir open during recursion within it
-	childFIs, err := df.Readdir(0)
+	childFIs, err := readDir(df, 0)
 	if err != nil {
-		glog.Errorf("LSDF failed reading dir [%s]:[%s] - %+v", jdfsRootPath, dir, err)
+		glog.Errorf("LSDF failed reading dir [%s]:[%s] - %+v", r.path, dir, err)
 		return
 	}
 
@@ -83,7 +82,7 @@ func listJDF(dir string, dfl *vfs.DataFileList, metaExt, dataExt string) {
 		if len(dir) > 0 {
 			dfPath = fmt.Sprintf("%s/%s", dir, subdir)
 		}
-		listJDF(dfPath, dfl, metaExt, dataExt)
+		r.listJDF(dfPath, dfl, metaExt, dataExt)
 	}
 }
 
@@ -93,8 +92,18 @@ func (efs *exportedFileSystem) ListJDF(rootDir string, metaExt, dataExt string)
 		panic(err)
 	}
 
+	efs.metaSlots.acquire()
+	defer efs.metaSlots.release()
+
 	var dfl vfs.DataFileList
-	listJDF(rootDir, &dfl, metaExt, dataExt)
+	if dir, err := efs.root.confinePath(rootDir); err != nil {
+		glog.Warningf("LSDF not listing [%s]:[%s] - %+v", efs.root.path, rootDir, err)
+	} else {
+		if dir == "." {
+			dir = ""
+		}
+		efs.root.listJDF(dir, &dfl, metaExt, dataExt)
+	}
 	listLen, pathFlatLen, payload := dfl.ToSend()
 
 	if err := co.StartSend(); err != nil {
@@ -109,6 +118,17 @@ func (efs *exportedFileSystem) ListJDF(rootDir string, metaExt, dataExt string)
 	if err := co.SendObj(hbi.Repr(pathFlatLen)); err != nil {
 		panic(err)
 	}
+	if !efs.codec.Raw() {
+		// each buffer sent as a payload of its own, jdfc knows sizes of them
+		for _, buf := range payload {
+			if len(buf) > 0 {
+				if err := efs.sendPayload(co, buf); err != nil {
+					panic(err)
+				}
+			}
+		}
+		return
+	}
 	i := 0
 	if err := co.SendStream(func() ([]byte, error) {
 		for i < len(payload) {
@@ -146,27 +166,37 @@ func (efs *exportedFileSystem) AllocJDF(jdfPath string, replaceExisting bool,
 		panic(err)
 	}
 
+	efs.dataSlots.acquire()
+	defer efs.dataSlots.release()
+
 	var handle vfs.DataFileHandle
 	fse := vfs.FsErr(func() (err error) {
+		if jdfPath, err = efs.root.confineJDF(jdfPath, metaExt, dataExt); err != nil {
+			return
+		}
+		if err = efs.checkWritable(jdfPath); err != nil {
+			return
+		}
+
 		// try best to have parent dir exist, but ignore error here,
 		// if parent dir can not be created, file creation will raise
 		// error and will be reported.
-		os.MkdirAll(filepath.Dir(jdfPath), 0750)
+		efs.root.mkdirAll(filepath.Dir(jdfPath), 0750)
 
 		mfPath := jdfPath + metaExt
 		if replaceExisting { // remove existing and ignore error - esp. ENOENT
-			syscall.Unlink(mfPath)
+			efs.root.unlink(mfPath)
 		}
-		if err = ioutil.WriteFile(mfPath, metaBuf, 0644); err != nil {
+		if err = efs.root.writeFile(mfPath, metaBuf, 0644); err != nil {
 			return
 		}
 
 		dfPath := jdfPath + dataExt
 		if replaceExisting { // remove existing and ignore error - esp. ENOENT
-			syscall.Unlink(dfPath)
+			efs.root.unlink(dfPath)
 		}
 		var f *os.File
-		f, err = os.OpenFile(dfPath, os.O_CREATE|os.O_RDWR, 0644)
+		f, err = efs.root.openFile(dfPath, os.O_CREATE|os.O_RDWR, 0644)
 		if err != nil {
 			return
 		}
@@ -231,31 +261,43 @@ func (efs *exportedFileSystem) CopyJDF(Handle int, inode vfs.InodeID, allocjdfPa
 		panic(err)
 	}
 
-	odfh, err := efs.dfd.GetFileHandle(vfs.DataFileHandle{Handle, inode}, 1)
-	if err != nil {
-		panic(err)
-	}
+	efs.dataSlots.acquire()
+	defer efs.dataSlots.release()
+
+	odfh, odfhErr := efs.dfd.GetFileHandle(vfs.DataFileHandle{Handle, inode}, 1)
 
 	// var hdrBuf, metaBuf []byte
 	// var dfSize uint64
 	var handle vfs.DataFileHandle
 
 	fse := vfs.FsErr(func() (err error) {
-		os.MkdirAll(filepath.Dir(allocjdfPath), 0750)
+		if odfhErr != nil {
+			return odfhErr
+		}
+		defer efs.dfd.FileHandleOpDone(odfh)
+
+		if allocjdfPath, err = efs.root.confineJDF(allocjdfPath, metaExt, dataExt); err != nil {
+			return
+		}
+		if err = efs.checkWritable(allocjdfPath); err != nil {
+			return
+		}
+
+		efs.root.mkdirAll(filepath.Dir(allocjdfPath), 0750)
 		allocmfPath := allocjdfPath + metaExt
 		if replaceExisting { // remove existing and ignore error - esp. ENOENT
-			syscall.Unlink(allocmfPath)
+			efs.root.unlink(allocmfPath)
 		}
-		if err = ioutil.WriteFile(allocmfPath, metaBuf, 0644); err != nil {
+		if err = efs.root.writeFile(allocmfPath, metaBuf, 0644); err != nil {
 			return
 		}
 
 		allocdfPath := allocjdfPath + dataExt
 		if replaceExisting { // remove existing and ignore error - esp. ENOENT
-			syscall.Unlink(allocdfPath)
+			efs.root.unlink(allocdfPath)
 		}
 		var allocf *os.File
-		allocf, err = os.OpenFile(allocdfPath, os.O_CREATE|os.O_RDWR, 0644)
+		allocf, err = efs.root.openFile(allocdfPath, os.O_CREATE|os.O_RDWR, 0644)
 		if err != nil {
 			return
 		}
@@ -306,7 +348,7 @@ func (efs *exportedFileSystem) CopyJDF(Handle int, inode vfs.InodeID, allocjdfPa
 		// closedfPath := closef.Name()
 		// if err := closef.Close(); err != nil {
 		// 	glog.Errorf("Error on closing jdfs data file [%s]:[%s] - %+v",
-		// 		jdfsRootPath, closedfPath, err)
+		// 		efs.root.path, closedfPath, err)
 		// }
 
 		return
@@ -336,20 +378,27 @@ func (efs *exportedFileSystem) OpenJDF(jdfPath string, headerBytes int,
 		panic(err)
 	}
 
+	efs.dataSlots.acquire()
+	defer efs.dataSlots.release()
+
 	var hdrBuf []byte
 	var metaBuf []byte
 	var dfSize int64
 	var handle vfs.DataFileHandle
 	fse := vfs.FsErr(func() (err error) {
+		if jdfPath, err = efs.root.confineJDF(jdfPath, metaExt, dataExt); err != nil {
+			return
+		}
+
 		mfPath := jdfPath + metaExt
-		metaBuf, err = ioutil.ReadFile(mfPath)
+		metaBuf, err = efs.root.readFile(mfPath)
 		if err != nil {
 			return
 		}
 
 		dfPath := jdfPath + dataExt
 		var f *os.File
-		f, err = os.OpenFile(dfPath, os.O_RDWR, 0644)
+		f, err = efs.root.openFile(dfPath, efs.dfOpenFlags(), 0644)
 		if err != nil {
 			return
 		}
@@ -362,7 +411,7 @@ func (efs *exportedFileSystem) OpenJDF(jdfPath string, headerBytes int,
 		if fi, err = f.Stat(); err != nil {
 			return
 		}
-		im := fi2im(dfPath, fi)
+		im := efs.root.fi2im(dfPath, fi)
 
 		if headerBytes > 0 {
 			hdrBuf = efs.bufPool.Get(headerBytes)
@@ -370,11 +419,11 @@ func (efs *exportedFileSystem) OpenJDF(jdfPath string, headerBytes int,
 			var hdrReadBytes int
 			if hdrReadBytes, err = f.ReadAt(hdrBuf, 0); err != nil {
 				glog.Errorf("Error reading header of data file [%d] [%s]:[%s] with handle %d - %+v",
-					im.inode, jdfsRootPath, f.Name(), handle, err)
+					im.inode, efs.root.path, f.Name(), handle, err)
 				return
 			} else if hdrReadBytes != headerBytes {
 				glog.Warningf("Partial header [%d/%d] read from data file [%d] [%s]:[%s] with handle %d",
-					hdrReadBytes, headerBytes, im.inode, jdfsRootPath, f.Name(), handle)
+					hdrReadBytes, headerBytes, im.inode, efs.root.path, f.Name(), handle)
 			}
 		}
 
@@ -425,6 +474,15 @@ func (efs *exportedFileSystem) OpenJDF(jdfPath string, headerBytes int,
 	}
 }
 
+// dfOpenFlags returns flags to open existing data files with, read-only sessions
+// won't write through the handles, and may be exporting a read-only local fs.
+func (efs *exportedFileSystem) dfOpenFlags() int {
+	if efs.readOnly {
+		return os.O_RDONLY
+	}
+	return os.O_RDWR
+}
+
 func (efs *exportedFileSystem) StatJDF(jdfPath string, metaExt, dataExt string) {
 	co := efs.ho.Co()
 
@@ -432,14 +490,21 @@ func (efs *exportedFileSystem) StatJDF(jdfPath string, metaExt, dataExt string)
 		panic(err)
 	}
 
+	efs.metaSlots.acquire()
+	defer efs.metaSlots.release()
+
 	var dfSize int64
 	var inode vfs.InodeID
 	fse := vfs.FsErr(func() (err error) {
+		if jdfPath, err = efs.root.confineJDF(jdfPath, metaExt, dataExt); err != nil {
+			return
+		}
+
 		// todo not checking meta file for now, need to in the future ?
 
 		dfPath := jdfPath + dataExt
 		var f *os.File
-		f, err = os.OpenFile(dfPath, os.O_RDWR, 0644)
+		f, err = efs.root.openFile(dfPath, efs.dfOpenFlags(), 0644)
 		if err != nil {
 			return
 		}
@@ -449,7 +514,7 @@ func (efs *exportedFileSystem) StatJDF(jdfPath string, metaExt, dataExt string)
 		if fi, err = f.Stat(); err != nil {
 			return
 		}
-		im := fi2im(dfPath, fi)
+		im := efs.root.fi2im(dfPath, fi)
 		inode = im.inode
 
 		dfSize, err = f.Seek(0, 2)
@@ -487,16 +552,21 @@ func (efs *exportedFileSystem) ReadJDF(handle int, inode vfs.InodeID,
 	defer efs.bufPool.Return(buf)
 
 	// do this before the underlying HBI wire released
-	dfh, err := efs.dfd.GetFileHandle(vfs.DataFileHandle{handle, inode}, 1)
-	if err != nil {
-		panic(err)
-	}
+	dfh, dfhErr := efs.dfd.GetFileHandle(vfs.DataFileHandle{handle, inode}, 1)
 	fse := vfs.FsErr(func() (err error) {
-		defer efs.dfd.FileHandleOpDone(dfh)
+		if dfhErr == nil {
+			defer efs.dfd.FileHandleOpDone(dfh)
+		}
 
 		if err := co.FinishRecv(); err != nil {
 			panic(err)
 		}
+		if dfhErr != nil {
+			return dfhErr
+		}
+
+		efs.dataSlots.acquire()
+		defer efs.dataSlots.release()
 
 		var bytesRead int
 		bytesRead, err = dfh.f.ReadAt(buf, int64(dataOffset))
@@ -507,7 +577,7 @@ func (efs *exportedFileSystem) ReadJDF(handle int, inode vfs.InodeID,
 				err = nil
 			} else {
 				glog.Errorf("Error reading data file [%d] [%s]:[%s] with handle %d - %+v",
-					dfh.inode, jdfsRootPath, dfh.f.Name(), handle, err)
+					dfh.inode, efs.root.path, dfh.f.Name(), handle, err)
 				return
 			}
 		}
@@ -516,7 +586,7 @@ func (efs *exportedFileSystem) ReadJDF(handle int, inode vfs.InodeID,
 
 		if glog.V(2) {
 			glog.Infof("Read %d bytes @%d from data file [%d] [%s]:[%s] with handle %d",
-				bytesRead, dataOffset, dfh.inode, jdfsRootPath, dfh.f.Name(), handle)
+				bytesRead, dataOffset, dfh.inode, efs.root.path, dfh.f.Name(), handle)
 		}
 		return
 	}())
@@ -525,7 +595,7 @@ func (efs *exportedFileSystem) ReadJDF(handle int, inode vfs.InodeID,
 		panic(err)
 	}
 
-	if err = co.SendObj(fse.Repr()); err != nil {
+	if err := co.SendObj(fse.Repr()); err != nil {
 		panic(err)
 	}
 	if fse != 0 {
@@ -536,7 +606,7 @@ func (efs *exportedFileSystem) ReadJDF(handle int, inode vfs.InodeID,
 		panic(err)
 	}
 	if len(buf) > 0 {
-		if err := co.SendData(buf); err != nil {
+		if err := efs.sendPayload(co, buf); err != nil {
 			panic(err)
 		}
 	}
@@ -549,33 +619,46 @@ func (efs *exportedFileSystem) WriteJDF(handle int, inode vfs.InodeID,
 	buf := efs.bufPool.Get(int(dataSize))
 	defer efs.bufPool.Return(buf)
 
-	if err := co.RecvData(buf); err != nil {
-		panic(err)
+	payloadErr := efs.recvPayload(co, buf)
+	if _, ok := payloadErr.(vfs.FsError); payloadErr != nil && !ok {
+		panic(payloadErr)
 	}
 
-	dfh, err := efs.dfd.GetFileHandle(vfs.DataFileHandle{handle, inode}, 1)
-	if err != nil {
-		panic(err)
-	}
+	dfh, dfhErr := efs.dfd.GetFileHandle(vfs.DataFileHandle{handle, inode}, 1)
 	fse := vfs.FsErr(func() (err error) {
 		// do this before the underlying HBI wire released
-		defer efs.dfd.FileHandleOpDone(dfh)
+		if dfhErr == nil {
+			defer efs.dfd.FileHandleOpDone(dfh)
+		}
 
 		if err := co.FinishRecv(); err != nil {
 			panic(err)
 		}
+		if dfhErr != nil {
+			return dfhErr
+		}
+		if payloadErr != nil {
+			return payloadErr
+		}
+
+		efs.dataSlots.acquire()
+		defer efs.dataSlots.release()
+
+		if err = efs.checkWritable(dfh.jdfPath); err != nil {
+			return
+		}
 
 		var bytesWritten int
 		bytesWritten, err = dfh.f.WriteAt(buf, int64(dataOffset))
 		if err != nil {
 			glog.Errorf("Error writing data file [%d] [%s]:[%s] with handle %d - %+v",
-				dfh.inode, jdfsRootPath, dfh.f.Name(), handle, err)
+				dfh.inode, efs.root.path, dfh.f.Name(), handle, err)
 			return
 		}
 
 		if glog.V(2) {
 			glog.Infof("Wrote %d bytes @%d to data file [%d] [%s]:[%s] with handle %d",
-				bytesWritten, dataOffset, dfh.inode, jdfsRootPath, dfh.f.Name(), handle)
+				bytesWritten, dataOffset, dfh.inode, efs.root.path, dfh.f.Name(), handle)
 		}
 		return
 	}())
@@ -598,26 +681,31 @@ func (efs *exportedFileSystem) SyncJDF(handle int, inode vfs.InodeID) {
 	co := efs.ho.Co()
 
 	// do this before the underlying HBI wire released
-	dfh, err := efs.dfd.GetFileHandle(vfs.DataFileHandle{handle, inode}, 1)
-	if err != nil {
-		panic(err)
-	}
+	dfh, dfhErr := efs.dfd.GetFileHandle(vfs.DataFileHandle{handle, inode}, 1)
 	fse := vfs.FsErr(func() (err error) {
-		defer efs.dfd.FileHandleOpDone(dfh)
+		if dfhErr == nil {
+			defer efs.dfd.FileHandleOpDone(dfh)
+		}
 
 		if err := co.FinishRecv(); err != nil {
 			panic(err)
 		}
+		if dfhErr != nil {
+			return dfhErr
+		}
+
+		efs.dataSlots.acquire()
+		defer efs.dataSlots.release()
 
 		if err = dfh.f.Sync(); err != nil {
 			glog.Errorf("Error syncing data file [%d] [%s]:[%s] with handle %d - %+v",
-				dfh.inode, jdfsRootPath, dfh.f.Name(), handle, err)
+				dfh.inode, efs.root.path, dfh.f.Name(), handle, err)
 			return
 		}
 
 		if glog.V(2) {
 			glog.Infof("Sync'ed data file [%d] [%s]:[%s] with handle %d", dfh.inode,
-				jdfsRootPath, dfh.f.Name(), handle)
+				efs.root.path, dfh.f.Name(), handle)
 		}
 		return
 	}())
@@ -642,20 +730,22 @@ func (efs *exportedFileSystem) CloseJDF(handle int, inode vfs.InodeID) {
 		panic(err)
 	}
 
-	f := efs.dfd.ReleaseFileHandle(vfs.DataFileHandle{handle, inode})
-	if f == nil {
-		glog.Fatal("no file pointer from released file handle ?!")
+	f, err := efs.dfd.ReleaseFileHandle(vfs.DataFileHandle{handle, inode})
+	if err != nil {
+		// jdfs sends nothing back
+		glog.Errorf("DREL failed releasing data file handle [%d/%d] on [%s] - %s",
+			handle, inode, efs.root.path, vfs.FsErr(err).Repr())
 		return
 	}
 
 	dfPath := f.Name()
 	if err := f.Close(); err != nil {
 		glog.Errorf("Error on closing jdfs data file [%s]:[%s] - %+v",
-			jdfsRootPath, dfPath, err)
+			efs.root.path, dfPath, err)
 	}
 
 	if glog.V(2) {
 		glog.Infof("DREL data file handle %d released for file [%d] [%s]:[%s]",
-			handle, inode, jdfsRootPath, dfPath)
+			handle, inode, efs.root.path, dfPath)
 	}
 }
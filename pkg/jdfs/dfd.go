@@ -4,7 +4,6 @@ import (
 	"os"
 	"sync"
 
-	"github.com/complyue/jdfs/pkg/errors"
 	"github.com/complyue/jdfs/pkg/vfs"
 
 	"github.com/golang/glog"
@@ -27,24 +26,25 @@ type dfHandle struct {
 	opc *sync.WaitGroup
 }
 
-// in-core data file data
-//
-// this shares jdfsRootPath etc. from icd.
-// a process should have only one icd active,
-// with its pwd chdir'ed to the mounted jdfsRootPath with icd.init()
+// in-core data file data of a jdfs session
 type icDFD struct {
 	// registry of file handles held open, a file handle value is index into this slice
 	fileHandles []dfHandle // flat storage of handles
 	freeFHIdxs  []int      // free list of indices into fileHandles
 
+	// the mounted root dir, shared with icd
+	root *mountedRoot
+
 	// guard access to session data structs
 	mu sync.Mutex
 }
 
-func (dfd *icDFD) init(readOnly bool) error {
+func (dfd *icDFD) init(root *mountedRoot) error {
 	dfd.mu.Lock()
 	defer dfd.mu.Unlock()
 
+	dfd.root = root
+
 	dfd.fileHandles = []dfHandle{dfHandle{}} // reserve 0 for nil handle
 	dfd.freeFHIdxs = nil
 
@@ -60,7 +60,7 @@ func (dfd *icDFD) CreateFileHandle(jdfPath, metaExt, dataExt string, f *os.File)
 	if fi, err = f.Stat(); err != nil {
 		return
 	}
-	im := fi2im(f.Name(), fi)
+	im := dfd.root.fi2im(f.Name(), fi)
 
 	var hsi int
 	if nFreeHdls := len(dfd.freeFHIdxs); nFreeHdls > 0 {
@@ -89,7 +89,7 @@ func (dfd *icDFD) CreateFileHandle(jdfPath, metaExt, dataExt string, f *os.File)
 
 	if glog.V(2) {
 		glog.Infof("DFH created data file handle %d for [%d] [%s]:[%s]", handle.Handle, handle.Inode,
-			jdfsRootPath, f.Name())
+			dfd.root.path, f.Name())
 	}
 
 	return
@@ -103,11 +103,20 @@ func (dfd *icDFD) GetFileHandle(handle vfs.DataFileHandle, incOpc int) (icfh dfH
 	dfd.mu.Lock()
 	defer dfd.mu.Unlock()
 
+	if handle.Handle <= 0 || handle.Handle >= len(dfd.fileHandles) {
+		err = vfs.EBADF
+		return
+	}
+
 	// the opc field (as a WaitGroup) can not be copied, must return a pointer
 	icfh = dfd.fileHandles[handle.Handle]
+	if icfh.f == nil {
+		err = vfs.EBADF
+		return
+	}
 	if icfh.inode != handle.Inode {
-		err = errors.Errorf("inode of dfh [%d] mismatch - %d vs %d",
-			handle.Handle, handle.Inode, icfh.inode)
+		err = vfs.EINVAL
+		return
 	}
 
 	if incOpc > 0 {
@@ -117,43 +126,47 @@ func (dfd *icDFD) GetFileHandle(handle vfs.DataFileHandle, incOpc int) (icfh dfH
 	return
 }
 
-func (dfd *icDFD) ReleaseFileHandle(handle vfs.DataFileHandle) (inoF *os.File) {
+func (dfd *icDFD) ReleaseFileHandle(handle vfs.DataFileHandle) (inoF *os.File, err error) {
 	var icfh dfHandle
 
-	func() {
+	if err = func() error {
 		dfd.mu.Lock()
 		defer dfd.mu.Unlock()
 
+		if handle.Handle <= 0 || handle.Handle >= len(dfd.fileHandles) {
+			return vfs.EBADF
+		}
+
 		icfh = dfd.fileHandles[handle.Handle]
+		if icfh.f == nil {
+			return vfs.EBADF
+		}
 		if icfh.inode != handle.Inode {
-			panic(errors.Errorf("inode of dfh [%d] mismatch - %d vs %d",
-				handle.Handle, handle.Inode, icfh.inode))
+			return vfs.EINVAL
 		}
 		inoF = icfh.f
 
 		if glog.V(2) {
 			glog.Infof("DFH release wait data file handle [%d/%d] [%s]:[%s]",
-				handle.Handle, handle.Inode, jdfsRootPath, inoF.Name())
+				handle.Handle, handle.Inode, dfd.root.path, inoF.Name())
 		}
-	}()
+		return nil
+	}(); err != nil {
+		return
+	}
 
 	// wait all operations done before closing the underlying file, or they'll fail
 	icfh.opc.Wait()
 
-	func() {
+	err = func() error {
 		dfd.mu.Lock()
 		defer dfd.mu.Unlock()
 
-		// locked dfd.mu again, check we are still good
+		// locked dfd.mu again, check we are still good, a concurrent release of the
+		// same handle may have won
 		icfh = dfd.fileHandles[handle.Handle]
-		if icfh.inode != handle.Inode {
-			panic(errors.Errorf("inode of dfh [%d] mismatch - %d vs %d",
-				handle.Handle, handle.Inode, icfh.inode))
-		}
-		if icfh.f != inoF {
-			glog.Fatalf("DFH [%d/%d] file changed [%v] => [%v] ?!",
-				handle.Handle, handle.Inode, inoF, icfh.f)
-			return
+		if icfh.inode != handle.Inode || icfh.f != inoF {
+			return vfs.EBADF
 		}
 
 		// fill fields with zero values
@@ -163,8 +176,9 @@ func (dfd *icDFD) ReleaseFileHandle(handle vfs.DataFileHandle) (inoF *os.File) {
 
 		if glog.V(2) {
 			glog.Infof("DFH release ready data file handle [%d/%d] [%s]:[%s]",
-				handle.Handle, handle.Inode, jdfsRootPath, inoF.Name())
+				handle.Handle, handle.Inode, dfd.root.path, inoF.Name())
 		}
+		return nil
 	}()
 
 	return
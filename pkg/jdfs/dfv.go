@@ -0,0 +1,322 @@
+package jdfs
+
+import (
+	"io"
+	"math"
+	"os"
+	"sort"
+
+	"github.com/complyue/hbi"
+	"github.com/complyue/jdfs/pkg/vfs"
+	"github.com/golang/glog"
+)
+
+// vectored data file access, many ranges of a data file are read/written in a
+// single conversation, with data of all ranges concatenated in request order, as a
+// single payload.
+//
+// ranges contiguous in the data file are read/written by a single preadv/pwritev,
+// with their segments of the payload as iovecs, regardless of their request order.
+
+// max iovecs per preadv/pwritev, IOV_MAX of Linux and macOS
+const iovMax = 1024
+
+// rangeSeg is a range of a data file, with its segment of the payload.
+type rangeSeg struct {
+	i   int // index of the range in request
+	off int64
+	seg []byte
+}
+
+// rangeRuns splits the payload buf into segments of ranges, and groups them into
+// runs contiguous in the data file. the size of buf must be the total of ranges.
+func rangeRuns(ranges []vfs.DataRange, buf []byte) (runs [][]rangeSeg) {
+	segs := make([]rangeSeg, 0, len(ranges))
+	pos := int64(0)
+	for i, r := range ranges {
+		if r.Size > 0 {
+			segs = append(segs, rangeSeg{i: i, off: r.Offset, seg: buf[pos : pos+r.Size]})
+		}
+		pos += r.Size
+	}
+	sort.SliceStable(segs, func(i, j int) bool {
+		return segs[i].off < segs[j].off
+	})
+
+	for i := 0; i < len(segs); {
+		j, end := i+1, segs[i].off+int64(len(segs[i].seg))
+		for j < len(segs) && j-i < iovMax && segs[j].off == end {
+			end += int64(len(segs[j].seg))
+			j++
+		}
+		runs = append(runs, segs[i:j])
+		i = j
+	}
+	return
+}
+
+// checkRanges validates ranges from jdfc, and returns their total size, EINVAL for
+// any range negative or overflowing, or a total exceeding vfs.MaxDataRangesSize.
+func checkRanges(ranges []vfs.DataRange) (total int64, err error) {
+	for _, r := range ranges {
+		if r.Offset < 0 || r.Size < 0 || r.Offset > math.MaxInt64-r.Size ||
+			r.Size > vfs.MaxDataRangesSize-total {
+			return 0, vfs.EINVAL
+		}
+		total += r.Size
+	}
+	return
+}
+
+// recvRanges receives nRanges ranges following a vectored read/write, and returns
+// their total size. vfs.EINVAL is returned for too many or bad ranges, with the
+// wire still in sync, other errors are from the wire.
+func (efs *exportedFileSystem) recvRanges(co *hbi.HoCo, nRanges int) (
+	ranges []vfs.DataRange, total int64, err error) {
+	if nRanges < 0 {
+		return nil, 0, vfs.EINVAL
+	}
+	if nRanges > vfs.MaxDataRanges {
+		if err = efs.codec.DiscardData(co, int64(nRanges)*vfs.DataRangeBytes); err != nil {
+			return
+		}
+		return nil, 0, vfs.EINVAL
+	}
+
+	ranges, rangesPayload := vfs.ToReceiveDataRanges(nRanges)
+	if len(rangesPayload) > 0 {
+		if err = co.RecvData(rangesPayload); err != nil {
+			return
+		}
+	}
+	total, err = checkRanges(ranges)
+	return
+}
+
+// readRanges reads ranges of f into their segments of buf, bytes read of each range
+// are returned, with segments past end of file zeroed.
+func readRanges(f *os.File, ranges []vfs.DataRange, buf []byte) (ns []int, err error) {
+	ns = make([]int, len(ranges))
+	for _, run := range rangeRuns(ranges, buf) {
+		iovs := make([][]byte, len(run))
+		for i, rs := range run {
+			iovs[i] = rs.seg
+		}
+		off, runRead := run[0].off, 0
+		for len(iovs) > 0 {
+			var n int
+			if n, err = preadv(f, iovs, off); err != nil {
+				return
+			}
+			if n <= 0 {
+				break // end of file
+			}
+			off += int64(n)
+			runRead += n
+			iovs = advanceIOVs(iovs, n)
+		}
+		for _, rs := range run {
+			nr := runRead
+			if nr > len(rs.seg) {
+				nr = len(rs.seg)
+			}
+			ns[rs.i] = nr
+			runRead -= nr
+			// the buffer is from the pool, don't leak stale data
+			for i := nr; i < len(rs.seg); i++ {
+				rs.seg[i] = 0
+			}
+		}
+	}
+	return
+}
+
+// writeRanges writes segments of buf to their ranges of f, overlapping ranges are
+// written in unspecified order.
+func writeRanges(f *os.File, ranges []vfs.DataRange, buf []byte) (err error) {
+	for _, run := range rangeRuns(ranges, buf) {
+		iovs := make([][]byte, len(run))
+		for i, rs := range run {
+			iovs[i] = rs.seg
+		}
+		off := run[0].off
+		for len(iovs) > 0 {
+			var n int
+			if n, err = pwritev(f, iovs, off); err != nil {
+				return
+			}
+			if n <= 0 {
+				return io.ErrShortWrite
+			}
+			off += int64(n)
+			iovs = advanceIOVs(iovs, n)
+		}
+	}
+	return
+}
+
+// advanceIOVs drops n bytes done from the head of iovs.
+func advanceIOVs(iovs [][]byte, n int) [][]byte {
+	for len(iovs) > 0 && n >= len(iovs[0]) {
+		n -= len(iovs[0])
+		iovs = iovs[1:]
+	}
+	if len(iovs) > 0 && n > 0 {
+		iovs[0] = iovs[0][n:]
+	}
+	return iovs
+}
+
+// ReadJDFv reads nRanges ranges of a data file, the ranges follow as binary data,
+// sends back bytes read of each range, and data of all ranges concatenated, with
+// segments past end of file zeroed.
+func (efs *exportedFileSystem) ReadJDFv(handle int, inode vfs.InodeID, nRanges int) {
+	co := efs.ho.Co()
+
+	ranges, total, rangesErr := efs.recvRanges(co, nRanges)
+	if _, ok := rangesErr.(vfs.FsError); rangesErr != nil && !ok {
+		panic(rangesErr)
+	}
+
+	var buf []byte
+	if rangesErr == nil && total > 0 {
+		buf = efs.bufPool.Get(int(total))
+		defer efs.bufPool.Return(buf)
+	}
+
+	// do this before the underlying HBI wire released, the op counter is held once
+	// for all ranges
+	dfh, dfhErr := efs.dfd.GetFileHandle(vfs.DataFileHandle{handle, inode}, 1)
+	var ns []int
+	fse := vfs.FsErr(func() (err error) {
+		if dfhErr == nil {
+			defer efs.dfd.FileHandleOpDone(dfh)
+		}
+
+		if err := co.FinishRecv(); err != nil {
+			panic(err)
+		}
+		if dfhErr != nil {
+			return dfhErr
+		}
+		if rangesErr != nil {
+			return rangesErr
+		}
+
+		efs.dataSlots.acquire()
+		defer efs.dataSlots.release()
+
+		if ns, err = readRanges(dfh.f, ranges, buf); err != nil {
+			glog.Errorf("Error reading %d ranges of data file [%d] [%s]:[%s] with handle %d - %+v",
+				len(ranges), dfh.inode, efs.root.path, dfh.f.Name(), handle, err)
+			return
+		}
+
+		if glog.V(2) {
+			glog.Infof("Read %d ranges of %d bytes from data file [%d] [%s]:[%s] with handle %d",
+				len(ranges), total, dfh.inode, efs.root.path, dfh.f.Name(), handle)
+		}
+		return
+	}())
+
+	if err := co.StartSend(); err != nil {
+		panic(err)
+	}
+
+	if err := co.SendObj(fse.Repr()); err != nil {
+		panic(err)
+	}
+	if fse != 0 {
+		return
+	}
+
+	bytesRead := make(hbi.LitListType, len(ns))
+	for i, n := range ns {
+		bytesRead[i] = n
+	}
+	if err := co.SendObj(hbi.Repr(bytesRead)); err != nil {
+		panic(err)
+	}
+	if total > 0 {
+		if err := efs.sendPayload(co, buf); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// WriteJDFv writes nRanges ranges of a data file, the ranges follow as binary data,
+// then data of all ranges concatenated, of dataSize bytes.
+func (efs *exportedFileSystem) WriteJDFv(handle int, inode vfs.InodeID, nRanges int,
+	dataSize int64) {
+	co := efs.ho.Co()
+
+	ranges, total, payloadErr := efs.recvRanges(co, nRanges)
+	if _, ok := payloadErr.(vfs.FsError); payloadErr != nil && !ok {
+		panic(payloadErr)
+	}
+	if payloadErr == nil && total != dataSize {
+		payloadErr = vfs.EINVAL
+	}
+
+	var buf []byte
+	if payloadErr != nil {
+		// the data follows anyway
+		if err := efs.codec.DiscardPayload(co, dataSize); err != nil {
+			panic(err)
+		}
+	} else if total > 0 {
+		buf = efs.bufPool.Get(int(total))
+		defer efs.bufPool.Return(buf)
+
+		payloadErr = efs.recvPayload(co, buf)
+		if _, ok := payloadErr.(vfs.FsError); payloadErr != nil && !ok {
+			panic(payloadErr)
+		}
+	}
+
+	// the op counter is held once for all ranges
+	dfh, dfhErr := efs.dfd.GetFileHandle(vfs.DataFileHandle{handle, inode}, 1)
+	fse := vfs.FsErr(func() (err error) {
+		// do this before the underlying HBI wire released
+		if dfhErr == nil {
+			defer efs.dfd.FileHandleOpDone(dfh)
+		}
+
+		if err := co.FinishRecv(); err != nil {
+			panic(err)
+		}
+		if dfhErr != nil {
+			return dfhErr
+		}
+		if payloadErr != nil {
+			return payloadErr
+		}
+
+		efs.dataSlots.acquire()
+		defer efs.dataSlots.release()
+
+		if err = efs.checkWritable(dfh.jdfPath); err != nil {
+			return
+		}
+
+		if err = writeRanges(dfh.f, ranges, buf); err != nil {
+			glog.Errorf("Error writing %d ranges to data file [%d] [%s]:[%s] with handle %d - %+v",
+				len(ranges), dfh.inode, efs.root.path, dfh.f.Name(), handle, err)
+			return
+		}
+
+		if glog.V(2) {
+			glog.Infof("Wrote %d ranges of %d bytes to data file [%d] [%s]:[%s] with handle %d",
+				len(ranges), total, dfh.inode, efs.root.path, dfh.f.Name(), handle)
+		}
+		return
+	}())
+
+	if err := co.StartSend(); err != nil {
+		panic(err)
+	}
+
+	if err := co.SendObj(fse.Repr()); err != nil {
+		panic(err)
+	}
+}
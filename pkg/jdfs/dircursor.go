@@ -0,0 +1,155 @@
+package jdfs
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/complyue/jdfs/pkg/vfs"
+	"github.com/golang/glog"
+)
+
+const (
+	// max number of children read from local fs per batch, for a dir handle
+	dirBatchSize = 1024
+
+	// max number of children cached in-core per dir, for lookups to skip
+	// stating local fs, dirs larger than this don't get their children cached.
+	maxCachedChildren = 16384
+)
+
+// dirCursor streams entries of a dir held open by a dir handle, from local fs in
+// batches, so a huge dir is never entirely in-core.
+//
+// entries are numbered from 1 in the order streamed, as the offsets exposed to
+// jdfc, a read at an offset before the current batch rewinds the stream.
+type dirCursor struct {
+	// a cursor is used by one op at a time
+	mu sync.Mutex
+
+	// meta data of the dir as (re)opened, and the dir file held open
+	dirM   iMeta
+	dir    *os.File
+	openAt time.Time
+
+	// number of entries streamed before current batch
+	base int
+	// current batch of children streamed, and when it was read
+	batch     []iMeta
+	batchTime time.Time
+	// whether streamed to end of the dir
+	eof bool
+
+	// inodes of children streamed from start, to be cached by the dir's in-core
+	// record once streamed to end, nil if exceeded maxCachedChildren
+	children map[string]vfs.InodeID
+}
+
+// close releases the dir file held open, the cursor rewinds on next read.
+func (dc *dirCursor) close(root *mountedRoot) {
+	if dc.dir != nil {
+		if err := dc.dir.Close(); err != nil {
+			glog.Errorf("Error closing dir [%s]:[%s] - %+v", root.path, dc.dirM.jdfPath, err)
+		}
+		dc.dir = nil
+	}
+}
+
+// rewind (re)opens the dir at its current path, to stream from start.
+func (efs *exportedFileSystem) rewindDir(dc *dirCursor, inode vfs.InodeID) error {
+	dc.close(efs.root)
+
+	ici, ok, _, _ := efs.icd.GetInode(0, inode, 0)
+	if !ok {
+		return vfs.ENOENT
+	}
+	dirM, outdatedPaths, err := efs.root.statInode(ici.inode, ici.reachedThrough)
+	if err != nil {
+		return err
+	}
+	openAt := time.Now()
+	if _, ok = efs.icd.LoadInode(0, dirM, outdatedPaths, nil, openAt); !ok {
+		return vfs.ENOENT
+	}
+	dir, err := efs.root.openFile(dirM.jdfPath, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	// don't overwrite dc.mu as locked
+	dc.dirM, dc.dir, dc.openAt = dirM, dir, openAt
+	dc.base, dc.batch, dc.eof = 0, nil, false
+	dc.children = make(map[string]vfs.InodeID)
+	return nil
+}
+
+// readDirAt returns children from the entry at offset on, as many as in the
+// batch streamed containing it, nil at end of the dir.
+//
+// the first child returned has offset+1 as its vfs.DirEnt.Offset, and so on.
+//
+// dc.mu must be locked by the caller.
+func (efs *exportedFileSystem) readDirAt(dc *dirCursor, inode vfs.InodeID, offset int) (
+	childMs []iMeta, err error) {
+	if dc.dir == nil || offset < dc.base {
+		if err = efs.rewindDir(dc, inode); err != nil {
+			return
+		}
+	}
+
+	for {
+		if i := offset - dc.base; i < len(dc.batch) {
+			return dc.batch[i:], nil
+		}
+		if dc.eof {
+			return nil, nil
+		}
+
+		dc.base += len(dc.batch)
+		dc.batchTime = time.Now()
+		if dc.batch, err = efs.root.readDirBatch(dc.dirM, dc.dir, dirBatchSize); err != nil {
+			if err != io.EOF {
+				return
+			}
+			err = nil
+			dc.eof = true
+		}
+
+		if dc.children != nil {
+			for i := range dc.batch {
+				dc.children[dc.batch[i].name] = dc.batch[i].inode
+			}
+			if len(dc.children) > maxCachedChildren {
+				dc.children = nil // too many to be cached
+			} else if dc.eof {
+				// streamed all children from start, have them cached for lookups
+				efs.icd.CacheChildren(inode, dc.children, dc.openAt)
+				dc.children = nil
+			}
+		}
+
+		if glog.V(2) {
+			glog.Infof("LS streamed %d entries @%d for [%s]:[%s] eof=%v", len(dc.batch), dc.base,
+				efs.root.path, dc.dirM.jdfPath, dc.eof)
+		}
+	}
+}
+
+// dirEntOf returns the dir entry of a child streamed at the specified index.
+func dirEntOf(idx int, childM *iMeta) vfs.DirEnt {
+	entType := vfs.DT_Unknown
+	if cMode := childM.attrs.Mode; cMode.IsDir() {
+		entType = vfs.DT_Directory
+	} else if cMode.IsRegular() {
+		entType = vfs.DT_File
+	} else if cMode&os.ModeSymlink != 0 {
+		entType = vfs.DT_Link
+	}
+	return vfs.DirEnt{
+		Offset: vfs.DirOffset(idx + 1),
+		Inode:  childM.inode,
+		Name:   childM.name,
+		Type:   entType,
+	}
+}
@@ -0,0 +1,48 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package jdfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/complyue/jdfs/pkg/vfs"
+)
+
+func TestFallocateModes(t *testing.T) {
+	te := newTestExport(t)
+	defer te.close()
+
+	w := te.dial(t)
+	defer w.close()
+	if err := w.mount(false, "/"); err != nil {
+		t.Fatalf("failed mounting export root - %v", err)
+	}
+
+	insideIno := w.lookUp(vfs.RootInodeID, "inside")
+	okIno := w.lookUp(insideIno, "ok"+testDataExt)
+	co := w.call(fmt.Sprintf(`
+OpenFile(%d, true, false)
+`, okIno))
+	if fse := w.recvObj(co).(vfs.FsError); fse != 0 {
+		t.Fatalf("opening [%d] for write failed - %s", okIno, fse.Repr())
+	}
+	fh := w.recvObj(co)
+	co.Close()
+
+	// FALLOC_FL_COLLAPSE_RANGE and FALLOC_FL_INSERT_RANGE of Linux
+	for _, mode := range []uint32{0x08, 0x20, 0x08 | vfs.FallocKeepSize} {
+		if fse := w.fsErr(fmt.Sprintf(`Fallocate(%d, %v, %d, %d, %d)`,
+			okIno, fh, 0, 4, mode)); fse != vfs.EOPNOTSUPP {
+			t.Errorf("Fallocate mode %#x got %s", mode, fse.Repr())
+		}
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(te.root, "inside", "ok"+testDataExt)); err != nil {
+		t.Error(err)
+	} else if string(b) != "ok data content." {
+		t.Errorf("data file changed to [%s]", b)
+	}
+}
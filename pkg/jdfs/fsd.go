@@ -11,49 +11,20 @@ import (
 	"github.com/golang/glog"
 )
 
-var (
-	// effective uid/gid of jdfs process, this is told to jdfc when initially
-	// mounted, jdfc is supposed to translate all inode owner uid/gid of these values
-	// to its FUSE uid/gid as exposed to client kernel/applications, so the owning uid/gid of
-	// inodes stored in the backing fs at jdfs can be different from the FUSE uid/gid
-	// at jdfc, while those files/dirs appear owned by the FUSE uid/gid.
-	//
-	// TODO decide handling of uid/gid other than these values, to leave them as is, or
-	//      maybe a good idea to translate to a fixed value (e.g. 0=root, 1=daemon) ?
-	jdfsUID, jdfsGID uint32
-
-	// absolute path at jdfs host for the mounted root dir
-	jdfsRootPath string
-
-	// hold the JDFS mounted root dir open, so as to prevent it from unlinked,
-	// until jdfc disconnected.
-	jdfRootDir *os.File
-
-	// device of JDFS mounted root dir
-	//
-	// nested directory with other filesystems mounted will be hidden to jdfc
-	jdfRootDevice int64
-
-	// inode value of the JDFS mounted root dir
-	//
-	// jdfc is not restricted to only mount root of local filesystem at jdfs host,
-	// in case a nested dir is mounted as JDFS root, inode of mounted root will be other
-	// than 1, which is the constant for FUSE fs root.
-	jdfRootInode vfs.InodeID
-)
-
 // in-core inode info
 type icInode struct {
 	// meta data of this inode
 	inode vfs.InodeID
+	gen   vfs.GenerationNumber
 	attrs vfs.InodeAttributes
 
 	// number of references counted by FUSE
 	//
 	// when an in-core record's reference count is decreased to zero, it'll be dropped,
-	// and all it's children with 0 refcnt will be dropped as well.
+	// unless still held open by dir/file handles.
 	//
-	// note: prefetched records will be in-core but have refcnt==0
+	// note: prefetched records will be in-core but have refcnt==0, they are kept in
+	// the LRU list until evicted, as well as records with all handles released.
 	refcnt int
 
 	// jdf paths through which this inode has been reached
@@ -62,13 +33,21 @@ type icInode struct {
 	// head of the file handle list
 	fhHead int
 
+	// number of dir handles held open
+	dhCnt int
+
+	// double-link pointers in the LRU list, valid only if inLRU
+	inLRU            bool
+	lruPrev, lruNext int
+
 	// last time at which attrs/children are refreshed
 	lastChecked         time.Time
 	lastChildrenChecked time.Time
 
 	// cached inode ids of children of a dir.
 	// will always be nil for non-dir inode; and will be nil for a dir inode, before it's
-	// loaded, or has been forcefully invalidated.
+	// fully streamed by a dir handle, or has been forcefully invalidated. dirs with more
+	// than maxCachedChildren children never get it cached.
 	//
 	// if non-nil, the map is per-see at lastChildrenChecked time, and is safe to be read
 	// concurrently as it won't be written concurrently.
@@ -83,7 +62,8 @@ type icdHandle struct {
 
 	inode vfs.InodeID
 
-	entries []vfs.DirEnt
+	// streams entries of the dir, shared by snapshots of the handle
+	cursor *dirCursor
 }
 
 // in-core handle to a regular file held open
@@ -114,10 +94,7 @@ type icfHandle struct {
 	opc *sync.WaitGroup
 }
 
-// in-core filesystem data
-//
-// a process should have only one icd active,
-// with its pwd chdir'ed to the mounted jdfsRootPath with icd.init()
+// in-core filesystem data of a jdfs session
 type icFSD struct {
 
 	// registry of in-core info of inodes
@@ -133,41 +110,36 @@ type icFSD struct {
 	fileHandles []icfHandle // flat storage of handles
 	freeFHIdxs  []int       // free list of indices into fileHandles
 
+	// LRU list of in-core inodes evictable, by indices into stoInodes, 0 for none as
+	// root is never evictable
+	lruHead, lruTail int
+
+	// counters of the in-core inode table, and as last logged
+	stats, statsLogged icInodeStats
+	statsLoggedTime    time.Time
+
+	// the mounted root dir
+	root *mountedRoot
+
+	// watcher of local fs changes, nil if not watching
+	watcher *fsWatcher
+
 	// guard access to session data structs
 	mu sync.Mutex
 }
 
-func (icd *icFSD) init(readOnly bool) error {
-	jdfsUID = uint32(os.Geteuid())
-	jdfsGID = uint32(os.Getegid())
-
-	if err := os.Chdir(jdfsRootPath); err != nil {
-		return errors.Errorf("Error chdir to jdfs path: [%s] - %+v", jdfsRootPath, err)
-	}
-	rootFI, err := os.Lstat(".")
+func (icd *icFSD) init(root *mountedRoot) error {
+	rootFI, err := root.lstat(".")
 	if err != nil {
-		return errors.Errorf("Bad jdfs path: [%s] - %+v", jdfsRootPath, err)
+		return errors.Errorf("Bad jdfs path: [%s] - %+v", root.path, err)
 	}
-	// dir can only be opened readonly
-	rootDir, err := os.OpenFile(".", os.O_RDONLY, 0)
-	if err != nil {
-		return errors.Errorf("Error open jdfs path: [%s] - %+v", jdfsRootPath, err)
-	}
-	if !readOnly {
-		// TODO test JDFS mount root dir writable
-	}
-
-	rootM := fi2im(".", rootFI)
+	// root is never mapped
+	rootM := localMeta(".", rootFI)
 
 	icd.mu.Lock()
 	defer icd.mu.Unlock()
 
-	if jdfRootDir != nil {
-		jdfRootDir.Close()
-	}
-	jdfRootDir = rootDir
-	jdfRootDevice = rootM.dev
-	jdfRootInode = rootM.inode
+	icd.root = root
 
 	// todo sophisticate initial in-core data allocation,
 	// may base on statistics from local fs and config.
@@ -178,6 +150,9 @@ func (icd *icFSD) init(readOnly bool) error {
 	icd.freeDHIdxs = nil
 	icd.fileHandles = []icfHandle{icfHandle{}} // reserve 0 for nil handle
 	icd.freeFHIdxs = nil
+	icd.lruHead, icd.lruTail = 0, 0
+	icd.stats, icd.statsLogged = icInodeStats{}, icInodeStats{}
+	icd.statsLoggedTime = time.Time{}
 
 	// fake mounted JDFS root inode to be constant 1
 	rootM.inode = vfs.RootInodeID
@@ -195,9 +170,9 @@ func (icd *icFSD) loadInode(incRef int, im iMeta,
 	outdatedPaths []string, children map[string]vfs.InodeID,
 	checkTime time.Time) (isi int) {
 	jdfPath := im.jdfPath
-	if im.dev != jdfRootDevice {
-		glog.Warningf("Nested mount point [%s] under [%s] not supported by JDFS.",
-			jdfPath, jdfsRootPath)
+	if !icd.root.revealInode(&im) {
+		glog.Warningf("Nested mount point [%s] under [%s] not exposed by JDFS.",
+			jdfPath, icd.root.path)
 		return -1
 	}
 
@@ -209,6 +184,17 @@ func (icd *icFSD) loadInode(incRef int, im iMeta,
 			panic(errors.New("regInodes corrupted ?!"))
 		}
 
+		if im.gen != ici.gen {
+			// the inode ID reused by another filesystem mounted on a same device,
+			// what's known about the previous incarnation is no longer valid
+			ici.gen = im.gen
+			ici.reachedThrough = nil
+			ici.attrs = im.attrs
+			ici.children = nil
+			ici.lastChecked = checkTime
+			ici.lastChildrenChecked = checkTime
+		}
+
 		// the algorithm here may fail to discard some of the outdated paths,
 		// but they'll be realized later again anyway, no need to try very hard here.
 		for _, outdatedPath := range outdatedPaths {
@@ -248,7 +234,9 @@ func (icd *icFSD) loadInode(incRef int, im iMeta,
 
 		// apply reference count increment
 		ici.refcnt += incRef
+		icd.lruUpdate(isi)
 
+		icd.stats.hits++
 		return
 	}
 
@@ -262,7 +250,7 @@ func (icd *icFSD) loadInode(incRef int, im iMeta,
 	}
 	ici := &icd.stoInodes[isi]
 	*ici = icInode{
-		inode: im.inode, attrs: im.attrs,
+		inode: im.inode, gen: im.gen, attrs: im.attrs,
 
 		refcnt: incRef,
 
@@ -273,6 +261,14 @@ func (icd *icFSD) loadInode(incRef int, im iMeta,
 	}
 	icd.regInodes[im.inode] = isi
 
+	if im.attrs.Mode.IsDir() {
+		icd.watcher.watchDir(im.inode, jdfPath)
+	}
+
+	icd.stats.misses++
+	icd.lruUpdate(isi)
+	icd.evictInodes(isi)
+
 	return
 }
 
@@ -311,6 +307,9 @@ func (icd *icFSD) InvalidateChildren(inode vfs.InodeID,
 
 	// Note: should NOT modify armed children map, for safe concurrent reading of it
 
+	// children streamed before now are outdated
+	ici.lastChildrenChecked = time.Now()
+
 	if len(comeName) > 0 {
 		// a new child comes in, invalidate the cache to force a reload next time needed
 		ici.children = nil
@@ -325,6 +324,53 @@ func (icd *icFSD) InvalidateChildren(inode vfs.InodeID,
 	}
 }
 
+// CacheChildren caches children of a dir as streamed from local fs since checkTime,
+// unless the dir's children have been invalidated after that.
+func (icd *icFSD) CacheChildren(inode vfs.InodeID, children map[string]vfs.InodeID,
+	checkTime time.Time) {
+	icd.mu.Lock()
+	defer icd.mu.Unlock()
+
+	isi, ok := icd.regInodes[inode]
+	if !ok {
+		return // dropped from in-core meanwhile
+	}
+	ici := &icd.stoInodes[isi]
+	if checkTime.Before(ici.lastChildrenChecked) {
+		return // outdated
+	}
+	ici.children = children
+	ici.lastChildrenChecked = checkTime
+}
+
+// ChildrenChanged invalidates cached children of a dir, for changes observed from
+// local fs. unlike InvalidateChildren, the dir may have been dropped from in-core.
+func (icd *icFSD) ChildrenChanged(inode vfs.InodeID) {
+	icd.mu.Lock()
+	defer icd.mu.Unlock()
+
+	if isi, ok := icd.regInodes[inode]; ok {
+		icd.stoInodes[isi].children = nil
+		icd.stoInodes[isi].lastChildrenChecked = time.Now()
+	}
+}
+
+// InvalidateAll invalidates cached children of all in-core dirs, and returns ids of
+// all in-core inodes.
+func (icd *icFSD) InvalidateAll() (inodes []vfs.InodeID) {
+	icd.mu.Lock()
+	defer icd.mu.Unlock()
+
+	now := time.Now()
+	inodes = make([]vfs.InodeID, 0, len(icd.regInodes))
+	for inode, isi := range icd.regInodes {
+		icd.stoInodes[isi].children = nil
+		icd.stoInodes[isi].lastChildrenChecked = now
+		inodes = append(inodes, inode)
+	}
+	return
+}
+
 func (icd *icFSD) ForgetInode(inode vfs.InodeID, n int) (refcnt int) {
 	if inode == vfs.RootInodeID {
 		panic(errors.Errorf("forget root ?!"))
@@ -353,9 +399,12 @@ func (icd *icFSD) ForgetInode(inode vfs.InodeID, n int) (refcnt int) {
 		return ici.refcnt // still referenced
 	}
 
-	delete(icd.regInodes, inode)
-	icd.stoInodes[isi] = icInode{} // fill all fields with zero values
-	icd.freeInoIdxs = append(icd.freeInoIdxs, isi)
+	if !icd.lruEvictable(isi) {
+		// still held open by dir/file handles, it'll enter the LRU list once all
+		// handles released
+		return 0
+	}
+	icd.dropInode(isi)
 
 	return 0
 }
@@ -365,6 +414,7 @@ func (icd *icFSD) getInode(inode vfs.InodeID) *icInode {
 	isi, ok := icd.regInodes[inode]
 	if !ok {
 		glog.V(1).Infof("inode not in-core [%v]", inode)
+		icd.stats.misses++
 		return nil
 	}
 	ici := &icd.stoInodes[isi]
@@ -372,6 +422,8 @@ func (icd *icFSD) getInode(inode vfs.InodeID) *icInode {
 		glog.Errorf("inode disappeared [%v] ?!", inode)
 		return nil
 	}
+	icd.stats.hits++
+	icd.lruUpdate(isi)
 	return ici
 }
 
@@ -395,7 +447,10 @@ func (icd *icFSD) GetInode(incRef int, inode vfs.InodeID, incOpc int) (
 		return
 	}
 
-	icip.refcnt += incRef
+	if incRef != 0 {
+		icip.refcnt += incRef
+		icd.lruUpdate(icd.regInodes[inode])
+	}
 	ici, ok = *icip, true
 
 	if incOpc > 0 {
@@ -442,26 +497,31 @@ func (icd *icFSD) CreateDirHandle(inode vfs.InodeID) (handle vfs.HandleID, err e
 		hsi = icd.freeDHIdxs[nFreeHdls-1]
 		icd.freeDHIdxs = icd.freeDHIdxs[:nFreeHdls-1]
 		icd.dirHandles[hsi] = icdHandle{
-			isi: isi, inode: inode,
+			isi: isi, inode: inode, cursor: &dirCursor{},
 		}
 	} else {
 		hsi = len(icd.dirHandles)
 		icd.dirHandles = append(icd.dirHandles, icdHandle{
-			isi: isi, inode: inode,
+			isi: isi, inode: inode, cursor: &dirCursor{},
 		})
 	}
 	handle = vfs.HandleID(hsi)
 
+	// a dir held open is not evictable
+	ici.dhCnt++
+	icd.lruUpdate(isi)
+
 	return
 }
 
-func (icd *icFSD) GetDirHandle(inode vfs.InodeID, handle int, entries []vfs.DirEnt) (
+func (icd *icFSD) GetDirHandle(inode vfs.InodeID, handle int) (
 	icdh icdHandle, err error) {
 	icd.mu.Lock()
 	defer icd.mu.Unlock()
 
-	if entries != nil {
-		icd.dirHandles[handle].entries = entries
+	if handle <= 0 || handle >= len(icd.dirHandles) {
+		err = vfs.EBADF
+		return
 	}
 
 	// snapshot the value instead of getting a pointer, tho it's unlikely the handle be
@@ -483,15 +543,21 @@ func (icd *icFSD) GetDirHandle(inode vfs.InodeID, handle int, entries []vfs.DirE
 	return
 }
 
-func (icd *icFSD) ReleaseDirHandle(handle int) (released icdHandle) {
+func (icd *icFSD) ReleaseDirHandle(handle int) (released icdHandle, err error) {
 	icd.mu.Lock()
 	defer icd.mu.Unlock()
 
+	if handle <= 0 || handle >= len(icd.dirHandles) {
+		err = vfs.EBADF
+		return
+	}
+
 	icdh := &icd.dirHandles[handle]
 	released = *icdh // snapshot a copy to return
 
 	if icdh.isi < 0 {
-		panic(errors.New("releasing non-existing dir handle ?!"))
+		err = vfs.EBADF
+		return
 	}
 
 	// fill fields with invalid values
@@ -501,6 +567,9 @@ func (icd *icFSD) ReleaseDirHandle(handle int) (released icdHandle) {
 
 	icd.freeDHIdxs = append(icd.freeDHIdxs, handle)
 
+	icd.stoInodes[released.isi].dhCnt--
+	icd.lruUpdate(released.isi)
+
 	return
 }
 
@@ -544,13 +613,14 @@ func (icd *icFSD) CreateFileHandle(inode vfs.InodeID, inoF *os.File, writable bo
 		icd.fileHandles[ici.fhHead].prevFH = hsi
 	}
 	ici.fhHead = hsi
+	icd.lruUpdate(isi) // a file held open is not evictable
 
 	// return this handle
 	handle = vfs.HandleID(hsi)
 
 	if glog.V(2) {
 		glog.Infof("FH created file handle %d for [%d] [%s]:[%s]", handle, inode,
-			jdfsRootPath, inoF.Name())
+			icd.root.path, inoF.Name())
 	}
 
 	return
@@ -564,6 +634,11 @@ func (icd *icFSD) GetFileHandle(inode vfs.InodeID, handle int, incOpc int) (icfh
 	icd.mu.Lock()
 	defer icd.mu.Unlock()
 
+	if handle <= 0 || handle >= len(icd.fileHandles) {
+		err = vfs.EBADF
+		return
+	}
+
 	icfh = icd.fileHandles[handle]
 
 	if icfh.isi <= 0 { // isi 0 is root dir, not possible to be an opened file
@@ -586,27 +661,34 @@ func (icd *icFSD) GetFileHandle(inode vfs.InodeID, handle int, incOpc int) (icfh
 	return
 }
 
-func (icd *icFSD) ReleaseFileHandle(handle int) (inode vfs.InodeID, inoF *os.File) {
+func (icd *icFSD) ReleaseFileHandle(handle int) (inode vfs.InodeID, inoF *os.File, err error) {
 	var icfh icfHandle
 	var isi int
 
-	func() {
+	if err = func() error {
 		icd.mu.Lock()
 		defer icd.mu.Unlock()
 
+		if handle <= 0 || handle >= len(icd.fileHandles) {
+			return vfs.EBADF
+		}
+
 		icfh = icd.fileHandles[handle]
 		isi = icfh.isi
 		inode, inoF = icfh.inode, icfh.f
 
 		if isi <= 0 { // isi 0 is root dir, not possible to be an opened file
-			glog.Fatal("releasing non-existing file handle ?!")
+			return vfs.EBADF
 		}
 
 		if glog.V(2) {
 			glog.Infof("FH release wait file handle %d for [%d] [%s]:[%s]", handle, inode,
-				jdfsRootPath, inoF.Name())
+				icd.root.path, inoF.Name())
 		}
-	}()
+		return nil
+	}(); err != nil {
+		return
+	}
 
 	// wait all operations done before closing the underlying file, or they'll fail
 	//
@@ -615,16 +697,15 @@ func (icd *icFSD) ReleaseFileHandle(handle int) (inode vfs.InodeID, inoF *os.Fil
 	//      to track down actual bug later.
 	icfh.opc.Wait()
 
-	func() {
+	err = func() error {
 		icd.mu.Lock()
 		defer icd.mu.Unlock()
 
-		// locked icd.mu again, check we are still good
+		// locked icd.mu again, check we are still good, a concurrent release of the
+		// same handle may have won
 		icfh = icd.fileHandles[handle]
 		if icfh.isi != isi || icfh.inode != inode || icfh.f != inoF {
-			glog.Fatalf("FH [%v] changed %v#[%v](%v) => %v#[%v](%v) ?!",
-				handle, isi, inode, inoF, icfh.isi, icfh.inode, icfh.f)
-			return
+			return vfs.EBADF
 		}
 
 		// remove this handle from it's inode's file handle list
@@ -636,6 +717,7 @@ func (icd *icFSD) ReleaseFileHandle(handle int) (inode vfs.InodeID, inoF *os.Fil
 		} else { // being the list head, modify ici pointer
 			ici := &icd.stoInodes[icfh.isi]
 			ici.fhHead = icfh.nextFH
+			icd.lruUpdate(icfh.isi)
 		}
 
 		// fill fields with zero values
@@ -645,8 +727,9 @@ func (icd *icFSD) ReleaseFileHandle(handle int) (inode vfs.InodeID, inoF *os.Fil
 
 		if glog.V(2) {
 			glog.Infof("FH release ready file handle %d for [%d] [%s]:[%s]", handle, inode,
-				jdfsRootPath, inoF.Name())
+				icd.root.path, inoF.Name())
 		}
+		return nil
 	}()
 
 	return
@@ -17,9 +17,18 @@ type iMeta struct {
 
 	dev   int64
 	inode vfs.InodeID
+	gen   vfs.GenerationNumber
 	attrs vfs.InodeAttributes
 }
 
+// fi2im converts local file info to inode meta data, with the inode number mapped
+// to FUSE inode ID if nested filesystems are exposed.
+func (r *mountedRoot) fi2im(jdfPath string, fi os.FileInfo) iMeta {
+	im := localMeta(jdfPath, fi)
+	r.mapInode(&im)
+	return im
+}
+
 func (im iMeta) childPath(name string) string {
 	if len(im.jdfPath) > 0 && im.jdfPath != "." {
 		return fmt.Sprintf("%s/%s", im.jdfPath, name)
@@ -28,34 +37,35 @@ func (im iMeta) childPath(name string) string {
 	return name
 }
 
-func statFileHandle(icfh icfHandle) (inoM iMeta, err error) {
+func (r *mountedRoot) statFileHandle(icfh icfHandle) (inoM iMeta, err error) {
 	var inoFI os.FileInfo
 	jdfPath := icfh.f.Name()
 	if inoFI, err = icfh.f.Stat(); err != nil {
-		glog.Fatalf("stat error through open file handle on [%s]:[%s] - %+v",
-			jdfsRootPath, jdfPath, errors.RichError(err))
+		glog.Errorf("stat error through open file handle on [%s]:[%s] - %+v",
+			r.path, jdfPath, errors.RichError(err))
+		return
 	}
-	if im := fi2im(jdfPath, inoFI); im.inode != icfh.inode {
-		glog.Fatalf("opened inode [%d] [%s]:[%s] changed to [%d] ?!",
-			icfh.inode, jdfsRootPath, jdfPath, im.inode)
+	if im := r.fi2im(jdfPath, inoFI); im.inode != icfh.inode {
+		glog.Errorf("opened inode [%d] [%s]:[%s] changed to [%d] ?!",
+			icfh.inode, r.path, jdfPath, im.inode)
+		err = vfs.EIO
 	} else {
 		inoM = im
 	}
 	return
 }
 
-func statInode(inode vfs.InodeID, reachedThrough []string) (
+func (r *mountedRoot) statInode(inode vfs.InodeID, reachedThrough []string) (
 	inoM iMeta, outdatedPaths []string, err error) {
 	ok := false
 
 	for iPath := len(reachedThrough) - 1; iPath >= 0; //
 	outdatedPaths, iPath = append(outdatedPaths, reachedThrough[iPath]), iPath-1 {
-		// jdfs process has jdfRootDir as pwd, so just use the relative jdfPath
 		jdfPath := reachedThrough[iPath]
 		var inoFI os.FileInfo
-		if inoFI, err = os.Lstat(jdfPath); err != nil {
+		if inoFI, err = r.lstat(jdfPath); err != nil {
 			glog.V(1).Infof("UNREACH inode [%d] not at [%s]:[%s] anymore - %+v",
-				inode, jdfsRootPath, jdfPath, err)
+				inode, r.path, jdfPath, err)
 			continue
 		}
 
@@ -68,31 +78,31 @@ func statInode(inode vfs.InodeID, reachedThrough []string) (
 		} else {
 			// a file not reigned by JDFS
 			glog.V(1).Infof("OUTLAW inode [%d] [%s]:[%s] with file mode [%#o] not revealed to jdfc.",
-				inode, jdfsRootPath, jdfPath, inoFI.Mode())
+				inode, r.path, jdfPath, inoFI.Mode())
 			continue
 		}
 
-		if im := fi2im(jdfPath, inoFI); im.inode != inode {
-			if inode == vfs.RootInodeID && im.inode == jdfRootInode {
+		if im := r.fi2im(jdfPath, inoFI); !r.revealInode(&im) {
+			glog.V(1).Infof("OUTLAW inode [%d] [%s]:[%s] not on same local fs, not revealed to jdfc.",
+				inode, r.path, jdfPath)
+			continue
+		} else if im.inode != inode {
+			if inode == vfs.RootInodeID && im.inode == r.inode {
 				// fake mounted JDFS root inode to be constant 1
 				im.inode = vfs.RootInodeID
 				inoM = im
 				ok = true
 			} else {
 				glog.V(1).Infof("ICHG [%s]:[%s] is inode [%d] instead of [%d] now.",
-					jdfsRootPath, jdfPath, im.inode, inode)
+					r.path, jdfPath, im.inode, inode)
 				continue
 			}
-		} else if im.dev != jdfRootDevice {
-			glog.V(1).Infof("OUTLAW inode [%d] [%s]:[%s] not on same local fs, not revealed to jdfc.",
-				inode, jdfsRootPath, jdfPath)
-			continue
 		} else {
 			inoM = im
 			ok = true
 
 			if glog.V(2) {
-				glog.Infof("STAT [%d] [%s]:[%s] nlink=%d, size=%d", im.inode, jdfsRootPath, jdfPath,
+				glog.Infof("STAT [%d] [%s]:[%s] nlink=%d, size=%d", im.inode, r.path, jdfPath,
 					im.attrs.Nlink, im.attrs.Size)
 			}
 		}
@@ -110,24 +120,15 @@ func statInode(inode vfs.InodeID, reachedThrough []string) (
 	return
 }
 
-func readInodeDir(parentM iMeta) (childMs []iMeta, err error) {
-	var (
-		parentDir *os.File
-		childFIs  []os.FileInfo
-		childM    iMeta
-	)
-
+// readDirBatch reads at most n more children of a dir from local fs, through
+// the dir file opened, err is io.EOF if no more to read.
+//
+// children not reigned by JDFS are left out, so the batch can be empty even
+// not at end of the dir.
+func (r *mountedRoot) readDirBatch(parentM iMeta, parentDir *os.File, n int) (childMs []iMeta, err error) {
+	var childFIs []os.FileInfo
 	parentPath := parentM.jdfPath
-	parentDir, err = os.OpenFile(parentPath, os.O_RDONLY, 0)
-	if err != nil {
-		return
-	}
-	defer parentDir.Close()
-
-	// TODO should either prevent extremely large directories, or implement out-of-core
-	//      handling of them, to prefetch huge amount of child inodes in-core may
-	//      overload the jdfs host or even crash it.
-	if childFIs, err = parentDir.Readdir(0); err != nil {
+	if childFIs, err = readDir(parentDir, n); err != nil {
 		return
 	}
 	if len(childFIs) > 0 {
@@ -143,23 +144,26 @@ func readInodeDir(parentM iMeta) (childMs []iMeta, err error) {
 		} else {
 			// a file not reigned by JDFS
 			glog.V(1).Infof("OUTLAW [%s]:[%s]/[%s] with file mode [%#o] not revealed to jdfc.",
-				jdfsRootPath, parentPath, childFI.Name(), childFI.Mode())
+				r.path, parentPath, childFI.Name(), childFI.Mode())
 			continue
 		}
 
-		childM = fi2im(parentM.childPath(childFI.Name()), childFI)
+		childM := r.fi2im(parentM.childPath(childFI.Name()), childFI)
 		if glog.V(2) {
-			glog.Infof("LS [%s]:[%s]/[%s] is inode [%v]:[%v]", jdfsRootPath, parentPath, childFI.Name(),
+			glog.Infof("LS [%s]:[%s]/[%s] is inode [%v]:[%v]", r.path, parentPath, childFI.Name(),
 				childM.dev, childM.inode)
 		}
 
-		if childM.dev != jdfRootDevice {
+		if !r.revealInode(&childM) {
 			if glog.V(1) {
 				glog.Infof("OUTLAW [%d] [%s]:[%s]/[%s] not on same local fs, not revealed to jdfc.",
-					childM.inode, jdfsRootPath, parentPath, childFI.Name())
+					childM.inode, r.path, parentPath, childFI.Name())
 			}
 			continue
 		}
+		if childM.dev != parentM.dev {
+			r.crossMount(&childM)
+		}
 
 		childMs = append(childMs, childM)
 	}
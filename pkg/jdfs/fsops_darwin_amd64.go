@@ -1,6 +1,7 @@
 package jdfs
 
 import (
+	"io"
 	"os"
 	"syscall"
 
@@ -28,7 +29,16 @@ func statFS(rootDir *os.File) (op vfs.StatFSOp, err error) {
 	return
 }
 
-func fi2im(jdfPath string, fi os.FileInfo) iMeta {
+// fsID identifies the local filesystem an absolute path is on.
+func fsID(path string) (uint64, error) {
+	var fsStat unix.Statfs_t
+	if err := unix.Statfs(path, &fsStat); err != nil {
+		return 0, err
+	}
+	return uint64(uint32(fsStat.Fsid.Val[0]))<<32 | uint64(uint32(fsStat.Fsid.Val[1])), nil
+}
+
+func localMeta(jdfPath string, fi os.FileInfo) iMeta {
 	sd, ok := fi.Sys().(*syscall.Stat_t)
 	if !ok {
 		panic(errors.Errorf("Incompatible local file: [%s]", fi.Name))
@@ -50,7 +60,11 @@ func fi2im(jdfPath string, fi os.FileInfo) iMeta {
 	}
 }
 
-func chftimes(f *os.File, jdfPath string, nsec int64) error {
+func statMtime(sd *syscall.Stat_t) int64 {
+	return ts2t(sd.Mtimespec)
+}
+
+func chftimes(f *os.File, path string, nsec int64) error {
 	t := syscall.NsecToTimeval(nsec)
 	return syscall.Futimes(int(f.Fd()), []syscall.Timeval{
 		t, t,
@@ -67,8 +81,8 @@ func fremovexattr(fd int, name string) error {
 	return err
 }
 
-func removexattr(jdfPath, name string) error {
-	err := unix.Removexattr(jdfPath, name)
+func removexattr(path, name string) error {
+	err := unix.Removexattr(path, name)
 	switch err {
 	case syscall.ENOATTR: // macOS has real ENOATTR,
 		// vfs uses ENODATA for compatibility with Linux
@@ -87,8 +101,8 @@ func fgetxattr(fd int, name string, buf []byte) (int, error) {
 	return n, err
 }
 
-func getxattr(jdfPath, name string, buf []byte) (int, error) {
-	n, err := unix.Getxattr(jdfPath, name, buf)
+func getxattr(path, name string, buf []byte) (int, error) {
+	n, err := unix.Getxattr(path, name, buf)
 	switch err {
 	case syscall.ENOATTR: // macOS has real ENOATTR,
 		// vfs uses ENODATA for compatibility with Linux
@@ -107,8 +121,8 @@ func flistxattr(fd int, buf []byte) (int, error) {
 	return n, err
 }
 
-func listxattr(jdfPath string, buf []byte) (int, error) {
-	n, err := unix.Llistxattr(jdfPath, buf)
+func listxattr(path string, buf []byte) (int, error) {
+	n, err := unix.Llistxattr(path, buf)
 	switch err {
 	case syscall.ENOATTR: // macOS has real ENOATTR,
 		// vfs uses ENODATA for compatibility with Linux
@@ -127,8 +141,8 @@ func fsetxattr(fd int, name string, buf []byte, flags int) error {
 	return err
 }
 
-func setxattr(jdfPath, name string, buf []byte, flags int) error {
-	err := unix.Setxattr(jdfPath, name, buf, flags)
+func setxattr(path, name string, buf []byte, flags int) error {
+	err := unix.Setxattr(path, name, buf, flags)
 	switch err {
 	case syscall.ENOATTR: // macOS has real ENOATTR,
 		// vfs uses ENODATA for compatibility with Linux
@@ -136,3 +150,99 @@ func setxattr(jdfPath, name string, buf []byte, flags int) error {
 	}
 	return err
 }
+
+// getLock is not supported on macOS, it has no OFD locks, and POSIX locks held
+// by jdfs itself won't conflict among jdfc.
+func getLock(f *os.File, lk *vfs.FileLock) error {
+	return vfs.ENOSYS
+}
+
+// setLock is not supported on macOS, see getLock.
+func setLock(f *os.File, lk vfs.FileLock) error {
+	return vfs.ENOSYS
+}
+
+// flockFile sets a flock(2) lock of lt on the file without waiting, fails with
+// vfs.EAGAIN on conflict.
+func flockFile(f *os.File, lt vfs.LockType) error {
+	how := unix.LOCK_UN
+	switch lt {
+	case vfs.LockRead:
+		how = unix.LOCK_SH | unix.LOCK_NB
+	case vfs.LockWrite:
+		how = unix.LOCK_EX | unix.LOCK_NB
+	}
+	err := unix.Flock(int(f.Fd()), how)
+	if err == unix.EWOULDBLOCK {
+		err = vfs.EAGAIN
+	}
+	return err
+}
+
+// local whence of lseek(2) for vfs.SeekData/vfs.SeekHole
+const (
+	seekData = unix.SEEK_DATA
+	seekHole = unix.SEEK_HOLE
+)
+
+// fallocate is not supported on macOS, its F_PREALLOCATE can't punch holes or
+// zero ranges.
+func fallocate(f *os.File, mode uint32, off, len int64) error {
+	return vfs.EOPNOTSUPP
+}
+
+// copyFileRange always fails with vfs.EOPNOTSUPP, for a chunked copy to be done.
+func copyFileRange(fIn *os.File, offIn int64, fOut *os.File, offOut int64, len int) (int, error) {
+	return 0, vfs.EOPNOTSUPP
+}
+
+// preadv reads into iovs from off of f, one after another, x/sys/unix has no
+// preadv(2) for macOS. 0 with no error is returned at end of file, as preadv(2) does.
+func preadv(f *os.File, iovs [][]byte, off int64) (n int, err error) {
+	for _, iov := range iovs {
+		var nr int
+		nr, err = f.ReadAt(iov, off+int64(n))
+		n += nr
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+	}
+	return
+}
+
+// pwritev writes iovs to off of f, one after another, see preadv.
+func pwritev(f *os.File, iovs [][]byte, off int64) (n int, err error) {
+	for _, iov := range iovs {
+		var nw int
+		nw, err = f.WriteAt(iov, off+int64(n))
+		n += nw
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// symlinkat creates a symlink against the root, with symlinkat(2).
+func symlinkat(r *mountedRoot, target, jdfPath string) error {
+	return r.inParent(jdfPath, func(dirfd int, name string) error {
+		return unix.Symlinkat(target, dirfd, name)
+	})
+}
+
+// linkat creates a hard link against the root, with linkat(2).
+func linkat(r *mountedRoot, oldPath, newPath string) error {
+	return r.inParent(oldPath, func(oldDirFD int, oldName string) error {
+		return r.inParent(newPath, func(newDirFD int, newName string) error {
+			return unix.Linkat(oldDirFD, oldName, newDirFD, newName, 0)
+		})
+	})
+}
+
+// readlinkat reads a symlink against the root, with readlinkat(2).
+func readlinkat(r *mountedRoot, jdfPath string, buf []byte) (int, error) {
+	return unix.Readlinkat(r.fd, jdfPath, buf)
+}
@@ -28,7 +28,16 @@ func statFS(rootDir *os.File) (op vfs.StatFSOp, err error) {
 	return
 }
 
-func fi2im(jdfPath string, fi os.FileInfo) iMeta {
+// fsID identifies the local filesystem an absolute path is on.
+func fsID(path string) (uint64, error) {
+	var fsStat unix.Statfs_t
+	if err := unix.Statfs(path, &fsStat); err != nil {
+		return 0, err
+	}
+	return uint64(uint32(fsStat.Fsid.Val[0]))<<32 | uint64(uint32(fsStat.Fsid.Val[1])), nil
+}
+
+func localMeta(jdfPath string, fi os.FileInfo) iMeta {
 	sd, ok := fi.Sys().(*syscall.Stat_t)
 	if !ok {
 		panic(errors.Errorf("Incompatible local file: [%s]", fi.Name))
@@ -51,7 +60,11 @@ func fi2im(jdfPath string, fi os.FileInfo) iMeta {
 	}
 }
 
-func chftimes(f *os.File, jdfPath string, nsec int64) error {
+func statMtime(sd *syscall.Stat_t) int64 {
+	return ts2t(sd.Mtim)
+}
+
+func chftimes(f *os.File, path string, nsec int64) error {
 	t := syscall.NsecToTimeval(nsec)
 	return syscall.Futimes(int(f.Fd()), []syscall.Timeval{
 		t, t,
@@ -62,30 +75,123 @@ func fremovexattr(fd int, name string) error {
 	return unix.Fremovexattr(fd, name)
 }
 
-func removexattr(jdfPath, name string) error {
-	return unix.Removexattr(jdfPath, name)
+func removexattr(path, name string) error {
+	return unix.Removexattr(path, name)
 }
 
 func fgetxattr(fd int, name string, buf []byte) (int, error) {
 	return unix.Fgetxattr(fd, name, buf)
 }
 
-func getxattr(jdfPath, name string, buf []byte) (int, error) {
-	return unix.Getxattr(jdfPath, name, buf)
+func getxattr(path, name string, buf []byte) (int, error) {
+	return unix.Getxattr(path, name, buf)
 }
 
 func flistxattr(fd int, buf []byte) (int, error) {
 	return unix.Flistxattr(fd, buf)
 }
 
-func listxattr(jdfPath string, buf []byte) (int, error) {
-	return unix.Llistxattr(jdfPath, buf)
+func listxattr(path string, buf []byte) (int, error) {
+	return unix.Llistxattr(path, buf)
 }
 
 func fsetxattr(fd int, name string, buf []byte, flags int) error {
 	return unix.Fsetxattr(fd, name, buf, flags)
 }
 
-func setxattr(jdfPath, name string, buf []byte, flags int) error {
-	return unix.Setxattr(jdfPath, name, buf, flags)
+func setxattr(path, name string, buf []byte, flags int) error {
+	return unix.Setxattr(path, name, buf, flags)
+}
+
+// getLock tests lk against OFD locks held on the file, lk is set to the
+// conflicting lock or with Type vfs.LockUnlock if there's none.
+func getLock(f *os.File, lk *vfs.FileLock) error {
+	flk := lk2flk(*lk)
+	if err := unix.FcntlFlock(f.Fd(), unix.F_OFD_GETLK, &flk); err != nil {
+		return err
+	}
+	*lk = flk2lk(flk)
+	return nil
+}
+
+// setLock sets lk as an OFD lock on the file without waiting, fails with
+// vfs.EAGAIN on conflict.
+func setLock(f *os.File, lk vfs.FileLock) error {
+	flk := lk2flk(lk)
+	err := unix.FcntlFlock(f.Fd(), unix.F_OFD_SETLK, &flk)
+	switch err {
+	case unix.EAGAIN, unix.EACCES:
+		err = vfs.EAGAIN
+	}
+	return err
+}
+
+// flockFile sets a flock(2) lock of lt on the file without waiting, fails with
+// vfs.EAGAIN on conflict.
+func flockFile(f *os.File, lt vfs.LockType) error {
+	how := unix.LOCK_UN
+	switch lt {
+	case vfs.LockRead:
+		how = unix.LOCK_SH | unix.LOCK_NB
+	case vfs.LockWrite:
+		how = unix.LOCK_EX | unix.LOCK_NB
+	}
+	err := unix.Flock(int(f.Fd()), how)
+	if err == unix.EWOULDBLOCK {
+		err = vfs.EAGAIN
+	}
+	return err
+}
+
+// local whence of lseek(2) for vfs.SeekData/vfs.SeekHole
+const (
+	seekData = unix.SEEK_DATA
+	seekHole = unix.SEEK_HOLE
+)
+
+func fallocate(f *os.File, mode uint32, off, len int64) error {
+	return unix.Fallocate(int(f.Fd()), mode, off, len)
+}
+
+// copyFileRange copies with copy_file_range(2), which reflinks where the fs
+// supports that, fails with vfs.EOPNOTSUPP if a chunked copy is needed instead.
+func copyFileRange(fIn *os.File, offIn int64, fOut *os.File, offOut int64, len int) (int, error) {
+	n, err := unix.CopyFileRange(int(fIn.Fd()), &offIn, int(fOut.Fd()), &offOut, len, 0)
+	switch err {
+	case unix.ENOSYS, unix.EXDEV, unix.EOPNOTSUPP, unix.EINVAL:
+		// old kernels, cross fs copies, or filesystems not supporting it
+		err = vfs.EOPNOTSUPP
+	}
+	return n, err
+}
+
+// preadv reads into iovs from off of f, with a single preadv(2).
+func preadv(f *os.File, iovs [][]byte, off int64) (int, error) {
+	return unix.Preadv(int(f.Fd()), iovs, off)
+}
+
+// pwritev writes iovs to off of f, with a single pwritev(2).
+func pwritev(f *os.File, iovs [][]byte, off int64) (int, error) {
+	return unix.Pwritev(int(f.Fd()), iovs, off)
+}
+
+// symlinkat creates a symlink against the root, with symlinkat(2).
+func symlinkat(r *mountedRoot, target, jdfPath string) error {
+	return r.inParent(jdfPath, func(dirfd int, name string) error {
+		return unix.Symlinkat(target, dirfd, name)
+	})
+}
+
+// linkat creates a hard link against the root, with linkat(2).
+func linkat(r *mountedRoot, oldPath, newPath string) error {
+	return r.inParent(oldPath, func(oldDirFD int, oldName string) error {
+		return r.inParent(newPath, func(newDirFD int, newName string) error {
+			return unix.Linkat(oldDirFD, oldName, newDirFD, newName, 0)
+		})
+	})
+}
+
+// readlinkat reads a symlink against the root, with readlinkat(2).
+func readlinkat(r *mountedRoot, jdfPath string, buf []byte) (int, error) {
+	return unix.Readlinkat(r.fd, jdfPath, buf)
 }
@@ -1,6 +1,7 @@
 package jdfs
 
 import (
+	"io"
 	"os"
 	"syscall"
 
@@ -27,7 +28,16 @@ func statFS(rootDir *os.File) (op vfs.StatFSOp, err error) {
 	return
 }
 
-func fi2im(jdfPath string, fi os.FileInfo) iMeta {
+// fsID identifies the local filesystem an absolute path is on.
+func fsID(path string) (uint64, error) {
+	var fsStat unix.Statvfs_t
+	if err := unix.Statvfs(path, &fsStat); err != nil {
+		return 0, err
+	}
+	return fsStat.Fsid, nil
+}
+
+func localMeta(jdfPath string, fi os.FileInfo) iMeta {
 	sd, ok := fi.Sys().(*syscall.Stat_t)
 	if !ok {
 		panic(errors.Errorf("Incompatible local file: [%s]", fi.Name))
@@ -49,11 +59,15 @@ func fi2im(jdfPath string, fi os.FileInfo) iMeta {
 	}
 }
 
-func chftimes(f *os.File, jdfPath string, nsec int64) error {
+func statMtime(sd *syscall.Stat_t) int64 {
+	return ts2t(sd.Mtim)
+}
+
+func chftimes(f *os.File, path string, nsec int64) error {
 	t := syscall.Timespec{
 		Sec: nsec / 1e9, Nsec: nsec % 1e9,
 	}
-	return syscall.UtimesNano(jdfPath, []syscall.Timespec{
+	return syscall.UtimesNano(path, []syscall.Timespec{
 		t, t,
 	})
 }
@@ -67,7 +81,7 @@ func fremovexattr(fd int, name string) error {
 	return vfs.ENOATTR
 }
 
-func removexattr(jdfPath, name string) error {
+func removexattr(path, name string) error {
 	return vfs.ENOATTR
 }
 
@@ -75,7 +89,7 @@ func fgetxattr(fd int, name string, buf []byte) (int, error) {
 	return 0, vfs.ENOATTR
 }
 
-func getxattr(jdfPath, name string, buf []byte) (int, error) {
+func getxattr(path, name string, buf []byte) (int, error) {
 	return 0, vfs.ENOATTR
 }
 
@@ -83,7 +97,7 @@ func flistxattr(fd int, buf []byte) (int, error) {
 	return 0, nil
 }
 
-func listxattr(jdfPath string, buf []byte) (int, error) {
+func listxattr(path string, buf []byte) (int, error) {
 	return 0, nil
 }
 
@@ -91,6 +105,111 @@ func fsetxattr(fd int, name string, buf []byte, flags int) error {
 	return vfs.ENOSPC
 }
 
-func setxattr(jdfPath, name string, buf []byte, flags int) error {
+func setxattr(path, name string, buf []byte, flags int) error {
 	return vfs.ENOSPC
 }
+
+// getLock tests lk against OFD locks held on the file, lk is set to the
+// conflicting lock or with Type vfs.LockUnlock if there's none.
+func getLock(f *os.File, lk *vfs.FileLock) error {
+	flk := lk2flk(*lk)
+	if err := unix.FcntlFlock(f.Fd(), unix.F_OFD_GETLK, &flk); err != nil {
+		return err
+	}
+	*lk = flk2lk(flk)
+	return nil
+}
+
+// setLock sets lk as an OFD lock on the file without waiting, fails with
+// vfs.EAGAIN on conflict.
+func setLock(f *os.File, lk vfs.FileLock) error {
+	flk := lk2flk(lk)
+	err := unix.FcntlFlock(f.Fd(), unix.F_OFD_SETLK, &flk)
+	switch err {
+	case unix.EAGAIN, unix.EACCES:
+		err = vfs.EAGAIN
+	}
+	return err
+}
+
+// flockFile sets a flock(2) lock of lt on the file without waiting, fails with
+// vfs.EAGAIN on conflict.
+func flockFile(f *os.File, lt vfs.LockType) error {
+	how := unix.LOCK_UN
+	switch lt {
+	case vfs.LockRead:
+		how = unix.LOCK_SH | unix.LOCK_NB
+	case vfs.LockWrite:
+		how = unix.LOCK_EX | unix.LOCK_NB
+	}
+	err := unix.Flock(int(f.Fd()), how)
+	if err == unix.EWOULDBLOCK {
+		err = vfs.EAGAIN
+	}
+	return err
+}
+
+// local whence of lseek(2) for vfs.SeekData/vfs.SeekHole, not defined by
+// x/sys/unix for solaris
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// fallocate is not supported on solaris.
+func fallocate(f *os.File, mode uint32, off, len int64) error {
+	return vfs.EOPNOTSUPP
+}
+
+// copyFileRange always fails with vfs.EOPNOTSUPP, for a chunked copy to be done.
+func copyFileRange(fIn *os.File, offIn int64, fOut *os.File, offOut int64, len int) (int, error) {
+	return 0, vfs.EOPNOTSUPP
+}
+
+// preadv reads into iovs from off of f, one after another, x/sys/unix has no
+// preadv(2) for solaris. 0 with no error is returned at end of file, as preadv(2) does.
+func preadv(f *os.File, iovs [][]byte, off int64) (n int, err error) {
+	for _, iov := range iovs {
+		var nr int
+		nr, err = f.ReadAt(iov, off+int64(n))
+		n += nr
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+	}
+	return
+}
+
+// pwritev writes iovs to off of f, one after another, see preadv.
+func pwritev(f *os.File, iovs [][]byte, off int64) (n int, err error) {
+	for _, iov := range iovs {
+		var nw int
+		nw, err = f.WriteAt(iov, off+int64(n))
+		n += nw
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// x/sys/unix has no symlinkat/linkat/readlinkat for solaris, they are done with
+// absolute paths under the root instead.
+
+// symlinkat creates a symlink under the root.
+func symlinkat(r *mountedRoot, target, jdfPath string) error {
+	return unix.Symlink(target, r.abs(jdfPath))
+}
+
+// linkat creates a hard link under the root.
+func linkat(r *mountedRoot, oldPath, newPath string) error {
+	return unix.Link(r.abs(oldPath), r.abs(newPath))
+}
+
+// readlinkat reads a symlink under the root.
+func readlinkat(r *mountedRoot, jdfPath string, buf []byte) (int, error) {
+	return unix.Readlink(r.abs(jdfPath), buf)
+}
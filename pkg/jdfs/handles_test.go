@@ -0,0 +1,84 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package jdfs
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/complyue/jdfs/pkg/vfs"
+)
+
+// notify sends code to a method replying nothing.
+func (w *testWire) notify(code string) {
+	co, err := w.po.NewCo(nil)
+	if err != nil {
+		w.t.Fatal(err)
+	}
+	defer co.Close()
+	if err = co.SendCode(code); err != nil {
+		w.t.Fatal(err)
+	}
+}
+
+func TestBadHandles(t *testing.T) {
+	te := newTestExport(t)
+	defer te.close()
+
+	w := te.dial(t)
+	defer w.close()
+	if err := w.mount(false, "/"); err != nil {
+		t.Fatalf("failed mounting export root - %v", err)
+	}
+
+	insideIno := w.lookUp(vfs.RootInodeID, "inside")
+	okIno := w.lookUp(insideIno, "ok"+testDataExt)
+
+	// released twice
+	fh := w.openFile(okIno)
+	dfh, _ := w.openJDF("inside/ok")
+	for i := 0; i < 2; i++ {
+		w.notify(fmt.Sprintf(`ReleaseFileHandle(%d)`, fh))
+		w.notify(fmt.Sprintf(`CloseJDF(%d, %d)`, dfh.Handle, dfh.Inode))
+	}
+
+	for _, handle := range []int{-1, 0, 999} {
+		w.notify(fmt.Sprintf(`ReleaseFileHandle(%d)`, handle))
+		w.notify(fmt.Sprintf(`ReleaseDirHandle(%d)`, handle))
+		w.notify(fmt.Sprintf(`CloseJDF(%d, %d)`, handle, dfh.Inode))
+
+		for _, op := range []struct {
+			code string
+			args []interface{}
+		}{
+			{code: fmt.Sprintf(`ReadDir(%d, %d, %d, %d)`, insideIno, handle, 0, 4096)},
+			{code: fmt.Sprintf(`ReadFile(%d, %d, %d, %d)`, okIno, handle, 0, 4)},
+			{code: fmt.Sprintf(`SyncFile(%d, %d)`, okIno, handle)},
+			{code: fmt.Sprintf(`Lseek(%d, %d, %d, %d)`, okIno, handle, 0, 0)},
+			{code: fmt.Sprintf(`ReadJDF(%d, %d, %d, %d)`, handle, dfh.Inode, 0, 4)},
+			{code: fmt.Sprintf(`WriteJDF(%d, %d, %d, %d)`, handle, dfh.Inode, 0, 4),
+				args: []interface{}{[]byte("HDR!")}},
+			{code: fmt.Sprintf(`SyncJDF(%d, %d)`, handle, dfh.Inode)},
+		} {
+			if fse := w.fsErr(op.code, op.args...); fse != vfs.EBADF && fse != vfs.ENOENT {
+				t.Errorf("%s got %s", op.code, fse.Repr())
+			}
+		}
+	}
+
+	// a data file handle reused by another inode
+	dfh, _ = w.openJDF("inside/ok")
+	if fse := w.fsErr(fmt.Sprintf(`SyncJDF(%d, %d)`, dfh.Handle, dfh.Inode+1)); fse != vfs.EINVAL {
+		t.Errorf("SyncJDF with mismatched inode got %s", fse.Repr())
+	}
+	w.notify(fmt.Sprintf(`CloseJDF(%d, %d)`, dfh.Handle, dfh.Inode+1))
+
+	// still serving this wire
+	if fse := w.fsErr(fmt.Sprintf(`SyncJDF(%d, %d)`, dfh.Handle, dfh.Inode)); fse != 0 {
+		t.Errorf("SyncJDF got %s", fse.Repr())
+	}
+	if w.po.Disconnected() {
+		t.Fatalf("disconnected by bad handles")
+	}
+}
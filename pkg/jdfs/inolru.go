@@ -0,0 +1,159 @@
+package jdfs
+
+import (
+	"flag"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// in-core inode records not referenced by FUSE, nor held open by any dir/file handle,
+// are kept as cache for fast stating, in a LRU list, and evicted from its tail once
+// the number of in-core inodes exceeds -max-inodes.
+//
+// an evicted inode is reloaded by stating local fs next time it's reached through a
+// path, inodes referenced by FUSE are never evicted, so jdfc can always resolve them
+// via their reachedThrough paths, the same way as before eviction was introduced.
+
+var (
+	// max number of inodes kept in-core, 0 for unlimited
+	maxInodes int
+)
+
+func init() {
+	flag.IntVar(&maxInodes, "max-inodes", 1000000,
+		"max `number` of inodes kept in-core, unreferenced ones beyond this are evicted LRU, 0 for unlimited")
+}
+
+// interval to log in-core inode stats, while inodes are being evicted
+const inodeStatsInterval = time.Minute
+
+// counters of the in-core inode table
+type icInodeStats struct {
+	// lookups of in-core inodes, found and not found
+	hits, misses uint64
+
+	// unreferenced inodes evicted
+	evicts uint64
+}
+
+// lruEvictable tells whether an in-core inode is neither referenced by FUSE, nor held
+// open by any dir/file handle.
+//
+// must have icd.mu locked
+func (icd *icFSD) lruEvictable(isi int) bool {
+	if isi == 0 {
+		return false // root is never evicted
+	}
+	ici := &icd.stoInodes[isi]
+	return ici.refcnt <= 0 && ici.fhHead <= 0 && ici.dhCnt <= 0
+}
+
+// lruUpdate moves an in-core inode to the head of the LRU list if it's evictable,
+// or removes it from the list otherwise.
+//
+// must have icd.mu locked
+func (icd *icFSD) lruUpdate(isi int) {
+	icd.lruRemove(isi)
+	if !icd.lruEvictable(isi) {
+		return
+	}
+
+	ici := &icd.stoInodes[isi]
+	ici.inLRU = true
+	ici.lruPrev, ici.lruNext = 0, icd.lruHead
+	if icd.lruHead > 0 {
+		icd.stoInodes[icd.lruHead].lruPrev = isi
+	} else {
+		icd.lruTail = isi
+	}
+	icd.lruHead = isi
+}
+
+// lruRemove removes an in-core inode from the LRU list, if it's there.
+//
+// must have icd.mu locked
+func (icd *icFSD) lruRemove(isi int) {
+	ici := &icd.stoInodes[isi]
+	if !ici.inLRU {
+		return
+	}
+
+	if ici.lruPrev > 0 {
+		icd.stoInodes[ici.lruPrev].lruNext = ici.lruNext
+	} else {
+		icd.lruHead = ici.lruNext
+	}
+	if ici.lruNext > 0 {
+		icd.stoInodes[ici.lruNext].lruPrev = ici.lruPrev
+	} else {
+		icd.lruTail = ici.lruPrev
+	}
+	ici.inLRU, ici.lruPrev, ici.lruNext = false, 0, 0
+}
+
+// dropInode removes an in-core inode record, and frees its storage for reuse.
+//
+// must have icd.mu locked
+func (icd *icFSD) dropInode(isi int) {
+	icd.lruRemove(isi)
+
+	ici := &icd.stoInodes[isi]
+	if ici.attrs.Mode.IsDir() {
+		icd.watcher.unwatchDir(ici.inode)
+	}
+
+	delete(icd.regInodes, ici.inode)
+	icd.stoInodes[isi] = icInode{} // fill all fields with zero values
+	icd.freeInoIdxs = append(icd.freeInoIdxs, isi)
+}
+
+// evictInodes evicts least recently used inodes from in-core, until their number is
+// within maxInodes, or no more evictable. the inode at keepIsi is never evicted, as
+// it's just loaded for use by the caller.
+//
+// must have icd.mu locked
+func (icd *icFSD) evictInodes(keepIsi int) {
+	if maxInodes <= 0 {
+		return
+	}
+
+	for len(icd.regInodes) > maxInodes && icd.lruTail > 0 && icd.lruTail != keepIsi {
+		isi := icd.lruTail
+		if glog.V(2) {
+			ici := &icd.stoInodes[isi]
+			glog.Infof("LRU evicting inode [%d] reached through %v", ici.inode, ici.reachedThrough)
+		}
+		icd.dropInode(isi)
+		icd.stats.evicts++
+	}
+
+	icd.logInodeStats()
+}
+
+// logInodeStats logs counters of the in-core inode table, if inodes have been evicted
+// and not logged within inodeStatsInterval.
+//
+// must have icd.mu locked
+func (icd *icFSD) logInodeStats() {
+	now := time.Now()
+	if icd.statsLoggedTime.IsZero() {
+		icd.statsLoggedTime = now
+	}
+	st, lst := icd.stats, icd.statsLogged
+	if st.evicts == lst.evicts || now.Sub(icd.statsLoggedTime) < inodeStatsInterval {
+		return
+	}
+
+	hits, misses, evicts := st.hits-lst.hits, st.misses-lst.misses, st.evicts-lst.evicts
+	hitRate := 100.0
+	if hits+misses > 0 {
+		hitRate = 100.0 * float64(hits) / float64(hits+misses)
+	}
+	evictRate := float64(evicts) / now.Sub(icd.statsLoggedTime).Seconds()
+
+	glog.Infof("In-core inodes %d/%d, hits %d misses %d (%.1f%% hit), evicted %d (%.1f/s), total evicted %d",
+		len(icd.regInodes), maxInodes, hits, misses, hitRate, evicts, evictRate, st.evicts)
+
+	icd.statsLogged, icd.statsLoggedTime = st, now
+}
@@ -0,0 +1,192 @@
+package jdfs
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/complyue/jdfs/pkg/vfs"
+	"github.com/golang/glog"
+
+	"golang.org/x/sys/unix"
+)
+
+// file locks requested by jdfc are taken as OFD locks (or flock(2) locks for
+// flock requests) on the fd of the jdfs file handle, so they conflict among
+// jdfc clients, as well as with local processes locking the same file at jdfs.
+//
+// as each open at jdfc gets its own jdfs file handle, locks are effectively
+// owned by open files at jdfc, the lock owner chosen by jdfc's kernel is only
+// logged at jdfs.
+
+const (
+	// initial and max interval to retry a conflicting lock, for a blocking wait
+	lockRetryMin = 5 * time.Millisecond
+	lockRetryMax = 500 * time.Millisecond
+)
+
+func (efs *exportedFileSystem) GetLock(inode vfs.InodeID, handle int, owner int64,
+	start, end int64, lt int) {
+	co := efs.ho.Co()
+
+	ctx, opDone := efs.opContext()
+	defer opDone()
+
+	lk := vfs.FileLock{Start: uint64(start), End: uint64(end), Type: vfs.LockType(lt)}
+	fsErr := func() error {
+		// do this before the underlying HBI wire released
+		icfh, err := efs.icd.GetFileHandle(inode, handle, 1)
+		if err != nil {
+			return err
+		}
+		defer efs.icd.FileHandleOpDone(icfh)
+
+		if err := co.FinishRecv(); err != nil {
+			panic(err)
+		}
+		if ctx.Err() != nil {
+			return vfs.EINTR
+		}
+
+		if err := getLock(icfh.f, &lk); err != nil {
+			glog.Errorf("Error testing lock on file [%d] [%s]:[%s] with handle %d - %+v",
+				inode, efs.root.path, icfh.f.Name(), handle, err)
+			return err
+		}
+
+		if glog.V(2) {
+			glog.Infof("GETLK %#x [%d,%d] type %d of file [%d] [%s]:[%s] with handle %d",
+				owner, lk.Start, lk.End, lk.Type, icfh.inode, efs.root.path, icfh.f.Name(), handle)
+		}
+		return nil
+	}()
+
+	if err := co.StartSend(); err != nil {
+		panic(err)
+	}
+
+	fse := vfs.FsErr(fsErr)
+	if err := co.SendObj(fse.Repr()); err != nil {
+		panic(err)
+	}
+	if fse != 0 {
+		return
+	}
+
+	if err := co.SendObj(fmt.Sprintf(`[%d,%d,%d]`,
+		lk.Type, int64(lk.Start), int64(lk.End))); err != nil {
+		panic(err)
+	}
+}
+
+// SetLock acquires, changes or releases a lock on the file of the handle.
+//
+// a blocking wait for a conflicting lock is done after the wire released, by
+// retrying with backoff, until acquired or cancelled by jdfc.
+func (efs *exportedFileSystem) SetLock(inode vfs.InodeID, handle int, owner int64,
+	start, end int64, lt int, wait, flock bool) {
+	co := efs.ho.Co()
+
+	ctx, opDone := efs.opContext()
+	defer opDone()
+
+	lk := vfs.FileLock{Start: uint64(start), End: uint64(end), Type: vfs.LockType(lt)}
+	fsErr := func() error {
+		// do this before the underlying HBI wire released
+		icfh, err := efs.icd.GetFileHandle(inode, handle, 1)
+		if err != nil {
+			return err
+		}
+		defer efs.icd.FileHandleOpDone(icfh)
+
+		if err := co.FinishRecv(); err != nil {
+			panic(err)
+		}
+
+		for retry := lockRetryMin; ; {
+			if ctx.Err() != nil {
+				return vfs.EINTR
+			}
+
+			if flock {
+				err = flockFile(icfh.f, lk.Type)
+			} else {
+				err = setLock(icfh.f, lk)
+			}
+			if err != vfs.EAGAIN || !wait {
+				break
+			}
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(retry):
+			}
+			if retry *= 2; retry > lockRetryMax {
+				retry = lockRetryMax
+			}
+		}
+		if err != nil {
+			if err != vfs.EAGAIN {
+				glog.Errorf("Error locking file [%d] [%s]:[%s] with handle %d - %+v",
+					inode, efs.root.path, icfh.f.Name(), handle, err)
+			}
+			return err
+		}
+
+		if glog.V(2) {
+			glog.Infof("SETLK %#x [%d,%d] type %d flock=%v of file [%d] [%s]:[%s] with handle %d",
+				owner, lk.Start, lk.End, lk.Type, flock, icfh.inode, efs.root.path, icfh.f.Name(), handle)
+		}
+		return nil
+	}()
+
+	if err := co.StartSend(); err != nil {
+		panic(err)
+	}
+
+	fse := vfs.FsErr(fsErr)
+	if err := co.SendObj(fse.Repr()); err != nil {
+		panic(err)
+	}
+	if fse != 0 {
+		return
+	}
+}
+
+// lk2flk converts a lock to its local fcntl(2) form, with pid 0 as required by
+// OFD locks.
+func lk2flk(lk vfs.FileLock) (flk unix.Flock_t) {
+	switch lk.Type {
+	case vfs.LockRead:
+		flk.Type = unix.F_RDLCK
+	case vfs.LockWrite:
+		flk.Type = unix.F_WRLCK
+	default:
+		flk.Type = unix.F_UNLCK
+	}
+	flk.Whence = 0 // SEEK_SET
+	flk.Start = int64(lk.Start)
+	if lk.End < vfs.OffsetMax {
+		flk.Len = int64(lk.End-lk.Start) + 1
+	} // else Len 0 locks through end of file
+	return
+}
+
+// flk2lk converts a lock from its local fcntl(2) form, the pid is not
+// meaningful to jdfc.
+func flk2lk(flk unix.Flock_t) (lk vfs.FileLock) {
+	switch flk.Type {
+	case unix.F_RDLCK:
+		lk.Type = vfs.LockRead
+	case unix.F_WRLCK:
+		lk.Type = vfs.LockWrite
+	default:
+		lk.Type = vfs.LockUnlock
+	}
+	lk.Start = uint64(flk.Start)
+	if flk.Len > 0 {
+		lk.End = uint64(flk.Start + flk.Len - 1)
+	} else {
+		lk.End = vfs.OffsetMax
+	}
+	return
+}
@@ -0,0 +1,198 @@
+package jdfs
+
+import (
+	"hash/fnv"
+	"os"
+	"sync"
+
+	"github.com/complyue/jdfs/pkg/vfs"
+	"github.com/golang/glog"
+)
+
+// nested filesystems mounted under the JDFS root are hidden to jdfc by default, as
+// inode numbers from different filesystems can collide.
+//
+// with nestedFS set by the export policy, for the whole export or per mount rule,
+// see policy.go, each local device is assigned a tag, and local inode numbers are
+// mapped to FUSE inode IDs with the tag in their high bits, the device of JDFS root
+// has tag 0 so inode IDs on it are not changed. tags are derived from hashes of the
+// devices, so inode IDs stay the same across jdfs sessions, for jdfc to resume.
+//
+// device numbers can be reused by another filesystem, after one unmounted, e.g.
+// anonymous devices of ZFS datasets, so the identity of the filesystem on a device is
+// checked where a mount point is crossed, and the generation of its tag is increased
+// once changed, which goes with inode IDs to jdfc as their generation numbers.
+
+const (
+	// bits of a FUSE inode ID for the local inode number, the rest for the device tag
+	devTagShift = 48
+	// max local inode number can be mapped
+	maxMappedIno = 1<<devTagShift - 1
+	// max device tag
+	maxDevTag = 1<<(64-devTagShift) - 1
+)
+
+// a local device, with the filesystem seen on it
+type devTag struct {
+	dev  int64
+	fsid uint64
+	gen  vfs.GenerationNumber
+}
+
+// registry of device tags, for a mounted root
+type devTags struct {
+	byDev map[int64]uint64
+	tags  map[uint64]*devTag
+
+	mu sync.Mutex
+}
+
+// reset restarts the registry of device tags, with the device of JDFS root.
+func (dts *devTags) reset(rootDev int64) {
+	dts.mu.Lock()
+	defer dts.mu.Unlock()
+
+	dts.byDev = map[int64]uint64{rootDev: 0}
+	dts.tags = map[uint64]*devTag{0: &devTag{dev: rootDev}}
+}
+
+// tagOfDev returns the tag assigned to a local device, the device is assigned a
+// new tag if seen 1st time, with jdfPath stated to identify the filesystem on it.
+//
+// must have r.nestedDevs.mu locked
+func (r *mountedRoot) tagOfDev(dev int64, jdfPath string) (tag uint64, dt *devTag, ok bool) {
+	dts := &r.nestedDevs
+	if tag, ok = dts.byDev[dev]; ok {
+		return tag, dts.tags[tag], true
+	}
+
+	fsid, err := fsID(r.abs(jdfPath))
+	if err != nil {
+		glog.Errorf("Error identifying local fs at [%s]:[%s] - %+v", r.path, jdfPath, err)
+		return 0, nil, false
+	}
+
+	h := fnv.New64a()
+	for i := uint(0); i < 64; i += 8 {
+		h.Write([]byte{byte(dev >> i)})
+	}
+	tag = 1 + h.Sum64()%maxDevTag
+	for n := 0; ; n++ {
+		if n >= maxDevTag {
+			glog.Errorf("Too many nested local filesystems under [%s]", r.path)
+			return 0, nil, false
+		}
+		if _, used := dts.tags[tag]; !used {
+			break
+		}
+		if tag++; tag > maxDevTag {
+			tag = 1
+		}
+	}
+
+	dt = &devTag{dev: dev, fsid: fsid}
+	dts.byDev[dev] = tag
+	dts.tags[tag] = dt
+
+	glog.V(1).Infof("NESTED local fs %#x on device %#x at [%s]:[%s] tagged %#x",
+		fsid, dev, r.path, jdfPath, tag)
+
+	return tag, dt, true
+}
+
+// mapInode maps the local inode number of an inode just stated, to its FUSE inode ID
+// tagged with its device. inode is left 0 if can not be mapped.
+func (r *mountedRoot) mapInode(im *iMeta) {
+	if !r.nestedFS {
+		return
+	}
+
+	if uint64(im.inode) > maxMappedIno {
+		glog.V(1).Infof("OUTLAW inode [%d] [%s]:[%s] with number too large to be mapped, not revealed to jdfc.",
+			im.inode, r.path, im.jdfPath)
+		im.inode = 0
+		return
+	}
+	if im.dev == r.dev {
+		return
+	}
+
+	r.nestedDevs.mu.Lock()
+	defer r.nestedDevs.mu.Unlock()
+
+	tag, dt, ok := r.tagOfDev(im.dev, im.jdfPath)
+	if !ok {
+		im.inode = 0
+		return
+	}
+	im.inode = vfs.InodeID(tag<<devTagShift | uint64(im.inode))
+	im.gen = dt.gen
+}
+
+// revealInode tells whether an inode just stated is to be revealed to jdfc.
+func (r *mountedRoot) revealInode(im *iMeta) bool {
+	if !r.nestedFS {
+		return im.dev == r.dev
+	}
+	return im.inode != 0
+}
+
+// crossMount checks the filesystem mounted at a mount point, i.e. im is known to be
+// on a device other than its parent dir's, the generation of its device tag is
+// increased if another filesystem is seen reusing the device.
+func (r *mountedRoot) crossMount(im *iMeta) {
+	if !r.nestedFS || im.inode == 0 || im.dev == r.dev {
+		return
+	}
+
+	fsid, err := fsID(r.abs(im.jdfPath))
+	if err != nil {
+		glog.Errorf("Error identifying local fs at [%s]:[%s] - %+v", r.path, im.jdfPath, err)
+		return
+	}
+
+	r.nestedDevs.mu.Lock()
+	defer r.nestedDevs.mu.Unlock()
+
+	tag := uint64(im.inode) >> devTagShift
+	dt := r.nestedDevs.tags[tag]
+	if dt == nil || dt.dev != im.dev {
+		return // not tagged by this root
+	}
+	if fsid != dt.fsid {
+		dt.fsid = fsid
+		dt.gen++
+		glog.V(1).Infof("NESTED local fs %#x on device %#x at [%s]:[%s] changed, tag %#x now gen %d",
+			fsid, im.dev, r.path, im.jdfPath, tag, dt.gen)
+	}
+	im.gen = dt.gen
+}
+
+// nestedInode tells whether an inode ID is mapped from a nested filesystem.
+func (r *mountedRoot) nestedInode(inode vfs.InodeID) bool {
+	return r.nestedFS && uint64(inode)>>devTagShift != 0
+}
+
+// statNestedFS stats the nested filesystem an inode is on, ENOENT is returned if the
+// inode is not on a nested filesystem, or not reachable now.
+func (efs *exportedFileSystem) statNestedFS(inode vfs.InodeID) (op vfs.StatFSOp, err error) {
+	if !efs.root.nestedInode(inode) {
+		err = vfs.ENOENT
+		return
+	}
+	ici, ok, _, _ := efs.icd.GetInode(0, inode, 0)
+	if !ok {
+		err = vfs.ENOENT
+		return
+	}
+	inoM, _, err := efs.root.statInode(ici.inode, ici.reachedThrough)
+	if err != nil {
+		return
+	}
+	f, err := efs.root.openFile(inoM.jdfPath, os.O_RDONLY, 0)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	return statFS(f)
+}
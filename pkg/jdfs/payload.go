@@ -0,0 +1,28 @@
+package jdfs
+
+import (
+	"github.com/complyue/hbi"
+)
+
+// bulk data payloads are sent/received by efs.codec, see vfs/payload.go for how
+// they are framed over the wire.
+
+// methodList returns methods of compression/checksum supported, to be told on mount.
+func methodList(methods []string) hbi.LitListType {
+	ml := make(hbi.LitListType, len(methods))
+	for i, method := range methods {
+		ml[i] = method
+	}
+	return ml
+}
+
+// sendPayload sends a bulk data payload, compressed/checksummed as in use.
+func (efs *exportedFileSystem) sendPayload(co *hbi.HoCo, payload []byte) error {
+	return efs.codec.SendPayload(co, payload)
+}
+
+// recvPayload receives a bulk data payload into buf, of the raw size of it, a bad
+// payload is reported as EIO.
+func (efs *exportedFileSystem) recvPayload(co *hbi.HoCo, buf []byte) error {
+	return efs.codec.RecvPayload(co, buf, efs.ho.NetIdent())
+}
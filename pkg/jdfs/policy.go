@@ -0,0 +1,256 @@
+package jdfs
+
+import (
+	"flag"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/complyue/jdfs/pkg/errors"
+	"github.com/complyue/jdfs/pkg/vfs"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	policyFile string
+)
+
+func init() {
+	flag.StringVar(&policyFile, "policy", "",
+		"`file` of YAML export policy, restricting which jdfc can mount which subpaths, and forcing read-only subtrees")
+}
+
+// exportPolicy is the server side access policy of an export root, e.g.
+//
+//	# who can mount what, the first rule covering the mount path and matching
+//	# the jdfc applies, any jdfc can mount anything if no rule is specified
+//	mounts:
+//	  - path: projects/alpha
+//	    clients: [10.1.0.0/16, "CN=alice", "uid:1000"]
+//	  - path: public
+//	    clients: ["*"]
+//	    readOnly: true
+//	  - path: datasets
+//	    clients: [10.1.0.0/16]
+//	    nestedFS: true
+//
+//	# subtrees forced read-only, whatever jdfc requests
+//	readOnly:
+//	  - projects/alpha/archive
+//
+//	# expose filesystems mounted under the export root, with their inode numbers
+//	# remapped, see nested.go, they are hidden to jdfc unless this is set for the
+//	# whole export, or for the mounts of a rule
+//	nestedFS: false
+//
+// a client pattern can be `*` for any jdfc, an IP address or CIDR for jdfc from
+// the network, a client certificate subject DN or `CN=<common name>` for jdfc over
+// TLS, or `uid:<uid>`/`gid:<gid>` for jdfc over a unix domain socket.
+//
+// all paths are relative to the export root.
+type exportPolicy struct {
+	Mounts   []mountRule `yaml:"mounts"`
+	ReadOnly []string    `yaml:"readOnly"`
+	NestedFS bool        `yaml:"nestedFS"`
+}
+
+type mountRule struct {
+	Path     string   `yaml:"path"`
+	Clients  []string `yaml:"clients"`
+	ReadOnly bool     `yaml:"readOnly"`
+	NestedFS bool     `yaml:"nestedFS"`
+}
+
+// loadExportPolicy reads the policy file, nil policy is returned if none configured.
+func loadExportPolicy() (*exportPolicy, error) {
+	if len(policyFile) <= 0 {
+		return nil, nil
+	}
+	yamlBytes, err := ioutil.ReadFile(policyFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading export policy [%s]", policyFile)
+	}
+	p := &exportPolicy{}
+	if err = yaml.UnmarshalStrict(yamlBytes, p); err != nil {
+		return nil, errors.Wrapf(err, "parsing export policy [%s]", policyFile)
+	}
+	for i := range p.Mounts {
+		p.Mounts[i].Path = cleanSubPath(p.Mounts[i].Path)
+		for _, cp := range p.Mounts[i].Clients {
+			if err = validClientPattern(cp); err != nil {
+				return nil, errors.Wrapf(err, "export policy [%s]", policyFile)
+			}
+		}
+	}
+	for i := range p.ReadOnly {
+		p.ReadOnly[i] = cleanSubPath(p.ReadOnly[i])
+	}
+	return p, nil
+}
+
+// subPathUnder tells whether p is equal to or under dir, both cleaned, empty dir
+// is the export root.
+func subPathUnder(p, dir string) bool {
+	return len(dir) <= 0 || p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// mountFor authorizes the jdfc identified to mount jdfsPath, returns the subtrees
+// to be forced read-only, relative to the mounted root, with "." for the whole mount,
+// and whether nested filesystems under the mounted root are exposed.
+func (p *exportPolicy) mountFor(jdfsPath string, ident *jdfcIdent, remoteAddr net.Addr) (
+	roSubtrees []string, nestedFS bool, err error) {
+	mountPath := cleanSubPath(jdfsPath)
+	nestedFS = p.NestedFS
+
+	if len(p.Mounts) > 0 {
+		var rule *mountRule
+	findRule:
+		for i := range p.Mounts {
+			if !subPathUnder(mountPath, p.Mounts[i].Path) {
+				continue
+			}
+			for _, cp := range p.Mounts[i].Clients {
+				if matchClient(cp, ident, remoteAddr) {
+					rule = &p.Mounts[i]
+					break findRule
+				}
+			}
+		}
+		if rule == nil {
+			return nil, false, errors.Errorf("mounting [%s] not allowed by export policy", jdfsPath)
+		}
+		if rule.ReadOnly {
+			roSubtrees = append(roSubtrees, ".")
+		}
+		if rule.NestedFS {
+			nestedFS = true
+		}
+	}
+
+	for _, roPath := range p.ReadOnly {
+		if subPathUnder(mountPath, roPath) {
+			roSubtrees = append(roSubtrees, ".")
+		} else if subPathUnder(roPath, mountPath) {
+			if len(mountPath) <= 0 {
+				roSubtrees = append(roSubtrees, roPath)
+			} else {
+				roSubtrees = append(roSubtrees, roPath[len(mountPath)+1:])
+			}
+		}
+	}
+
+	return
+}
+
+func validClientPattern(cp string) error {
+	if cp == "*" || strings.Contains(cp, "=") {
+		return nil
+	}
+	if strings.HasPrefix(cp, "uid:") || strings.HasPrefix(cp, "gid:") {
+		if _, err := strconv.ParseUint(cp[4:], 10, 32); err != nil {
+			return errors.Errorf("invalid client [%s]", cp)
+		}
+		return nil
+	}
+	if net.ParseIP(cp) != nil {
+		return nil
+	}
+	if _, _, err := net.ParseCIDR(cp); err != nil {
+		return errors.Errorf("invalid client [%s]", cp)
+	}
+	return nil
+}
+
+func matchClient(cp string, ident *jdfcIdent, remoteAddr net.Addr) bool {
+	if cp == "*" {
+		return true
+	}
+
+	if strings.Contains(cp, "=") {
+		if len(ident.subject) <= 0 {
+			return false
+		}
+		if cp == ident.subject {
+			return true
+		}
+		if strings.HasPrefix(cp, "CN=") {
+			for _, rdn := range strings.Split(ident.subject, ",") {
+				if rdn == cp {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	if strings.HasPrefix(cp, "uid:") || strings.HasPrefix(cp, "gid:") {
+		if ident.peer == nil {
+			return false
+		}
+		id, err := strconv.ParseUint(cp[4:], 10, 32)
+		if err != nil {
+			return false
+		}
+		if cp[0] == 'u' {
+			return ident.peer.uid == uint32(id)
+		}
+		return ident.peer.gid == uint32(id)
+	}
+
+	var ip net.IP
+	if len(ident.addr) > 0 {
+		if host, _, err := net.SplitHostPort(ident.addr); err == nil {
+			ip = net.ParseIP(host)
+		}
+	} else if tcpAddr, ok := remoteAddr.(*net.TCPAddr); ok {
+		ip = tcpAddr.IP
+	}
+	if ip == nil {
+		return false
+	}
+	if strings.Contains(cp, "/") {
+		_, ipNet, err := net.ParseCIDR(cp)
+		return err == nil && ipNet.Contains(ip)
+	}
+	return ip.Equal(net.ParseIP(cp))
+}
+
+// checkWritable tells whether the local fs path, relative to the mounted root, can
+// be modified by this session, returns EROFS if the session is mounted read-only,
+// or EACCES if the path is read-only under the export policy.
+//
+// every reactor method modifying the local fs must check this, a jdfc's FUSE
+// ReadOnly flag is not to be trusted.
+func (efs *exportedFileSystem) checkWritable(jdfPath string) error {
+	if efs.readOnly {
+		return vfs.EROFS
+	}
+	if len(efs.roSubtrees) <= 0 {
+		return nil
+	}
+	p := filepath.Clean(jdfPath)
+	for _, roPath := range efs.roSubtrees {
+		if roPath == "." || p == roPath || strings.HasPrefix(p, roPath+"/") {
+			return vfs.EACCES
+		}
+	}
+	return nil
+}
+
+// checkSubtreeWritable is checkWritable on jdfPath, and as well on everything under
+// it, for renaming or removing a whole subtree must not take a read-only subtree
+// under it out of protection.
+func (efs *exportedFileSystem) checkSubtreeWritable(jdfPath string) error {
+	if err := efs.checkWritable(jdfPath); err != nil {
+		return err
+	}
+	p := filepath.Clean(jdfPath)
+	for _, roPath := range efs.roSubtrees {
+		if subPathUnder(roPath, p) {
+			return vfs.EACCES
+		}
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package jdfs
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/complyue/jdfs/pkg/vfs"
+)
+
+func TestMountForNestedFS(t *testing.T) {
+	p := &exportPolicy{Mounts: []mountRule{
+		{Path: "datasets", Clients: []string{"10.1.0.0/16"}, NestedFS: true},
+		{Path: "", Clients: []string{"*"}},
+	}}
+	ident := &jdfcIdent{}
+	inNet := &net.TCPAddr{IP: net.ParseIP("10.1.2.3")}
+	elsewhere := &net.TCPAddr{IP: net.ParseIP("192.168.1.2")}
+
+	for _, c := range []struct {
+		jdfsPath   string
+		remoteAddr net.Addr
+		nestedFS   bool
+	}{
+		{"datasets/a", inNet, true},
+		{"/datasets", inNet, true},
+		{"datasets/a", elsewhere, false},
+		{"projects", inNet, false},
+	} {
+		_, nestedFS, err := p.mountFor(c.jdfsPath, ident, c.remoteAddr)
+		if err != nil {
+			t.Fatalf("mounting [%s] from %v refused - %v", c.jdfsPath, c.remoteAddr, err)
+		}
+		if nestedFS != c.nestedFS {
+			t.Errorf("mounting [%s] from %v got nestedFS=%v", c.jdfsPath, c.remoteAddr, nestedFS)
+		}
+	}
+
+	p.NestedFS = true
+	if _, nestedFS, _ := p.mountFor("projects", ident, elsewhere); !nestedFS {
+		t.Errorf("nestedFS of the whole export not applied")
+	}
+}
+
+func TestCheckSubtreeWritable(t *testing.T) {
+	efs := &exportedFileSystem{roSubtrees: []string{"a/b/ro"}}
+	for _, c := range []struct {
+		jdfPath string
+		err     error
+	}{
+		{"a/b/ro/x", vfs.EACCES},
+		{"a/b/ro", vfs.EACCES},
+		{"a/b", vfs.EACCES},
+		{"a", vfs.EACCES},
+		{"a/b/rox", nil},
+		{"a/c", nil},
+	} {
+		if err := efs.checkSubtreeWritable(c.jdfPath); err != c.err {
+			t.Errorf("checkSubtreeWritable(%#v) got %v instead of %v", c.jdfPath, err, c.err)
+		}
+	}
+
+	efs.readOnly = true
+	if err := efs.checkSubtreeWritable("a/c"); err != vfs.EROFS {
+		t.Errorf("checkSubtreeWritable on read-only mount got %v", err)
+	}
+}
+
+func TestMountFor(t *testing.T) {
+	p := &exportPolicy{
+		Mounts: []mountRule{
+			{Path: "projects/alpha", Clients: []string{"10.1.0.0/16", "CN=alice"}},
+			{Path: "projects", Clients: []string{"10.1.2.3"}, ReadOnly: true},
+			{Path: "public", Clients: []string{"*"}, ReadOnly: true},
+		},
+		ReadOnly: []string{"projects/alpha/archive", "projects/beta/archive"},
+	}
+	inNet := &net.TCPAddr{IP: net.ParseIP("10.1.2.3")}
+	elsewhere := &net.TCPAddr{IP: net.ParseIP("192.168.1.2")}
+	anon := &jdfcIdent{}
+	alice := &jdfcIdent{subject: "CN=alice,O=example"}
+
+	for _, c := range []struct {
+		jdfsPath   string
+		ident      *jdfcIdent
+		remoteAddr net.Addr
+		refused    bool
+		roSubtrees []string
+	}{
+		// the first matching rule applies, though a later one also covers it
+		{"projects/alpha", anon, inNet, false, []string{"archive"}},
+		{"/projects/alpha/src", anon, inNet, false, nil},
+		{"projects/alpha/archive/2019", anon, inNet, false, []string{"."}},
+		{"projects/alpha", alice, elsewhere, false, []string{"archive"}},
+		// rules not matching the jdfc are passed over
+		{"projects/beta", anon, inNet, false, []string{".", "archive"}},
+		{"projects", anon, inNet, false, []string{".", "alpha/archive", "beta/archive"}},
+		{"public", anon, elsewhere, false, []string{"."}},
+		// refused if no rule matches
+		{"projects/alpha", anon, elsewhere, true, nil},
+		{"projects/beta", alice, elsewhere, true, nil},
+		{"private", anon, inNet, true, nil},
+		{"", anon, inNet, true, nil},
+		{"projects-x", anon, inNet, true, nil},
+	} {
+		roSubtrees, _, err := p.mountFor(c.jdfsPath, c.ident, c.remoteAddr)
+		if c.refused {
+			if err == nil {
+				t.Errorf("mounting [%s] from %v not refused", c.jdfsPath, c.remoteAddr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("mounting [%s] from %v refused - %v", c.jdfsPath, c.remoteAddr, err)
+		} else if fmt.Sprint(roSubtrees) != fmt.Sprint(c.roSubtrees) {
+			t.Errorf("mounting [%s] from %v got read-only subtrees %v instead of %v",
+				c.jdfsPath, c.remoteAddr, roSubtrees, c.roSubtrees)
+		}
+	}
+
+	// any jdfc mounts anything without mount rules, still with read-only subtrees
+	p.Mounts = nil
+	if roSubtrees, _, err := p.mountFor("", anon, elsewhere); err != nil {
+		t.Errorf("mounting export root refused - %v", err)
+	} else if fmt.Sprint(roSubtrees) != fmt.Sprint([]string{"projects/alpha/archive", "projects/beta/archive"}) {
+		t.Errorf("mounting export root got read-only subtrees %v", roSubtrees)
+	}
+}
+
+func TestMatchClient(t *testing.T) {
+	tcpAddr := &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234}
+	tlsIdent := &jdfcIdent{subject: "CN=alice,OU=research,O=example"}
+	unixIdent := &jdfcIdent{peer: &peerCred{uid: 1000, gid: 100}}
+	// the address a spawned jdfs got handed, instead of the wire's
+	handedIdent := &jdfcIdent{addr: "192.168.1.2:5678"}
+
+	for _, c := range []struct {
+		cp         string
+		ident      *jdfcIdent
+		remoteAddr net.Addr
+		match      bool
+	}{
+		{"*", &jdfcIdent{}, nil, true},
+
+		{"10.1.0.0/16", &jdfcIdent{}, tcpAddr, true},
+		{"10.2.0.0/16", &jdfcIdent{}, tcpAddr, false},
+		{"10.1.2.3", &jdfcIdent{}, tcpAddr, true},
+		{"10.1.2.4", &jdfcIdent{}, tcpAddr, false},
+		{"192.168.1.2", handedIdent, tcpAddr, true},
+		{"10.1.2.3", handedIdent, tcpAddr, false},
+		{"10.1.2.3", unixIdent, nil, false},
+
+		{"CN=alice", tlsIdent, tcpAddr, true},
+		{"CN=bob", tlsIdent, tcpAddr, false},
+		{"CN=alice,OU=research,O=example", tlsIdent, tcpAddr, true},
+		{"CN=alice,O=example", tlsIdent, tcpAddr, false},
+		{"OU=research", tlsIdent, tcpAddr, false},
+		{"CN=alice", &jdfcIdent{}, tcpAddr, false},
+
+		{"uid:1000", unixIdent, nil, true},
+		{"uid:1001", unixIdent, nil, false},
+		{"gid:100", unixIdent, nil, true},
+		{"gid:1000", unixIdent, nil, false},
+		{"uid:1000", &jdfcIdent{}, tcpAddr, false},
+	} {
+		if match := matchClient(c.cp, c.ident, c.remoteAddr); match != c.match {
+			t.Errorf("matchClient(%#v) for %+v from %v got %v", c.cp, c.ident, c.remoteAddr, match)
+		}
+	}
+}
+
+func TestValidClientPattern(t *testing.T) {
+	for _, c := range []struct {
+		cp    string
+		valid bool
+	}{
+		{"*", true},
+		{"10.1.2.3", true},
+		{"10.1.0.0/16", true},
+		{"fd00::/8", true},
+		{"CN=alice", true},
+		{"CN=alice,O=example", true},
+		{"uid:1000", true},
+		{"gid:0", true},
+		{"uid:alice", false},
+		{"gid:-1", false},
+		{"uid:", false},
+		{"10.1.2", false},
+		{"10.1.0.0/33", false},
+		{"alice", false},
+		{"", false},
+	} {
+		if err := validClientPattern(c.cp); (err == nil) != c.valid {
+			t.Errorf("validClientPattern(%#v) got %v", c.cp, err)
+		}
+	}
+}
+
+func TestCheckWritable(t *testing.T) {
+	for _, c := range []struct {
+		readOnly   bool
+		roSubtrees []string
+		jdfPath    string
+		err        error
+	}{
+		{false, nil, "a/b", nil},
+		{true, nil, "a/b", vfs.EROFS},
+		{true, []string{"a"}, "a/b", vfs.EROFS},
+		{false, []string{"."}, "a/b", vfs.EACCES},
+		{false, []string{"a/b"}, "a/b", vfs.EACCES},
+		{false, []string{"a/b"}, "a/b/c", vfs.EACCES},
+		{false, []string{"a/b"}, "./a/b/c", vfs.EACCES},
+		{false, []string{"a/b"}, "a/bc", nil},
+		{false, []string{"a/b"}, "a", nil},
+		{false, []string{"x", "a/b"}, "a/b/c", vfs.EACCES},
+	} {
+		efs := &exportedFileSystem{readOnly: c.readOnly, roSubtrees: c.roSubtrees}
+		if err := efs.checkWritable(c.jdfPath); err != c.err {
+			t.Errorf("checkWritable(%#v) with readOnly=%v roSubtrees=%v got %v instead of %v",
+				c.jdfPath, c.readOnly, c.roSubtrees, err, c.err)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package jdfs
+
+import (
+	"context"
+	"flag"
+
+	"github.com/complyue/jdfs/pkg/vfs"
+)
+
+// a jdfc can have many FUSE ops in flight over its connection, each landed as a
+// hosting conversation, which is served concurrently with others once it released
+// the wire. ops hitting local fs are bounded in parallelism per connection by -ppc,
+// metadata ops and data ops each has its own slots, so a session doing bulk data
+// transfer won't starve its own metadata ops, nor the local disks from other sessions.
+//
+// ops only working with in-core data, e.g. forgetting inodes and releasing handles,
+// or waiting for others, i.e. file locking, take no slot.
+
+var (
+	// max number of metadata/data ops each, in progress concurrently per connection
+	ppc int
+)
+
+func init() {
+	flag.IntVar(&ppc, "ppc", 16,
+		"max `parallelism` per connection, of metadata ops and of data ops each, 0 for unlimited")
+}
+
+// opSlots bounds ops of a class in progress concurrently, nil for unlimited.
+type opSlots chan struct{}
+
+func newOpSlots(n int) opSlots {
+	if n <= 0 {
+		return nil
+	}
+	return make(opSlots, n)
+}
+
+// acquire waits for a free slot, it must be released once the op finished.
+func (s opSlots) acquire() {
+	if s != nil {
+		s <- struct{}{}
+	}
+}
+
+// acquireFor waits for a free slot for a cancellable op, EINTR is returned if the
+// op is cancelled before a slot available.
+func (s opSlots) acquireFor(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return vfs.EINTR
+	}
+}
+
+func (s opSlots) release() {
+	if s != nil {
+		<-s
+	}
+}
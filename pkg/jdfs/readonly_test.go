@@ -0,0 +1,184 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package jdfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/complyue/hbi"
+	"github.com/complyue/jdfs/pkg/vfs"
+)
+
+// lookUp resolves name under parent, returns the child inode.
+func (w *testWire) lookUp(parent vfs.InodeID, name string) vfs.InodeID {
+	co := w.call(fmt.Sprintf(`
+LookUpInode(%d, %#v)
+`, parent, name))
+	defer co.Close()
+	if fse := w.recvObj(co).(vfs.FsError); fse != 0 {
+		w.t.Fatalf("looking up [%s] failed - %s", name, fse.Repr())
+	}
+	var ce vfs.ChildInodeEntry
+	bufView := ((*[unsafe.Sizeof(ce)]byte)(unsafe.Pointer(&ce)))[0:unsafe.Sizeof(ce)]
+	if err := co.RecvData(bufView); err != nil {
+		w.t.Fatal(err)
+	}
+	return ce.Child
+}
+
+// openFile opens inode read-only, returns the file handle.
+func (w *testWire) openFile(inode vfs.InodeID) int {
+	co := w.call(fmt.Sprintf(`
+OpenFile(%d, false, false)
+`, inode))
+	defer co.Close()
+	if fse := w.recvObj(co).(vfs.FsError); fse != 0 {
+		w.t.Fatalf("opening [%d] failed - %s", inode, fse.Repr())
+	}
+	return int(w.recvObj(co).(hbi.LitIntType))
+}
+
+func TestReadOnlyMount(t *testing.T) {
+	te := newTestExport(t)
+	defer te.close()
+
+	// a workset left by some read-write session
+	wsrd := ".ws/left"
+	if err := os.MkdirAll(filepath.Join(te.root, wsrd, "inside"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	w := te.dial(t)
+	defer w.close()
+	if err := w.mount(true, "/"); err != nil {
+		t.Fatalf("failed mounting export root read-only - %v", err)
+	}
+
+	insideIno := w.lookUp(vfs.RootInodeID, "inside")
+	okIno := w.lookUp(insideIno, "ok"+testDataExt)
+	fh := w.openFile(okIno)
+	dfh, dfSize := w.openJDF("inside/ok")
+	payload := []byte("HDR!")
+
+	t.Run("fs ops", func(t *testing.T) {
+		for _, op := range []struct {
+			code string
+			args []interface{}
+		}{
+			{code: fmt.Sprintf(`SetInodeAttributes(%d, true, false, false, %d, %d, %d)`,
+				okIno, 0, 0, 0)},
+			{code: fmt.Sprintf(`SetInodeAttributes(%d, false, true, false, %d, %d, %d)`,
+				okIno, 0, 0600, 0)},
+			{code: fmt.Sprintf(`SetInodeAttributes(%d, false, false, true, %d, %d, %d)`,
+				okIno, 0, 0, time.Now().UnixNano())},
+			{code: fmt.Sprintf(`MkDir(%d, %#v, %d)`, insideIno, "new", 0755)},
+			{code: fmt.Sprintf(`CreateFile(%d, %#v, %d)`, insideIno, "new", 0644)},
+			{code: fmt.Sprintf(`CreateSymlink(%d, %#v, %#v)`, insideIno, "new", "ok"+testDataExt)},
+			{code: fmt.Sprintf(`CreateLink(%d, %#v, %d)`, insideIno, "new", okIno)},
+			{code: fmt.Sprintf(`Rename(%d, %#v, %d, %#v)`, insideIno, "ok"+testDataExt,
+				insideIno, "renamed")},
+			{code: fmt.Sprintf(`RmDir(%d, %#v)`, vfs.RootInodeID, "inside")},
+			{code: fmt.Sprintf(`Unlink(%d, %#v)`, insideIno, "ok"+testDataExt)},
+			{code: fmt.Sprintf(`OpenFile(%d, true, false)`, okIno)},
+			{code: fmt.Sprintf(`OpenFile(%d, false, true)`, okIno)},
+			{code: fmt.Sprintf(`WriteFile(%d, %d, %d, %d)`, okIno, fh, 0, len(payload)),
+				args: []interface{}{payload}},
+			{code: fmt.Sprintf(`Fallocate(%d, %d, %d, %d, %d)`, okIno, fh, 0, 64, 0)},
+			{code: fmt.Sprintf(`CopyFileRange(%d, %d, %d, %d, %d, %d, %d)`,
+				okIno, fh, 0, okIno, fh, 4, 4)},
+			{code: fmt.Sprintf(`SetXattr(%d, %#v, %d, %d)`, okIno, "user.test", len(payload), 0),
+				args: []interface{}{payload}},
+			{code: fmt.Sprintf(`RemoveXattr(%d, %#v)`, okIno, "user.test")},
+		} {
+			if fse := w.fsErr(op.code, op.args...); fse != vfs.EROFS {
+				t.Errorf("%s got %s", op.code, fse.Repr())
+			}
+		}
+	})
+
+	t.Run("jdf ops", func(t *testing.T) {
+		ranges := []vfs.DataRange{{Offset: 0, Size: 2}, {Offset: 8, Size: 2}}
+		for _, op := range []struct {
+			code string
+			args []interface{}
+		}{
+			{code: fmt.Sprintf(`AllocJDF(%#v, %#v, %#v, %#v, %d, %d, %d)`,
+				"inside/new", false, testMetaExt, testDataExt, len(payload), 0, 16),
+				args: []interface{}{payload}},
+			{code: fmt.Sprintf(`AllocJDF(%#v, %#v, %#v, %#v, %d, %d, %d)`,
+				"inside/ok", true, testMetaExt, testDataExt, len(payload), 0, 16),
+				args: []interface{}{payload}},
+			{code: fmt.Sprintf(`CopyJDF(%d, %d, %#v, %#v, %d, %d, %d, %d, %d, %d, %#v, %#v)`,
+				dfh.Handle, dfh.Inode, "inside/copied", true, dfSize, 0, 0, 0, len(payload), 0,
+				testMetaExt, testDataExt), args: []interface{}{payload}},
+			{code: fmt.Sprintf(`WriteJDF(%d, %d, %d, %d)`, dfh.Handle, dfh.Inode, 0, len(payload)),
+				args: []interface{}{payload}},
+			{code: fmt.Sprintf(`WriteJDFv(%d, %d, %d, %d)`, dfh.Handle, dfh.Inode, len(ranges), len(payload)),
+				args: []interface{}{vfs.DataRangesBytes(ranges), payload}},
+		} {
+			if fse := w.fsErr(op.code, op.args...); fse != vfs.EROFS {
+				t.Errorf("%s got %s", op.code, fse.Repr())
+			}
+		}
+	})
+
+	t.Run("workset ops", func(t *testing.T) {
+		if reason := w.errReason(fmt.Sprintf(`
+MakeWorksetRoot(%#v, %#v)
+`, ".ws", "new")); !strings.Contains(reason, vfs.EROFS.Repr()) {
+			t.Errorf("making workset got [%s]", reason)
+		}
+		if reason := w.errReason(fmt.Sprintf(`
+CommitWorkset(%#v, 0, %#v, %#v)
+`, wsrd, testMetaExt, testDataExt)); !strings.Contains(reason, vfs.EROFS.Repr()) {
+			t.Errorf("committing workset got [%s]", reason)
+		}
+		if reason := w.errReason(fmt.Sprintf(`
+CommitWorkset(%#v, 1, %#v, %#v)
+`, wsrd, testMetaExt, testDataExt), "inside/ok"); !strings.Contains(reason, vfs.EROFS.Repr()) {
+			t.Errorf("committing workset to inside/ok got [%s]", reason)
+		}
+
+		// jdfs replies nothing, give it time to wrongly remove the workset
+		co, err := w.po.NewCo(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = co.SendCode(fmt.Sprintf(`
+DiscardWorksetRoot(%#v)
+`, wsrd)); err != nil {
+			t.Fatal(err)
+		}
+		co.Close()
+		w.fsErr(fmt.Sprintf(`StatJDF(%#v, %#v, %#v)`, "inside/ok", testMetaExt, testDataExt))
+		time.Sleep(100 * time.Millisecond)
+		if _, err := os.Lstat(filepath.Join(te.root, wsrd)); err != nil {
+			t.Errorf("workset [%s] discarded - %v", wsrd, err)
+		}
+	})
+
+	// nothing changed on the local fs
+	for fn, content := range map[string]string{
+		filepath.Join(te.root, "inside", "ok"+testMetaExt): "ok meta",
+		filepath.Join(te.root, "inside", "ok"+testDataExt): "ok data content.",
+	} {
+		if b, err := ioutil.ReadFile(fn); err != nil {
+			t.Errorf("reading [%s] failed - %v", fn, err)
+		} else if string(b) != content {
+			t.Errorf("[%s] changed to [%s]", fn, b)
+		}
+	}
+	for _, jdfPath := range []string{"inside/new", "inside/copied", "inside/renamed", ".ws/new"} {
+		if _, err := os.Lstat(filepath.Join(te.root, jdfPath)); !os.IsNotExist(err) {
+			t.Errorf("[%s] created", jdfPath)
+		}
+	}
+}
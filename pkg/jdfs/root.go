@@ -0,0 +1,419 @@
+package jdfs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/complyue/jdfs/pkg/errors"
+	"github.com/complyue/jdfs/pkg/vfs"
+
+	"github.com/golang/glog"
+	"golang.org/x/sys/unix"
+)
+
+// mountedRoot is the local dir mounted by a jdfc as JDFS root, a session of jdfs
+// has one open after mounted.
+//
+// jdfPaths of a session are relative to its mounted root, and local fs is accessed
+// through *at syscalls against the root dir's fd, instead of chdir'ing into it, so
+// multiple sessions can be served by a same jdfs process.
+type mountedRoot struct {
+	// absolute path at jdfs host
+	path string
+
+	// the root dir held open, so as to prevent it from unlinked until jdfc
+	// disconnected, its fd is the base of all *at syscalls of the session.
+	//
+	// it's not closed explicitly on disconnection, as ops in flight may still be
+	// using the fd, but left to be finalized once the session is garbage collected.
+	dir *os.File
+	fd  int
+
+	// device of the root dir
+	//
+	// nested directory with other filesystems mounted will be hidden to jdfc, unless
+	// nestedFS is set
+	dev int64
+
+	// inode value of the root dir
+	//
+	// jdfc is not restricted to only mount root of local filesystem at jdfs host,
+	// in case a nested dir is mounted as JDFS root, inode of mounted root will be other
+	// than 1, which is the constant for FUSE fs root.
+	inode vfs.InodeID
+
+	// effective uid/gid of jdfs process, this is told to jdfc when initially
+	// mounted, jdfc is supposed to translate all inode owner uid/gid of these values
+	// to its FUSE uid/gid as exposed to client kernel/applications, so the owning uid/gid of
+	// inodes stored in the backing fs at jdfs can be different from the FUSE uid/gid
+	// at jdfc, while those files/dirs appear owned by the FUSE uid/gid.
+	//
+	// TODO decide handling of uid/gid other than these values, to leave them as is, or
+	//      maybe a good idea to translate to a fixed value (e.g. 0=root, 1=daemon) ?
+	uid, gid uint32
+
+	// whether nested filesystems under the root are exposed, as set by the export
+	// policy, see nested.go
+	nestedFS bool
+	// tags of nested filesystems under the root, see nested.go
+	nestedDevs devTags
+}
+
+// openRoot opens the local dir at mountPath under exportRoot as JDFS root, with
+// nested filesystems under it exposed if nestedFS.
+//
+// mountPath is confined to exportRoot by the caller, it's opened beneath exportRoot
+// nonetheless, so it can't escape by symlinks swapped in meanwhile.
+func openRoot(exportRoot, mountPath string, readOnly, nestedFS bool) (*mountedRoot, error) {
+	rootPath := exportRoot
+	if mountPath != "." {
+		rootPath = filepath.Join(exportRoot, mountPath)
+	}
+
+	exportFD, err := unix.Open(exportRoot, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, errors.Errorf("Error open jdfs export root: [%s] - %+v", exportRoot, err)
+	}
+	// dir can only be opened readonly
+	fd, err := openBeneath(exportFD, mountPath, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	unix.Close(exportFD)
+	if err != nil {
+		return nil, errors.Errorf("Error open jdfs path: [%s] - %+v", rootPath, err)
+	}
+	rootDir := os.NewFile(uintptr(fd), rootPath)
+	rootFI, err := rootDir.Stat()
+	if err != nil {
+		rootDir.Close()
+		return nil, errors.Errorf("Bad jdfs path: [%s] - %+v", rootPath, err)
+	}
+	if !readOnly {
+		// subdirs may still be writable, don't fail the mount
+		if err := unix.Access(rootPath, unix.W_OK); err != nil {
+			glog.Warningf("jdfs path [%s] mounted read-write but not writable - %+v",
+				rootPath, err)
+		}
+	}
+
+	// root is never mapped, nested filesystems are told from the device of it
+	rootM := localMeta(".", rootFI)
+
+	r := &mountedRoot{
+		path: rootPath,
+		dir:  rootDir, fd: int(rootDir.Fd()),
+		dev: rootM.dev, inode: rootM.inode,
+		uid: uint32(os.Geteuid()), gid: uint32(os.Getegid()),
+		nestedFS: nestedFS,
+	}
+	r.nestedDevs.reset(rootM.dev)
+	return r, nil
+}
+
+// abs returns the absolute path of a jdfPath, for syscalls having no *at variants.
+func (r *mountedRoot) abs(jdfPath string) string {
+	return filepath.Join(r.path, jdfPath)
+}
+
+// lstat is os.Lstat against the root.
+func (r *mountedRoot) lstat(jdfPath string) (os.FileInfo, error) {
+	fi := &statInfo{name: filepath.Base(jdfPath)}
+	// unix.Stat_t is of the same layout as syscall.Stat_t, both defined after the
+	// local struct stat, while syscall has no fstatat exported on all platforms.
+	if err := unix.Fstatat(r.fd, jdfPath, (*unix.Stat_t)(unsafe.Pointer(&fi.sd)),
+		unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return nil, &os.PathError{Op: "lstat", Path: jdfPath, Err: err}
+	}
+	return fi, nil
+}
+
+// openFile is os.OpenFile against the root, never resolving to outside of it.
+func (r *mountedRoot) openFile(jdfPath string, flag int, perm os.FileMode) (*os.File, error) {
+	fd, err := openBeneath(r.fd, jdfPath, flag|unix.O_CLOEXEC, sysMode(perm))
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: jdfPath, Err: err}
+	}
+	return os.NewFile(uintptr(fd), jdfPath), nil
+}
+
+// inParent runs fn with the parent dir of jdfPath opened beneath the root, and the
+// base name of jdfPath, so symlinks swapped into the path after it's confined can't
+// redirect fn to outside of the root.
+func (r *mountedRoot) inParent(jdfPath string, fn func(dirfd int, name string) error) error {
+	dir, name := filepath.Dir(jdfPath), filepath.Base(jdfPath)
+	if dir == "." {
+		return fn(r.fd, name)
+	}
+	dirfd, err := openBeneath(r.fd, dir, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dirfd)
+	return fn(dirfd, name)
+}
+
+// mkdir is os.Mkdir against the root.
+func (r *mountedRoot) mkdir(jdfPath string, perm os.FileMode) error {
+	if err := r.inParent(jdfPath, func(dirfd int, name string) error {
+		return unix.Mkdirat(dirfd, name, sysMode(perm))
+	}); err != nil {
+		return &os.PathError{Op: "mkdir", Path: jdfPath, Err: err}
+	}
+	return nil
+}
+
+// mkdirAll is os.MkdirAll against the root.
+func (r *mountedRoot) mkdirAll(jdfPath string, perm os.FileMode) error {
+	if fi, err := r.lstat(jdfPath); err == nil {
+		if fi.IsDir() {
+			return nil
+		}
+		return &os.PathError{Op: "mkdir", Path: jdfPath, Err: syscall.ENOTDIR}
+	}
+	if parent := filepath.Dir(jdfPath); parent != "." && parent != jdfPath {
+		if err := r.mkdirAll(parent, perm); err != nil {
+			return err
+		}
+	}
+	if err := r.mkdir(jdfPath, perm); err != nil {
+		// the dir may have been made meanwhile
+		if fi, e := r.lstat(jdfPath); e == nil && fi.IsDir() {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// removeAll is os.RemoveAll against the root.
+func (r *mountedRoot) removeAll(jdfPath string) error {
+	if err := r.inParent(jdfPath, removeAllAt); err != nil {
+		return &os.PathError{Op: "removeall", Path: jdfPath, Err: err}
+	}
+	return nil
+}
+
+// removeAllAt removes name in the dir of dirfd, and any children it contains,
+// never following symlinks.
+func removeAllAt(dirfd int, name string) error {
+	err := unix.Unlinkat(dirfd, name, 0)
+	if err == nil || err == unix.ENOENT {
+		return nil
+	}
+	fd, e := unix.Openat(dirfd, name,
+		unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if e == unix.ENOENT {
+		return nil // removed meanwhile
+	} else if e != nil {
+		return err // not a dir
+	}
+	dir := os.NewFile(uintptr(fd), name)
+	defer dir.Close()
+	for {
+		names, e := dir.Readdirnames(256)
+		for _, child := range names {
+			if err = removeAllAt(fd, child); err != nil {
+				return err
+			}
+		}
+		if e == io.EOF || len(names) <= 0 {
+			break
+		} else if e != nil {
+			return e
+		}
+	}
+	if err = unix.Unlinkat(dirfd, name, unix.AT_REMOVEDIR); err == unix.ENOENT {
+		return nil
+	}
+	return err
+}
+
+// symlink is os.Symlink against the root.
+func (r *mountedRoot) symlink(target, jdfPath string) error {
+	if err := symlinkat(r, target, jdfPath); err != nil {
+		return &os.LinkError{Op: "symlink", Old: target, New: jdfPath, Err: err}
+	}
+	return nil
+}
+
+// link is os.Link against the root.
+func (r *mountedRoot) link(oldPath, newPath string) error {
+	if err := linkat(r, oldPath, newPath); err != nil {
+		return &os.LinkError{Op: "link", Old: oldPath, New: newPath, Err: err}
+	}
+	return nil
+}
+
+// rename is os.Rename against the root.
+func (r *mountedRoot) rename(oldPath, newPath string) error {
+	if err := r.inParent(oldPath, func(oldDirFD int, oldName string) error {
+		return r.inParent(newPath, func(newDirFD int, newName string) error {
+			return unix.Renameat(oldDirFD, oldName, newDirFD, newName)
+		})
+	}); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: err}
+	}
+	return nil
+}
+
+// rmdir is syscall.Rmdir against the root.
+func (r *mountedRoot) rmdir(jdfPath string) error {
+	return r.inParent(jdfPath, func(dirfd int, name string) error {
+		return unix.Unlinkat(dirfd, name, unix.AT_REMOVEDIR)
+	})
+}
+
+// unlink is syscall.Unlink against the root.
+func (r *mountedRoot) unlink(jdfPath string) error {
+	return r.inParent(jdfPath, func(dirfd int, name string) error {
+		return unix.Unlinkat(dirfd, name, 0)
+	})
+}
+
+// readlink is os.Readlink against the root.
+func (r *mountedRoot) readlink(jdfPath string) (string, error) {
+	for bufLen := 256; ; bufLen *= 2 {
+		buf := make([]byte, bufLen)
+		n, err := readlinkat(r, jdfPath, buf)
+		if err != nil {
+			return "", &os.PathError{Op: "readlink", Path: jdfPath, Err: err}
+		}
+		if n < bufLen {
+			return string(buf[:n]), nil
+		}
+	}
+}
+
+// chmod is os.Chmod against the root.
+func (r *mountedRoot) chmod(jdfPath string, mode os.FileMode) error {
+	if err := unix.Fchmodat(r.fd, jdfPath, sysMode(mode), 0); err != nil {
+		return &os.PathError{Op: "chmod", Path: jdfPath, Err: err}
+	}
+	return nil
+}
+
+// readFile is ioutil.ReadFile against the root.
+func (r *mountedRoot) readFile(jdfPath string) ([]byte, error) {
+	f, err := r.openFile(jdfPath, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, fi.Size())
+	n, err := f.ReadAt(buf, 0)
+	if err == io.EOF {
+		err = nil // shrunk meanwhile
+	}
+	return buf[:n], err
+}
+
+// writeFile is ioutil.WriteFile against the root.
+func (r *mountedRoot) writeFile(jdfPath string, data []byte, perm os.FileMode) error {
+	f, err := r.openFile(jdfPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+// readDir is os.File.Readdir of a dir opened against a root, os.File.Readdir can
+// not be used as it states children by paths relative to cwd, children here are
+// stated against the dir's fd.
+//
+// children with reserved names are left out, see confine.go.
+func readDir(dir *os.File, n int) (fis []os.FileInfo, err error) {
+	names, err := dir.Readdirnames(n)
+	if len(names) > 0 {
+		fis = make([]os.FileInfo, 0, len(names))
+	}
+	for _, name := range names {
+		if reservedName(name) {
+			continue
+		}
+		fi := &statInfo{name: name}
+		if e := unix.Fstatat(int(dir.Fd()), name, (*unix.Stat_t)(unsafe.Pointer(&fi.sd)),
+			unix.AT_SYMLINK_NOFOLLOW); e != nil {
+			if e == unix.ENOENT {
+				continue // removed meanwhile
+			}
+			return fis, &os.PathError{Op: "lstat", Path: dir.Name() + "/" + name, Err: e}
+		}
+		fis = append(fis, fi)
+	}
+	return
+}
+
+// statInfo is the os.FileInfo stated against a root.
+type statInfo struct {
+	name string
+	sd   syscall.Stat_t
+}
+
+func (fi *statInfo) Name() string       { return fi.name }
+func (fi *statInfo) Size() int64        { return fi.sd.Size }
+func (fi *statInfo) Mode() os.FileMode  { return fileMode(uint32(fi.sd.Mode)) }
+func (fi *statInfo) ModTime() time.Time { return time.Unix(0, statMtime(&fi.sd)) }
+func (fi *statInfo) IsDir() bool        { return fi.Mode().IsDir() }
+func (fi *statInfo) Sys() interface{}   { return &fi.sd }
+
+// sameFile is os.SameFile for file infos stated against a root.
+func sameFile(fi1, fi2 os.FileInfo) bool {
+	sd1, ok1 := fi1.Sys().(*syscall.Stat_t)
+	sd2, ok2 := fi2.Sys().(*syscall.Stat_t)
+	return ok1 && ok2 && sd1.Dev == sd2.Dev && sd1.Ino == sd2.Ino
+}
+
+// fileMode converts st_mode to os.FileMode, the same way as package os does.
+func fileMode(stMode uint32) os.FileMode {
+	mode := os.FileMode(stMode & 0777)
+	switch stMode & syscall.S_IFMT {
+	case syscall.S_IFBLK:
+		mode |= os.ModeDevice
+	case syscall.S_IFCHR:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case syscall.S_IFDIR:
+		mode |= os.ModeDir
+	case syscall.S_IFIFO:
+		mode |= os.ModeNamedPipe
+	case syscall.S_IFLNK:
+		mode |= os.ModeSymlink
+	case syscall.S_IFSOCK:
+		mode |= os.ModeSocket
+	}
+	if stMode&syscall.S_ISGID != 0 {
+		mode |= os.ModeSetgid
+	}
+	if stMode&syscall.S_ISUID != 0 {
+		mode |= os.ModeSetuid
+	}
+	if stMode&syscall.S_ISVTX != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// sysMode converts os.FileMode to mode bits of syscalls, the same way as package
+// os does.
+func sysMode(mode os.FileMode) (o uint32) {
+	o = uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		o |= syscall.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		o |= syscall.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		o |= syscall.S_ISVTX
+	}
+	return
+}
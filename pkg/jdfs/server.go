@@ -2,10 +2,12 @@
 package jdfs
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
-	"path/filepath"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 	"unsafe"
@@ -18,7 +20,29 @@ import (
 	"github.com/golang/glog"
 )
 
-func newServiceEnv(exportRoot string) *hbi.HostingEnv {
+// jdfcIdent is what's known about a connected jdfc, beyond the HBI wire.
+type jdfcIdent struct {
+	// what the jdfc is allowed to mount per its client certificate, nil for no restriction
+	grant *exportGrant
+
+	// subject DN of the jdfc's client certificate, empty if not over TLS
+	subject string
+
+	// network address of the jdfc, empty to take the remote address of the HBI wire
+	addr string
+
+	// credentials of the jdfc process, available for owner mapping when connected
+	// over a unix domain socket, nil otherwise
+	peer *peerCred
+}
+
+// newServiceEnv creates the hosting environment for a jdfc connection, ident can
+// be nil if nothing is known about the jdfc beyond the HBI wire.
+func newServiceEnv(exportRoot string, ident *jdfcIdent) *hbi.HostingEnv {
+	if ident == nil {
+		ident = &jdfcIdent{}
+	}
+
 	// prepare the hosting environment to be reacting to jdfc
 	he := hbi.NewHostingEnv()
 	// expose names for interop
@@ -35,19 +59,53 @@ func newServiceEnv(exportRoot string) *hbi.HostingEnv {
 	he.ExposeValue("ERANGE", vfs.ERANGE)
 	he.ExposeValue("ENOSPC", vfs.ENOSPC)
 	he.ExposeValue("ENOATTR", vfs.ENOATTR)
+	he.ExposeValue("EACCES", vfs.EACCES)
+	he.ExposeValue("EROFS", vfs.EROFS)
+	he.ExposeValue("EINTR", vfs.EINTR)
+	he.ExposeValue("EAGAIN", vfs.EAGAIN)
+	he.ExposeValue("EBADF", vfs.EBADF)
+	he.ExposeValue("ENXIO", vfs.ENXIO)
+	he.ExposeValue("EFBIG", vfs.EFBIG)
+	he.ExposeValue("ENODEV", vfs.ENODEV)
+	he.ExposeValue("EPERM", vfs.EPERM)
+	he.ExposeValue("ESPIPE", vfs.ESPIPE)
+	he.ExposeValue("EOVERFLOW", vfs.EOVERFLOW)
+	he.ExposeValue("ETXTBSY", vfs.ETXTBSY)
+	he.ExposeValue("EOPNOTSUPP", vfs.EOPNOTSUPP)
+
+	var efs *exportedFileSystem
 
 	he.ExposeFunction("__hbi_init__", // callback on wire connected
 		func(po *hbi.PostingEnd, ho *hbi.HostingEnd) {
-			efs := &exportedFileSystem{
+			efs = &exportedFileSystem{
 				exportRoot: exportRoot,
+				ident:      ident,
 
 				po: po, ho: ho,
+
+				icd: &icFSD{}, dfd: &icDFD{},
+
+				metaSlots: newOpSlots(ppc), dataSlots: newOpSlots(ppc),
 			}
+			efs.codec.Bufs = &efs.bufPool
 
 			// expose efs as the reactor
 			he.ExposeReactor(efs)
 		})
 
+	he.ExposeFunction("__hbi_cleanup__", // callback on wire disconnected
+		func(po *hbi.PostingEnd, ho *hbi.HostingEnd, discReason string) {
+			if efs != nil {
+				if efs.session != nil {
+					efs.detachSession()
+					return
+				}
+				efs.unregisterSession()
+				efs.watcher.stop()
+				efs.releaseWorksets()
+			}
+		})
+
 	return he
 }
 
@@ -60,12 +118,17 @@ type exportedFileSystem struct {
 	// multiple local filesystems can be separately mounted under this path for different
 	// jdfc to mount.
 	//
-	// todo for a JDFS mount to expose nested filesystems under its mounted root dir,
-	// there're possibilities that inode numbers from different fs collide, maybe FUSE
-	// generationNumber can be used to support that, or just don't support nested fs over
-	// JDFS, as what we are doing now.
+	// nested filesystems under the mounted root dir are only exposed if the export
+	// policy says so, with inode numbers from different fs remapped to not collide,
+	// see nested.go
 	exportRoot string
 
+	// what's known about the connected jdfc
+	ident *jdfcIdent
+
+	// subtrees forced read-only by the export policy, relative to the mounted root
+	roSubtrees []string
+
 	// HBI posting/hosting ends
 	po *hbi.PostingEnd
 	ho *hbi.HostingEnd
@@ -73,59 +136,154 @@ type exportedFileSystem struct {
 	// whether readOnly, as jdfc requested on initial mount
 	readOnly bool
 
-	// in-core filesystem data
-	icd icFSD
+	// the local dir mounted as JDFS root, nil before mounted
+	root *mountedRoot
+
+	// in-core filesystem data, shared with data channels attached
+	icd *icFSD
+
+	// watcher of local fs changes, nil if not watching
+	watcher *fsWatcher
 
 	// buffer pool
 	bufPool BufPool
 
-	// in-core data file data
-	dfd icDFD
+	// in-core data file data, shared with data channels attached
+	dfd *icDFD
+
+	// worksets made by this session, to their owner files held locked
+	ownedWorksets map[string]*os.File
+	wsMu          sync.Mutex
+
+	// cancel funcs of ops in flight, by coSeq of their conversations
+	opCancels map[string]context.CancelFunc
+	opMu      sync.Mutex
+
+	// slots bounding metadata/data ops in progress concurrently, see ppc.go
+	metaSlots, dataSlots opSlots
+
+	// token for data channels to attach to this session, see datachan.go
+	token string
+	// data channels attached to this session
+	dataChans []*exportedFileSystem
+	// the session this wire is attached to as a data channel, nil for the wire
+	// mounted over
+	session *exportedFileSystem
+
+	// how bulk data payloads are sent/received, raw and unchecked unless
+	// negotiated otherwise, see vfs.PayloadCodec
+	codec vfs.PayloadCodec
 }
 
 func (efs *exportedFileSystem) NamesToExpose() []string {
 	return []string{
 		// house keeping
-		"Mount", "StatFS",
+		"Mount", "ResumeInode", "StatFS", "CancelOp", "AttachSession",
+		"UseCompression", "UseChecksum",
 
 		// vfs operations
 		"LookUpInode", "GetInodeAttributes", "SetInodeAttributes", "ForgetInode",
 		"MkDir", "CreateFile", "CreateSymlink", "CreateLink", "Rename", "RmDir",
-		"Unlink", "OpenDir", "ReadDir", "ReleaseDirHandle", "OpenFile", "ReadFile",
-		"WriteFile", "SyncFile", "ReleaseFileHandle", "ReadSymlink", "RemoveXattr",
-		"GetXattr", "ListXattr", "SetXattr",
+		"Unlink", "OpenDir", "ReadDir", "ReadDirPlus", "ReleaseDirHandle", "OpenFile",
+		"ReadFile", "WriteFile", "SyncFile", "Fallocate", "Lseek", "ReleaseFileHandle",
+		"ReadSymlink", "RemoveXattr", "GetXattr", "ListXattr", "SetXattr", "GetLock",
+		"SetLock", "CopyFileRange",
 
 		// direct data file access
 		"ListJDF", "StatJDF", "AllocJDF", "CopyJDF",
 		"OpenJDF", "ReadJDF", "WriteJDF", "SyncJDF", "CloseJDF",
+		"ReadJDFv", "WriteJDFv",
 
 		// workset management methods
 		"MakeWorksetRoot", "DiscardWorksetRoot", "CommitWorkset",
+		"ListWorksets", "StatWorkset",
 	}
 }
 
 func (efs *exportedFileSystem) Mount(readOnly bool, jdfsPath string) {
-	efs.readOnly = readOnly
+	if efs.root != nil || efs.session != nil {
+		err := errors.Errorf("mounting [%s] over a wire already mounted or attached", jdfsPath)
+		efs.ho.Disconnect(fmt.Sprintf("%s", err), true)
+		panic(err)
+	}
 
-	var rootPath string
-	if jdfsPath == "/" || jdfsPath == "" {
-		rootPath = efs.exportRoot
+	// no escaping from export root through ../ or symlinks
+	mountPath, err := confineUnder(efs.exportRoot, strings.TrimPrefix(jdfsPath, "/"))
+	if err != nil {
+		err = errors.Wrapf(err, "mounting [%s]", jdfsPath)
+		efs.ho.Disconnect(fmt.Sprintf("%s", err), true)
+		panic(err)
+	}
 
-	} else {
-		rootPath = filepath.Join(efs.exportRoot, jdfsPath)
+	if efs.ident.grant != nil {
+		if err := efs.ident.grant.permits(jdfsPath, readOnly); err != nil {
+			efs.ho.Disconnect(fmt.Sprintf("%s", err), true)
+			panic(err)
+		}
+	}
+
+	if efs.ident.peer != nil {
+		glog.V(1).Infof("Mounting [%s] for jdfc %s", jdfsPath, efs.ident.peer)
+	}
+
+	nestedFS := false
+	if policy, err := loadExportPolicy(); err != nil {
+		efs.ho.Disconnect(fmt.Sprintf("%s", err), true)
+		panic(err)
+	} else if policy != nil {
+		if efs.roSubtrees, nestedFS, err = policy.mountFor(jdfsPath, efs.ident, efs.ho.RemoteAddr()); err != nil {
+			efs.ho.Disconnect(fmt.Sprintf("%s", err), true)
+			panic(err)
+		}
+		if len(efs.roSubtrees) > 0 {
+			glog.V(1).Infof("Mounting [%s] with read-only subtrees %v", jdfsPath, efs.roSubtrees)
+		}
+		if nestedFS {
+			glog.V(1).Infof("Mounting [%s] with nested filesystems exposed", jdfsPath)
+		}
 	}
 
-	jdfsRootPath = rootPath
-	if err := efs.icd.init(readOnly); err != nil {
+	efs.readOnly = readOnly
+
+	if efs.root, err = openRoot(efs.exportRoot, mountPath, readOnly, nestedFS); err != nil {
 		efs.ho.Disconnect(fmt.Sprintf("%s", err), true)
 		panic(err)
 	}
 
-	if err := efs.dfd.init(readOnly); err != nil {
+	// watch dirs as they are loaded in-core, starting from root
+	efs.watcher = newFsWatcher(efs)
+	efs.icd.watcher = efs.watcher
+
+	if err := efs.icd.init(efs.root); err != nil {
+		efs.ho.Disconnect(fmt.Sprintf("%s", err), true)
+		panic(err)
+	}
+
+	if err := efs.dfd.init(efs.root); err != nil {
 		efs.ho.Disconnect(fmt.Sprintf("%s", err), true)
 		panic(err)
 	}
 
+	if !readOnly {
+		// roll interrupted workset commits forward or back
+		efs.recoverCommits()
+
+		if worksetTTL > 0 {
+			go func() {
+				if removed, err := GCWorksets(efs.exportRoot, worksetTTL); err != nil {
+					glog.Errorf("WS failed collecting stale worksets under [%s] - %+v", efs.exportRoot, err)
+				} else if removed > 0 {
+					glog.V(1).Infof("WS collected %d stale worksets under [%s]", removed, efs.exportRoot)
+				}
+			}()
+		}
+	}
+
+	// data channels can only attach within this process
+	if soloMode && !spawnedConn() {
+		efs.registerSession()
+	}
+
 	co := efs.ho.Co()
 	if err := co.StartSend(); err != nil {
 		panic(err)
@@ -133,13 +291,58 @@ func (efs *exportedFileSystem) Mount(readOnly bool, jdfsPath string) {
 
 	// send mount result fields
 	if err := co.SendObj(hbi.Repr(hbi.LitListType{
-		jdfRootInode, jdfsUID, jdfsGID, os.Getpid(),
+		efs.root.inode, efs.root.uid, efs.root.gid, os.Getpid(), efs.token,
+		methodList(vfs.WireCompressions), methodList(vfs.WireChecksums),
 	})); err != nil {
 		panic(err)
 	}
 }
 
-func (efs *exportedFileSystem) StatFS() {
+// ResumeInode loads an inode known to a jdfc reconnected after its previous jdfs
+// session lost, with the number of references its FUSE kernel counted.
+//
+// the inode must still be reachable through jdfPath, or ENOENT is returned.
+func (efs *exportedFileSystem) ResumeInode(inode vfs.InodeID, jdfPath string, refcnt int) {
+	co := efs.ho.Co()
+
+	if err := co.FinishRecv(); err != nil {
+		panic(err)
+	}
+
+	efs.metaSlots.acquire()
+	defer efs.metaSlots.release()
+
+	fse := vfs.FsErr(func() error {
+		jdfPath, err := efs.root.confinePath(jdfPath)
+		if err != nil {
+			return err
+		}
+		inoM, _, err := efs.root.statInode(inode, []string{jdfPath})
+		if err != nil {
+			return err
+		}
+		if _, ok := efs.icd.LoadInode(refcnt, inoM, nil, nil, time.Now()); !ok {
+			return vfs.ENOENT
+		}
+
+		if glog.V(2) {
+			glog.Infof("RESUME inode [%d] [%s]:[%s] refcnt=%d", inode, efs.root.path, jdfPath, refcnt)
+		}
+		return nil
+	}())
+
+	if err := co.StartSend(); err != nil {
+		panic(err)
+	}
+
+	if err := co.SendObj(fse.Repr()); err != nil {
+		panic(err)
+	}
+}
+
+// StatFS reports figures of the local filesystem JDFS root is on, or of the nested
+// one an inode is on, if nested filesystems are exposed by the export policy.
+func (efs *exportedFileSystem) StatFS(inode vfs.InodeID) {
 	co := efs.ho.Co()
 
 	if err := co.StartSend(); err != nil {
@@ -148,10 +351,13 @@ func (efs *exportedFileSystem) StatFS() {
 
 	var op vfs.StatFSOp
 
-	op, err := statFS(jdfRootDir)
+	op, err := efs.statNestedFS(inode)
 	if err != nil {
-		panic(err)
+		if op, err = statFS(efs.root.dir); err != nil {
+			panic(err)
+		}
 	}
+	op.Inode = inode
 
 	bufView := ((*[unsafe.Sizeof(op)]byte)(unsafe.Pointer(&op)))[0:unsafe.Sizeof(op)]
 	if err := co.SendData(bufView); err != nil {
@@ -166,8 +372,14 @@ func (efs *exportedFileSystem) LookUpInode(parent vfs.InodeID, name string) {
 		panic(err)
 	}
 
+	efs.metaSlots.acquire()
+	defer efs.metaSlots.release()
+
 	var ce vfs.ChildInodeEntry
 	fse := vfs.FsErr(func() error {
+		if err := checkName(name); err != nil {
+			return err
+		}
 		ici, ok, _, _ := efs.icd.GetInode(0, parent, 0)
 		if !ok {
 			return vfs.ENOENT
@@ -175,48 +387,10 @@ func (efs *exportedFileSystem) LookUpInode(parent vfs.InodeID, name string) {
 		// the children map won't be modified after armed to ici, no sync needed to read it
 		children := ici.children
 
-		// cache dir entries at jdfs side with 10ms timeout.
+		// children are cached at jdfs side with 10ms timeout, after a dir fully streamed
+		// by ReadDir, and not too large.
 		// note this has nothing to do with FUSE kernel caching.
-		if children == nil || time.Now().Sub(ici.lastChildrenChecked) > 10*time.Millisecond {
-			// read dir contents from local fs, cache to children list
-			parentM, outdatedPaths, err := statInode(parent, ici.reachedThrough)
-			if err != nil {
-				return err
-			}
-			childMs, err := readInodeDir(parentM)
-			if err != nil {
-				return err
-			}
-			checkTime := time.Now()
-			found := false
-			children = make(map[string]vfs.InodeID, len(childMs))
-			for i := range childMs {
-				childM := &childMs[i]
-				children[childM.name] = childM.inode
-				if childM.name == name {
-					if cici, ok := efs.icd.LoadInode(1, *childM, nil, nil, checkTime); ok {
-						ce = vfs.ChildInodeEntry{
-							Child:      cici.inode,
-							Generation: 0,
-							Attributes: cici.attrs,
-						}
-						found = true
-
-						if glog.V(2) {
-							glog.Infof("Resolved path [%s]:[%s]/[%s] to inode %d",
-								jdfsRootPath, parentM.jdfPath, name, cici.inode)
-						}
-					}
-				}
-			}
-			if ici, ok = efs.icd.LoadInode(0, parentM, outdatedPaths, children, checkTime); !ok {
-				return vfs.ENOENT
-			}
-			if found {
-				return nil
-			}
-			return vfs.ENOENT
-		} else {
+		if children != nil && time.Now().Sub(ici.lastChildrenChecked) <= 10*time.Millisecond {
 			// use cached children map
 			cInode, ok := children[name]
 			if !ok {
@@ -226,31 +400,49 @@ func (efs *exportedFileSystem) LookUpInode(parent vfs.InodeID, name string) {
 				// already in-core
 				ce = vfs.ChildInodeEntry{
 					Child:      cici.inode,
-					Generation: 0,
+					Generation: cici.gen,
 					Attributes: cici.attrs,
 				}
 				return nil
 			}
-			// not yet in-core, consult local fs
-			parentM, outdatedPaths, err := statInode(ici.inode, ici.reachedThrough)
-			if err != nil {
-				return err // failed stating parent dir
-			}
-			// update stat'ed parent meta data to in-core record
-			if ici, ok = efs.icd.LoadInode(0, parentM, outdatedPaths, nil, time.Now()); !ok {
-				return vfs.ENOENT // parent dir disappeared
+		}
+
+		// consult local fs, stating only the child, never reading the whole dir
+		parentM, outdatedPaths, err := efs.root.statInode(ici.inode, ici.reachedThrough)
+		if err != nil {
+			return err // failed stating parent dir
+		}
+		// update stat'ed parent meta data to in-core record
+		if ici, ok = efs.icd.LoadInode(0, parentM, outdatedPaths, nil, time.Now()); !ok {
+			return vfs.ENOENT // parent dir disappeared
+		}
+		childPath := parentM.childPath(name)
+		cFI, err := efs.root.lstat(childPath)
+		if err != nil {
+			return err
+		}
+		if cMode := cFI.Mode(); !cMode.IsDir() && !cMode.IsRegular() && cMode&os.ModeSymlink == 0 {
+			// a file not reigned by JDFS
+			glog.V(1).Infof("OUTLAW [%s]:[%s] with file mode [%#o] not revealed to jdfc.",
+				efs.root.path, childPath, cMode)
+			return vfs.ENOENT
+		}
+		childM := efs.root.fi2im(childPath, cFI)
+		if childM.dev != parentM.dev {
+			efs.root.crossMount(&childM)
+		}
+		if cici, ok := efs.icd.LoadInode(1, childM, nil, nil, time.Now()); ok {
+			ce = vfs.ChildInodeEntry{
+				Child:      cici.inode,
+				Generation: cici.gen,
+				Attributes: cici.attrs,
 			}
-			childPath := parentM.childPath(name)
-			if cFI, err := os.Lstat(childPath); err != nil {
-				return err
-			} else if cici, ok := efs.icd.LoadInode(1, fi2im(childPath, cFI), nil, nil, time.Now()); ok {
-				ce = vfs.ChildInodeEntry{
-					Child:      cici.inode,
-					Generation: 0,
-					Attributes: cici.attrs,
-				}
-				return nil
+
+			if glog.V(2) {
+				glog.Infof("Resolved path [%s]:[%s]/[%s] to inode %d",
+					efs.root.path, parentM.jdfPath, name, cici.inode)
 			}
+			return nil
 		}
 		return vfs.ENOENT
 	}())
@@ -279,6 +471,9 @@ func (efs *exportedFileSystem) GetInodeAttributes(inode vfs.InodeID) {
 		panic(err)
 	}
 
+	efs.metaSlots.acquire()
+	defer efs.metaSlots.release()
+
 	var attrs vfs.InodeAttributes
 
 	fsErr := func() (err error) {
@@ -289,7 +484,7 @@ func (efs *exportedFileSystem) GetInodeAttributes(inode vfs.InodeID) {
 		}
 		if gotHandle {
 			defer efs.icd.FileHandleOpDone(icfh)
-			if inoM, err = statFileHandle(icfh); err != nil {
+			if inoM, err = efs.root.statFileHandle(icfh); err != nil {
 				return
 			}
 			if ici, ok = efs.icd.LoadInode(0, inoM, nil, nil, time.Now()); !ok {
@@ -297,7 +492,7 @@ func (efs *exportedFileSystem) GetInodeAttributes(inode vfs.InodeID) {
 			}
 		} else {
 			var outdatedPaths []string
-			if inoM, outdatedPaths, err = statInode(
+			if inoM, outdatedPaths, err = efs.root.statInode(
 				ici.inode, ici.reachedThrough,
 			); err != nil {
 				return
@@ -339,6 +534,9 @@ func (efs *exportedFileSystem) SetInodeAttributes(inode vfs.InodeID,
 		panic(err)
 	}
 
+	efs.metaSlots.acquire()
+	defer efs.metaSlots.release()
+
 	var attrs vfs.InodeAttributes
 
 	fse := vfs.FsErr(func() (err error) {
@@ -352,12 +550,12 @@ func (efs *exportedFileSystem) SetInodeAttributes(inode vfs.InodeID,
 		}
 		if gotHandle {
 			defer efs.icd.FileHandleOpDone(icfh)
-			if inoM, err = statFileHandle(icfh); err != nil {
+			if inoM, err = efs.root.statFileHandle(icfh); err != nil {
 				return
 			}
 			inoF, writable = icfh.f, icfh.writable
 		} else {
-			if inoM, outdatedPaths, err = statInode(ici.inode, ici.reachedThrough); err != nil {
+			if inoM, outdatedPaths, err = efs.root.statInode(ici.inode, ici.reachedThrough); err != nil {
 				return
 			}
 		}
@@ -365,13 +563,18 @@ func (efs *exportedFileSystem) SetInodeAttributes(inode vfs.InodeID,
 
 		// perform FUSE requested ops on local fs
 
+		if err := efs.checkWritable(jdfPath); err != nil {
+			return err
+		}
+		efs.watcher.selfChange(jdfPath)
+
 		if chgSize {
 			if glog.V(2) {
 				glog.Infof("SZ setting size of [%d] [%s]:[%s] to %d bytes", ici.inode,
-					jdfsRootPath, jdfPath, sz)
+					efs.root.path, jdfPath, sz)
 			}
 			if inoF == nil || !writable {
-				if inoF, err = os.OpenFile(jdfPath, os.O_RDWR, 0); err != nil {
+				if inoF, err = efs.root.openFile(jdfPath, os.O_RDWR, 0); err != nil {
 					return
 				}
 				defer inoF.Close()
@@ -384,7 +587,7 @@ func (efs *exportedFileSystem) SetInodeAttributes(inode vfs.InodeID,
 		if chgMode {
 			if glog.V(2) {
 				glog.Infof("MOD setting mode of [%d] [%s]:[%s] to [%+v]", ici.inode,
-					jdfsRootPath, jdfPath, os.FileMode(mode))
+					efs.root.path, jdfPath, os.FileMode(mode))
 			}
 
 			if inoF != nil {
@@ -392,7 +595,7 @@ func (efs *exportedFileSystem) SetInodeAttributes(inode vfs.InodeID,
 					return
 				}
 			} else {
-				if err = os.Chmod(jdfPath, os.FileMode(mode)); err != nil {
+				if err = efs.root.chmod(jdfPath, os.FileMode(mode)); err != nil {
 					return
 				}
 			}
@@ -401,11 +604,11 @@ func (efs *exportedFileSystem) SetInodeAttributes(inode vfs.InodeID,
 		if chgMtime {
 			if glog.V(2) {
 				glog.Infof("MTIM setting mtime of [%d] [%s]:[%s] to %v", ici.inode,
-					jdfsRootPath, jdfPath, time.Unix(0, mNsec))
+					efs.root.path, jdfPath, time.Unix(0, mNsec))
 			}
 
 			if inoF != nil && writable {
-				if err = chftimes(inoF, jdfPath, mNsec); err != nil {
+				if err = chftimes(inoF, efs.root.abs(jdfPath), mNsec); err != nil {
 					return
 				}
 			} else {
@@ -414,10 +617,10 @@ func (efs *exportedFileSystem) SetInodeAttributes(inode vfs.InodeID,
 		}
 
 		// stat local fs again for new meta attrs
-		if inoFI, e := os.Lstat(jdfPath); e != nil {
+		if inoFI, e := efs.root.lstat(jdfPath); e != nil {
 			err = e // local fs error
 			return
-		} else if ici, ok = efs.icd.LoadInode(0, fi2im(jdfPath, inoFI), outdatedPaths, nil, time.Now()); !ok {
+		} else if ici, ok = efs.icd.LoadInode(0, efs.root.fi2im(jdfPath, inoFI), outdatedPaths, nil, time.Now()); !ok {
 			err = vfs.ENOENT // inode disappeared
 			return
 		}
@@ -468,16 +671,22 @@ func (efs *exportedFileSystem) MkDir(parent vfs.InodeID, name string, mode uint3
 		panic(err)
 	}
 
+	efs.metaSlots.acquire()
+	defer efs.metaSlots.release()
+
 	var ce vfs.ChildInodeEntry
 
 	fse := vfs.FsErr(func() error {
+		if err := checkName(name); err != nil {
+			return err
+		}
 		ici, ok, _, _ := efs.icd.GetInode(0, parent, 0)
 		if !ok {
 			return vfs.ENOENT
 		}
 		// parent can not have open file handle, always stat the local fs namespace for
 		// a reachable path to parent dir.
-		parentM, outdatedPaths, err := statInode(ici.inode, ici.reachedThrough)
+		parentM, outdatedPaths, err := efs.root.statInode(ici.inode, ici.reachedThrough)
 		if err != nil {
 			return err
 		}
@@ -487,18 +696,22 @@ func (efs *exportedFileSystem) MkDir(parent vfs.InodeID, name string, mode uint3
 
 		// perform requested FUSE op on local fs
 		childPath := parentM.childPath(name)
-		if err = os.Mkdir(childPath, os.FileMode(mode)); err != nil {
+		if err := efs.checkWritable(childPath); err != nil {
+			return err
+		}
+		efs.watcher.selfChange(childPath)
+		if err = efs.root.mkdir(childPath, os.FileMode(mode)); err != nil {
 			return err
 		}
-		cFI, err := os.Lstat(childPath)
+		cFI, err := efs.root.lstat(childPath)
 		if err != nil {
 			return err
 		}
 		checkTime := time.Now()
-		childM := fi2im(childPath, cFI)
+		childM := efs.root.fi2im(childPath, cFI)
 		if glog.V(2) {
 			glog.Infof("Made dir [%s]:[%s]/[%s] with mode [%+v] => [%+v]",
-				jdfsRootPath, parentM.jdfPath, name,
+				efs.root.path, parentM.jdfPath, name,
 				os.FileMode(mode), cFI.Mode())
 		}
 		if cici, ok := efs.icd.LoadInode(1, childM, nil, nil, checkTime); !ok {
@@ -507,7 +720,7 @@ func (efs *exportedFileSystem) MkDir(parent vfs.InodeID, name string, mode uint3
 			efs.icd.InvalidateChildren(ici.inode, "", name)
 			ce = vfs.ChildInodeEntry{
 				Child:      cici.inode,
-				Generation: 0,
+				Generation: cici.gen,
 				Attributes: cici.attrs,
 			}
 			return nil
@@ -538,6 +751,9 @@ func (efs *exportedFileSystem) CreateFile(parent vfs.InodeID, name string, mode
 		panic(err)
 	}
 
+	efs.metaSlots.acquire()
+	defer efs.metaSlots.release()
+
 	var ce vfs.ChildInodeEntry
 	handle, fsErr := func() (handle vfs.HandleID, err error) {
 		parentPath := "<?!?>"
@@ -552,16 +768,19 @@ func (efs *exportedFileSystem) CreateFile(parent vfs.InodeID, name string, mode
 				}
 				if cF != nil { // don't leak file object on error
 					glog.Warningf("File [%s]:[%s]/[%s] created but no handle created for it.",
-						jdfsRootPath, parentPath, name)
+						efs.root.path, parentPath, name)
 					cF.Close()
 				}
 			}
 		}()
+		if err = checkName(name); err != nil {
+			return
+		}
 		ici, ok, _, _ := efs.icd.GetInode(0, parent, 0)
 		if !ok {
 			return 0, vfs.ENOENT
 		}
-		parentM, outdatedPaths, e := statInode(ici.inode, ici.reachedThrough)
+		parentM, outdatedPaths, e := efs.root.statInode(ici.inode, ici.reachedThrough)
 		if e != nil {
 			err = e
 			return
@@ -574,20 +793,24 @@ func (efs *exportedFileSystem) CreateFile(parent vfs.InodeID, name string, mode
 
 		// perform requested FUSE op on local fs
 		childPath := parentM.childPath(name)
-		if cF, err = os.OpenFile(childPath,
+		if err = efs.checkWritable(childPath); err != nil {
+			return
+		}
+		efs.watcher.selfChange(childPath)
+		if cF, err = efs.root.openFile(childPath,
 			// TODO need to figure out how to tell whether end user has specified O_EXCL
 			// os.O_EXCL|
 			os.O_CREATE|os.O_RDWR, os.FileMode(mode),
 		); err != nil {
 			return
 		}
-		cFI, e := os.Lstat(childPath)
+		cFI, e := efs.root.lstat(childPath)
 		if e != nil {
 			err = e
 			return
 		}
 		checkTime := time.Now()
-		childM := fi2im(childPath, cFI)
+		childM := efs.root.fi2im(childPath, cFI)
 		cici, ok := efs.icd.LoadInode(1, childM, nil, nil, checkTime)
 		if !ok {
 			err = vfs.ENOENT
@@ -597,7 +820,7 @@ func (efs *exportedFileSystem) CreateFile(parent vfs.InodeID, name string, mode
 
 		ce = vfs.ChildInodeEntry{
 			Child:      cici.inode,
-			Generation: 0,
+			Generation: cici.gen,
 			Attributes: cici.attrs,
 		}
 
@@ -607,7 +830,7 @@ func (efs *exportedFileSystem) CreateFile(parent vfs.InodeID, name string, mode
 
 		if glog.V(2) {
 			glog.Infof("Created file [%d] [%s]:[%s]/[%s] with mode [%+v] => [%+v], as handle %d",
-				cici.inode, jdfsRootPath, parentM.jdfPath, name,
+				cici.inode, efs.root.path, parentM.jdfPath, name,
 				os.FileMode(mode), cFI.Mode(), handle)
 		}
 
@@ -643,14 +866,20 @@ func (efs *exportedFileSystem) CreateSymlink(parent vfs.InodeID, name string, ta
 		panic(err)
 	}
 
+	efs.metaSlots.acquire()
+	defer efs.metaSlots.release()
+
 	var ce vfs.ChildInodeEntry
 
 	fse := vfs.FsErr(func() error {
+		if err := checkName(name); err != nil {
+			return err
+		}
 		ici, ok, _, _ := efs.icd.GetInode(0, parent, 0)
 		if !ok {
 			return vfs.ENOENT
 		}
-		parentM, outdatedPaths, err := statInode(ici.inode, ici.reachedThrough)
+		parentM, outdatedPaths, err := efs.root.statInode(ici.inode, ici.reachedThrough)
 		if err != nil {
 			return err
 		}
@@ -660,19 +889,23 @@ func (efs *exportedFileSystem) CreateSymlink(parent vfs.InodeID, name string, ta
 
 		// perform requested FUSE op on local fs
 		childPath := parentM.childPath(name)
-		if err = os.Symlink(target, childPath); err != nil {
+		if err := efs.checkWritable(childPath); err != nil {
 			return err
 		}
-		cFI, err := os.Lstat(childPath)
+		efs.watcher.selfChange(childPath)
+		if err = efs.root.symlink(target, childPath); err != nil {
+			return err
+		}
+		cFI, err := efs.root.lstat(childPath)
 		if err != nil {
 			return err
 		}
 		checkTime := time.Now()
-		childM := fi2im(childPath, cFI)
+		childM := efs.root.fi2im(childPath, cFI)
 
 		if glog.V(2) {
 			glog.Infof("Created symlink [%s]:[%s]/[%s] -> [%s] with mode [%+v]",
-				jdfsRootPath, parentM.jdfPath, name,
+				efs.root.path, parentM.jdfPath, name,
 				target, cFI.Mode())
 		}
 
@@ -682,7 +915,7 @@ func (efs *exportedFileSystem) CreateSymlink(parent vfs.InodeID, name string, ta
 			efs.icd.InvalidateChildren(ici.inode, "", name)
 			ce = vfs.ChildInodeEntry{
 				Child:      cici.inode,
-				Generation: 0,
+				Generation: cici.gen,
 				Attributes: cici.attrs,
 			}
 			return nil
@@ -713,14 +946,20 @@ func (efs *exportedFileSystem) CreateLink(parent vfs.InodeID, name string, targe
 		panic(err)
 	}
 
+	efs.metaSlots.acquire()
+	defer efs.metaSlots.release()
+
 	var ce vfs.ChildInodeEntry
 
 	fse := vfs.FsErr(func() error {
+		if err := checkName(name); err != nil {
+			return err
+		}
 		ici, ok, _, _ := efs.icd.GetInode(0, parent, 0)
 		if !ok {
 			return vfs.ENOENT
 		}
-		parentM, outdatedPaths, err := statInode(ici.inode, ici.reachedThrough)
+		parentM, outdatedPaths, err := efs.root.statInode(ici.inode, ici.reachedThrough)
 		if err != nil {
 			return err
 		}
@@ -735,12 +974,12 @@ func (efs *exportedFileSystem) CreateLink(parent vfs.InodeID, name string, targe
 		}
 		if gotHandle {
 			defer efs.icd.FileHandleOpDone(icfhTarget)
-			if targetM, err = statFileHandle(icfhTarget); err != nil {
+			if targetM, err = efs.root.statFileHandle(icfhTarget); err != nil {
 				return err
 			}
 		} else {
 			var outdatedPaths []string
-			if targetM, outdatedPaths, err = statInode(iciTarget.inode, iciTarget.reachedThrough); err != nil {
+			if targetM, outdatedPaths, err = efs.root.statInode(iciTarget.inode, iciTarget.reachedThrough); err != nil {
 				return err
 			}
 			if iciTarget, ok = efs.icd.LoadInode(0, targetM, outdatedPaths, nil, time.Now()); !ok {
@@ -750,19 +989,28 @@ func (efs *exportedFileSystem) CreateLink(parent vfs.InodeID, name string, targe
 
 		// perform requested FUSE op on local fs
 		childPath := parentM.childPath(name)
-		if err = os.Link(targetM.jdfPath, childPath); err != nil {
+		if err := efs.checkWritable(childPath); err != nil {
+			return err
+		}
+		// a file in a read-only subtree must not get a writable link elsewhere
+		if err := efs.checkWritable(targetM.jdfPath); err != nil {
 			return err
 		}
-		cFI, err := os.Lstat(childPath)
+		efs.watcher.selfChange(childPath)
+		efs.watcher.selfChange(targetM.jdfPath) // nlink changes
+		if err = efs.root.link(targetM.jdfPath, childPath); err != nil {
+			return err
+		}
+		cFI, err := efs.root.lstat(childPath)
 		if err != nil {
 			return err
 		}
 		checkTime := time.Now()
-		childM := fi2im(childPath, cFI)
+		childM := efs.root.fi2im(childPath, cFI)
 
 		if glog.V(2) {
 			glog.Infof("Created Link [%s]:[%s]/[%s] with mode [%+v]",
-				jdfsRootPath, parentM.jdfPath, name,
+				efs.root.path, parentM.jdfPath, name,
 				cFI.Mode())
 		}
 
@@ -772,7 +1020,7 @@ func (efs *exportedFileSystem) CreateLink(parent vfs.InodeID, name string, targe
 			efs.icd.InvalidateChildren(ici.inode, "", name)
 			ce = vfs.ChildInodeEntry{
 				Child:      cici.inode,
-				Generation: 0,
+				Generation: cici.gen,
 				Attributes: cici.attrs,
 			}
 			return nil
@@ -803,12 +1051,21 @@ func (efs *exportedFileSystem) Rename(oldParent vfs.InodeID, oldName string, new
 		panic(err)
 	}
 
+	efs.metaSlots.acquire()
+	defer efs.metaSlots.release()
+
 	fse := vfs.FsErr(func() error {
+		if err := checkName(oldName); err != nil {
+			return err
+		}
+		if err := checkName(newName); err != nil {
+			return err
+		}
 		iciOldParent, ok, _, _ := efs.icd.GetInode(0, oldParent, 0)
 		if !ok {
 			return vfs.ENOENT
 		}
-		oldParentM, outdatedPaths, err := statInode(iciOldParent.inode, iciOldParent.reachedThrough)
+		oldParentM, outdatedPaths, err := efs.root.statInode(iciOldParent.inode, iciOldParent.reachedThrough)
 		if err != nil {
 			return err
 		}
@@ -820,7 +1077,7 @@ func (efs *exportedFileSystem) Rename(oldParent vfs.InodeID, oldName string, new
 		if !ok {
 			return vfs.ENOENT
 		}
-		newParentM, outdatedPaths, err := statInode(iciNewParent.inode, iciNewParent.reachedThrough)
+		newParentM, outdatedPaths, err := efs.root.statInode(iciNewParent.inode, iciNewParent.reachedThrough)
 		if err != nil {
 			return err
 		}
@@ -831,24 +1088,32 @@ func (efs *exportedFileSystem) Rename(oldParent vfs.InodeID, oldName string, new
 		// perform requested FUSE op on local fs
 		oldPath := oldParentM.childPath(oldName)
 		newPath := newParentM.childPath(newName)
-		if err = os.Rename(oldPath, newPath); err != nil {
+		if err := efs.checkSubtreeWritable(oldPath); err != nil {
+			return err
+		}
+		efs.watcher.selfChange(oldPath)
+		if err := efs.checkSubtreeWritable(newPath); err != nil {
+			return err
+		}
+		efs.watcher.selfChange(newPath)
+		if err = efs.root.rename(oldPath, newPath); err != nil {
 			return err
 		}
 
 		// load meta data of renamed file to update its reachedThrough list
-		newFI, err := os.Lstat(newPath)
+		newFI, err := efs.root.lstat(newPath)
 		if err != nil {
 			return err
 		}
 		checkTime := time.Now()
-		newM := fi2im(newPath, newFI)
+		newM := efs.root.fi2im(newPath, newFI)
 		_, ok = efs.icd.LoadInode(0, newM, []string{oldPath}, nil, checkTime)
 		if !ok {
 			return vfs.ENOENT
 		}
 
 		if glog.V(2) {
-			glog.Infof("Renamed [%s]: [%s]/[%s] to [%s]/[%s]", jdfsRootPath,
+			glog.Infof("Renamed [%s]: [%s]/[%s] to [%s]/[%s]", efs.root.path,
 				oldParentM.jdfPath, oldName, newParentM.jdfPath, newName)
 		}
 
@@ -880,12 +1145,18 @@ func (efs *exportedFileSystem) RmDir(parent vfs.InodeID, name string) {
 		panic(err)
 	}
 
+	efs.metaSlots.acquire()
+	defer efs.metaSlots.release()
+
 	fse := vfs.FsErr(func() error {
+		if err := checkName(name); err != nil {
+			return err
+		}
 		ici, ok, _, _ := efs.icd.GetInode(0, parent, 0)
 		if !ok {
 			return vfs.ENOENT
 		}
-		parentM, outdatedPaths, err := statInode(ici.inode, ici.reachedThrough)
+		parentM, outdatedPaths, err := efs.root.statInode(ici.inode, ici.reachedThrough)
 		if err != nil {
 			return err
 		}
@@ -895,13 +1166,17 @@ func (efs *exportedFileSystem) RmDir(parent vfs.InodeID, name string) {
 
 		// perform requested FUSE op on local fs
 		childPath := parentM.childPath(name)
-		if err = syscall.Rmdir(childPath); err != nil {
+		if err := efs.checkWritable(childPath); err != nil {
+			return err
+		}
+		efs.watcher.selfChange(childPath)
+		if err = efs.root.rmdir(childPath); err != nil {
 			return err
 		}
 
 		if glog.V(2) {
 			glog.Infof("Removed dir [%s]:[%s]/[%s]",
-				jdfsRootPath, parentM.jdfPath, name)
+				efs.root.path, parentM.jdfPath, name)
 		}
 
 		efs.icd.InvalidateChildren(ici.inode, name, "")
@@ -928,12 +1203,18 @@ func (efs *exportedFileSystem) Unlink(parent vfs.InodeID, name string) {
 		panic(err)
 	}
 
+	efs.metaSlots.acquire()
+	defer efs.metaSlots.release()
+
 	fse := vfs.FsErr(func() error {
+		if err := checkName(name); err != nil {
+			return err
+		}
 		ici, ok, _, _ := efs.icd.GetInode(0, parent, 0)
 		if !ok {
 			return vfs.ENOENT
 		}
-		parentM, outdatedPaths, err := statInode(ici.inode, ici.reachedThrough)
+		parentM, outdatedPaths, err := efs.root.statInode(ici.inode, ici.reachedThrough)
 		if err != nil {
 			return err
 		}
@@ -943,13 +1224,17 @@ func (efs *exportedFileSystem) Unlink(parent vfs.InodeID, name string) {
 
 		// perform requested FUSE op on local fs
 		childPath := parentM.childPath(name)
-		if err = syscall.Unlink(childPath); err != nil {
+		if err := efs.checkWritable(childPath); err != nil {
+			return err
+		}
+		efs.watcher.selfChange(childPath)
+		if err = efs.root.unlink(childPath); err != nil {
 			return err
 		}
 
 		if glog.V(2) {
 			glog.Infof("Removed file [%s]:[%s]/[%s]",
-				jdfsRootPath, parentM.jdfPath, name)
+				efs.root.path, parentM.jdfPath, name)
 		}
 
 		efs.icd.InvalidateChildren(ici.inode, "", name)
@@ -976,6 +1261,9 @@ func (efs *exportedFileSystem) OpenDir(inode vfs.InodeID) {
 		panic(err)
 	}
 
+	efs.metaSlots.acquire()
+	defer efs.metaSlots.release()
+
 	handle, fse := efs.icd.CreateDirHandle(inode)
 
 	if glog.V(2) {
@@ -1001,97 +1289,166 @@ func (efs *exportedFileSystem) OpenDir(inode vfs.InodeID) {
 func (efs *exportedFileSystem) ReadDir(inode vfs.InodeID, handle int, offset int, bufSz int) {
 	co := efs.ho.Co()
 
+	ctx, opDone := efs.opContext()
+	defer opDone()
+
 	if err := co.FinishRecv(); err != nil {
 		panic(err)
 	}
 
-	var entries []vfs.DirEnt
-	var fse vfs.FsError
-	if offset == 0 { // reading from start, refresh entry list
-		fse = vfs.FsErr(func() error {
-			ici, ok, _, _ := efs.icd.GetInode(0, inode, 0)
-			if !ok {
-				return vfs.ENOENT
+	var bytesRead int
+	var buf []byte
+	fse := vfs.FsErr(func() error {
+		if err := efs.metaSlots.acquireFor(ctx); err != nil {
+			return err
+		}
+		defer efs.metaSlots.release()
+
+		icdh, err := efs.icd.GetDirHandle(inode, handle)
+		if err != nil {
+			return err
+		}
+		dc := icdh.cursor
+		dc.mu.Lock()
+		defer dc.mu.Unlock()
+
+		buf = efs.bufPool.Get(bufSz)
+
+		// stream entries in batches until the buffer is full
+		i := offset
+	fillBuf:
+		for {
+			if ctx.Err() != nil {
+				if bytesRead > 0 {
+					break // return what's read
+				}
+				return vfs.EINTR // interrupted at jdfc amid reading a huge dir
 			}
-			parentM, outdatedPaths, err := statInode(ici.inode, ici.reachedThrough)
+			childMs, err := efs.readDirAt(dc, inode, i)
 			if err != nil {
 				return err
 			}
-			if ici, ok = efs.icd.LoadInode(0, parentM, outdatedPaths, nil, time.Now()); !ok {
-				return vfs.ENOENT
-			}
-			childMs, err := readInodeDir(parentM)
-			if err != nil {
-				return err
+			if len(childMs) <= 0 {
+				break // end of dir
 			}
-			checkTime := time.Now()
-
-			if glog.V(2) {
-				glog.Infof("LS loaded %d entries for [%s]:[%s]", len(childMs), jdfsRootPath,
-					parentM.jdfPath)
-			}
-
-			var children map[string]vfs.InodeID
-			if len(childMs) > 0 {
-				children = make(map[string]vfs.InodeID, len(childMs))
-				entries = make([]vfs.DirEnt, 0, len(childMs))
-			}
-			for i := range childMs {
-				childM := &childMs[i]
-
-				children[childM.name] = childM.inode
-
-				cMode := childM.attrs.Mode
-				entType := vfs.DT_Unknown
-				if cMode.IsDir() {
-					entType = vfs.DT_Directory
-				} else if cMode.IsRegular() {
-					entType = vfs.DT_File
-				} else if cMode&os.ModeSymlink != 0 {
-					entType = vfs.DT_Link
-				} else {
-					if glog.V(1) {
-						glog.Infof("jdfs [%s]:[%s]/[%s] has mode [%v], not revealed to jdfc.",
-							jdfsRootPath, parentM.jdfPath, childM.name, cMode)
-					}
-					continue // hide this strange inode to jdfc
+			for j := range childMs {
+				n := vfs.WriteDirEnt(buf[bytesRead:], dirEntOf(i, &childMs[j]))
+				if n <= 0 {
+					break fillBuf
 				}
-				entries = append(entries, vfs.DirEnt{
-					Offset: vfs.DirOffset(len(entries) + 1),
-					Inode:  childM.inode,
-					Name:   childM.name,
-					Type:   entType,
-				})
-			}
-			if ici, ok = efs.icd.LoadInode(0, parentM, outdatedPaths, children, checkTime); !ok {
-				return vfs.ENOENT
+				bytesRead += n
+				i++
 			}
+		}
 
-			return nil
-		}())
+		if glog.V(2) {
+			glog.Infof("LS returning %d (%d~%d) entries from handle [%d] for dir [%d]",
+				i-offset, offset, i, handle, icdh.inode)
+		}
+		return nil
+	}())
+	if buf != nil {
+		defer efs.bufPool.Return(buf)
 	}
 
-	var bytesRead int
-	var buf []byte
-	icdh, fsErr := efs.icd.GetDirHandle(inode, handle, entries)
-	if fsErr == nil {
-		buf = efs.bufPool.Get(bufSz)
-		defer efs.bufPool.Return(buf)
+	if err := co.StartSend(); err != nil {
+		panic(err)
+	}
 
+	if err := co.SendObj(fse.Repr()); err != nil {
+		panic(err)
+	}
+	if fse != 0 {
+		return
+	}
+
+	if err := co.SendObj(hbi.Repr(bytesRead)); err != nil {
+		panic(err)
+	}
+	if bytesRead > 0 {
+		if err := co.SendData(buf[:bytesRead]); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// ReadDirPlus reads dir entries as ReadDir does, along with the child inodes
+// as LookUpInode does, with a reference counted for each child returned.
+func (efs *exportedFileSystem) ReadDirPlus(inode vfs.InodeID, handle int, offset int, bufSz int) {
+	co := efs.ho.Co()
+
+	ctx, opDone := efs.opContext()
+	defer opDone()
+
+	if err := co.FinishRecv(); err != nil {
+		panic(err)
+	}
+
+	var dirEnts []vfs.DirEnt
+	var ces []vfs.ChildInodeEntry
+	fse := vfs.FsErr(func() error {
+		if err := efs.metaSlots.acquireFor(ctx); err != nil {
+			return err
+		}
+		defer efs.metaSlots.release()
+
+		icdh, err := efs.icd.GetDirHandle(inode, handle)
+		if err != nil {
+			return err
+		}
+		dc := icdh.cursor
+		dc.mu.Lock()
+		defer dc.mu.Unlock()
+
+		// stream entries in batches until the buffer is full
+		bytesRead := 0
 		i := offset
-		for ; i < len(icdh.entries); i++ {
-			n := vfs.WriteDirEnt(buf[bytesRead:], icdh.entries[i])
-			if n <= 0 {
-				break
+	fillBuf:
+		for {
+			if ctx.Err() != nil {
+				if len(dirEnts) > 0 {
+					break // return what's read
+				}
+				return vfs.EINTR // interrupted at jdfc amid reading a huge dir
+			}
+			childMs, err := efs.readDirAt(dc, inode, i)
+			if err != nil {
+				return err
+			}
+			if len(childMs) <= 0 {
+				break // end of dir
+			}
+			for j := range childMs {
+				childM := &childMs[j]
+				n := vfs.DirEntPlusSize(childM.name)
+				if bytesRead+n > bufSz {
+					break fillBuf
+				}
+				de := dirEntOf(i, childM)
+				i++
+
+				cici, ok := efs.icd.LoadInode(1, *childM, nil, nil, dc.batchTime)
+				if !ok {
+					continue // not revealed to jdfc, leave it out
+				}
+
+				de.Inode = cici.inode
+				dirEnts = append(dirEnts, de)
+				ces = append(ces, vfs.ChildInodeEntry{
+					Child:      cici.inode,
+					Generation: cici.gen,
+					Attributes: cici.attrs,
+				})
+				bytesRead += n
 			}
-			bytesRead += n
 		}
 
 		if glog.V(2) {
-			glog.Infof("LS returning %d (%d~%d) of %d entries from handle [%d] for dir [%d]",
-				i-offset, offset, i, len(icdh.entries), handle, icdh.inode)
+			glog.Infof("LS+ returning %d (%d~%d) entries from handle [%d] for dir [%d]",
+				len(dirEnts), offset, i, handle, icdh.inode)
 		}
-	}
+		return nil
+	}())
 
 	if err := co.StartSend(); err != nil {
 		panic(err)
@@ -1104,11 +1461,18 @@ func (efs *exportedFileSystem) ReadDir(inode vfs.InodeID, handle int, offset int
 		return
 	}
 
-	if err := co.SendObj(hbi.Repr(bytesRead)); err != nil {
+	var deList strings.Builder
+	deList.WriteString("[")
+	for _, de := range dirEnts {
+		fmt.Fprintf(&deList, "[%d,%d,%#v],", de.Offset, de.Type, de.Name)
+	}
+	deList.WriteString("]")
+	if err := co.SendObj(deList.String()); err != nil {
 		panic(err)
 	}
-	if bytesRead > 0 {
-		if err := co.SendData(buf[:bytesRead]); err != nil {
+	if len(ces) > 0 {
+		bufView := ((*[1 << 30]byte)(unsafe.Pointer(&ces[0])))[:uintptr(len(ces))*unsafe.Sizeof(ces[0])]
+		if err := co.SendData(bufView); err != nil {
 			panic(err)
 		}
 	}
@@ -1121,7 +1485,18 @@ func (efs *exportedFileSystem) ReleaseDirHandle(handle int) {
 		panic(err)
 	}
 
-	released := efs.icd.ReleaseDirHandle(handle)
+	released, err := efs.icd.ReleaseDirHandle(handle)
+	if err != nil {
+		// jdfc expects nothing back
+		glog.Errorf("LS failed releasing dir handle [%d] on [%s] - %s",
+			handle, efs.root.path, vfs.FsErr(err).Repr())
+		return
+	}
+	if dc := released.cursor; dc != nil {
+		dc.mu.Lock()
+		dc.close(efs.root)
+		dc.mu.Unlock()
+	}
 
 	if glog.V(2) {
 		glog.Infof("LS released dir handle [%d] for [%d]", handle, released.inode)
@@ -1135,6 +1510,9 @@ func (efs *exportedFileSystem) OpenFile(inode vfs.InodeID, writable, createIfNE
 		panic(err)
 	}
 
+	efs.metaSlots.acquire()
+	defer efs.metaSlots.release()
+
 	handle, fsErr := func() (handle vfs.HandleID, err error) {
 		// do this before the underlying HBI wire released
 		ici, ok, icfh, gotHandle := efs.icd.GetInode(0, inode, 1)
@@ -1165,12 +1543,17 @@ func (efs *exportedFileSystem) OpenFile(inode vfs.InodeID, writable, createIfNE
 			}
 		}()
 		if gotHandle {
+			if writable || createIfNE {
+				if err = efs.checkWritable(icfh.f.Name()); err != nil {
+					return
+				}
+			}
 			if !writable || icfh.writable {
 				jdfPath := icfh.f.Name()
 				if !writable && icfh.writable {
 					// todo should this be a problem ?
 					glog.V(1).Infof("Reusing a writable file handle on [%d] [%s]:[%s] for readonly.",
-						inode, jdfsRootPath, jdfPath)
+						inode, efs.root.path, jdfPath)
 				}
 				var fd int
 				// by dup the fd, the file can be opened another time even it has been unlinked
@@ -1181,7 +1564,7 @@ func (efs *exportedFileSystem) OpenFile(inode vfs.InodeID, writable, createIfNE
 			}
 		}
 		if oF == nil {
-			inoM, outdatedPaths, e := statInode(ici.inode, ici.reachedThrough)
+			inoM, outdatedPaths, e := efs.root.statInode(ici.inode, ici.reachedThrough)
 			if e != nil {
 				err = e
 				return
@@ -1191,7 +1574,12 @@ func (efs *exportedFileSystem) OpenFile(inode vfs.InodeID, writable, createIfNE
 				return
 			}
 			jdfPath := inoM.jdfPath
-			if oF, err = os.OpenFile(jdfPath, openFlags, 0644); err != nil {
+			if writable || createIfNE {
+				if err = efs.checkWritable(jdfPath); err != nil {
+					return
+				}
+			}
+			if oF, err = efs.root.openFile(jdfPath, openFlags, 0644); err != nil {
 				return
 			}
 		}
@@ -1202,7 +1590,7 @@ func (efs *exportedFileSystem) OpenFile(inode vfs.InodeID, writable, createIfNE
 
 		if glog.V(2) {
 			glog.Infof("Opened file [%d] [%s]:[%s] writable=%v, as handle %d",
-				ici.inode, jdfsRootPath, oF.Name(), writable, handle)
+				ici.inode, efs.root.path, oF.Name(), writable, handle)
 		}
 
 		return
@@ -1228,8 +1616,16 @@ func (efs *exportedFileSystem) OpenFile(inode vfs.InodeID, writable, createIfNE
 func (efs *exportedFileSystem) ReadFile(inode vfs.InodeID, handle int, offset int64, bufSz int) {
 	co := efs.ho.Co()
 
+	ctx, opDone := efs.opContext()
+	defer opDone()
+
 	var bytesRead int
 	var buf []byte
+	defer func() {
+		if buf != nil {
+			efs.bufPool.Return(buf)
+		}
+	}()
 	fsErr := func() error {
 		// do this before the underlying HBI wire released
 		icfh, err := efs.icd.GetFileHandle(inode, handle, 1)
@@ -1241,19 +1637,27 @@ func (efs *exportedFileSystem) ReadFile(inode vfs.InodeID, handle int, offset in
 		if err := co.FinishRecv(); err != nil {
 			panic(err)
 		}
+		if ctx.Err() != nil {
+			return vfs.EINTR
+		}
+
+		if err := efs.dataSlots.acquireFor(ctx); err != nil {
+			return err
+		}
+		defer efs.dataSlots.release()
 
+		// returned after sent
 		buf = efs.bufPool.Get(bufSz)
-		defer efs.bufPool.Return(buf)
 
 		if bytesRead, err = icfh.f.ReadAt(buf, offset); err != nil && err != io.EOF {
 			glog.Errorf("Error reading file [%d] [%s]:[%s] with handle %d - %+v",
-				inode, jdfsRootPath, icfh.f.Name(), handle, err)
+				inode, efs.root.path, icfh.f.Name(), handle, err)
 			return err
 		}
 
 		if glog.V(2) {
 			glog.Infof("Read %d bytes @%d from file [%d] [%s]:[%s] with handle %d", bytesRead, offset,
-				icfh.inode, jdfsRootPath, icfh.f.Name(), handle)
+				icfh.inode, efs.root.path, icfh.f.Name(), handle)
 		}
 		return nil
 	}()
@@ -1283,7 +1687,7 @@ func (efs *exportedFileSystem) ReadFile(inode vfs.InodeID, handle int, offset in
 		panic(err)
 	}
 	if bytesRead > 0 {
-		if err := co.SendData(buf[:bytesRead]); err != nil {
+		if err := efs.sendPayload(co, buf[:bytesRead]); err != nil {
 			panic(err)
 		}
 	}
@@ -1292,10 +1696,14 @@ func (efs *exportedFileSystem) ReadFile(inode vfs.InodeID, handle int, offset in
 func (efs *exportedFileSystem) WriteFile(inode vfs.InodeID, handle int, offset int64, dataSz int) {
 	co := efs.ho.Co()
 
+	ctx, opDone := efs.opContext()
+	defer opDone()
+
 	buf := efs.bufPool.Get(dataSz)
 	defer efs.bufPool.Return(buf)
-	if err := co.RecvData(buf); err != nil {
-		panic(err)
+	payloadErr := efs.recvPayload(co, buf)
+	if _, ok := payloadErr.(vfs.FsError); payloadErr != nil && !ok {
+		panic(payloadErr)
 	}
 
 	fsErr := func() error {
@@ -1309,17 +1717,32 @@ func (efs *exportedFileSystem) WriteFile(inode vfs.InodeID, handle int, offset i
 		if err := co.FinishRecv(); err != nil {
 			panic(err)
 		}
+		if payloadErr != nil {
+			return payloadErr
+		}
+		if ctx.Err() != nil {
+			return vfs.EINTR
+		}
+
+		if err := efs.dataSlots.acquireFor(ctx); err != nil {
+			return err
+		}
+		defer efs.dataSlots.release()
 
+		if err := efs.checkWritable(icfh.f.Name()); err != nil {
+			return err
+		}
+		efs.watcher.selfChange(icfh.f.Name())
 		bytesWritten := 0
 		if bytesWritten, err = icfh.f.WriteAt(buf, offset); err != nil {
 			glog.Errorf("Error writing file [%d] [%s]:[%s] with handle %d - %+v",
-				inode, jdfsRootPath, icfh.f.Name(), handle, err)
+				inode, efs.root.path, icfh.f.Name(), handle, err)
 			return err
 		}
 
 		if glog.V(2) {
 			glog.Infof("Written %d bytes @%d to file [%d] [%s]:[%s] with handle %d", bytesWritten, offset,
-				icfh.inode, jdfsRootPath, icfh.f.Name(), handle)
+				icfh.inode, efs.root.path, icfh.f.Name(), handle)
 		}
 		return nil
 	}()
@@ -1352,14 +1775,17 @@ func (efs *exportedFileSystem) SyncFile(inode vfs.InodeID, handle int) {
 			panic(err)
 		}
 
+		efs.dataSlots.acquire()
+		defer efs.dataSlots.release()
+
 		if err = icfh.f.Sync(); err != nil {
 			glog.Errorf("Error syncing file [%d] [%s]:[%s] with handle %d - %+v",
-				inode, jdfsRootPath, icfh.f.Name(), handle, err)
+				inode, efs.root.path, icfh.f.Name(), handle, err)
 			return err
 		}
 
 		if glog.V(2) {
-			glog.Infof("Sync'ed file [%d] [%s]:[%s] with handle %d", icfh.inode, jdfsRootPath,
+			glog.Infof("Sync'ed file [%d] [%s]:[%s] with handle %d", icfh.inode, efs.root.path,
 				icfh.f.Name(), handle)
 		}
 		return nil
@@ -1378,6 +1804,135 @@ func (efs *exportedFileSystem) SyncFile(inode vfs.InodeID, handle int) {
 	}
 }
 
+func (efs *exportedFileSystem) Fallocate(inode vfs.InodeID, handle int, offset, length int64, mode uint32) {
+	co := efs.ho.Co()
+
+	ctx, opDone := efs.opContext()
+	defer opDone()
+
+	fsErr := func() error {
+		// do this before the underlying HBI wire released
+		icfh, err := efs.icd.GetFileHandle(inode, handle, 1)
+		if err != nil {
+			return err
+		}
+		defer efs.icd.FileHandleOpDone(icfh)
+
+		if err := co.FinishRecv(); err != nil {
+			panic(err)
+		}
+		if ctx.Err() != nil {
+			return vfs.EINTR
+		}
+		if mode&^vfs.FallocModes != 0 {
+			return vfs.EOPNOTSUPP
+		}
+
+		if err := efs.dataSlots.acquireFor(ctx); err != nil {
+			return err
+		}
+		defer efs.dataSlots.release()
+
+		if err := efs.checkWritable(icfh.f.Name()); err != nil {
+			return err
+		}
+		efs.watcher.selfChange(icfh.f.Name())
+		if err = fallocate(icfh.f, mode, offset, length); err != nil {
+			glog.Errorf("Error fallocating file [%d] [%s]:[%s] with handle %d mode %#x - %+v",
+				inode, efs.root.path, icfh.f.Name(), handle, mode, err)
+			return err
+		}
+
+		if glog.V(2) {
+			glog.Infof("Fallocated %d bytes @%d mode %#x of file [%d] [%s]:[%s] with handle %d",
+				length, offset, mode, icfh.inode, efs.root.path, icfh.f.Name(), handle)
+		}
+		return nil
+	}()
+
+	if err := co.StartSend(); err != nil {
+		panic(err)
+	}
+
+	fse := vfs.FsErr(fsErr)
+	if err := co.SendObj(fse.Repr()); err != nil {
+		panic(err)
+	}
+	if fse != 0 {
+		return
+	}
+}
+
+func (efs *exportedFileSystem) Lseek(inode vfs.InodeID, handle int, offset int64, whence int) {
+	co := efs.ho.Co()
+
+	ctx, opDone := efs.opContext()
+	defer opDone()
+
+	var found int64
+	fsErr := func() error {
+		// do this before the underlying HBI wire released
+		icfh, err := efs.icd.GetFileHandle(inode, handle, 1)
+		if err != nil {
+			return err
+		}
+		defer efs.icd.FileHandleOpDone(icfh)
+
+		if err := co.FinishRecv(); err != nil {
+			panic(err)
+		}
+		if ctx.Err() != nil {
+			return vfs.EINTR
+		}
+
+		if err := efs.metaSlots.acquireFor(ctx); err != nil {
+			return err
+		}
+		defer efs.metaSlots.release()
+
+		var localWhence int
+		switch vfs.SeekWhence(whence) {
+		case vfs.SeekData:
+			localWhence = seekData
+		case vfs.SeekHole:
+			localWhence = seekHole
+		default:
+			return vfs.EINVAL
+		}
+
+		// the file offset is not otherwise used by jdfs, reads/writes are positional
+		if found, err = icfh.f.Seek(offset, localWhence); err != nil {
+			if vfs.FsErr(err) != vfs.ENXIO {
+				glog.Errorf("Error seeking file [%d] [%s]:[%s] with handle %d - %+v",
+					inode, efs.root.path, icfh.f.Name(), handle, err)
+			}
+			return err
+		}
+
+		if glog.V(2) {
+			glog.Infof("Seeked %d from @%d whence %d in file [%d] [%s]:[%s] with handle %d",
+				found, offset, whence, icfh.inode, efs.root.path, icfh.f.Name(), handle)
+		}
+		return nil
+	}()
+
+	if err := co.StartSend(); err != nil {
+		panic(err)
+	}
+
+	fse := vfs.FsErr(fsErr)
+	if err := co.SendObj(fse.Repr()); err != nil {
+		panic(err)
+	}
+	if fse != 0 {
+		return
+	}
+
+	if err := co.SendObj(hbi.Repr(found)); err != nil {
+		panic(err)
+	}
+}
+
 func (efs *exportedFileSystem) ReleaseFileHandle(handle int) {
 	co := efs.ho.Co()
 
@@ -1386,21 +1941,23 @@ func (efs *exportedFileSystem) ReleaseFileHandle(handle int) {
 		panic(err)
 	}
 
-	inode, f := efs.icd.ReleaseFileHandle(handle)
-	if f == nil {
-		glog.Fatal("no file pointer from released file handle ?!")
+	inode, f, err := efs.icd.ReleaseFileHandle(handle)
+	if err != nil {
+		// jdfc expects nothing back
+		glog.Errorf("REL failed releasing file handle %d on [%s] - %s",
+			handle, efs.root.path, vfs.FsErr(err).Repr())
 		return
 	}
 
 	jdfPath := f.Name()
 	if err := f.Close(); err != nil {
 		glog.Errorf("Error on closing jdfs file [%s]:[%s] - %+v",
-			jdfsRootPath, jdfPath, err)
+			efs.root.path, jdfPath, err)
 	}
 
 	if glog.V(2) {
 		glog.Infof("REL file handle %d released for file [%d] [%s]:[%s]", handle, inode,
-			jdfsRootPath, jdfPath)
+			efs.root.path, jdfPath)
 	}
 }
 
@@ -1411,13 +1968,16 @@ func (efs *exportedFileSystem) ReadSymlink(inode vfs.InodeID) {
 		panic(err)
 	}
 
+	efs.metaSlots.acquire()
+	defer efs.metaSlots.release()
+
 	target, fsErr := func() (target string, err error) {
 		ici, ok, _, _ := efs.icd.GetInode(0, inode, 0)
 		if !ok {
 			err = vfs.ENOENT
 			return
 		}
-		inoM, outdatedPaths, e := statInode(ici.inode, ici.reachedThrough)
+		inoM, outdatedPaths, e := efs.root.statInode(ici.inode, ici.reachedThrough)
 		if e != nil {
 			err = e
 			return
@@ -1428,12 +1988,12 @@ func (efs *exportedFileSystem) ReadSymlink(inode vfs.InodeID) {
 		}
 
 		jdfPath := inoM.jdfPath
-		if target, err = os.Readlink(jdfPath); err != nil {
+		if target, err = efs.root.readlink(jdfPath); err != nil {
 			return
 		}
 
 		if glog.V(2) {
-			glog.Infof("Resolved symlink [%s]: [%s] to [%s]", jdfsRootPath, jdfPath, target)
+			glog.Infof("Resolved symlink [%s]: [%s] to [%s]", efs.root.path, jdfPath, target)
 		}
 
 		return
@@ -1463,6 +2023,9 @@ func (efs *exportedFileSystem) RemoveXattr(inode vfs.InodeID, name string) {
 		panic(err)
 	}
 
+	efs.metaSlots.acquire()
+	defer efs.metaSlots.release()
+
 	fsErr := func() (err error) {
 		var jdfPath string
 		ici, ok, icfh, gotHandle := efs.icd.GetInode(0, inode, 1)
@@ -1472,11 +2035,15 @@ func (efs *exportedFileSystem) RemoveXattr(inode vfs.InodeID, name string) {
 		if gotHandle {
 			defer efs.icd.FileHandleOpDone(icfh)
 			jdfPath = icfh.f.Name()
+			if err := efs.checkWritable(jdfPath); err != nil {
+				return err
+			}
+			efs.watcher.selfChange(jdfPath)
 			if err = fremovexattr(int(icfh.f.Fd()), name); err != nil {
 				return
 			}
 		} else {
-			inoM, outdatedPaths, e := statInode(ici.inode, ici.reachedThrough)
+			inoM, outdatedPaths, e := efs.root.statInode(ici.inode, ici.reachedThrough)
 			if e != nil {
 				return e
 			}
@@ -1484,13 +2051,17 @@ func (efs *exportedFileSystem) RemoveXattr(inode vfs.InodeID, name string) {
 				return vfs.ENOENT
 			}
 			jdfPath = inoM.jdfPath
-			if err = removexattr(jdfPath, name); err != nil {
+			if err := efs.checkWritable(jdfPath); err != nil {
+				return err
+			}
+			efs.watcher.selfChange(jdfPath)
+			if err = removexattr(efs.root.abs(jdfPath), name); err != nil {
 				return
 			}
 		}
 
 		if glog.V(2) {
-			glog.Infof("Removed xattr [%s] from [%d] [%s]:[%s]", name, inode, jdfsRootPath, jdfPath)
+			glog.Infof("Removed xattr [%s] from [%d] [%s]:[%s]", name, inode, efs.root.path, jdfPath)
 		}
 
 		return
@@ -1516,6 +2087,9 @@ func (efs *exportedFileSystem) GetXattr(inode vfs.InodeID, name string, bufSz in
 		panic(err)
 	}
 
+	efs.metaSlots.acquire()
+	defer efs.metaSlots.release()
+
 	var buf []byte
 	if bufSz > 0 {
 		buf = efs.bufPool.Get(bufSz)
@@ -1538,7 +2112,7 @@ func (efs *exportedFileSystem) GetXattr(inode vfs.InodeID, name string, bufSz in
 				return
 			}
 		} else {
-			inoM, outdatedPaths, e := statInode(ici.inode, ici.reachedThrough)
+			inoM, outdatedPaths, e := efs.root.statInode(ici.inode, ici.reachedThrough)
 			if e != nil {
 				return err
 			}
@@ -1546,14 +2120,14 @@ func (efs *exportedFileSystem) GetXattr(inode vfs.InodeID, name string, bufSz in
 				return vfs.ENOENT
 			}
 			jdfPath = inoM.jdfPath
-			if bytesRead, err = getxattr(jdfPath, name, buf); err != nil {
+			if bytesRead, err = getxattr(efs.root.abs(jdfPath), name, buf); err != nil {
 				return
 			}
 		}
 
 		if glog.V(2) {
 			glog.Infof("Read xattr [%s]=[%s] %d#>%d for file [%d] [%s]:[%s]", name, string(buf),
-				bufSz, bytesRead, inode, jdfsRootPath, jdfPath)
+				bufSz, bytesRead, inode, efs.root.path, jdfPath)
 		}
 		return nil
 	}()
@@ -1588,6 +2162,9 @@ func (efs *exportedFileSystem) ListXattr(inode vfs.InodeID, bufSz int) {
 		panic(err)
 	}
 
+	efs.metaSlots.acquire()
+	defer efs.metaSlots.release()
+
 	var buf []byte
 	if bufSz > 0 {
 		buf = efs.bufPool.Get(bufSz)
@@ -1610,7 +2187,7 @@ func (efs *exportedFileSystem) ListXattr(inode vfs.InodeID, bufSz int) {
 				return
 			}
 		} else {
-			inoM, outdatedPaths, e := statInode(ici.inode, ici.reachedThrough)
+			inoM, outdatedPaths, e := efs.root.statInode(ici.inode, ici.reachedThrough)
 			if e != nil {
 				return e
 			}
@@ -1618,14 +2195,14 @@ func (efs *exportedFileSystem) ListXattr(inode vfs.InodeID, bufSz int) {
 				return vfs.ENOENT
 			}
 			jdfPath = inoM.jdfPath
-			if bytesRead, err = listxattr(jdfPath, buf); err != nil && err != syscall.ERANGE {
+			if bytesRead, err = listxattr(efs.root.abs(jdfPath), buf); err != nil && err != syscall.ERANGE {
 				return
 			}
 		}
 
 		if glog.V(2) {
 			glog.Infof("Listed xattr %d=>%d bytes for file [%d] [%s]:[%s]",
-				bufSz, bytesRead, inode, jdfsRootPath, jdfPath)
+				bufSz, bytesRead, inode, efs.root.path, jdfPath)
 		}
 		return nil
 	}()
@@ -1667,6 +2244,9 @@ func (efs *exportedFileSystem) SetXattr(inode vfs.InodeID, name string, valSz in
 		panic(err)
 	}
 
+	efs.metaSlots.acquire()
+	defer efs.metaSlots.release()
+
 	fsErr := func() (err error) {
 		var jdfPath string
 		ici, ok, icfh, gotHandle := efs.icd.GetInode(0, inode, 1)
@@ -1676,11 +2256,15 @@ func (efs *exportedFileSystem) SetXattr(inode vfs.InodeID, name string, valSz in
 		if gotHandle {
 			defer efs.icd.FileHandleOpDone(icfh)
 			jdfPath = icfh.f.Name()
+			if err := efs.checkWritable(jdfPath); err != nil {
+				return err
+			}
+			efs.watcher.selfChange(jdfPath)
 			if err = fsetxattr(int(icfh.f.Fd()), name, buf, flags); err != nil {
 				return
 			}
 		} else {
-			inoM, outdatedPaths, e := statInode(ici.inode, ici.reachedThrough)
+			inoM, outdatedPaths, e := efs.root.statInode(ici.inode, ici.reachedThrough)
 			if e != nil {
 				return e
 			}
@@ -1688,14 +2272,18 @@ func (efs *exportedFileSystem) SetXattr(inode vfs.InodeID, name string, valSz in
 				return vfs.ENOENT
 			}
 			jdfPath = inoM.jdfPath
-			if err = setxattr(jdfPath, name, buf, flags); err != nil {
+			if err := efs.checkWritable(jdfPath); err != nil {
+				return err
+			}
+			efs.watcher.selfChange(jdfPath)
+			if err = setxattr(efs.root.abs(jdfPath), name, buf, flags); err != nil {
 				return
 			}
 		}
 
 		if glog.V(2) {
 			glog.Infof("Updated xattr [%s]=[%s] of [%d] [%s]:[%s]", name, buf,
-				inode, jdfsRootPath, jdfPath)
+				inode, efs.root.path, jdfPath)
 		}
 
 		return
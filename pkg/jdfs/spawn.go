@@ -0,0 +1,90 @@
+package jdfs
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+
+	"github.com/complyue/hbi"
+	"github.com/golang/glog"
+)
+
+// env vars telling a jdfs process it's spawned to serve a single connection passed
+// as fd 3, with what's known about the connected jdfc
+const (
+	// the grant to the connected jdfc as value, empty for no restriction
+	spawnedConnEnv = "JDFS_SPAWNED_CONN"
+	// subject DN of the jdfc's client certificate
+	spawnedSubjectEnv = "JDFS_JDFC_SUBJECT"
+	// network address of the jdfc, the passed connection may be relayed
+	spawnedAddrEnv = "JDFS_JDFC_ADDR"
+)
+
+// spawnedConn tells whether this process is spawned to serve a single connection.
+func spawnedConn() bool {
+	_, ok := os.LookupEnv(spawnedConnEnv)
+	return ok
+}
+
+// spawnConnServer starts a jdfs subprocess, with the same command line as this
+// process, to serve the connection passed as connF, from the jdfc identified.
+//
+// connF is not closed by this function.
+func spawnConnServer(netIdent string, connF *os.File, ident *jdfcIdent) (*exec.Cmd, error) {
+	grantStr := ""
+	if ident.grant != nil {
+		grantStr = ident.grant.String()
+	}
+
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("%s=%s", spawnedConnEnv, grantStr),
+		fmt.Sprintf("%s=%s", spawnedSubjectEnv, ident.subject),
+		fmt.Sprintf("%s=%s", spawnedAddrEnv, ident.addr),
+	)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = []*os.File{connF} // will be fd 3 in subprocess
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	glog.V(1).Infof("jdfs %d spawned to serve [%s]", cmd.Process.Pid, netIdent)
+	return cmd, nil
+}
+
+// serveSpawnedConn serves the connection passed as fd 3, until disconnected.
+func serveSpawnedConn(exportRoot string) error {
+	ident := &jdfcIdent{
+		subject: os.Getenv(spawnedSubjectEnv),
+		addr:    os.Getenv(spawnedAddrEnv),
+	}
+	if grantStr := os.Getenv(spawnedConnEnv); len(grantStr) > 0 {
+		var err error
+		if ident.grant, err = parseGrant(grantStr); err != nil {
+			return err
+		}
+	}
+
+	connF := os.NewFile(3, "conn")
+	conn, err := net.FileConn(connF)
+	connF.Close()
+	if err != nil {
+		return err
+	}
+
+	if uc, ok := conn.(*net.UnixConn); ok && len(ident.addr) <= 0 {
+		// not relayed, a jdfc on this host connected directly
+		if ident.peer, err = unixPeerCred(uc); err != nil {
+			glog.Warningf("Peer credentials not available from [%s] - %+v", conn.RemoteAddr(), err)
+		}
+	}
+
+	he := newServiceEnv(exportRoot, ident)
+	po, _, err := hbi.TakeConn(conn, he)
+	if err != nil {
+		return err
+	}
+	<-po.Done()
+
+	return nil
+}
@@ -11,11 +11,14 @@ import (
 )
 
 var (
-	soloMode bool
+	// sessions served in a same process can have data channels attached, see
+	// datachan.go
+	soloMode = true
 )
 
 func init() {
-	flag.BoolVar(&soloMode, "solo", false, "run jdfs in solo mode (no subprocess spawning) for easy debug")
+	flag.BoolVar(&soloMode, "solo", soloMode,
+		"serve all jdfc connections in this process, with data wires attachable to sessions, -solo=false to spawn a subprocess per connection, where jdfc does without data wires")
 }
 
 // ExportTCP exports the specified root directory from local filesystem,
@@ -25,12 +28,12 @@ func init() {
 func ExportTCP(exportRoot string, servAddr string) (err error) {
 
 	servMethod := mp.UpstartTCP
-	if soloMode { // should run in solo mode only for debug purpose
+	if soloMode { // sessions share this process, with no process-global state among them
 		servMethod = hbi.ServeTCP
 	}
 
 	if err = servMethod(servAddr, func() *hbi.HostingEnv {
-		return newServiceEnv(exportRoot)
+		return newServiceEnv(exportRoot, nil)
 	}, func(listener *net.TCPListener) error {
 		fmt.Fprintf(os.Stderr, "JDFS server %d for [%s] listening: %s\n",
 			os.Getpid(), exportRoot, listener.Addr())
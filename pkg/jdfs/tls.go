@@ -0,0 +1,275 @@
+package jdfs
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/complyue/jdfs/pkg/errors"
+	"github.com/golang/glog"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	tlsCertFile, tlsKeyFile string
+	clientCAFile            string
+	tlsGrantsFile           string
+)
+
+func init() {
+	flag.StringVar(&tlsCertFile, "tls-cert", "", "`file` of PEM encoded certificate, to serve JDFS over TLS")
+	flag.StringVar(&tlsKeyFile, "tls-key", "", "`file` of PEM encoded private key for -tls-cert")
+	flag.StringVar(&clientCAFile, "client-ca", "",
+		"`file` of PEM encoded CA certificates, jdfc must present a client certificate signed by one of them")
+	flag.StringVar(&tlsGrantsFile, "tls-grants", "",
+		"`file` granting certificate subjects export subpaths with ro/rw rights, one per line: <ro|rw> <subpath> <subject>")
+}
+
+// TLSEnabled tells whether jdfs is configured to serve over TLS.
+func TLSEnabled() bool {
+	return len(tlsCertFile) > 0 || len(tlsKeyFile) > 0 || len(clientCAFile) > 0
+}
+
+// exportGrant is what a jdfc is allowed to mount, per its client certificate.
+type exportGrant struct {
+	// the subpath under export root, empty for the export root itself
+	subPath string
+
+	readOnly bool
+}
+
+func (g *exportGrant) String() string {
+	rights := "rw"
+	if g.readOnly {
+		rights = "ro"
+	}
+	return fmt.Sprintf("%s %s", rights, g.subPath)
+}
+
+func parseGrant(s string) (*exportGrant, error) {
+	fields := strings.SplitN(strings.TrimSpace(s), " ", 2)
+	g := &exportGrant{}
+	switch fields[0] {
+	case "ro":
+		g.readOnly = true
+	case "rw":
+	default:
+		return nil, errors.Errorf("invalid rights [%s]", fields[0])
+	}
+	if len(fields) > 1 {
+		g.subPath = cleanSubPath(fields[1])
+	}
+	return g, nil
+}
+
+func cleanSubPath(p string) string {
+	p = filepath.Clean("/" + p)[1:]
+	return p
+}
+
+// permits tells whether the grant allows mounting jdfsPath with readOnly or not
+func (g *exportGrant) permits(jdfsPath string, readOnly bool) error {
+	if g.readOnly && !readOnly {
+		return errors.Errorf("read-write mount not granted")
+	}
+	if len(g.subPath) <= 0 {
+		return nil
+	}
+	mountPath := cleanSubPath(jdfsPath)
+	if mountPath != g.subPath && !strings.HasPrefix(mountPath, g.subPath+"/") {
+		return errors.Errorf("mounting [%s] not granted", jdfsPath)
+	}
+	return nil
+}
+
+// loadTLSGrants reads the grants file, mapping certificate subjects to grants
+func loadTLSGrants(grantsFile string) (grants map[string]*exportGrant, err error) {
+	f, err := os.Open(grantsFile)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	grants = make(map[string]*exportGrant)
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) <= 0 || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, errors.Errorf("[%s:%d] expecting <ro|rw> <subpath> <subject>", grantsFile, lineNo)
+		}
+		g, e := parseGrant(fields[0] + " " + fields[1])
+		if e != nil {
+			return nil, errors.Wrapf(e, "[%s:%d]", grantsFile, lineNo)
+		}
+		// subject is the rest of the line, may contain spaces
+		subject := strings.TrimSpace(line[len(fields[0]):])
+		subject = strings.TrimSpace(subject[len(fields[1]):])
+		grants[subject] = g
+	}
+	err = scanner.Err()
+	return
+}
+
+// grantFor finds the grant to a verified client certificate, by its full subject DN,
+// or in `CN=<common name>` form.
+func grantFor(grants map[string]*exportGrant, cert *x509.Certificate) *exportGrant {
+	if g, ok := grants[cert.Subject.String()]; ok {
+		return g
+	}
+	if g, ok := grants["CN="+cert.Subject.CommonName]; ok {
+		return g
+	}
+	return nil
+}
+
+// ExportTLS exports the specified root directory from local filesystem,
+// over TLS at the specified TCP service address, with client certificates
+// required, and what each client can mount restricted by -tls-grants.
+//
+// each connection is served by a jdfs subprocess, with TLS terminated at this
+// process and plain HBI traffic relayed through a socket pair.
+func ExportTLS(exportRoot string, servAddr string) (err error) {
+	if spawnedConn() {
+		// spawned to serve a single connection
+		return serveSpawnedConn(exportRoot)
+	}
+
+	if len(tlsCertFile) <= 0 || len(tlsKeyFile) <= 0 || len(clientCAFile) <= 0 || len(tlsGrantsFile) <= 0 {
+		return errors.New("-tls-cert, -tls-key, -client-ca and -tls-grants are all required to serve over TLS")
+	}
+
+	cfg, err := serverTLSConfig(tlsCertFile, tlsKeyFile, clientCAFile)
+	if err != nil {
+		return
+	}
+	grants, err := loadTLSGrants(tlsGrantsFile)
+	if err != nil {
+		return errors.Wrap(err, "loading TLS grants")
+	}
+
+	listener, err := tls.Listen("tcp", servAddr, cfg)
+	if err != nil {
+		return
+	}
+	defer listener.Close()
+
+	fmt.Fprintf(os.Stderr, "JDFS server %d for [%s] listening over TLS: %s\n",
+		os.Getpid(), exportRoot, listener.Addr())
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go relayTLSConn(conn.(*tls.Conn), grants)
+	}
+}
+
+// serverTLSConfig creates the TLS config to serve jdfc with the certificate from
+// PEM encoded certFile/keyFile, requiring client certificates signed by a CA from
+// PEM encoded clientCAFile.
+func serverTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading TLS certificate")
+	}
+	caPEM, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading client CA")
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caPEM) {
+		return nil, errors.Errorf("no CA certificate found in [%s]", clientCAFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// authorizeTLSConn finishes the TLS handshake with a jdfc, and identifies it with
+// what its client certificate is granted.
+func authorizeTLSConn(conn *tls.Conn, grants map[string]*exportGrant) (*jdfcIdent, error) {
+	if err := conn.Handshake(); err != nil {
+		return nil, errors.Wrap(err, "TLS handshake failed")
+	}
+	peerCerts := conn.ConnectionState().PeerCertificates
+	if len(peerCerts) <= 0 {
+		return nil, errors.New("no client certificate")
+	}
+	grant := grantFor(grants, peerCerts[0])
+	if grant == nil {
+		return nil, errors.Errorf("client [%s] not granted anything", peerCerts[0].Subject)
+	}
+	return &jdfcIdent{
+		grant:   grant,
+		subject: peerCerts[0].Subject.String(),
+		addr:    conn.RemoteAddr().String(),
+	}, nil
+}
+
+// relayTLSConn authorizes a jdfc by its client certificate, then spawns a jdfs
+// subprocess to serve it, relaying plain traffic in between.
+func relayTLSConn(conn *tls.Conn, grants map[string]*exportGrant) {
+	defer conn.Close()
+
+	netIdent := fmt.Sprintf("%s<->%s", conn.LocalAddr(), conn.RemoteAddr())
+	ident, err := authorizeTLSConn(conn, grants)
+	if err != nil {
+		glog.Warningf("Client from [%s] refused - %+v", netIdent, err)
+		return
+	}
+	glog.V(1).Infof("Client [%s] from [%s] granted [%s]", ident.subject, netIdent, ident.grant)
+
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		glog.Errorf("Failed creating socket pair for [%s] - %+v", netIdent, err)
+		return
+	}
+	// not to be leaked to subprocesses spawned concurrently, ExtraFiles will be
+	// dup'ed without this flag
+	unix.CloseOnExec(fds[0])
+	unix.CloseOnExec(fds[1])
+	relayEnd := os.NewFile(uintptr(fds[0]), "relay")
+	serveEnd := os.NewFile(uintptr(fds[1]), "serve")
+
+	cmd, err := spawnConnServer(netIdent, serveEnd, ident)
+	serveEnd.Close()
+	if err != nil {
+		glog.Errorf("Failed spawning jdfs for [%s] - %+v", netIdent, err)
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(relayEnd, conn)
+		unix.Shutdown(fds[0], unix.SHUT_WR)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, relayEnd)
+		conn.CloseWrite()
+		done <- struct{}{}
+	}()
+	<-done // either side finished, tear down the other
+	conn.Close()
+	relayEnd.Close()
+	<-done
+
+	if err = cmd.Wait(); err != nil {
+		glog.Warningf("jdfs serving [%s] exited - %+v", netIdent, err)
+	}
+}
@@ -0,0 +1,227 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package jdfs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/complyue/jdfs/pkg/jdfc"
+)
+
+// testCA is a self-signed CA, issuing certificates as PEM files under dir.
+type testCA struct {
+	dir    string
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	serial int64
+
+	// PEM file of the CA certificate
+	certFile string
+}
+
+func newTestCA(t *testing.T, dir, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &testCA{dir: dir, cert: cert, key: key, serial: 1}
+	ca.certFile = writePEM(t, dir, name+"-ca.pem", "CERTIFICATE", der)
+	return ca
+}
+
+// issue creates a certificate of cn signed by the CA, returns its cert and key files.
+func (ca *testCA) issue(t *testing.T, cn string, server bool) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.serial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		tmpl.DNSNames = []string{"localhost"}
+		tmpl.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = writePEM(t, ca.dir, cn+"-cert.pem", "CERTIFICATE", der)
+	keyFile = writePEM(t, ca.dir, cn+"-key.pem", "EC PRIVATE KEY", keyDER)
+	return
+}
+
+func writePEM(t *testing.T, dir, name, blockType string, der []byte) string {
+	fn := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(fn, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+func TestTLSClientCertGrants(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jdfs-tls-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, dir, "jdfs-test")
+	otherCA := newTestCA(t, dir, "other")
+
+	srvCert, srvKey := ca.issue(t, "jdfs", true)
+	grantsFile := filepath.Join(dir, "grants")
+	if err := ioutil.WriteFile(grantsFile, []byte(`
+# test grants
+rw proj CN=alice
+ro / CN=bob
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := serverTLSConfig(srvCert, srvKey, ca.certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	grants, err := loadTLSGrants(grantsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// connect with a client certificate, returns what jdfs authorized, or why not
+	connect := func(certFile, keyFile, serverCAFile string) (*jdfcIdent, error, error) {
+		type authResult struct {
+			ident *jdfcIdent
+			err   error
+		}
+		authorized := make(chan authResult, 1)
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				authorized <- authResult{nil, err}
+				return
+			}
+			defer conn.Close()
+			ident, err := authorizeTLSConn(conn.(*tls.Conn), grants)
+			authorized <- authResult{ident, err}
+		}()
+
+		cliCfg, err := jdfc.TLSConfig("localhost", certFile, keyFile, serverCAFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// with TLS 1.3, the client can finish its handshake before jdfs verified its
+		// certificate, what jdfs authorized is the outcome
+		conn, cliErr := tls.Dial("tcp", listener.Addr().String(), cliCfg)
+		if cliErr == nil {
+			defer conn.Close()
+		}
+		res := <-authorized
+		return res.ident, res.err, cliErr
+	}
+
+	t.Run("granted rw subpath", func(t *testing.T) {
+		cert, key := ca.issue(t, "alice", false)
+		ident, err, cliErr := connect(cert, key, ca.certFile)
+		if err != nil || cliErr != nil {
+			t.Fatalf("alice refused - %v / %v", err, cliErr)
+		}
+		if ident.subject != "CN=alice" {
+			t.Errorf("unexpected subject [%s]", ident.subject)
+		}
+		if err := ident.grant.permits("proj/data", false); err != nil {
+			t.Errorf("alice should mount proj/data rw - %v", err)
+		}
+		if err := ident.grant.permits("/proj", false); err != nil {
+			t.Errorf("alice should mount /proj rw - %v", err)
+		}
+		if err := ident.grant.permits("project", true); err == nil {
+			t.Errorf("alice should not mount project")
+		}
+		if err := ident.grant.permits("/", true); err == nil {
+			t.Errorf("alice should not mount the export root")
+		}
+	})
+
+	t.Run("granted ro root", func(t *testing.T) {
+		cert, key := ca.issue(t, "bob", false)
+		ident, err, cliErr := connect(cert, key, ca.certFile)
+		if err != nil || cliErr != nil {
+			t.Fatalf("bob refused - %v / %v", err, cliErr)
+		}
+		if err := ident.grant.permits("any/where", true); err != nil {
+			t.Errorf("bob should mount any/where ro - %v", err)
+		}
+		if err := ident.grant.permits("/", false); err == nil {
+			t.Errorf("bob should not mount rw")
+		}
+	})
+
+	t.Run("not granted", func(t *testing.T) {
+		cert, key := ca.issue(t, "carol", false)
+		if _, err, _ := connect(cert, key, ca.certFile); err == nil {
+			t.Fatalf("carol should not be granted anything")
+		}
+	})
+
+	t.Run("client of other CA", func(t *testing.T) {
+		cert, key := otherCA.issue(t, "alice", false)
+		if _, err, _ := connect(cert, key, ca.certFile); err == nil {
+			t.Fatalf("alice certified by other CA should be refused")
+		}
+	})
+
+	t.Run("jdfs of other CA", func(t *testing.T) {
+		cert, key := ca.issue(t, "alice", false)
+		if _, _, cliErr := connect(cert, key, otherCA.certFile); cliErr == nil {
+			t.Fatalf("jdfs should fail verification against other CA")
+		}
+	})
+}
@@ -0,0 +1,121 @@
+package jdfs
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/complyue/hbi"
+	"github.com/complyue/jdfs/pkg/errors"
+	"github.com/golang/glog"
+)
+
+// peerCred is the credentials of a jdfc process connected over a unix domain socket.
+type peerCred struct {
+	pid      int32 // 0 if not known
+	uid, gid uint32
+}
+
+func (pc *peerCred) String() string {
+	if pc.pid == 0 {
+		return fmt.Sprintf("uid=%d gid=%d", pc.uid, pc.gid)
+	}
+	return fmt.Sprintf("pid=%d uid=%d gid=%d", pc.pid, pc.uid, pc.gid)
+}
+
+func unixPeerCred(conn *net.UnixConn) (pc *peerCred, err error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	if cerr := rc.Control(func(fd uintptr) {
+		pc, err = sockPeerCred(int(fd))
+	}); cerr != nil {
+		err = cerr
+	}
+	return
+}
+
+// ExportUnix exports the specified root directory from local filesystem,
+// mountable by jdfc on the same host, over a unix domain socket at socketPath.
+//
+// credentials of the connecting jdfc process are obtained from the socket.
+func ExportUnix(exportRoot string, socketPath string) (err error) {
+	if spawnedConn() {
+		// spawned to serve a single connection
+		return serveSpawnedConn(exportRoot)
+	}
+
+	if fi, e := os.Lstat(socketPath); e == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return errors.Errorf("[%s] exists and is not a socket", socketPath)
+		}
+		// stale socket from a previous run
+		if err = os.Remove(socketPath); err != nil {
+			return
+		}
+	}
+
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: socketPath, Net: "unix"})
+	if err != nil {
+		return
+	}
+	defer listener.Close()
+
+	fmt.Fprintf(os.Stderr, "JDFS server %d for [%s] listening: %s\n",
+		os.Getpid(), exportRoot, socketPath)
+
+	for {
+		conn, err := listener.AcceptUnix()
+		if err != nil {
+			return err
+		}
+		if soloMode { // sessions share this process, with no process-global state among them
+			go serveUnixConn(exportRoot, conn)
+		} else {
+			go spawnUnixConn(conn)
+		}
+	}
+}
+
+// serveUnixConn serves a jdfc connection in this process.
+func serveUnixConn(exportRoot string, conn *net.UnixConn) {
+	peer, err := unixPeerCred(conn)
+	if err != nil {
+		glog.Warningf("Peer credentials not available from [%s] - %+v", socketIdent(conn), err)
+	}
+	po, _, err := hbi.TakeConn(conn, newServiceEnv(exportRoot, &jdfcIdent{peer: peer}))
+	if err != nil {
+		glog.Errorf("Failed serving [%s] - %+v", socketIdent(conn), err)
+		conn.Close()
+		return
+	}
+	<-po.Done()
+}
+
+// spawnUnixConn passes a jdfc connection to a jdfs subprocess to serve it.
+func spawnUnixConn(conn *net.UnixConn) {
+	defer conn.Close()
+
+	netIdent := socketIdent(conn)
+	connF, err := conn.File()
+	if err != nil {
+		glog.Errorf("Failed passing [%s] to subprocess - %+v", netIdent, err)
+		return
+	}
+	cmd, err := spawnConnServer(netIdent, connF, &jdfcIdent{})
+	connF.Close()
+	if err != nil {
+		glog.Errorf("Failed spawning jdfs for [%s] - %+v", netIdent, err)
+		return
+	}
+	conn.Close() // the subprocess owns the connection now
+
+	if err = cmd.Wait(); err != nil {
+		glog.Warningf("jdfs serving [%s] exited - %+v", netIdent, err)
+	}
+}
+
+func socketIdent(conn *net.UnixConn) string {
+	return fmt.Sprintf("unix:%s", conn.LocalAddr())
+}
@@ -0,0 +1,17 @@
+package jdfs
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+func sockPeerCred(fd int) (*peerCred, error) {
+	xucred, err := unix.GetsockoptXucred(fd, unix.SOL_LOCAL, unix.LOCAL_PEERCRED)
+	if err != nil {
+		return nil, err
+	}
+	pc := &peerCred{uid: xucred.Uid}
+	if xucred.Ngroups > 0 {
+		pc.gid = xucred.Groups[0]
+	}
+	return pc, nil
+}
@@ -0,0 +1,13 @@
+package jdfs
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+func sockPeerCred(fd int) (*peerCred, error) {
+	ucred, err := unix.GetsockoptUcred(fd, unix.SOL_SOCKET, unix.SO_PEERCRED)
+	if err != nil {
+		return nil, err
+	}
+	return &peerCred{pid: ucred.Pid, uid: ucred.Uid, gid: ucred.Gid}, nil
+}
@@ -0,0 +1,10 @@
+package jdfs
+
+import (
+	"github.com/complyue/jdfs/pkg/errors"
+)
+
+func sockPeerCred(fd int) (*peerCred, error) {
+	// todo use getpeerucred(3C)
+	return nil, errors.New("peer credentials not supported on solaris yet")
+}
@@ -0,0 +1,208 @@
+package jdfs
+
+import (
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/complyue/jdfs/pkg/vfs"
+
+	"github.com/golang/glog"
+)
+
+var (
+	// whether to watch local fs for changes not made through JDFS
+	watchLocalFS bool
+)
+
+func init() {
+	flag.BoolVar(&watchLocalFS, "watch", true,
+		"watch local fs at jdfs host for changes not made through JDFS, and invalidate jdfc caches accordingly")
+}
+
+// local fs events on a path, within this duration after the same path has been changed
+// through this JDFS session, are considered echoes of the session's own changes, and
+// won't cause jdfc caches invalidated.
+const selfEchoWindow = 2 * time.Second
+
+// kinds of change observed on local fs
+type changeKind uint8
+
+const (
+	// a child name appeared/disappeared from a dir
+	chgEntry changeKind = 1 << iota
+	// file content modified
+	chgData
+	// meta attributes changed
+	chgAttrs
+)
+
+// a change observed on local fs, name is empty if the dir itself changed
+type localChange struct {
+	dir  vfs.InodeID
+	name string
+	kind changeKind
+}
+
+// fsWatcher watches in-core dirs of a JDFS mount on local fs, and pushes invalidations
+// to jdfc for changes made by local processes or other JDFS sessions at the jdfs host.
+//
+// the os specific watching mechanism is embedded as osWatch.
+type fsWatcher struct {
+	efs *exportedFileSystem
+
+	osWatch
+
+	// paths recently changed through this JDFS session, to their change time
+	selfChanged map[string]time.Time
+	// last time stale entries were swept out of selfChanged
+	lastSwept time.Time
+	echoMu    sync.Mutex
+}
+
+// newFsWatcher creates a watcher for the efs, it returns nil with watching disabled
+// or not supported on this os.
+func newFsWatcher(efs *exportedFileSystem) *fsWatcher {
+	if !watchLocalFS {
+		return nil
+	}
+	w := &fsWatcher{
+		efs:         efs,
+		selfChanged: make(map[string]time.Time),
+		lastSwept:   time.Now(),
+	}
+	if err := w.start(); err != nil {
+		glog.Warningf("Local fs changes at [%s] won't be watched - %+v", efs.exportRoot, err)
+		return nil
+	}
+	return w
+}
+
+// selfChange records a path as changed through this JDFS session.
+//
+// safe to be called on a nil watcher.
+func (w *fsWatcher) selfChange(jdfPath string) {
+	if w == nil {
+		return
+	}
+	now := time.Now()
+
+	w.echoMu.Lock()
+	defer w.echoMu.Unlock()
+
+	w.selfChanged[jdfPath] = now
+	if now.Sub(w.lastSwept) > selfEchoWindow {
+		for p, t := range w.selfChanged {
+			if now.Sub(t) > selfEchoWindow {
+				delete(w.selfChanged, p)
+			}
+		}
+		w.lastSwept = now
+	}
+}
+
+func (w *fsWatcher) isSelfEcho(jdfPath string) bool {
+	w.echoMu.Lock()
+	defer w.echoMu.Unlock()
+
+	t, ok := w.selfChanged[jdfPath]
+	return ok && time.Now().Sub(t) <= selfEchoWindow
+}
+
+// dispatch invalidates caches at jdfs and jdfc for a batch of changes observed from
+// local fs. if overflow is true, some events have been lost, all in-core inodes are
+// invalidated then.
+func (w *fsWatcher) dispatch(changes []localChange, overflow bool) {
+	if overflow {
+		glog.Warningf("Local fs events overflowed at [%s], invalidating all in-core inodes.", w.efs.root.path)
+		for _, inode := range w.efs.icd.InvalidateAll() {
+			w.notify(fmt.Sprintf("InvalidateNode(%#v, %#v, %#v)", inode, 0, -1))
+		}
+		return
+	}
+
+	// coalesce repeated events on a same path, e.g. from a sequence of writes
+	type chgKey struct {
+		dir  vfs.InodeID
+		name string
+	}
+	var (
+		order []chgKey
+		kinds = make(map[chgKey]changeKind, len(changes))
+	)
+	for _, chg := range changes {
+		k := chgKey{chg.dir, chg.name}
+		if pk, ok := kinds[k]; ok {
+			kinds[k] = pk | chg.kind
+		} else {
+			kinds[k] = chg.kind
+			order = append(order, k)
+		}
+	}
+
+	for _, k := range order {
+		kind := kinds[k]
+
+		ici, ok, _, _ := w.efs.icd.GetInode(0, k.dir, 0)
+		if !ok || len(ici.reachedThrough) <= 0 {
+			continue // dir no longer in-core
+		}
+		dirM := iMeta{jdfPath: ici.reachedThrough[len(ici.reachedThrough)-1]}
+
+		if len(k.name) <= 0 { // the dir itself changed
+			if w.isSelfEcho(dirM.jdfPath) {
+				continue
+			}
+			w.efs.icd.ChildrenChanged(k.dir)
+			w.notify(fmt.Sprintf("InvalidateNode(%#v, %#v, %#v)", k.dir, -1, 0))
+			continue
+		}
+
+		childPath := dirM.childPath(k.name)
+		if w.isSelfEcho(childPath) {
+			continue
+		}
+
+		if glog.V(2) {
+			glog.Infof("WATCH local change %#x on [%s]:[%s]", kind, w.efs.root.path, childPath)
+		}
+
+		if kind&chgEntry != 0 {
+			w.efs.icd.ChildrenChanged(k.dir)
+			w.notify(fmt.Sprintf("InvalidateEntry(%#v, %#v)", k.dir, k.name))
+			// mtime/nlink of the dir changed as well
+			w.notify(fmt.Sprintf("InvalidateNode(%#v, %#v, %#v)", k.dir, -1, 0))
+		}
+
+		if kind&(chgData|chgAttrs) == 0 {
+			continue
+		}
+		child, ok := ici.children[k.name]
+		if !ok {
+			childFI, err := w.efs.root.lstat(childPath)
+			if err != nil {
+				continue // gone already
+			}
+			childM := w.efs.root.fi2im(childPath, childFI)
+			if !w.efs.root.revealInode(&childM) {
+				continue
+			}
+			child = childM.inode
+		}
+		if _, ok, _, _ := w.efs.icd.GetInode(0, child, 0); !ok {
+			continue // jdfc can not have it cached if not in-core here
+		}
+		if kind&chgData != 0 {
+			w.notify(fmt.Sprintf("InvalidateNode(%#v, %#v, %#v)", child, 0, -1))
+		} else {
+			w.notify(fmt.Sprintf("InvalidateNode(%#v, %#v, %#v)", child, -1, 0))
+		}
+	}
+}
+
+func (w *fsWatcher) notify(code string) {
+	if err := w.efs.po.Notif(code); err != nil {
+		glog.Warningf("Failed pushing invalidation to jdfc: %s - %+v", code, err)
+	}
+}
@@ -0,0 +1,170 @@
+package jdfs
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/complyue/jdfs/pkg/errors"
+	"github.com/complyue/jdfs/pkg/vfs"
+	"github.com/golang/glog"
+	"golang.org/x/sys/unix"
+)
+
+// events of interest on a watched dir and its direct children
+const inotifyMask = unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO |
+	unix.IN_MODIFY | unix.IN_ATTRIB | unix.IN_DELETE_SELF | unix.IN_MOVE_SELF |
+	unix.IN_ONLYDIR | unix.IN_DONT_FOLLOW | unix.IN_EXCL_UNLINK
+
+// inotify based watching of local fs
+type osWatch struct {
+	// the inotify instance, opened non-blocking so its reading is managed by go's
+	// poller, and Close() will wake the reading goroutine up
+	inoF *os.File
+	// raw fd of inoF, as inoF.Fd() would put it into blocking mode
+	inoFd int
+	// set when stopped, reading errors are expected after that
+	stopped bool
+
+	// map between watch descriptors and in-core dir inodes
+	wd2ino map[int32]vfs.InodeID
+	ino2wd map[vfs.InodeID]int32
+	mu     sync.Mutex
+}
+
+func (w *fsWatcher) start() error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return errors.Wrap(err, "inotify_init1")
+	}
+	w.inoFd = fd
+	w.inoF = os.NewFile(uintptr(fd), "inotify")
+	w.wd2ino = make(map[int32]vfs.InodeID)
+	w.ino2wd = make(map[vfs.InodeID]int32)
+
+	go w.run()
+
+	return nil
+}
+
+func (w *fsWatcher) stop() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	w.stopped = true
+	w.mu.Unlock()
+
+	w.inoF.Close()
+}
+
+// watchDir starts watching a dir newly loaded in-core.
+//
+// safe to be called on a nil watcher.
+func (w *fsWatcher) watchDir(inode vfs.InodeID, jdfPath string) {
+	if w == nil {
+		return
+	}
+	wd, err := unix.InotifyAddWatch(w.inoFd, w.efs.root.abs(jdfPath), inotifyMask)
+	if err != nil {
+		glog.Warningf("Failed watching dir [%d] [%s]:[%s] - %+v", inode, w.efs.root.path, jdfPath, err)
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.wd2ino[int32(wd)] = inode
+	w.ino2wd[inode] = int32(wd)
+}
+
+// unwatchDir stops watching a dir dropped from in-core.
+//
+// safe to be called on a nil watcher.
+func (w *fsWatcher) unwatchDir(inode vfs.InodeID) {
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	wd, ok := w.ino2wd[inode]
+	if !ok {
+		return
+	}
+	delete(w.ino2wd, inode)
+	delete(w.wd2ino, wd)
+	// the kernel may have removed the watch already, e.g. after the dir deleted
+	unix.InotifyRmWatch(w.inoFd, uint32(wd))
+}
+
+func (w *fsWatcher) wdInode(wd int32, ignored bool) (inode vfs.InodeID, ok bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	inode, ok = w.wd2ino[wd]
+	if ok && ignored { // watch removed by kernel
+		delete(w.wd2ino, wd)
+		if w.ino2wd[inode] == wd {
+			delete(w.ino2wd, inode)
+		}
+	}
+	return
+}
+
+func (w *fsWatcher) run() {
+	defer w.inoF.Close()
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.inoF.Read(buf)
+		if err != nil {
+			w.mu.Lock()
+			stopped := w.stopped
+			w.mu.Unlock()
+			if !stopped {
+				glog.Errorf("Error reading inotify events for [%s] - %+v", w.efs.root.path, err)
+			}
+			return
+		}
+
+		var (
+			changes  []localChange
+			overflow bool
+		)
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			nameEnd := off + unix.SizeofInotifyEvent + int(ev.Len)
+			name := strings.TrimRight(string(buf[off+unix.SizeofInotifyEvent:nameEnd]), "\x00")
+			off = nameEnd
+
+			if ev.Mask&unix.IN_Q_OVERFLOW != 0 {
+				overflow = true
+				continue
+			}
+			dir, ok := w.wdInode(ev.Wd, ev.Mask&unix.IN_IGNORED != 0)
+			if !ok || ev.Mask&unix.IN_IGNORED != 0 {
+				continue
+			}
+
+			var kind changeKind
+			if ev.Mask&(unix.IN_CREATE|unix.IN_DELETE|unix.IN_MOVED_FROM|unix.IN_MOVED_TO) != 0 {
+				kind |= chgEntry
+			}
+			if ev.Mask&unix.IN_MODIFY != 0 {
+				kind |= chgData
+			}
+			if ev.Mask&(unix.IN_ATTRIB|unix.IN_DELETE_SELF|unix.IN_MOVE_SELF) != 0 {
+				kind |= chgAttrs
+			}
+			if kind == 0 {
+				continue
+			}
+			changes = append(changes, localChange{dir: dir, name: name, kind: kind})
+		}
+
+		w.dispatch(changes, overflow)
+	}
+}
@@ -0,0 +1,19 @@
+package jdfs
+
+import (
+	"github.com/complyue/jdfs/pkg/errors"
+	"github.com/complyue/jdfs/pkg/vfs"
+)
+
+// TODO watch local fs changes on this os, e.g. with FEN
+type osWatch struct{}
+
+func (w *fsWatcher) start() error {
+	return errors.New("local fs watching not supported on this os yet")
+}
+
+func (w *fsWatcher) stop() {}
+
+func (w *fsWatcher) watchDir(inode vfs.InodeID, jdfPath string) {}
+
+func (w *fsWatcher) unwatchDir(inode vfs.InodeID) {}
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
+	"github.com/complyue/jdfs/pkg/vfs"
 	"github.com/golang/glog"
 )
 
@@ -22,6 +24,9 @@ func (efs *exportedFileSystem) MakeWorksetRoot(baseDir, nameHint string) {
 		panic(err)
 	}
 
+	efs.metaSlots.acquire()
+	defer efs.metaSlots.release()
+
 	wsrd, errReason := "", ""
 	// finally send result back
 	defer func() {
@@ -41,8 +46,25 @@ func (efs *exportedFileSystem) MakeWorksetRoot(baseDir, nameHint string) {
 		errReason = fmt.Sprintf("invalid base dir [%s] for workset", baseDir)
 		return
 	}
+	if len(nameHint) <= 0 || nameHint == "." || nameHint == ".." ||
+		strings.ContainsRune(nameHint, '/') {
+		errReason = fmt.Sprintf("invalid name hint [%s] for workset", nameHint)
+		return
+	}
+	if cleanDir, err := efs.root.confinePath(baseDir); err != nil {
+		errReason = fmt.Sprintf("%s - workset base dir [%s] not confined to the mounted root",
+			vfs.FsErr(err).Repr(), baseDir)
+		return
+	} else {
+		baseDir = cleanDir
+	}
+	if err := efs.checkWritable(baseDir); err != nil {
+		errReason = fmt.Sprintf("%s - workset base dir [%s] is read-only",
+			vfs.FsErr(err).Repr(), baseDir)
+		return
+	}
 	// ensure the baseDir dir
-	if err := os.MkdirAll(baseDir, 0755); err != nil && !os.IsExist(err) {
+	if err := efs.root.mkdirAll(baseDir, 0755); err != nil && !os.IsExist(err) {
 		errReason = fmt.Sprintf("can not create workset base dir [%s] - %+v", baseDir, err)
 		return
 	}
@@ -50,7 +72,12 @@ func (efs *exportedFileSystem) MakeWorksetRoot(baseDir, nameHint string) {
 	wsrd = fmt.Sprintf("%s/%s", baseDir, nameHint)
 	seq := 1
 	for ; seq <= 50000; seq++ {
-		if err := os.Mkdir(wsrd, 0755); err == nil {
+		if err := efs.root.mkdir(wsrd, 0755); err == nil {
+			if err = efs.ownWorkset(wsrd); err != nil {
+				errReason = fmt.Sprintf("can not own workset [%s] - %+v", wsrd, err)
+				efs.root.removeAll(wsrd)
+				wsrd = ""
+			}
 			return
 		} else if !os.IsExist(err) {
 			errReason = fmt.Sprintf("unexpected error making workset dir [%s] - %+v",
@@ -71,18 +98,48 @@ func (efs *exportedFileSystem) DiscardWorksetRoot(wsrd string) {
 		panic(err)
 	}
 
+	efs.metaSlots.acquire()
+	defer efs.metaSlots.release()
+
 	if len(wsrd) <= 1 || wsrd[0] != '.' {
 		glog.Errorf("WS not removing malformed workset root dir [%s]", wsrd)
+		return
 	}
-	if err := os.RemoveAll(wsrd); err != nil {
+	if cleanWSRD, err := efs.root.confinePath(wsrd); err != nil {
+		glog.Errorf("WS not removing workset root dir [%s] not confined to the mounted root - %+v",
+			wsrd, err)
+		return
+	} else {
+		wsrd = cleanWSRD
+	}
+	if err := efs.checkSubtreeWritable(wsrd); err != nil {
+		glog.Errorf("WS not removing read-only workset root dir [%s]", wsrd)
+		return
+	}
+	mountPath, err := efs.mountPath()
+	if err != nil {
+		glog.Errorf("WS not removing workset root dir [%s] - %+v", wsrd, err)
+		return
+	}
+	unlock, err := lockCommits(efs.exportRoot)
+	if err != nil {
+		glog.Errorf("WS not removing workset root dir [%s] - %+v", wsrd, err)
+		return
+	}
+	defer unlock()
+	if commitPending(efs.exportRoot, filepath.Join(mountPath, wsrd)) {
+		// a failed commit left its journal and backups for recovery
+		glog.Errorf("WS not removing workset root dir [%s] with a commit pending recovery", wsrd)
+		return
+	}
+	efs.disownWorkset(wsrd)
+	if err := efs.root.removeAll(wsrd); err != nil {
 		glog.Errorf("WS failed removing workset root dir [%s] - %+v", wsrd, err)
 	}
 }
 
 // CommitWorkset moves specified persistent data files under the workset root dir to
-// overwrite public data files at same path.
-//
-// todo support for 2 phase commit ?
+// overwrite public data files at same path, atomically, see wscommit.go
 func (efs *exportedFileSystem) CommitWorkset(wsrd string, nFiles int,
 	metaExt, dataExt string) {
 	co := efs.ho.Co()
@@ -101,6 +158,9 @@ func (efs *exportedFileSystem) CommitWorkset(wsrd string, nFiles int,
 		panic(err)
 	}
 
+	efs.metaSlots.acquire()
+	defer efs.metaSlots.release()
+
 	errReason := ""
 
 	// finally send result back
@@ -120,33 +180,51 @@ func (efs *exportedFileSystem) CommitWorkset(wsrd string, nFiles int,
 		return
 	}
 
-	// todo currently it's a best-effort commit and prone to partial errors during the commit.
-	//      consider jdfs node scoped workset lock, make use of ZFS snapshot to implement
-	//      atomic recovery from commit failures. note it might be mandatory for jdfsRootPath
-	//      to be a ZFS filesystem root for free of collision with the snapshot mechanism.
-
-	ed := ensuredDirs{madeDirs: make(map[string]struct{}, 2*len(pubPathList))}
-	for _, pubPath := range pubPathList {
-		if err := ed.ensure(filepath.Dir(pubPath)); err != nil {
-			errReason = fmt.Sprintf("Failed making parent dir for public path [%s] - %+v",
-				pubPath, err)
-			return
+	// reject the whole commit if any path involved escapes the mounted root
+	if cleanWSRD, err := efs.root.confinePath(wsrd); err != nil {
+		errReason = fmt.Sprintf("%s - workset root dir [%s] not confined to the mounted root",
+			vfs.FsErr(err).Repr(), wsrd)
+		return
+	} else {
+		wsrd = cleanWSRD
+	}
+	for i, pubPath := range pubPathList {
+		cleanPath, err := efs.root.confineJDF(pubPath, metaExt, dataExt)
+		if err == nil {
+			_, err = efs.root.confineJDF(wsrd+"/"+cleanPath, metaExt, dataExt)
 		}
-		privPath := wsrd + "/" + pubPath
-		if err := os.Rename(privPath+metaExt, pubPath+metaExt); err != nil {
-			errReason = fmt.Sprintf("Failed committing meta file [%s] - %+v", pubPath, err)
+		if err != nil {
+			errReason = fmt.Sprintf("%s - public path [%s] not confined to the mounted root",
+				vfs.FsErr(err).Repr(), pubPath)
 			return
 		}
-		if err := os.Rename(privPath+dataExt, pubPath+dataExt); err != nil {
-			errReason = fmt.Sprintf("Failed committing data file [%s] - %+v", pubPath, err)
+		pubPathList[i] = cleanPath
+	}
+
+	// or read-only to this session
+	if err := efs.checkWritable(wsrd); err != nil {
+		errReason = fmt.Sprintf("%s - workset root dir [%s] is read-only",
+			vfs.FsErr(err).Repr(), wsrd)
+		return
+	}
+	for _, pubPath := range pubPathList {
+		if err := efs.checkWritable(pubPath); err != nil {
+			errReason = fmt.Sprintf("%s - public path [%s] is read-only",
+				vfs.FsErr(err).Repr(), pubPath)
 			return
 		}
 	}
+
+	if err := efs.commitWorkset(wsrd, pubPathList, metaExt, dataExt); err != nil {
+		errReason = fmt.Sprintf("Failed committing workset [%s] - %+v", wsrd, err)
+		return
+	}
 }
 
 // ensuredDirs maintains a set of dirs ensured to exists during a course of dir tree making,
 // to reduce trips to kernel (syscall) as much as possible.
 type ensuredDirs struct {
+	root     *mountedRoot
 	madeDirs map[string]struct{}
 }
 
@@ -154,7 +232,7 @@ func (ed ensuredDirs) ensure(dir string) error {
 	if _, made := ed.madeDirs[dir]; made {
 		return nil
 	}
-	if err := os.MkdirAll(dir, 0755); err != nil {
+	if err := ed.root.mkdirAll(dir, 0755); err != nil {
 		return err
 	}
 	for d := dir; len(d) > 0 && d != "." && d != "/"; d = filepath.Dir(d) {
@@ -164,22 +242,20 @@ func (ed ensuredDirs) ensure(dir string) error {
 }
 
 // process work dir `wd` for commit of the workset identified by the root dir `wsrd`
-func commitFiles(wsrd, wd string) {
-	// Note: pwd is jdfsRootPath, all paths to underlying fs should be relative,
-	// so as to be against jdfsRootPath.
+func (r *mountedRoot) commitFiles(wsrd, wd string) {
 	wsd := wsrd
 	if len(wd) > 0 {
 		wsd = wsrd + "/" + wd
 	}
-	df, err := os.OpenFile(wsd, os.O_RDONLY, 0)
+	df, err := r.openFile(wsd, os.O_RDONLY, 0)
 	if err != nil {
-		glog.Warningf("WS failed open workset dir [%s]:[%s] - %+v", jdfsRootPath, wsd, err)
+		glog.Warningf("WS failed open workset dir [%s]:[%s] - %+v", r.path, wsd, err)
 		return
 	}
 	defer df.Close() // hold an ancestor dir open during recursion within it
-	childFIs, err := df.Readdir(0)
+	childFIs, err := readDir(df, 0)
 	if err != nil {
-		glog.Errorf("WS failed reading workset dir [%s]:[%s] - %+v", jdfsRootPath, wsd, err)
+		glog.Errorf("WS failed reading workset dir [%s]:[%s] - %+v", r.path, wsd, err)
 		return
 	}
 	for _, childFI := range childFIs {
@@ -190,8 +266,8 @@ func commitFiles(wsrd, wd string) {
 			if len(wd) > 0 {
 				pubDir = wd + "/" + fn
 			}
-			os.MkdirAll(pubDir, 0755)
-			commitFiles(wsrd, pubDir)
+			r.mkdirAll(pubDir, 0755)
+			r.commitFiles(wsrd, pubDir)
 		} else if childFI.Mode().IsRegular() {
 			// a regular file
 			pubPath := fn
@@ -199,15 +275,15 @@ func commitFiles(wsrd, wd string) {
 				pubPath = wd + "/" + fn
 			}
 			privPath := wsd + "/" + fn
-			if err := os.Rename(privPath, pubPath); err != nil {
+			if err := r.rename(privPath, pubPath); err != nil {
 				// TODO fail the whole commit, atomatically
 				glog.Errorf("WS failed committing workset file [%s]:[%s]$[%s] - %+v",
-					jdfsRootPath, wsrd, pubPath, err)
+					r.path, wsrd, pubPath, err)
 			}
 		} else {
 			// a file not reigned by JDFS
 			glog.Warningf("WS not committing file in workset [%s]:[%s]$[%s/%s]",
-				jdfsRootPath, wsrd, wd, fn)
+				r.path, wsrd, wd, fn)
 			continue
 		}
 	}
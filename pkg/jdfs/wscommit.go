@@ -0,0 +1,491 @@
+package jdfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/complyue/jdfs/pkg/errors"
+	"github.com/golang/glog"
+	"golang.org/x/sys/unix"
+)
+
+// workset commits are done in 2 phases:
+//
+//  1. prepare: with the workset lock held, verify all private files present, back
+//     up public files to be overwritten by hard links, then journal the intent in
+//     the commit registry under the export root.
+//  2. publish: rename private files over public ones, on any failure, roll back
+//     to restore public files from the backups.
+//
+// an interrupted commit is found in the registry at next mount, and rolled
+// forward if all its files are still accounted for, or back otherwise.
+//
+// the registry and backups have reserved names, see confine.go, so no jdfc can
+// see or touch them, still paths from a journal are confined to the export root
+// before recovered, and all file ops of a commit are done beneath its mounted root.
+
+const (
+	// dir under export root, journaling commits in progress
+	commitsDirName = ".jdfs-commits"
+	// lock file in commitsDirName, serializing commits and recoveries
+	commitLockName = ".lock"
+
+	// dir under the workset root, hard linking public files overwritten
+	backupDirName = ".jdfs-commit-backup"
+)
+
+// fcntl locks don't exclude sessions within a same process, i.e. in solo mode
+var commitMu sync.Mutex
+
+// lockCommits acquires the workset lock of the export root, no 2 commits can
+// proceed concurrently, so no overlapping paths can be committed at once.
+func lockCommits(exportRoot string) (unlock func(), err error) {
+	commitMu.Lock()
+	defer func() {
+		if err != nil {
+			commitMu.Unlock()
+		}
+	}()
+
+	regDir := filepath.Join(exportRoot, commitsDirName)
+	if err = os.MkdirAll(regDir, 0755); err != nil {
+		return
+	}
+	lockF, err := os.OpenFile(filepath.Join(regDir, commitLockName), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return
+	}
+	lk := unix.Flock_t{Type: unix.F_WRLCK}
+	if err = unix.FcntlFlock(lockF.Fd(), unix.F_SETLKW, &lk); err != nil {
+		lockF.Close()
+		return
+	}
+	return func() {
+		lockF.Close() // releases the fcntl lock
+		commitMu.Unlock()
+	}, nil
+}
+
+// commitIntent is the journal of a workset commit in progress.
+type commitIntent struct {
+	// the mounted root relative to export root, other paths are relative to it
+	MountPath string `json:"mount"`
+
+	Wsrd     string   `json:"wsrd"`
+	MetaExt  string   `json:"metaExt"`
+	DataExt  string   `json:"dataExt"`
+	PubPaths []string `json:"pubPaths"`
+
+	// set once all files have been published
+	Committed bool `json:"committed"`
+	// set once publishing failed, to be rolled back
+	RollingBack bool `json:"rollingBack"`
+}
+
+// wsCommit carries out a commit per its intent.
+type wsCommit struct {
+	intent *commitIntent
+
+	exportRoot string
+	// the mounted root paths in intent are relative to, i.e. of the committing
+	// session, or opened per the journal on recovery
+	root *mountedRoot
+
+	// path of the registry entry journaling the intent, relative to export root
+	regEntry string
+}
+
+func (wc *wsCommit) exts() []string {
+	return []string{wc.intent.MetaExt, wc.intent.DataExt}
+}
+
+func (wc *wsCommit) pubPath(pubPath, ext string) string {
+	return pubPath + ext
+}
+
+func (wc *wsCommit) privPath(pubPath, ext string) string {
+	return filepath.Join(wc.intent.Wsrd, pubPath+ext)
+}
+
+func (wc *wsCommit) backupPath(pubPath, ext string) string {
+	return filepath.Join(wc.intent.Wsrd, backupDirName, pubPath+ext)
+}
+
+// writeFileSync durably writes a file, by renaming a synced temporary file over it.
+func writeFileSync(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func syncDir(dir string) error {
+	df, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer df.Close()
+	return df.Sync()
+}
+
+func (wc *wsCommit) writeIntent() error {
+	data, err := json.Marshal(wc.intent)
+	if err != nil {
+		return err
+	}
+	return writeFileSync(filepath.Join(wc.exportRoot, wc.regEntry), data)
+}
+
+// prepare is the 1st phase of a commit.
+func (wc *wsCommit) prepare() error {
+	r := wc.root
+	for _, pubPath := range wc.intent.PubPaths {
+		for _, ext := range wc.exts() {
+			if _, err := r.lstat(wc.privPath(pubPath, ext)); err != nil {
+				return errors.Wrapf(err, "private file of [%s] missing", pubPath)
+			}
+		}
+	}
+
+	// backups left by a previous failed commit, if any, are stale
+	if err := r.removeAll(filepath.Join(wc.intent.Wsrd, backupDirName)); err != nil {
+		return err
+	}
+	for _, pubPath := range wc.intent.PubPaths {
+		for _, ext := range wc.exts() {
+			pubPath, backupPath := wc.pubPath(pubPath, ext), wc.backupPath(pubPath, ext)
+			if _, err := r.lstat(pubPath); os.IsNotExist(err) {
+				continue // nothing to be overwritten
+			}
+			if err := r.mkdirAll(filepath.Dir(backupPath), 0755); err != nil {
+				return err
+			}
+			if err := r.link(pubPath, backupPath); err != nil {
+				return errors.Wrapf(err, "backing up [%s]", pubPath)
+			}
+		}
+	}
+
+	// journal the intent before any public file touched
+	regName := fmt.Sprintf("%d-%d", time.Now().UnixNano(), os.Getpid())
+	wc.regEntry = filepath.Join(commitsDirName, regName)
+	if err := wc.writeIntent(); err != nil {
+		wc.regEntry = ""
+		return errors.Wrap(err, "journaling commit intent")
+	}
+
+	return nil
+}
+
+// publish is the 2nd phase of a commit.
+func (wc *wsCommit) publish() error {
+	ed := ensuredDirs{root: wc.root, madeDirs: make(map[string]struct{}, len(wc.intent.PubPaths))}
+	for _, pubPath := range wc.intent.PubPaths {
+		if err := ed.ensure(filepath.Dir(wc.pubPath(pubPath, ""))); err != nil {
+			return errors.Wrapf(err, "making parent dir for public path [%s]", pubPath)
+		}
+		for _, ext := range wc.exts() {
+			if err := wc.root.rename(wc.privPath(pubPath, ext), wc.pubPath(pubPath, ext)); err != nil {
+				return errors.Wrapf(err, "publishing [%s]", pubPath+ext)
+			}
+		}
+	}
+
+	wc.intent.Committed = true
+	if err := wc.writeIntent(); err != nil {
+		// all files published, recovery will roll it forward anyway
+		glog.Warningf("WS failed marking commit of [%s]:[%s] done - %+v", wc.root.path, wc.intent.Wsrd, err)
+	}
+	return nil
+}
+
+// fileState tells how far a file has gone in the commit.
+func (wc *wsCommit) fileState(pubPath, ext string) (pending, published bool) {
+	r := wc.root
+	if _, err := r.lstat(wc.privPath(pubPath, ext)); err == nil {
+		return true, false
+	}
+	pubFI, err := r.lstat(wc.pubPath(pubPath, ext))
+	if err != nil {
+		return false, false
+	}
+	if backupFI, err := r.lstat(wc.backupPath(pubPath, ext)); err == nil && sameFile(pubFI, backupFI) {
+		// still the original public file, the private one is lost
+		return false, false
+	}
+	return false, true
+}
+
+// canRollForward tells whether every file is either published or still pending.
+func (wc *wsCommit) canRollForward() bool {
+	for _, pubPath := range wc.intent.PubPaths {
+		for _, ext := range wc.exts() {
+			if pending, published := wc.fileState(pubPath, ext); !pending && !published {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// rollForward publishes files still pending.
+func (wc *wsCommit) rollForward() error {
+	ed := ensuredDirs{root: wc.root, madeDirs: make(map[string]struct{}, len(wc.intent.PubPaths))}
+	for _, pubPath := range wc.intent.PubPaths {
+		for _, ext := range wc.exts() {
+			if pending, _ := wc.fileState(pubPath, ext); !pending {
+				continue
+			}
+			if err := ed.ensure(filepath.Dir(wc.pubPath(pubPath, ext))); err != nil {
+				return err
+			}
+			if err := wc.root.rename(wc.privPath(pubPath, ext), wc.pubPath(pubPath, ext)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rollBack moves published files back to the workset, and restores public files
+// from the backups.
+func (wc *wsCommit) rollBack() (err error) {
+	r := wc.root
+	for _, pubPath := range wc.intent.PubPaths {
+		for _, ext := range wc.exts() {
+			if _, published := wc.fileState(pubPath, ext); published {
+				if e := r.rename(wc.pubPath(pubPath, ext), wc.privPath(pubPath, ext)); e != nil && err == nil {
+					err = e
+				}
+			}
+			backupPath := wc.backupPath(pubPath, ext)
+			if _, e := r.lstat(backupPath); e == nil {
+				if e = r.rename(backupPath, wc.pubPath(pubPath, ext)); e != nil && err == nil {
+					err = e
+				}
+			}
+		}
+	}
+	return
+}
+
+// finish cleans up after a commit completed or rolled back, the journal is
+// removed first, as nothing is to be recovered then.
+func (wc *wsCommit) finish() {
+	if len(wc.regEntry) > 0 {
+		if err := os.Remove(filepath.Join(wc.exportRoot, wc.regEntry)); err != nil && !os.IsNotExist(err) {
+			glog.Warningf("WS failed removing commit registry entry [%s] - %+v", wc.regEntry, err)
+			return // leave the backups for recovery
+		}
+	}
+	if err := wc.root.removeAll(filepath.Join(wc.intent.Wsrd, backupDirName)); err != nil {
+		glog.Warningf("WS failed removing commit backups of [%s] - %+v", wc.intent.Wsrd, err)
+	}
+}
+
+// commitWorkset atomically publishes the data files from a workset, all or nothing.
+func (efs *exportedFileSystem) commitWorkset(wsrd string, pubPaths []string,
+	metaExt, dataExt string) error {
+	unlock, err := lockCommits(efs.exportRoot)
+	if err != nil {
+		return errors.Wrap(err, "acquiring workset lock")
+	}
+	defer unlock()
+
+	mountPath, err := efs.mountPath()
+	if err != nil {
+		return err
+	}
+	wc := &wsCommit{
+		intent: &commitIntent{
+			MountPath: mountPath,
+			Wsrd:      wsrd, MetaExt: metaExt, DataExt: dataExt,
+			PubPaths: pubPaths,
+		},
+		exportRoot: efs.exportRoot,
+		root:       efs.root,
+	}
+
+	if err = wc.prepare(); err != nil {
+		efs.root.removeAll(filepath.Join(wsrd, backupDirName))
+		return err
+	}
+	if err = wc.publish(); err != nil {
+		wc.intent.RollingBack = true
+		if jErr := wc.writeIntent(); jErr != nil {
+			glog.Warningf("WS failed journaling roll back of [%s]:[%s] - %+v", efs.root.path, wsrd, jErr)
+		}
+		if rbErr := wc.rollBack(); rbErr != nil {
+			// leave the journal for recovery at next mount
+			glog.Errorf("WS failed rolling back commit of [%s]:[%s] - %+v",
+				efs.root.path, wsrd, rbErr)
+			return errors.Wrapf(err, "rolling back also failed - %+v", rbErr)
+		}
+		wc.finish()
+		return err
+	}
+	wc.finish()
+
+	if glog.V(1) {
+		glog.Infof("WS committed %d data files from [%s]:[%s]", len(pubPaths), efs.root.path, wsrd)
+	}
+	return nil
+}
+
+// readCommitIntents reads intents journaled in the registry under the export root,
+// by their registry entries relative to export root, malformed entries are logged
+// and left out.
+func readCommitIntents(exportRoot string) (map[string]*commitIntent, error) {
+	regDir := filepath.Join(exportRoot, commitsDirName)
+	regFIs, err := ioutil.ReadDir(regDir)
+	if os.IsNotExist(err) {
+		return nil, nil // never committed anything
+	} else if err != nil {
+		return nil, err
+	}
+	intents := make(map[string]*commitIntent, len(regFIs))
+	for _, regFI := range regFIs {
+		if regFI.Name() == commitLockName || filepath.Ext(regFI.Name()) == ".tmp" {
+			continue
+		}
+		regEntry := filepath.Join(commitsDirName, regFI.Name())
+		intentData, err := ioutil.ReadFile(filepath.Join(exportRoot, regEntry))
+		if os.IsNotExist(err) {
+			continue // finished meanwhile
+		} else if err != nil {
+			glog.Errorf("WS failed reading commit registry entry [%s] - %+v", regEntry, err)
+			continue
+		}
+		intent := &commitIntent{}
+		if err = json.Unmarshal(intentData, intent); err != nil {
+			glog.Errorf("WS malformed commit registry entry [%s] - %+v", regEntry, err)
+			continue
+		}
+		intents[regEntry] = intent
+	}
+	return intents, nil
+}
+
+// commitPending tells whether a commit from the workset at wsRel, relative to the
+// export root, is journaled, i.e. in progress or interrupted and pending recovery.
+//
+// it's told pending if the registry can't be read.
+func commitPending(exportRoot, wsRel string) bool {
+	intents, err := readCommitIntents(exportRoot)
+	if err != nil {
+		glog.Errorf("WS failed reading commit registry under [%s] - %+v", exportRoot, err)
+		return true
+	}
+	wsRel = filepath.Clean(wsRel)
+	for _, intent := range intents {
+		if filepath.Join(intent.MountPath, intent.Wsrd) == wsRel {
+			return true
+		}
+	}
+	return false
+}
+
+// resumeCommit confines paths from a journaled intent to the export root, and
+// opens the mounted root it was committed from.
+func resumeCommit(exportRoot string, intent *commitIntent) (*wsCommit, error) {
+	mountPath, err := confineUnder(exportRoot, intent.MountPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "mount path [%s]", intent.MountPath)
+	}
+	r, err := openRoot(exportRoot, mountPath, false, false)
+	if err != nil {
+		return nil, err
+	}
+	if err = func() error {
+		wsrd, err := r.confinePath(intent.Wsrd)
+		if err != nil || wsrd == "." {
+			return errors.Errorf("workset root dir [%s] not confined", intent.Wsrd)
+		}
+		for i, pubPath := range intent.PubPaths {
+			cleanPath, err := r.confineJDF(pubPath, intent.MetaExt, intent.DataExt)
+			if err == nil {
+				_, err = r.confineJDF(wsrd+"/"+cleanPath, intent.MetaExt, intent.DataExt)
+			}
+			if err != nil {
+				return errors.Errorf("public path [%s] not confined", pubPath)
+			}
+			intent.PubPaths[i] = cleanPath
+		}
+		intent.MountPath, intent.Wsrd = mountPath, wsrd
+		return nil
+	}(); err != nil {
+		r.dir.Close()
+		return nil, err
+	}
+	return &wsCommit{intent: intent, exportRoot: exportRoot, root: r}, nil
+}
+
+// recoverCommits rolls interrupted commits under the export root forward or back.
+func (efs *exportedFileSystem) recoverCommits() {
+	regDir := filepath.Join(efs.exportRoot, commitsDirName)
+	if _, err := os.Stat(regDir); os.IsNotExist(err) {
+		return // never committed anything
+	}
+
+	unlock, err := lockCommits(efs.exportRoot)
+	if err != nil {
+		glog.Errorf("WS failed acquiring workset lock for recovery under [%s] - %+v",
+			efs.exportRoot, err)
+		return
+	}
+	defer unlock()
+
+	intents, err := readCommitIntents(efs.exportRoot)
+	if err != nil {
+		glog.Errorf("WS failed reading commit registry under [%s] - %+v", efs.exportRoot, err)
+		return
+	}
+	for regEntry, intent := range intents {
+		wc, err := resumeCommit(efs.exportRoot, intent)
+		if err != nil {
+			glog.Errorf("WS not recovering interrupted commit [%s] - %+v", regEntry, err)
+			continue
+		}
+		wc.regEntry = regEntry
+		func() {
+			defer wc.root.dir.Close()
+
+			if !intent.RollingBack && (intent.Committed || wc.canRollForward()) {
+				if err = wc.rollForward(); err != nil {
+					glog.Errorf("WS failed rolling forward interrupted commit [%s] - %+v", regEntry, err)
+					return // leave it for next recovery
+				}
+				glog.Infof("WS rolled forward interrupted commit [%s] of [%s]:[%s]",
+					regEntry, intent.MountPath, intent.Wsrd)
+			} else {
+				if err = wc.rollBack(); err != nil {
+					glog.Errorf("WS failed rolling back interrupted commit [%s] - %+v", regEntry, err)
+					return // leave it for next recovery
+				}
+				glog.Infof("WS rolled back interrupted commit [%s] of [%s]:[%s]",
+					regEntry, intent.MountPath, intent.Wsrd)
+			}
+			wc.finish()
+		}()
+	}
+}
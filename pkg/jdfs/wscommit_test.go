@@ -0,0 +1,291 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package jdfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testWsrd = ".ws/commit"
+
+// writeTestFiles writes files of content under dir, by paths relative to it.
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	for fn, content := range files {
+		p := filepath.Join(dir, fn)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// checkTestFiles checks files under dir are of content, or absent if content is
+// empty.
+func checkTestFiles(t *testing.T, dir string, files map[string]string) {
+	for fn, content := range files {
+		b, err := ioutil.ReadFile(filepath.Join(dir, fn))
+		if len(content) <= 0 {
+			if !os.IsNotExist(err) {
+				t.Errorf("[%s] not expected to exist - %v", fn, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("reading [%s] failed - %v", fn, err)
+		} else if string(b) != content {
+			t.Errorf("[%s] is [%s] instead of [%s]", fn, b, content)
+		}
+	}
+}
+
+// checkNoCommitJournaled checks no commit is left in the registry.
+func checkNoCommitJournaled(t *testing.T, exportRoot string) {
+	if intents, err := readCommitIntents(exportRoot); err != nil {
+		t.Error(err)
+	} else if len(intents) > 0 {
+		t.Errorf("commits left journaled - %v", intents)
+	}
+}
+
+func TestCommitWorkset(t *testing.T) {
+	te := newTestExport(t)
+	defer te.close()
+	writeTestFiles(t, te.root, map[string]string{
+		// a file in the way of the parent dir of a public path
+		"blocker": "blocker",
+
+		testWsrd + "/inside/ok" + testMetaExt:   "new meta",
+		testWsrd + "/inside/ok" + testDataExt:   "new data",
+		testWsrd + "/blocker/new" + testMetaExt: "blocked meta",
+		testWsrd + "/blocker/new" + testDataExt: "blocked data",
+		testWsrd + "/inside/more" + testMetaExt: "more meta",
+		testWsrd + "/inside/more" + testDataExt: "more data",
+	})
+
+	w := te.dial(t)
+	defer w.close()
+	if err := w.mount(false, "/"); err != nil {
+		t.Fatalf("failed mounting export root - %v", err)
+	}
+
+	t.Run("failed publishing rolled back", func(t *testing.T) {
+		// inside/ok is published before blocker/new fails
+		if reason := w.errReason(fmt.Sprintf(`
+CommitWorkset(%#v, 2, %#v, %#v)
+`, testWsrd, testMetaExt, testDataExt), "inside/ok", "blocker/new"); reason == "" {
+			t.Fatalf("commit not failed")
+		}
+		checkTestFiles(t, te.root, map[string]string{
+			"inside/ok" + testMetaExt:                                   "ok meta",
+			"inside/ok" + testDataExt:                                   "ok data content.",
+			"blocker":                                                   "blocker",
+			testWsrd + "/inside/ok" + testMetaExt:                       "new meta",
+			testWsrd + "/inside/ok" + testDataExt:                       "new data",
+			testWsrd + "/blocker/new" + testDataExt:                     "blocked data",
+			testWsrd + "/" + backupDirName + "/inside/ok" + testDataExt: "",
+		})
+		checkNoCommitJournaled(t, te.root)
+	})
+
+	t.Run("published", func(t *testing.T) {
+		if reason := w.errReason(fmt.Sprintf(`
+CommitWorkset(%#v, 2, %#v, %#v)
+`, testWsrd, testMetaExt, testDataExt), "inside/ok", "inside/more"); reason != "" {
+			t.Fatalf("commit failed - %s", reason)
+		}
+		checkTestFiles(t, te.root, map[string]string{
+			"inside/ok" + testMetaExt:                                   "new meta",
+			"inside/ok" + testDataExt:                                   "new data",
+			"inside/more" + testMetaExt:                                 "more meta",
+			"inside/more" + testDataExt:                                 "more data",
+			testWsrd + "/inside/ok" + testDataExt:                       "",
+			testWsrd + "/inside/more" + testDataExt:                     "",
+			testWsrd + "/" + backupDirName + "/inside/ok" + testDataExt: "",
+		})
+		checkNoCommitJournaled(t, te.root)
+	})
+}
+
+func TestRecoverCommits(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		// state journaled
+		committed, rollingBack bool
+		// private file of inside/two lost before published
+		lost bool
+		// rolled forward, or back
+		forward bool
+	}{
+		{name: "committed", committed: true, forward: true},
+		{name: "uncommitted all accounted", forward: true},
+		{name: "uncommitted lost", lost: true, forward: false},
+		{name: "rolling back", rollingBack: true, forward: false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			te := newTestExport(t)
+			defer te.close()
+
+			// the commit got inside/ok published, but not inside/two yet
+			writeTestFiles(t, te.root, map[string]string{
+				"inside/two" + testMetaExt:             "two meta",
+				"inside/two" + testDataExt:             "two data",
+				testWsrd + "/inside/ok" + testMetaExt:  "new meta",
+				testWsrd + "/inside/ok" + testDataExt:  "new data",
+				testWsrd + "/inside/two" + testMetaExt: "new two meta",
+				testWsrd + "/inside/two" + testDataExt: "new two data",
+			})
+			for _, fn := range []string{
+				"inside/ok" + testMetaExt, "inside/ok" + testDataExt,
+				"inside/two" + testMetaExt, "inside/two" + testDataExt,
+			} {
+				backupPath := filepath.Join(te.root, testWsrd, backupDirName, fn)
+				if err := os.MkdirAll(filepath.Dir(backupPath), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Link(filepath.Join(te.root, fn), backupPath); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, ext := range []string{testMetaExt, testDataExt} {
+				if err := os.Rename(filepath.Join(te.root, testWsrd, "inside/ok"+ext),
+					filepath.Join(te.root, "inside/ok"+ext)); err != nil {
+					t.Fatal(err)
+				}
+				if c.lost {
+					if err := os.Remove(filepath.Join(te.root, testWsrd, "inside/two"+ext)); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			journalTestCommit(t, te.root, &commitIntent{
+				MountPath: ".", Wsrd: testWsrd, MetaExt: testMetaExt, DataExt: testDataExt,
+				PubPaths:  []string{"inside/ok", "inside/two"},
+				Committed: c.committed, RollingBack: c.rollingBack,
+			})
+
+			// recovered on read-write mount
+			w := te.dial(t)
+			defer w.close()
+			if err := w.mount(false, "/"); err != nil {
+				t.Fatalf("failed mounting export root - %v", err)
+			}
+
+			if c.forward {
+				checkTestFiles(t, te.root, map[string]string{
+					"inside/ok" + testMetaExt:              "new meta",
+					"inside/ok" + testDataExt:              "new data",
+					"inside/two" + testMetaExt:             "new two meta",
+					"inside/two" + testDataExt:             "new two data",
+					testWsrd + "/inside/ok" + testDataExt:  "",
+					testWsrd + "/inside/two" + testDataExt: "",
+				})
+			} else {
+				checkTestFiles(t, te.root, map[string]string{
+					"inside/ok" + testMetaExt:             "ok meta",
+					"inside/ok" + testDataExt:             "ok data content.",
+					"inside/two" + testMetaExt:            "two meta",
+					"inside/two" + testDataExt:            "two data",
+					testWsrd + "/inside/ok" + testMetaExt: "new meta",
+					testWsrd + "/inside/ok" + testDataExt: "new data",
+				})
+			}
+			checkTestFiles(t, te.root, map[string]string{
+				testWsrd + "/" + backupDirName + "/inside/ok" + testDataExt: "",
+			})
+			checkNoCommitJournaled(t, te.root)
+		})
+	}
+}
+
+func TestRecoverForgedCommits(t *testing.T) {
+	te := newTestExport(t)
+	defer te.close()
+	outsideFiles := te.listOutside(t)
+
+	writeTestFiles(t, te.root, map[string]string{
+		testWsrd + "/inside/ok" + testMetaExt: "new meta",
+		testWsrd + "/inside/ok" + testDataExt: "new data",
+	})
+	for _, intent := range []*commitIntent{
+		{MountPath: "..", Wsrd: "outside/.victim", PubPaths: []string{"secret"}},
+		{MountPath: "escape", Wsrd: ".victim", PubPaths: []string{"secret"}},
+		{MountPath: ".", Wsrd: "../outside/.victim", PubPaths: []string{"inside/ok"}},
+		{MountPath: ".", Wsrd: testWsrd, PubPaths: []string{"../outside/secret"}},
+		{MountPath: ".", Wsrd: testWsrd, PubPaths: []string{"abs/secret"}},
+	} {
+		intent.MetaExt, intent.DataExt = testMetaExt, testDataExt
+		journalTestCommit(t, te.root, intent)
+	}
+
+	w := te.dial(t)
+	defer w.close()
+	if err := w.mount(false, "/"); err != nil {
+		t.Fatalf("failed mounting export root - %v", err)
+	}
+
+	if intents, err := readCommitIntents(te.root); err != nil {
+		t.Fatal(err)
+	} else if len(intents) != 5 {
+		t.Errorf("forged commits should be left alone, got %d journaled", len(intents))
+	}
+	checkTestFiles(t, te.root, map[string]string{
+		"inside/ok" + testDataExt:             "ok data content.",
+		testWsrd + "/inside/ok" + testDataExt: "new data",
+	})
+	if files := te.listOutside(t); fmt.Sprint(files) != fmt.Sprint(outsideFiles) {
+		t.Errorf("files outside changed from %v to %v", outsideFiles, files)
+	}
+}
+
+func TestGCWorksetsKeepsPendingCommit(t *testing.T) {
+	te := newTestExport(t)
+	defer te.close()
+
+	stale := time.Now().Add(-2 * time.Hour)
+	for _, wsRel := range []string{".ws/pending", ".ws/stale"} {
+		writeTestFiles(t, te.root, map[string]string{
+			wsRel + "/" + backupDirName + "/inside/ok" + testDataExt: "ok data content.",
+			worksetRegEntry(wsRel): wsRel,
+		})
+		if err := os.Chtimes(filepath.Join(te.root, wsRel), stale, stale); err != nil {
+			t.Fatal(err)
+		}
+	}
+	journalTestCommit(t, te.root, &commitIntent{
+		MountPath: ".", Wsrd: ".ws/pending", MetaExt: testMetaExt, DataExt: testDataExt,
+		PubPaths: []string{"inside/ok"},
+	})
+
+	if removed, err := GCWorksets(te.root, time.Hour); err != nil {
+		t.Fatal(err)
+	} else if removed != 1 {
+		t.Errorf("%d worksets removed", removed)
+	}
+	checkTestFiles(t, te.root, map[string]string{
+		".ws/pending/" + backupDirName + "/inside/ok" + testDataExt: "ok data content.",
+		".ws/stale/" + backupDirName + "/inside/ok" + testDataExt:   "",
+	})
+}
+
+var testCommitSeq int
+
+// journalTestCommit registers an intent in the commit registry under exportRoot.
+func journalTestCommit(t *testing.T, exportRoot string, intent *commitIntent) {
+	data, err := json.Marshal(intent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCommitSeq++
+	writeTestFiles(t, exportRoot, map[string]string{
+		filepath.Join(commitsDirName, fmt.Sprintf("%d-test", testCommitSeq)): string(data),
+	})
+}
@@ -0,0 +1,363 @@
+package jdfs
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/complyue/jdfs/pkg/errors"
+	"github.com/golang/glog"
+	"golang.org/x/sys/unix"
+)
+
+// worksets made by MakeWorksetRoot are registered under the export root, each
+// with an owner file in it, flock'ed by the owning session while it's connected,
+// so those left behind by crashed writers can be found and garbage collected.
+
+const (
+	// dir under export root, registering worksets
+	worksetsDirName = ".jdfs-worksets"
+
+	// owner file under a workset root
+	wsOwnerFileName = ".jdfs-ws-owner"
+)
+
+var (
+	worksetTTL time.Duration
+)
+
+func init() {
+	flag.DurationVar(&worksetTTL, "ws-ttl", 0,
+		"`ttl` after which worksets not owned by a live connection are garbage collected, 0 to never")
+}
+
+// WorksetTTL returns the ttl configured by -ws-ttl, 0 for never to gc worksets.
+func WorksetTTL() time.Duration {
+	return worksetTTL
+}
+
+// worksetOwner is the content of a workset's owner file.
+type worksetOwner struct {
+	// the jdfs process and jdfc connection that made the workset
+	Session string `json:"session"`
+
+	Created time.Time `json:"created"`
+}
+
+// worksetInfo describes a workset.
+type worksetInfo struct {
+	// the workset root dir, relative to the mounted root
+	wsrd string
+
+	created time.Time
+
+	// total bytes of files in it
+	size int64
+
+	// the session made it, empty if unknown
+	owner string
+
+	// whether the owner session is still connected
+	live bool
+}
+
+// repr is the workset info to be sent over HBI wire, as a list of:
+//
+//	[ wsrd, age in seconds, size in bytes, owner session, whether owner live ]
+func (wi *worksetInfo) repr() string {
+	return fmt.Sprintf("[%#v, %d, %d, %#v, %#v]", wi.wsrd,
+		int64(time.Since(wi.created)/time.Second), wi.size, wi.owner, wi.live)
+}
+
+// mountPath returns the mounted root relative to export root
+func (efs *exportedFileSystem) mountPath() (string, error) {
+	return filepath.Rel(efs.exportRoot, efs.root.path)
+}
+
+// worksetRegEntry returns the registry entry path of a workset, relative to the
+// export root, wsRel is the workset root relative to export root as well.
+func worksetRegEntry(wsRel string) string {
+	return filepath.Join(worksetsDirName, url.PathEscape(filepath.Clean(wsRel)))
+}
+
+// ownWorkset makes this session the owner of a newly made workset, holding its
+// owner file locked until the workset is discarded or the session ends.
+func (efs *exportedFileSystem) ownWorkset(wsrd string) error {
+	mountPath, err := efs.mountPath()
+	if err != nil {
+		return err
+	}
+
+	ownerF, err := efs.root.openFile(filepath.Join(wsrd, wsOwnerFileName), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	if err = unix.Flock(int(ownerF.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		ownerF.Close()
+		return err
+	}
+	ownerJSON, err := json.Marshal(&worksetOwner{
+		Session: fmt.Sprintf("jdfs:%d jdfc:%s", os.Getpid(), efs.ho.NetIdent()),
+		Created: time.Now(),
+	})
+	if err == nil {
+		_, err = ownerF.Write(ownerJSON)
+	}
+	if err == nil {
+		regDir := filepath.Join(efs.exportRoot, worksetsDirName)
+		if err = os.MkdirAll(regDir, 0755); err == nil {
+			wsRel := filepath.Join(mountPath, wsrd)
+			err = ioutil.WriteFile(filepath.Join(efs.exportRoot, worksetRegEntry(wsRel)),
+				[]byte(wsRel), 0644)
+		}
+	}
+	if err != nil {
+		ownerF.Close()
+		return err
+	}
+
+	efs.wsMu.Lock()
+	defer efs.wsMu.Unlock()
+	if efs.ownedWorksets == nil {
+		efs.ownedWorksets = make(map[string]*os.File)
+	}
+	efs.ownedWorksets[wsrd] = ownerF
+	return nil
+}
+
+// disownWorkset is called when a workset is discarded.
+func (efs *exportedFileSystem) disownWorkset(wsrd string) {
+	efs.wsMu.Lock()
+	ownerF := efs.ownedWorksets[wsrd]
+	delete(efs.ownedWorksets, wsrd)
+	efs.wsMu.Unlock()
+
+	if ownerF != nil {
+		ownerF.Close()
+	}
+	if mountPath, err := efs.mountPath(); err == nil {
+		os.Remove(filepath.Join(efs.exportRoot, worksetRegEntry(filepath.Join(mountPath, wsrd))))
+	}
+}
+
+// releaseWorksets releases worksets owned by this session, on disconnection.
+func (efs *exportedFileSystem) releaseWorksets() {
+	efs.wsMu.Lock()
+	defer efs.wsMu.Unlock()
+
+	for wsrd, ownerF := range efs.ownedWorksets {
+		ownerF.Close()
+		delete(efs.ownedWorksets, wsrd)
+	}
+}
+
+// statWorkset inspects a workset, wsrd is relative to base.
+func statWorkset(base, wsrd string) (*worksetInfo, error) {
+	wsPath := filepath.Join(base, wsrd)
+	wsFI, err := os.Stat(wsPath)
+	if err != nil {
+		return nil, err
+	}
+	if !wsFI.IsDir() {
+		return nil, errors.Errorf("[%s] is not a workset root dir", wsrd)
+	}
+
+	wi := &worksetInfo{wsrd: wsrd, created: wsFI.ModTime()}
+
+	ownerPath := filepath.Join(wsPath, wsOwnerFileName)
+	if ownerF, err := os.Open(ownerPath); err == nil {
+		// flock is per open file description, this doesn't disturb the lock held by
+		// the owner session, even it's in this same process
+		if err = unix.Flock(int(ownerF.Fd()), unix.LOCK_SH|unix.LOCK_NB); err == unix.EWOULDBLOCK {
+			wi.live = true
+		} else if err == nil {
+			unix.Flock(int(ownerF.Fd()), unix.LOCK_UN)
+		}
+		var owner worksetOwner
+		if ownerJSON, err := ioutil.ReadAll(ownerF); err == nil &&
+			json.Unmarshal(ownerJSON, &owner) == nil {
+			wi.owner, wi.created = owner.Session, owner.Created
+		}
+		ownerF.Close()
+	}
+
+	if err = filepath.Walk(wsPath, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil // best effort
+		}
+		if fi.Mode().IsRegular() {
+			wi.size += fi.Size()
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return wi, nil
+}
+
+// listWorksets lists worksets under baseDir, relative to base.
+func listWorksets(base, baseDir string) ([]*worksetInfo, error) {
+	childFIs, err := ioutil.ReadDir(filepath.Join(base, baseDir))
+	if err != nil {
+		return nil, err
+	}
+	var wsl []*worksetInfo
+	for _, childFI := range childFIs {
+		if !childFI.IsDir() {
+			continue
+		}
+		wi, err := statWorkset(base, filepath.Join(baseDir, childFI.Name()))
+		if err != nil {
+			glog.Warningf("WS failed inspecting workset [%s]/[%s] - %+v", baseDir, childFI.Name(), err)
+			continue
+		}
+		wsl = append(wsl, wi)
+	}
+	return wsl, nil
+}
+
+// GCWorksets removes worksets registered under the export root, those older than
+// ttl and not owned by a live connection.
+func GCWorksets(exportRoot string, ttl time.Duration) (removed int, err error) {
+	if ttl <= 0 {
+		return 0, errors.New("ttl must be positive")
+	}
+
+	regDir := filepath.Join(exportRoot, worksetsDirName)
+	regFIs, err := ioutil.ReadDir(regDir)
+	if os.IsNotExist(err) {
+		return 0, nil // never made any workset
+	} else if err != nil {
+		return 0, err
+	}
+
+	// hold off commits, a workset with a commit pending recovery still holds the
+	// backups of public files it replaced
+	unlock, err := lockCommits(exportRoot)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	for _, regFI := range regFIs {
+		regPath := filepath.Join(regDir, regFI.Name())
+		wsRelBytes, err := ioutil.ReadFile(regPath)
+		if err != nil {
+			glog.Warningf("WS failed reading workset registry entry [%s] - %+v", regPath, err)
+			continue
+		}
+		wsRel, err := confineUnder(exportRoot, string(wsRelBytes))
+		if err != nil {
+			glog.Warningf("WS invalid workset registry entry [%s] - %+v", regPath, err)
+			continue
+		}
+
+		wi, err := statWorkset(exportRoot, wsRel)
+		if os.IsNotExist(err) {
+			os.Remove(regPath) // removed otherwise
+			continue
+		} else if err != nil {
+			glog.Warningf("WS failed inspecting workset [%s]:[%s] - %+v", exportRoot, wsRel, err)
+			continue
+		}
+		if wi.live || time.Since(wi.created) < ttl {
+			continue
+		}
+		if commitPending(exportRoot, wsRel) {
+			glog.Warningf("WS stale workset [%s]:[%s] kept for its commit pending recovery",
+				exportRoot, wsRel)
+			continue
+		}
+
+		if err = os.RemoveAll(filepath.Join(exportRoot, wsRel)); err != nil {
+			glog.Errorf("WS failed removing stale workset [%s]:[%s] - %+v", exportRoot, wsRel, err)
+			continue
+		}
+		os.Remove(regPath)
+		removed++
+		glog.Infof("WS removed stale workset [%s]:[%s] made by [%s] at %v, %d bytes",
+			exportRoot, wsRel, wi.owner, wi.created, wi.size)
+	}
+	return
+}
+
+// ListWorksets lists worksets under baseDir, sends back an error reason, and the
+// number of worksets followed by each's info as repr'ed by worksetInfo.repr().
+func (efs *exportedFileSystem) ListWorksets(baseDir string) {
+	co := efs.ho.Co()
+	// release wire during working
+	if err := co.FinishRecv(); err != nil {
+		panic(err)
+	}
+
+	efs.metaSlots.acquire()
+	defer efs.metaSlots.release()
+
+	var wsl []*worksetInfo
+	errReason := ""
+	if cleanDir, err := efs.root.confinePath(baseDir); err != nil {
+		errReason = fmt.Sprintf("workset base dir [%s] not confined to the mounted root - %+v",
+			baseDir, err)
+	} else if wsl, err = listWorksets(efs.root.path, cleanDir); err != nil && !os.IsNotExist(err) {
+		errReason = fmt.Sprintf("failed listing worksets under [%s] - %+v", baseDir, err)
+	}
+
+	if err := co.StartSend(); err != nil {
+		panic(err)
+	}
+	if err := co.SendObj(fmt.Sprintf("%#v", errReason)); err != nil {
+		panic(err)
+	}
+	if len(errReason) > 0 {
+		return
+	}
+	if err := co.SendObj(fmt.Sprintf("%d", len(wsl))); err != nil {
+		panic(err)
+	}
+	for _, wi := range wsl {
+		if err := co.SendObj(wi.repr()); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// StatWorkset inspects a workset, sends back an error reason, and the workset's
+// info as repr'ed by worksetInfo.repr() if no error.
+func (efs *exportedFileSystem) StatWorkset(wsrd string) {
+	co := efs.ho.Co()
+	// release wire during working
+	if err := co.FinishRecv(); err != nil {
+		panic(err)
+	}
+
+	efs.metaSlots.acquire()
+	defer efs.metaSlots.release()
+
+	var wi *worksetInfo
+	errReason := ""
+	if cleanWSRD, err := efs.root.confinePath(wsrd); err != nil {
+		errReason = fmt.Sprintf("workset root dir [%s] not confined to the mounted root - %+v",
+			wsrd, err)
+	} else if wi, err = statWorkset(efs.root.path, cleanWSRD); err != nil {
+		errReason = fmt.Sprintf("failed inspecting workset [%s] - %+v", wsrd, err)
+	}
+
+	if err := co.StartSend(); err != nil {
+		panic(err)
+	}
+	if err := co.SendObj(fmt.Sprintf("%#v", errReason)); err != nil {
+		panic(err)
+	}
+	if len(errReason) > 0 {
+		return
+	}
+	if err := co.SendObj(wi.repr()); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,56 @@
+package vfs
+
+import (
+	"hash/crc32"
+
+	"github.com/complyue/jdfs/pkg/errors"
+)
+
+// end-to-end checksums of bulk data payloads, jdfs tells methods it supports on
+// mount, and jdfc can request one of them to be used by the session.
+
+// WireChecksums lists checksum methods supported over the wire.
+var WireChecksums = []string{"crc32c"}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Checksum sums bulk data payloads with a method negotiated for a session, nil for
+// payloads to be sent unchecked.
+type Checksum struct {
+	method string
+	table  *crc32.Table
+}
+
+// NewChecksum returns the checksum of method, nil for empty method.
+func NewChecksum(method string) (*Checksum, error) {
+	switch method {
+	case "":
+		return nil, nil
+	case "crc32c":
+		return &Checksum{method: method, table: crc32cTable}, nil
+	}
+	return nil, errors.Errorf("unsupported wire checksum [%s]", method)
+}
+
+// Method returns the checksum method, empty for nil checksum.
+func (c *Checksum) Method() string {
+	if c == nil {
+		return ""
+	}
+	return c.method
+}
+
+// Sum returns the checksum of a payload, before compressed if compression is in
+// use as well.
+func (c *Checksum) Sum(payload []byte) uint32 {
+	return crc32.Checksum(payload, c.table)
+}
+
+// Verify checks a payload received against the checksum sent along with it.
+func (c *Checksum) Verify(payload []byte, sum uint32) error {
+	if actual := c.Sum(payload); actual != sum {
+		return errors.Errorf("%s mismatch of %d bytes payload, %08x sent, %08x received",
+			c.method, len(payload), sum, actual)
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package vfs
+
+import (
+	"sync"
+
+	"github.com/complyue/jdfs/pkg/errors"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+)
+
+// wire compression of bulk data payloads, jdfs tells methods it supports on mount,
+// and jdfc can request one of them to be used by the session.
+
+// WireCompressions lists compression methods supported over the wire.
+var WireCompressions = []string{"zstd", "lz4"}
+
+// CompressMinSize is the size under which payloads are always sent raw.
+const CompressMinSize = 8 * 1024
+
+// size of the sample tried before compressing a large payload in full
+const compressSampleSize = 4 * 1024
+
+// Compressor compresses bulk data payloads with a method negotiated for a session,
+// nil for payloads to be sent raw.
+type Compressor struct {
+	method string
+
+	// compress returns number of bytes compressed into dst, 0 if not fit
+	compress func(dst, src []byte) int
+	// decompress returns number of bytes decompressed into dst
+	decompress func(dst, src []byte) (int, error)
+}
+
+// NewCompressor returns the compressor of method, nil for empty method.
+func NewCompressor(method string) (*Compressor, error) {
+	switch method {
+	case "":
+		return nil, nil
+	case "zstd":
+		zstdOnce.Do(initZstd)
+		if zstdErr != nil {
+			return nil, zstdErr
+		}
+		return &Compressor{method: method, compress: zstdCompress, decompress: zstdDecompress}, nil
+	case "lz4":
+		return &Compressor{method: method, compress: lz4Compress, decompress: lz4Decompress}, nil
+	}
+	return nil, errors.Errorf("unsupported wire compression [%s]", method)
+}
+
+// Method returns the compression method, empty for nil compressor.
+func (c *Compressor) Method() string {
+	if c == nil {
+		return ""
+	}
+	return c.method
+}
+
+// Compress compresses src into dst, returns the compressed bytes, or nil if src is
+// not worth compressing, i.e. too small or incompressible, to be sent raw then.
+//
+// dst must have a capacity of len(src), compressed bytes not saving 1/8 of src are
+// considered incompressible.
+func (c *Compressor) Compress(dst, src []byte) []byte {
+	if c == nil || len(src) < CompressMinSize {
+		return nil
+	}
+
+	if len(src) >= 4*compressSampleSize {
+		// already compressed data, e.g. images or archives, is told by a sample,
+		// without compressing it in full
+		sample := src[:compressSampleSize]
+		if c.compress(dst[:len(sample)-len(sample)/8], sample) <= 0 {
+			return nil
+		}
+	}
+
+	n := c.compress(dst[:len(src)-len(src)/8], src)
+	if n <= 0 {
+		return nil
+	}
+	return dst[:n]
+}
+
+// Decompress decompresses src into dst, which must be of the exact size of the
+// payload before compressed.
+func (c *Compressor) Decompress(dst, src []byte) error {
+	n, err := c.decompress(dst, src)
+	if err != nil {
+		return errors.Wrapf(err, "corrupt %s payload of %d bytes", c.method, len(src))
+	}
+	if n != len(dst) {
+		return errors.Errorf("%s payload decompressed to %d bytes, %d expected", c.method, n, len(dst))
+	}
+	return nil
+}
+
+var (
+	// zstd encoder/decoder are safe for concurrent EncodeAll/DecodeAll calls, shared
+	// by all sessions
+	zstdOnce sync.Once
+	zstdEnc  *zstd.Encoder
+	zstdDec  *zstd.Decoder
+	zstdErr  error
+)
+
+func initZstd() {
+	if zstdEnc, zstdErr = zstd.NewWriter(nil); zstdErr != nil {
+		return
+	}
+	// decompressed size of a payload is capped by its buffer, against hostile
+	// payloads expanding to whatever size
+	zstdDec, zstdErr = zstd.NewReader(nil, zstd.WithDecodeAllCapLimit(true))
+}
+
+func zstdCompress(dst, src []byte) int {
+	// dst won't be reallocated unless compressed to more than its capacity
+	compressed := zstdEnc.EncodeAll(src, dst[:0])
+	if len(compressed) > len(dst) {
+		return 0
+	}
+	return len(compressed)
+}
+
+func zstdDecompress(dst, src []byte) (int, error) {
+	// decoding more bytes than dst can hold fails
+	decompressed, err := zstdDec.DecodeAll(src, dst[:0:len(dst)])
+	return len(decompressed), err
+}
+
+// hash tables for lz4 block compression, big enough to be worth reusing
+var lz4HashTables = sync.Pool{New: func() interface{} {
+	return make([]int, 64*1024)
+}}
+
+func lz4Compress(dst, src []byte) int {
+	ht := lz4HashTables.Get().([]int)
+	defer lz4HashTables.Put(ht)
+
+	// 0 with no error if incompressible, or error if not fit into dst
+	n, err := lz4.CompressBlock(src, dst, ht)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+func lz4Decompress(dst, src []byte) (int, error) {
+	// note lz4 takes src first
+	return lz4.UncompressBlock(src, dst)
+}
@@ -73,3 +73,38 @@ func ToReceiveDataFileList(listLen int, pathFlatLen int) (dfl *DataFileList, pay
 	}
 	return
 }
+
+// DataRange is a range of a data file, for vectored reads/writes.
+type DataRange struct {
+	Offset int64
+	Size   int64
+}
+
+// DataRangesBytes returns the bytes view of ranges, to be sent as is.
+func DataRangesBytes(ranges []DataRange) []byte {
+	if len(ranges) <= 0 {
+		return nil
+	}
+	rangesBytes := int64(len(ranges)) * int64(unsafe.Sizeof(ranges[0]))
+	return (*[maxAllocSize]byte)(unsafe.Pointer(&ranges[0]))[0:rangesBytes:rangesBytes]
+}
+
+// ToReceiveDataRanges returns n ranges, with the bytes view of them to receive.
+func ToReceiveDataRanges(n int) (ranges []DataRange, payload []byte) {
+	if n <= 0 {
+		return
+	}
+	ranges = make([]DataRange, n)
+	payload = DataRangesBytes(ranges)
+	return
+}
+
+// bounds of a single vectored read/write conversation, jdfs refuses larger ones
+// with EINVAL, jdfc splits larger batches.
+const (
+	MaxDataRanges     = 64 * 1024
+	MaxDataRangesSize = 16 * 1024 * 1024
+)
+
+// DataRangeBytes is the size of a DataRange sent over the wire.
+const DataRangeBytes = int64(unsafe.Sizeof(DataRange{}))
@@ -115,3 +115,25 @@ func WriteDirEnt(buf []byte, d DirEnt) (n int) {
 
 	return
 }
+
+// A directory entry with the child inode it refers to, as read by ReadDirPlusOp.
+type DirEntPlus struct {
+	DirEnt
+
+	Entry ChildInodeEntry
+}
+
+// DirEntPlusHeaderSize is the size of fuse_direntplus without the name, i.e.
+// fuse_entry_out plus fuse_dirent, as of Linux.
+const DirEntPlusHeaderSize = 128 + 24
+
+// DirEntPlusSize returns the number of bytes a directory entry with the
+// specified name takes in the read buffer of ReadDirPlusOp.
+func DirEntPlusSize(name string) int {
+	const direntAlignment = 8
+	n := DirEntPlusHeaderSize + len(name)
+	if n%direntAlignment != 0 {
+		n += direntAlignment - n%direntAlignment
+	}
+	return n
+}
@@ -46,6 +46,21 @@ const (
 	ENOTEMPTY = FsError(syscall.ENOTEMPTY)
 	ERANGE    = FsError(syscall.ERANGE)
 	ENOSPC    = FsError(syscall.ENOSPC)
+	EACCES    = FsError(syscall.EACCES)
+	EROFS     = FsError(syscall.EROFS)
+	EINTR     = FsError(syscall.EINTR)
+	EAGAIN    = FsError(syscall.EAGAIN)
+	EBADF     = FsError(syscall.EBADF)
+	ENXIO     = FsError(syscall.ENXIO)
+	EFBIG     = FsError(syscall.EFBIG)
+	ENODEV    = FsError(syscall.ENODEV)
+	EPERM     = FsError(syscall.EPERM)
+	ESPIPE    = FsError(syscall.ESPIPE)
+	EOVERFLOW = FsError(syscall.EOVERFLOW)
+	ETXTBSY   = FsError(syscall.ETXTBSY)
+
+	// same as ENOTSUP on Linux, but not on macOS
+	EOPNOTSUPP = FsError(syscall.EOPNOTSUPP)
 
 	// ENOATTR and/or ENODATA diverse greatly among OSes,
 	// using ENODATA for ENOATTR should work for Linux/macOS/Solaris(SmartOS),
@@ -58,32 +73,39 @@ func (fse FsError) Error() string {
 	return syscall.Errno(fse).Error()
 }
 
+// const names of portable fs errors, as exposed to HBI peers
+var fsErrNames = map[FsError]string{
+	EOKAY:      "EOKAY",
+	EEXIST:     "EEXIST",
+	EINVAL:     "EINVAL",
+	EIO:        "EIO",
+	ENOENT:     "ENOENT",
+	ENOSYS:     "ENOSYS",
+	ENOTDIR:    "ENOTDIR",
+	ENOTEMPTY:  "ENOTEMPTY",
+	ERANGE:     "ERANGE",
+	ENOSPC:     "ENOSPC",
+	ENOATTR:    "ENOATTR",
+	EACCES:     "EACCES",
+	EROFS:      "EROFS",
+	EINTR:      "EINTR",
+	EAGAIN:     "EAGAIN",
+	EBADF:      "EBADF",
+	ENXIO:      "ENXIO",
+	EFBIG:      "EFBIG",
+	ENODEV:     "ENODEV",
+	EPERM:      "EPERM",
+	ESPIPE:     "ESPIPE",
+	EOVERFLOW:  "EOVERFLOW",
+	ETXTBSY:    "ETXTBSY",
+	EOPNOTSUPP: "EOPNOTSUPP",
+}
+
 // Repr returns the const name of the error value, for representation to appear in
 // peer script as to be executed by HBI interpreters.
 func (fse FsError) Repr() string {
-	switch fse {
-	case EOKAY:
-		return "EOKAY"
-	case EEXIST:
-		return "EEXIST"
-	case EINVAL:
-		return "EINVAL"
-	case EIO:
-		return "EIO"
-	case ENOENT:
-		return "ENOENT"
-	case ENOSYS:
-		return "ENOSYS"
-	case ENOTDIR:
-		return "ENOTDIR"
-	case ENOTEMPTY:
-		return "ENOTEMPTY"
-	case ERANGE:
-		return "ERANGE"
-	case ENOSPC:
-		return "ENOSPC"
-	case ENOATTR:
-		return "ENOATTR"
+	if name, ok := fsErrNames[fse]; ok {
+		return name
 	}
 	panic(fmt.Sprintf("Unexpected file system error number %#x on %s %s - %+v",
 		int(fse), runtime.GOOS, runtime.GOARCH, syscall.Errno(fse)))
@@ -97,7 +119,10 @@ func FsErr(fsErr error) FsError {
 	case FsError:
 		return fse
 	case syscall.Errno:
-		return translateSysErrno(fse)
+		if portable := translateSysErrno(fse); fsErrNames[portable] != "" {
+			return portable
+		}
+		glog.Errorf("Unexpected local fs errno %#x - %+v", int(fse), fse)
 	case *os.PathError:
 		return FsErr(fse.Err)
 	default:
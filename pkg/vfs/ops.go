@@ -41,6 +41,10 @@ import (
 // file system will not successfully mount. If you don't model a sane amount of
 // free space, the Finder will refuse to copy files into the file system.
 type StatFSOp struct {
+	// The inode statfs(2) is called on, a file system composed of multiple
+	// underlying ones can report figures of the one containing it.
+	Inode InodeID
+
 	// The size of the file system's blocks. This may be used, in combination
 	// with the block counts below,  by callers of statfs(2) to infer the file
 	// system's capacity and space availability.
@@ -524,6 +528,29 @@ type ReadDirOp struct {
 	BytesRead int
 }
 
+// Read entries from a directory previously opened with OpenDir, along with
+// the child inodes they refer to, as if each had been looked up.
+//
+// This is sent in place of ReadDirOp once READDIRPLUS is enabled at mount,
+// e.g. for `ls -l` to not cost a LookUpInodeOp per entry. The kernel counts
+// one reference to every child inode returned, as with LookUpInodeOp.
+type ReadDirPlusOp struct {
+	// The directory inode that we are reading, and the handle previously
+	// returned by OpenDir when opening that inode.
+	Inode  InodeID
+	Handle HandleID
+
+	// The offset within the directory at which to read, see ReadDirOp.Offset.
+	Offset DirOffset
+
+	// The size of the read, the entries returned must fit in it, each taking
+	// DirEntPlusSize() bytes.
+	Size int
+
+	// Set by the file system: the entries read, empty at end of the directory.
+	Entries []DirEntPlus
+}
+
 // Release a previously-minted directory handle. The kernel sends this when
 // there are no more references to an open directory: all file descriptors are
 // closed and all memory mappings are unmapped.
@@ -861,3 +888,163 @@ type SetXattrOp struct {
 	// simply replace the value if the attribute exists.
 	Flags uint32
 }
+
+////////////////////////////////////////////////////////////////////////
+// File locks
+////////////////////////////////////////////////////////////////////////
+
+// LockType is the portable type of a file lock, values of F_RDLCK etc. differ
+// among OSes.
+type LockType uint32
+
+const (
+	LockUnlock LockType = iota
+	LockRead
+	LockWrite
+)
+
+// OffsetMax is the End of a lock extending to the end of file, however large the
+// file grows.
+const OffsetMax = 1<<63 - 1
+
+// FileLock describes an advisory lock on a byte range of a file.
+type FileLock struct {
+	// The locked range, End is inclusive.
+	Start uint64
+	End   uint64
+
+	Type LockType
+
+	// The process holding the lock, meaningful only at jdfc, 0 for locks held
+	// by other jdfc.
+	Pid uint32
+}
+
+// Test for a POSIX lock on a file, sent in response to fcntl(2) with F_GETLK.
+type GetLockOp struct {
+	// The file inode and the handle opened on it.
+	Inode  InodeID
+	Handle HandleID
+
+	// Identifies the lock owner, as chosen by the kernel, i.e. a process' file
+	// table for POSIX locks.
+	Owner uint64
+
+	// The lock to test, set by the file system to the conflicting lock, or with
+	// Type LockUnlock if there's none.
+	Lock FileLock
+}
+
+// Acquire, change or release a lock on a file, sent in response to fcntl(2)
+// with F_SETLK/F_SETLKW, or flock(2) if Flock is true.
+//
+// Locks of different owners conflict, across jdfc clients of the same jdfs as
+// well. A release of the whole file (Start 0, End OffsetMax) releases all locks
+// of the owner.
+type SetLockOp struct {
+	// The file inode and the handle opened on it.
+	Inode  InodeID
+	Handle HandleID
+
+	// Identifies the lock owner, as chosen by the kernel, i.e. a process' file
+	// table for POSIX locks, or an open file for flock(2).
+	Owner uint64
+
+	// The lock to set, Type LockUnlock to release.
+	Lock FileLock
+
+	// Whether to wait for a conflicting lock to be released, or fail with EAGAIN.
+	Wait bool
+
+	// Whether it's a flock(2) lock on the whole file, not a POSIX lock.
+	Flock bool
+}
+
+////////////////////////////////////////////////////////////////////////
+// Space allocation and sparse files
+////////////////////////////////////////////////////////////////////////
+
+// Modes of FallocateOp, with values as of Linux fallocate(2), they're passed
+// through as is to jdfs.
+const (
+	// Don't extend the file size when allocating beyond its end.
+	FallocKeepSize = 0x01
+	// Deallocate the range, must be combined with FallocKeepSize.
+	FallocPunchHole = 0x02
+	// Zero the range, allocating it as necessary.
+	FallocZeroRange = 0x10
+
+	// All modes jdfs performs, others like collapsing or inserting a range are
+	// refused with EOPNOTSUPP. Each of these is idempotent, so safe to repeat.
+	FallocModes = FallocKeepSize | FallocPunchHole | FallocZeroRange
+)
+
+// Preallocate, deallocate or zero a range of a file, sent in response to
+// fallocate(2).
+type FallocateOp struct {
+	// The file inode and the handle opened on it, must be opened for writing.
+	Inode  InodeID
+	Handle HandleID
+
+	// The range to operate on.
+	Offset uint64
+	Length uint64
+
+	// FallocKeepSize etc. combined, 0 to allocate the range and extend the file
+	// size as necessary.
+	Mode uint32
+}
+
+// SeekWhence is the portable whence of LseekOp, values of SEEK_DATA and
+// SEEK_HOLE differ among OSes.
+type SeekWhence uint32
+
+const (
+	SeekData SeekWhence = iota + 1
+	SeekHole
+)
+
+// Find the next data or hole extent of a sparse file, sent in response to
+// lseek(2) with SEEK_DATA or SEEK_HOLE, the kernel handles other whences on
+// its own.
+type LseekOp struct {
+	// The file inode and the handle opened on it.
+	Inode  InodeID
+	Handle HandleID
+
+	// The offset to start searching from, set by the file system to the offset
+	// found. ENXIO is to be returned if there's no data beyond.
+	Offset uint64
+
+	Whence SeekWhence
+}
+
+////////////////////////////////////////////////////////////////////////
+// Server side copy
+////////////////////////////////////////////////////////////////////////
+
+// Copy a range of data from one file to another, sent in response to
+// copy_file_range(2). jdfs copies the data locally, without it crossing the
+// wire.
+type CopyFileRangeOp struct {
+	// The source file inode and the handle opened on it.
+	InodeIn  InodeID
+	HandleIn HandleID
+	OffsetIn uint64
+
+	// The destination file inode and the handle opened on it, must be opened
+	// for writing.
+	InodeOut  InodeID
+	HandleOut HandleID
+	OffsetOut uint64
+
+	// Number of bytes to copy, at most.
+	Length uint64
+
+	// Flags of copy_file_range(2), currently always 0.
+	Flags uint64
+
+	// Set by the file system: the number of bytes copied, which may be less than
+	// Length, e.g. at end of the source file.
+	BytesCopied uint64
+}
@@ -0,0 +1,220 @@
+package vfs
+
+import (
+	"github.com/complyue/hbi"
+	"github.com/complyue/jdfs/pkg/errors"
+
+	"github.com/golang/glog"
+)
+
+// bulk data payloads of file reads/writes and data file listing, are sent with
+// SendData as is, unless compression or checksum is in use by the session, then
+// each payload is sent as:
+//
+//	[ compressed size, 0 for raw ], if compressed
+//	payload data, compressed or raw
+//	[ checksum of raw data ], if checksummed
+//
+// small or incompressible payloads are sent raw even if compression is in use,
+// and the receiver always knows the raw size of a payload from the conversation.
+//
+// both jdfs and jdfc send/receive payloads with PayloadCodec, so the framing is
+// the same at both sides.
+
+// PayloadCo is the HBI conversation a bulk data payload is sent/received in, i.e.
+// *hbi.HoCo at jdfs or *hbi.PoCo at jdfc.
+type PayloadCo interface {
+	SendObj(code string) error
+	SendData(buf []byte) error
+	RecvObj() (interface{}, error)
+	RecvData(buf []byte) error
+}
+
+// PayloadBufs provides scratch buffers for compressed payloads.
+type PayloadBufs interface {
+	Get(length int) []byte
+	Return(buf []byte)
+}
+
+// PayloadCodec is how bulk data payloads of a session are sent/received, the zero
+// value sends them raw and unchecked.
+type PayloadCodec struct {
+	// nil for raw
+	Compressor *Compressor
+	// nil for unchecked
+	Checksum *Checksum
+
+	// nil for scratch buffers to be allocated per payload
+	Bufs PayloadBufs
+}
+
+// Raw tells whether bulk data payloads are sent as is.
+func (pc PayloadCodec) Raw() bool {
+	return pc.Compressor == nil && pc.Checksum == nil
+}
+
+func (pc PayloadCodec) getBuf(length int) []byte {
+	if pc.Bufs == nil {
+		return make([]byte, length)
+	}
+	return pc.Bufs.Get(length)
+}
+
+func (pc PayloadCodec) returnBuf(buf []byte) {
+	if pc.Bufs != nil {
+		pc.Bufs.Return(buf)
+	}
+}
+
+// SendPayload sends a bulk data payload, compressed/checksummed as in use.
+func (pc PayloadCodec) SendPayload(co PayloadCo, payload []byte) error {
+	if pc.Raw() {
+		return co.SendData(payload)
+	}
+
+	data := payload
+	if pc.Compressor != nil {
+		buf := pc.getBuf(len(payload))
+		defer pc.returnBuf(buf)
+
+		compressed := pc.Compressor.Compress(buf, payload)
+		if err := co.SendObj(hbi.Repr(len(compressed))); err != nil {
+			return err
+		}
+		if compressed != nil {
+			data = compressed
+		}
+	}
+	if err := co.SendData(data); err != nil {
+		return err
+	}
+	if pc.Checksum != nil {
+		if err := co.SendObj(hbi.Repr(pc.Checksum.Sum(payload))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecvPayload receives a bulk data payload from peer into buf, of the raw size of
+// it.
+//
+// a payload failed decompressing or verification is logged and reported as EIO,
+// with the wire still in sync.
+func (pc PayloadCodec) RecvPayload(co PayloadCo, buf []byte, peer string) error {
+	if pc.Raw() {
+		return co.RecvData(buf)
+	}
+
+	var compressedLen hbi.LitIntType
+	if pc.Compressor != nil {
+		var err error
+		if compressedLen, err = recvPayloadInt(co); err != nil {
+			return err
+		}
+	}
+
+	if compressedLen < 0 || int(compressedLen) > len(buf) {
+		// never sent by a sane peer, as only payloads compressed smaller are sent
+		// compressed
+		return errors.Errorf("invalid compressed size %d of a %d bytes payload", compressedLen, len(buf))
+	}
+
+	var badPayload error
+	if compressedLen > 0 {
+		compressed := pc.getBuf(int(compressedLen))
+		defer pc.returnBuf(compressed)
+		if err := co.RecvData(compressed); err != nil {
+			return err
+		}
+		badPayload = pc.Compressor.Decompress(buf, compressed)
+	} else if err := co.RecvData(buf); err != nil {
+		return err
+	}
+
+	if pc.Checksum != nil {
+		sum, err := recvPayloadInt(co)
+		if err != nil {
+			return err
+		}
+		if badPayload == nil {
+			badPayload = pc.Checksum.Verify(buf, uint32(sum))
+		}
+	}
+
+	if badPayload != nil {
+		glog.Errorf("Bad payload from [%s] - %+v", peer, badPayload)
+		return EIO
+	}
+	return nil
+}
+
+// DiscardPayload receives and drops a bulk data payload of size bytes raw, to keep
+// the wire in sync with the request it follows refused.
+func (pc PayloadCodec) DiscardPayload(co PayloadCo, size int64) error {
+	if size <= 0 {
+		return nil // never sent
+	}
+	if pc.Raw() {
+		return pc.DiscardData(co, size)
+	}
+
+	dataLen := size
+	if pc.Compressor != nil {
+		compressedLen, err := recvPayloadInt(co)
+		if err != nil {
+			return err
+		}
+		if compressedLen < 0 || int64(compressedLen) > size {
+			return errors.Errorf("invalid compressed size %d of a %d bytes payload", compressedLen, size)
+		}
+		if compressedLen > 0 {
+			dataLen = int64(compressedLen)
+		}
+	}
+	if err := pc.DiscardData(co, dataLen); err != nil {
+		return err
+	}
+	if pc.Checksum != nil {
+		if _, err := recvPayloadInt(co); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DiscardData receives and drops n bytes of binary data, in chunks.
+func (pc PayloadCodec) DiscardData(co PayloadCo, n int64) error {
+	chunkSize := int64(64 * 1024)
+	if n < chunkSize {
+		chunkSize = n
+	}
+	if chunkSize <= 0 {
+		return nil
+	}
+	buf := pc.getBuf(int(chunkSize))
+	defer pc.returnBuf(buf)
+	for n > 0 {
+		chunk := buf
+		if n < int64(len(chunk)) {
+			chunk = chunk[:n]
+		}
+		if err := co.RecvData(chunk); err != nil {
+			return err
+		}
+		n -= int64(len(chunk))
+	}
+	return nil
+}
+
+func recvPayloadInt(co PayloadCo) (hbi.LitIntType, error) {
+	obj, err := co.RecvObj()
+	if err != nil {
+		return 0, err
+	}
+	i, ok := obj.(hbi.LitIntType)
+	if !ok {
+		return 0, errors.Errorf("unexpected int type [%T] of value [%v]", obj, obj)
+	}
+	return i, nil
+}